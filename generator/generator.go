@@ -86,6 +86,11 @@ func (gen *Generator) GenerateWithMessage(message *IncomingMessage, signFunc Sig
 }
 
 func (gen *Generator) GenerateWithOnroad(sendBlock ledger.AccountBlock, consensusMsg *ConsensusMessage, signFunc SignFunc, difficulty *big.Int) (*GenResult, error) {
+	return gen.GenerateWithOnroadData(sendBlock, consensusMsg, signFunc, difficulty, nil)
+}
+
+// GenerateWithOnroadData is the same as GenerateWithOnroad, and set data to the receive block
+func (gen *Generator) GenerateWithOnroadData(sendBlock ledger.AccountBlock, consensusMsg *ConsensusMessage, signFunc SignFunc, difficulty *big.Int, data []byte) (*GenResult, error) {
 	var producer types.Address
 	if consensusMsg == nil {
 		producer = sendBlock.ToAddress
@@ -93,7 +98,7 @@ func (gen *Generator) GenerateWithOnroad(sendBlock ledger.AccountBlock, consensu
 		producer = consensusMsg.Producer
 	}
 
-	block, err := gen.packBlockWithSendBlock(&sendBlock, consensusMsg, difficulty)
+	block, err := gen.packBlockWithSendBlock(&sendBlock, consensusMsg, difficulty, data)
 	if err != nil {
 		return nil, err
 	}
@@ -196,10 +201,10 @@ func (gen *Generator) packSendBlockWithMessage(message *IncomingMessage) (blockP
 	return blockPacked, nil
 }
 
-func (gen *Generator) packBlockWithSendBlock(sendBlock *ledger.AccountBlock, consensusMsg *ConsensusMessage, difficulty *big.Int) (blockPacked *ledger.AccountBlock, err error) {
+func (gen *Generator) packBlockWithSendBlock(sendBlock *ledger.AccountBlock, consensusMsg *ConsensusMessage, difficulty *big.Int, data []byte) (blockPacked *ledger.AccountBlock, err error) {
 	gen.log.Info("PackReceiveBlock", "sendBlock.Hash", sendBlock.Hash, "sendBlock.To", sendBlock.ToAddress)
 
-	blockPacked = &ledger.AccountBlock{BlockType: ledger.BlockTypeReceive}
+	blockPacked = &ledger.AccountBlock{BlockType: ledger.BlockTypeReceive, Data: data}
 
 	gen.getDatasFromSendBlock(blockPacked, sendBlock)
 
@@ -5,17 +5,21 @@ import (
 	"fmt"
 	"github.com/vitelabs/go-vite/chain"
 	"github.com/vitelabs/go-vite/common"
+	"github.com/vitelabs/go-vite/common/fork"
 	"github.com/vitelabs/go-vite/common/types"
 	"github.com/vitelabs/go-vite/config"
 	"github.com/vitelabs/go-vite/crypto/ed25519"
 	"github.com/vitelabs/go-vite/ledger"
 	"github.com/vitelabs/go-vite/log15"
+	"github.com/vitelabs/go-vite/trie"
 	"github.com/vitelabs/go-vite/vm"
 	"github.com/vitelabs/go-vite/vm/contracts/abi"
+	"github.com/vitelabs/go-vite/vm_context"
 	"math/big"
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 )
 
 var (
@@ -213,3 +217,100 @@ func TestGenerator(t *testing.T) {
 	block, err := gen.generateBlock(&ledger.AccountBlock{}, &ledger.AccountBlock{}, types.Address{}, nil)
 	t.Error(err, block)
 }
+
+// mockChain hold the snapshot blocks and the latest account block of one account,
+// other methods are not used by packing receive block
+type mockChain struct {
+	vm_context.Chain
+	snapshots []*ledger.SnapshotBlock
+	latest    *ledger.AccountBlock
+}
+
+func newMockChain(height uint64) *mockChain {
+	c := &mockChain{}
+	for i := uint64(1); i <= height; i++ {
+		now := time.Now()
+		sb := &ledger.SnapshotBlock{Height: i, Timestamp: &now}
+		sb.Hash = sb.ComputeHash()
+		c.snapshots = append(c.snapshots, sb)
+	}
+	return c
+}
+
+func (c *mockChain) GetLatestSnapshotBlock() *ledger.SnapshotBlock {
+	return c.snapshots[len(c.snapshots)-1]
+}
+
+func (c *mockChain) GetSnapshotBlockByHash(hash *types.Hash) (*ledger.SnapshotBlock, error) {
+	for _, sb := range c.snapshots {
+		if sb.Hash == *hash {
+			return sb, nil
+		}
+	}
+	return nil, nil
+}
+
+func (c *mockChain) GetLatestAccountBlock(addr *types.Address) (*ledger.AccountBlock, error) {
+	if c.latest == nil || c.latest.AccountAddress != *addr {
+		return nil, nil
+	}
+	return c.latest, nil
+}
+
+func (c *mockChain) GetStateTrie(hash *types.Hash) *trie.Trie {
+	return trie.NewTrie(nil, nil, nil)
+}
+
+func (c *mockChain) NewStateTrie() *trie.Trie {
+	return trie.NewTrie(nil, nil, nil)
+}
+
+func TestGenerator_packBlockWithSendBlock(t *testing.T) {
+	fork.SetForkPoints(&config.ForkPoints{Smart: &config.ForkPoint{}})
+
+	c := newMockChain(5)
+	head := c.GetLatestSnapshotBlock()
+
+	sendBlock := &ledger.AccountBlock{
+		BlockType:      ledger.BlockTypeSendCall,
+		AccountAddress: addr1,
+		ToAddress:      addr2,
+		Amount:         big.NewInt(1),
+		Fee:            big.NewInt(0),
+		Hash:           types.DataHash([]byte("send")),
+	}
+
+	check := func(name string, prevHash types.Hash, height uint64) {
+		gen, err := NewGenerator(c, nil, nil, &addr2)
+		if err != nil {
+			t.Fatalf("%s: failed to new generator: %v", name, err)
+		}
+
+		block, err := gen.packBlockWithSendBlock(sendBlock, nil, nil, nil)
+		if err != nil {
+			t.Fatalf("%s: failed to pack receive block: %v", name, err)
+		}
+
+		if block.SnapshotHash != head.Hash {
+			t.Errorf("%s: should refer snapshot head %s, but got %s", name, head.Hash, block.SnapshotHash)
+		}
+		if block.PrevHash != prevHash {
+			t.Errorf("%s: prevHash should be %s, but got %s", name, prevHash, block.PrevHash)
+		}
+		if block.Height != height {
+			t.Errorf("%s: height should be %d, but got %d", name, height, block.Height)
+		}
+	}
+
+	check("first receive", types.ZERO_HASH, 1)
+
+	c.latest = &ledger.AccountBlock{
+		BlockType:      ledger.BlockTypeReceive,
+		AccountAddress: addr2,
+		Height:         3,
+		Hash:           types.DataHash([]byte("prev")),
+		SnapshotHash:   c.snapshots[2].Hash,
+	}
+
+	check("next receive", c.latest.Hash, 4)
+}
@@ -142,8 +142,15 @@ func (ab *AccountBlock) Copy() *AccountBlock {
 	newAb.Data = make([]byte, len(ab.Data))
 	copy(newAb.Data, ab.Data)
 
-	timestamp := time.Unix(0, ab.Timestamp.UnixNano())
-	newAb.Timestamp = &timestamp
+	if ab.Timestamp != nil {
+		timestamp := time.Unix(0, ab.Timestamp.UnixNano())
+		newAb.Timestamp = &timestamp
+	}
+
+	if ab.PublicKey != nil {
+		newAb.PublicKey = make(ed25519.PublicKey, len(ab.PublicKey))
+		copy(newAb.PublicKey, ab.PublicKey)
+	}
 
 	if ab.LogHash != nil {
 		logHash := *ab.LogHash
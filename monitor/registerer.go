@@ -0,0 +1,32 @@
+package monitor
+
+import "errors"
+
+// Registerer expose metrics sampled by fn when they are collected, so the statistics can be
+// scraped by a metrics system without depending on it, e.g. adapted to prometheus by
+// prometheus.NewGaugeFunc and prometheus.NewCounterFunc.
+// Register a name twice should return error.
+type Registerer interface {
+	RegisterGauge(name, help string, fn func() float64) error
+	RegisterCounter(name, help string, fn func() float64) error
+}
+
+// MapRegisterer keep the metrics registered in memory keyed by name, so they can be sampled directly,
+// e.g. by tests
+type MapRegisterer map[string]func() float64
+
+func (r MapRegisterer) RegisterGauge(name, help string, fn func() float64) error {
+	return r.register(name, fn)
+}
+
+func (r MapRegisterer) RegisterCounter(name, help string, fn func() float64) error {
+	return r.register(name, fn)
+}
+
+func (r MapRegisterer) register(name string, fn func() float64) error {
+	if _, ok := r[name]; ok {
+		return errors.New("duplicate metric " + name)
+	}
+	r[name] = fn
+	return nil
+}
@@ -1,16 +1,39 @@
 package onroad
 
 import (
+	"errors"
 	"github.com/vitelabs/go-vite/common"
 	"github.com/vitelabs/go-vite/common/types"
 	"github.com/vitelabs/go-vite/generator"
 	"github.com/vitelabs/go-vite/ledger"
 	"github.com/vitelabs/go-vite/log15"
-	"github.com/vitelabs/go-vite/onroad/model"
+	"github.com/vitelabs/go-vite/vm/util"
+	"github.com/vitelabs/go-vite/vm_context"
 	"math/big"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
+const fetchRetryTimes = 3
+
+// a send block received recently will not be received again in this window
+const recentReceivedTTL = time.Minute
+
+// MaxReceiveDataLength is the max length of data ReceiveDataFunc can attach to a receive block
+const MaxReceiveDataLength = 1024
+
+// ReceiveDataFunc return application-specific data of the receive block, e.g. a memo
+type ReceiveDataFunc func(sendBlock *ledger.AccountBlock) []byte
+
+// Signer sign the receive blocks of the address, return the signature and the public key
+type Signer func(addr types.Address, data []byte) (signedData, pubkey []byte, err error)
+
+var fetchRetryInterval = 100 * time.Millisecond
+
+// receive block will be packed again at most this times if the head of account changed meanwhile
+const maxRepackTimes = 3
+
 type SimpleAutoReceiveFilterPair struct {
 	tti      types.TokenTypeId
 	minValue big.Int
@@ -20,14 +43,16 @@ type AutoReceiveWorker struct {
 	log           log15.Logger
 	address       types.Address
 	powDifficulty *big.Int
+	powMutex      sync.RWMutex
 	entropystore  string
 
 	manager          *Manager
-	onroadBlocksPool *model.OnroadBlocksPool
+	onroadBlocksPool commonTxPool
 
 	status     int
 	isSleeping bool
-	isCancel   bool
+	paused     int32 // atomic
+	lazyFetch  int32 // atomic, 1 if onroad blocks are not fetched until the first alarm after Start
 
 	breaker          chan struct{}
 	stopListener     chan struct{}
@@ -35,29 +60,112 @@ type AutoReceiveWorker struct {
 
 	filters map[types.TokenTypeId]big.Int
 
+	// only send blocks of these types are received
+	allowedTypes map[byte]struct{}
+	typesMutex   sync.RWMutex
+
+	// blocks of a token with batch threshold are held until their summed amount reaches it
+	batchThresholds map[types.TokenTypeId]big.Int
+	heldBlocks      map[types.TokenTypeId][]*ledger.AccountBlock
+	heldAmounts     map[types.TokenTypeId]*big.Int
+	batchMutex      sync.Mutex
+
+	recentReceived *recentHashes
+
+	processed uint64 // count of receive blocks inserted into pool, atomic
+
+	// amount received of each token over the lifetime of the worker
+	receivedByToken map[types.TokenTypeId]*big.Int
+	receivedMutex   sync.Mutex
+
+	// hooks are read by the worker goroutine, they have their own mutex since Stop waits for
+	// the worker under statusMutex
+	receiveDataFunc ReceiveDataFunc
+	// signer of receive blocks, nil means sign by the entropystore
+	signer     Signer
+	hooksMutex sync.RWMutex
+
+	// pack receive block of the send block, replaced in tests
+	pack func(sendBlock *ledger.AccountBlock, data []byte) ([]*vm_context.VmAccountBlock, error)
+
+	// generate the receive block of the send block signed by signFunc, used by packReceiveBlock, replaced in tests
+	generate func(sendBlock *ledger.AccountBlock, signFunc generator.SignFunc, data []byte) (*generator.GenResult, error)
+
+	// pledge quota of the address at the latest snapshot block, replaced in tests
+	pledgeQuota func() (uint64, error)
+
+	// receives are spaced at least receiveInterval apart, so the quota of the address
+	// can regenerate, it works as a token bucket holds only one token
+	receiveInterval int64     // nanoseconds, atomic
+	lastReceive     time.Time // only accessed by startWork
+
+	// at most receivesPerSnapshot receives are processed in a snapshot block, the quota regenerates per
+	// snapshot block, 0 means no limit. snapshotHeight is polled every snapshotPoll when the cap is hit
+	receivesPerSnapshot int64 // atomic
+	snapshotHeight      func() uint64
+	snapshotPoll        time.Duration
+	receiveHeight       uint64 // snapshot height of the receives counted, only accessed by startWork
+	receivedInHeight    int64  // only accessed by startWork
+
+	// receives are paused while the address has maxOutstanding unconfirmed receive blocks, 0 means no limit,
+	// outstanding is polled every snapshotPoll, blocks are confirmed by snapshot blocks
+	maxOutstanding int64 // atomic
+	outstanding    func() int
+
+	// send blocks referring a snapshot block lower than minSnapshotHeight are stale and skipped, 0 means no limit
+	minSnapshotHeight uint64 // atomic
+
 	statusMutex sync.Mutex
+
+	lastErr  error
+	errMutex sync.RWMutex
 }
 
-func NewAutoReceiveWorker(manager *Manager, entropystore string, address types.Address, filters map[types.TokenTypeId]big.Int, powDifficulty *big.Int) *AutoReceiveWorker {
-	return &AutoReceiveWorker{
+// NewAutoReceiveWorker use log if it is not nil, otherwise a default logger of the address
+func NewAutoReceiveWorker(manager *Manager, entropystore string, address types.Address, filters map[types.TokenTypeId]big.Int, powDifficulty *big.Int, log log15.Logger) *AutoReceiveWorker {
+	if log == nil {
+		log = slog.New("worker", "a", "addr", address)
+	}
+
+	w := &AutoReceiveWorker{
 		manager:          manager,
 		entropystore:     entropystore,
 		onroadBlocksPool: manager.onroadBlocksPool,
 		address:          address,
 		status:           Create,
 		isSleeping:       false,
-		isCancel:         false,
 		filters:          filters,
+		allowedTypes:     map[byte]struct{}{ledger.BlockTypeSendCall: {}},
+		heldBlocks:       make(map[types.TokenTypeId][]*ledger.AccountBlock),
+		heldAmounts:      make(map[types.TokenTypeId]*big.Int),
+		recentReceived:   newRecentHashes(recentReceivedTTL),
+		receivedByToken:  make(map[types.TokenTypeId]*big.Int),
 		powDifficulty:    powDifficulty,
-		log:              slog.New("worker", "a", "addr", address),
+		log:              log,
 	}
+	w.pack = w.packReceiveBlock
+	w.generate = w.generateReceiveBlock
+	w.snapshotHeight = w.latestSnapshotHeight
+	w.pledgeQuota = w.latestPledgeQuota
+	w.snapshotPoll = snapshotPollInterval
+	w.outstanding = w.unconfirmedReceives
+
+	return w
 }
 
-func (w AutoReceiveWorker) ResetPowDifficulty(powDifficulty *big.Int) {
+func (w *AutoReceiveWorker) ResetPowDifficulty(powDifficulty *big.Int) {
+	w.powMutex.Lock()
+	defer w.powMutex.Unlock()
 	w.powDifficulty = powDifficulty
 }
 
-func (w AutoReceiveWorker) GetEntropystore() string {
+func (w *AutoReceiveWorker) getPowDifficulty() *big.Int {
+	w.powMutex.RLock()
+	defer w.powMutex.RUnlock()
+	return w.powDifficulty
+}
+
+func (w *AutoReceiveWorker) GetEntropystore() string {
 	return w.entropystore
 }
 
@@ -68,18 +176,14 @@ func (w *AutoReceiveWorker) Start() {
 	defer w.statusMutex.Unlock()
 	if w.status != Start {
 
-		w.isCancel = false
-
 		w.breaker = make(chan struct{})
-		w.newOnroadTxAlarm = make(chan struct{})
+		w.newOnroadTxAlarm = make(chan struct{}, 1)
 		w.stopListener = make(chan struct{})
 
 		w.onroadBlocksPool.AddCommonTxLis(w.address, func() {
 			w.NewOnroadTxAlarm()
 		})
 
-		w.onroadBlocksPool.AcquireFullOnroadBlocksCache(w.address)
-
 		common.Go(w.startWork)
 
 		w.status = Start
@@ -91,47 +195,455 @@ func (w *AutoReceiveWorker) Start() {
 	w.log.Info("end start()")
 }
 
+// acquireOnroadBlocks load onroad blocks of the address into cache,
+// retry with a short backoff in case the db is busy, give up if the worker is broken meanwhile.
+// It`s called by the worker goroutine, so statusMutex is not held while sleeping
+func (w *AutoReceiveWorker) acquireOnroadBlocks() {
+	var err error
+	for i := 0; i < fetchRetryTimes; i++ {
+		if err = w.onroadBlocksPool.AcquireFullOnroadBlocksCache(w.address); err == nil {
+			return
+		}
+
+		w.log.Error("acquire onroad blocks failed", "times", i+1, "error", err)
+		select {
+		case <-w.breaker:
+			return
+		case <-time.After(fetchRetryInterval * time.Duration(i+1)):
+		}
+	}
+
+	w.setLastError(err)
+}
+
+func (w *AutoReceiveWorker) setLastError(err error) {
+	w.errMutex.Lock()
+	defer w.errMutex.Unlock()
+	w.lastErr = err
+}
+
+// LastError return the last error which the worker give up with
+func (w *AutoReceiveWorker) LastError() error {
+	w.errMutex.RLock()
+	defer w.errMutex.RUnlock()
+	return w.lastErr
+}
+
+// Stop is safe to be called concurrently, the whole body runs under statusMutex,
+// so only the first caller really stops the worker
 func (w *AutoReceiveWorker) Stop() {
-	w.log.Info("Stop()", "current status", w.status)
 	w.statusMutex.Lock()
 	defer w.statusMutex.Unlock()
+	w.log.Info("Stop()", "current status", w.status)
 	if w.status == Start {
 
-		w.isCancel = true
-
-		w.onroadBlocksPool.ReleaseFullOnroadBlocksCache(w.address)
-
-		w.breaker <- struct{}{}
+		// closed breaker wakes the worker whether it is sleeping or not
 		close(w.breaker)
 
 		w.onroadBlocksPool.RemoveCommonTxLis(w.address)
-		close(w.newOnroadTxAlarm)
 
 		// make sure we can stop the worker
 		<-w.stopListener
 		close(w.stopListener)
 
+		// released after the worker exits, it may be acquiring the cache
+		w.onroadBlocksPool.ReleaseFullOnroadBlocksCache(w.address)
+
+		// the onroad cache is released, held blocks will be fetched again after restart
+		w.batchMutex.Lock()
+		w.dropHeldBlocks()
+		w.batchMutex.Unlock()
+
 		w.status = Stop
 	}
 	w.log.Info("stopped")
 }
 
+// SetEagerFetch decide whether the onroad blocks are fetched as soon as the worker starts, default true.
+// If not, the backlog is not received until the first new onroad tx alarm, it avoids the spike at startup.
+// It takes effect on the next Start
+func (w *AutoReceiveWorker) SetEagerFetch(eager bool) {
+	var lazy int32
+	if !eager {
+		lazy = 1
+	}
+	atomic.StoreInt32(&w.lazyFetch, lazy)
+}
+
+// Pause keeps the worker and its onroad cache alive, but stops receiving until Resume
+func (w *AutoReceiveWorker) Pause() {
+	w.log.Info("Pause()")
+	atomic.StoreInt32(&w.paused, 1)
+}
+
+func (w *AutoReceiveWorker) Resume() {
+	w.log.Info("Resume()")
+	if atomic.CompareAndSwapInt32(&w.paused, 1, 0) {
+		// awake it in order to receive the blocks accumulated while paused
+		w.NewOnroadTxAlarm()
+	}
+}
+
+func (w *AutoReceiveWorker) IsPaused() bool {
+	return atomic.LoadInt32(&w.paused) == 1
+}
+
+// SetReceiveInterval set the minimum interval between receives, 0 means no limit
+func (w *AutoReceiveWorker) SetReceiveInterval(interval time.Duration) {
+	atomic.StoreInt64(&w.receiveInterval, int64(interval))
+}
+
+// throttle wait until the next receive is allowed, return true if the worker is broken meanwhile
+func (w *AutoReceiveWorker) throttle() (broken bool) {
+	interval := time.Duration(atomic.LoadInt64(&w.receiveInterval))
+	if wait := time.Until(w.lastReceive.Add(interval)); interval > 0 && wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+
+		select {
+		case <-timer.C:
+		case <-w.breaker:
+			return true
+		}
+	}
+
+	w.lastReceive = time.Now()
+	return false
+}
+
+const snapshotPollInterval = 200 * time.Millisecond
+
+// SetReceivesPerSnapshot cap the receives processed in a snapshot block, the worker waits for the next
+// snapshot block when the cap is hit, 0 means no limit
+func (w *AutoReceiveWorker) SetReceivesPerSnapshot(n int64) {
+	atomic.StoreInt64(&w.receivesPerSnapshot, n)
+}
+
+func (w *AutoReceiveWorker) latestSnapshotHeight() uint64 {
+	if sb := w.manager.Chain().GetLatestSnapshotBlock(); sb != nil {
+		return sb.Height
+	}
+	return 0
+}
+
+// waitSnapshot wait until the next snapshot block if the receives of the current one reach the cap,
+// return true if the worker is broken meanwhile
+func (w *AutoReceiveWorker) waitSnapshot() (broken bool) {
+	limit := atomic.LoadInt64(&w.receivesPerSnapshot)
+	if limit <= 0 {
+		return false
+	}
+
+	for {
+		if height := w.snapshotHeight(); height != w.receiveHeight {
+			w.receiveHeight = height
+			w.receivedInHeight = 0
+		}
+
+		if w.receivedInHeight < limit {
+			w.receivedInHeight++
+			return false
+		}
+
+		timer := time.NewTimer(w.snapshotPoll)
+		select {
+		case <-timer.C:
+		case <-w.breaker:
+			timer.Stop()
+			return true
+		}
+	}
+}
+
+// SetMaxOutstanding pause receiving while the address has n unconfirmed receive blocks, 0 means no limit
+func (w *AutoReceiveWorker) SetMaxOutstanding(n int64) {
+	atomic.StoreInt64(&w.maxOutstanding, n)
+}
+
+func (w *AutoReceiveWorker) unconfirmedReceives() (n int) {
+	for _, block := range w.manager.Chain().GetUnConfirmAccountBlocks(&w.address) {
+		if block.IsReceiveBlock() {
+			n++
+		}
+	}
+	return
+}
+
+// waitOutstanding wait until some unconfirmed receive blocks are confirmed if they reach the cap,
+// return true if the worker is broken meanwhile
+func (w *AutoReceiveWorker) waitOutstanding() (broken bool) {
+	for {
+		limit := atomic.LoadInt64(&w.maxOutstanding)
+		if limit <= 0 || int64(w.outstanding()) < limit {
+			return false
+		}
+
+		timer := time.NewTimer(w.snapshotPoll)
+		select {
+		case <-timer.C:
+		case <-w.breaker:
+			timer.Stop()
+			return true
+		}
+	}
+}
+
+// SetMinSnapshotHeight skip the send blocks referring a snapshot block lower than height, 0 means no limit
+func (w *AutoReceiveWorker) SetMinSnapshotHeight(height uint64) {
+	atomic.StoreUint64(&w.minSnapshotHeight, height)
+}
+
+// isRecent return false if tx refers a snapshot block lower than minSnapshotHeight, or unknown
+func (w *AutoReceiveWorker) isRecent(tx *ledger.AccountBlock) bool {
+	min := atomic.LoadUint64(&w.minSnapshotHeight)
+	if min == 0 {
+		return true
+	}
+
+	sb, err := w.manager.Chain().GetSnapshotBlockByHash(&tx.SnapshotHash)
+	if err != nil || sb == nil {
+		w.log.Info("snapshot block of send block not found", "hash", tx.Hash, "error", err)
+		return false
+	}
+	return sb.Height >= min
+}
+
+// SetReceiveDataFunc set the hook to populate data of receive blocks, nil means no data
+func (w *AutoReceiveWorker) SetReceiveDataFunc(f ReceiveDataFunc) {
+	w.hooksMutex.Lock()
+	defer w.hooksMutex.Unlock()
+	w.receiveDataFunc = f
+}
+
+func (w *AutoReceiveWorker) receiveData(sendBlock *ledger.AccountBlock) ([]byte, error) {
+	w.hooksMutex.RLock()
+	f := w.receiveDataFunc
+	w.hooksMutex.RUnlock()
+
+	if f == nil {
+		return nil, nil
+	}
+
+	data := f(sendBlock)
+	if len(data) > MaxReceiveDataLength {
+		return nil, ErrReceiveDataTooLong
+	}
+	return data, nil
+}
+
+// Rekey replace the signer of receive blocks packed afterwards, e.g. the wallet unlocked another key of
+// the address, the queued send blocks are kept. nil restores signing by the entropystore
+func (w *AutoReceiveWorker) Rekey(signer Signer) {
+	w.hooksMutex.Lock()
+	defer w.hooksMutex.Unlock()
+	w.signer = signer
+}
+
+func (w *AutoReceiveWorker) currentSigner() Signer {
+	w.hooksMutex.RLock()
+	defer w.hooksMutex.RUnlock()
+
+	if w.signer != nil {
+		return w.signer
+	}
+	return w.signByEntropystore
+}
+
+func (w *AutoReceiveWorker) signByEntropystore(addr types.Address, data []byte) (signedData, pubkey []byte, err error) {
+	manager, err := w.manager.wallet.GetEntropyStoreManager(w.entropystore)
+	if err != nil {
+		return nil, nil, err
+	}
+	return manager.SignData(addr, data)
+}
+
+// SetAllowedBlockTypes set the types of send blocks will be received, others are skipped,
+// default is BlockTypeSendCall only, e.g. plain transfers
+func (w *AutoReceiveWorker) SetAllowedBlockTypes(blockTypes ...byte) {
+	allowed := make(map[byte]struct{}, len(blockTypes))
+	for _, t := range blockTypes {
+		allowed[t] = struct{}{}
+	}
+
+	w.typesMutex.Lock()
+	defer w.typesMutex.Unlock()
+	w.allowedTypes = allowed
+}
+
+func (w *AutoReceiveWorker) isAllowedType(blockType byte) bool {
+	w.typesMutex.RLock()
+	defer w.typesMutex.RUnlock()
+
+	_, ok := w.allowedTypes[blockType]
+	return ok
+}
+
 func (w *AutoReceiveWorker) ResetAutoReceiveFilter(filters map[types.TokenTypeId]big.Int) {
 	w.log.Info("ResetAutoReceiveFilter", "len", len(filters))
 	w.filters = filters
+	// the cursor is reset, held blocks will be fetched again
+	w.batchMutex.Lock()
+	w.dropHeldBlocks()
+	w.batchMutex.Unlock()
 	w.onroadBlocksPool.ResetCacheCursor(w.address)
 }
 
+// ResetBatchThreshold set the per-token batch thresholds, blocks held before are dropped
+// and will be fetched from the onroad cache again
+func (w *AutoReceiveWorker) ResetBatchThreshold(thresholds map[types.TokenTypeId]big.Int) {
+	w.log.Info("ResetBatchThreshold", "len", len(thresholds))
+	w.batchMutex.Lock()
+	w.batchThresholds = thresholds
+	w.dropHeldBlocks()
+	w.batchMutex.Unlock()
+
+	w.onroadBlocksPool.ResetCacheCursor(w.address)
+}
+
+// dropHeldBlocks must be called with batchMutex held
+func (w *AutoReceiveWorker) dropHeldBlocks() {
+	w.heldBlocks = make(map[types.TokenTypeId][]*ledger.AccountBlock)
+	w.heldAmounts = make(map[types.TokenTypeId]*big.Int)
+}
+
+// RevalidateQueued drop the held blocks whose send block no longer exists on the chain, e.g. after a reorg
+func (w *AutoReceiveWorker) RevalidateQueued() {
+	w.batchMutex.Lock()
+	defer w.batchMutex.Unlock()
+
+	for tti, blocks := range w.heldBlocks {
+		valid := blocks[:0]
+		sum := new(big.Int)
+
+		for _, block := range blocks {
+			if b, err := w.manager.Chain().GetAccountBlockByHash(&block.Hash); err != nil || b == nil {
+				w.log.Info("drop held block reverted", "hash", block.Hash, "error", err)
+				w.recentReceived.remove(block.Hash)
+				continue
+			}
+
+			valid = append(valid, block)
+			if block.Amount != nil {
+				sum.Add(sum, block.Amount)
+			}
+		}
+
+		if len(valid) == 0 {
+			delete(w.heldBlocks, tti)
+			delete(w.heldAmounts, tti)
+		} else {
+			w.heldBlocks[tti] = valid
+			w.heldAmounts[tti] = sum
+		}
+	}
+}
+
+// Queued return the count of blocks held until their batch threshold is reached
+func (w *AutoReceiveWorker) Queued() int {
+	w.batchMutex.Lock()
+	defer w.batchMutex.Unlock()
+
+	var n int
+	for _, blocks := range w.heldBlocks {
+		n += len(blocks)
+	}
+	return n
+}
+
+// Processed return the count of receive blocks inserted into pool by the worker
+func (w *AutoReceiveWorker) Processed() uint64 {
+	return atomic.LoadUint64(&w.processed)
+}
+
+// ReceivedByToken return a copy of the amount received of each token by the worker
+func (w *AutoReceiveWorker) ReceivedByToken() map[types.TokenTypeId]*big.Int {
+	w.receivedMutex.Lock()
+	defer w.receivedMutex.Unlock()
+
+	received := make(map[types.TokenTypeId]*big.Int, len(w.receivedByToken))
+	for tti, amount := range w.receivedByToken {
+		received[tti] = new(big.Int).Set(amount)
+	}
+	return received
+}
+
+func (w *AutoReceiveWorker) addReceived(sendBlock *ledger.AccountBlock) {
+	if sendBlock.Amount == nil {
+		return
+	}
+
+	w.receivedMutex.Lock()
+	defer w.receivedMutex.Unlock()
+
+	sum, ok := w.receivedByToken[sendBlock.TokenId]
+	if !ok {
+		sum = new(big.Int)
+		w.receivedByToken[sendBlock.TokenId] = sum
+	}
+	sum.Add(sum, sendBlock.Amount)
+}
+
+// batch return the blocks should be processed now, if the token of tx has a batch threshold,
+// tx is held until the summed amount of held blocks reaches the threshold, then all of them are released
+func (w *AutoReceiveWorker) batch(tx *ledger.AccountBlock) []*ledger.AccountBlock {
+	w.batchMutex.Lock()
+	defer w.batchMutex.Unlock()
+
+	threshold, ok := w.batchThresholds[tx.TokenId]
+	if !ok {
+		return []*ledger.AccountBlock{tx}
+	}
+
+	sum, ok := w.heldAmounts[tx.TokenId]
+	if !ok {
+		sum = new(big.Int)
+		w.heldAmounts[tx.TokenId] = sum
+	}
+	if tx.Amount != nil {
+		sum.Add(sum, tx.Amount)
+	}
+	blocks := append(w.heldBlocks[tx.TokenId], tx)
+
+	if sum.Cmp(&threshold) < 0 {
+		w.heldBlocks[tx.TokenId] = blocks
+		return nil
+	}
+
+	delete(w.heldBlocks, tx.TokenId)
+	delete(w.heldAmounts, tx.TokenId)
+	return blocks
+}
+
 func (w *AutoReceiveWorker) startWork() {
 	w.log.Info("startWork")
+	w.acquireOnroadBlocks()
+
+	lazy := atomic.LoadInt32(&w.lazyFetch) == 1
 LOOP:
 	for {
 		w.isSleeping = false
-		if w.isCancel {
+		if w.isBroken() {
 			w.log.Info("found cancel true")
 			break
 		}
 
+		if lazy {
+			lazy = false
+			w.log.Debug("lazy fetch, start sleep")
+			if w.sleep() {
+				break LOOP
+			}
+			continue
+		}
+
+		if w.IsPaused() {
+			w.log.Debug("paused, start sleep")
+			if w.sleep() {
+				break LOOP
+			}
+			continue
+		}
+
 		entropyStoreManager, e := w.manager.wallet.GetEntropyStoreManager(w.entropystore)
 		if e != nil {
 			w.log.Error("startWork ", "err", e)
@@ -145,25 +657,31 @@ LOOP:
 
 		tx := w.onroadBlocksPool.GetNextCommonTx(w.address)
 		if tx != nil {
-			if len(w.filters) == 0 {
-				w.ProcessOneBlock(tx)
+			if !w.isAllowedType(tx.BlockType) {
+				w.log.Debug("skip block type not allowed", "hash", tx.Hash, "type", tx.BlockType)
 				continue
 			}
-			minAmount, ok := w.filters[tx.TokenId]
-			if !ok || tx.Amount.Cmp(&minAmount) < 0 {
+			if !w.isRecent(tx) {
+				w.log.Debug("skip stale block", "hash", tx.Hash, "snapshot", tx.SnapshotHash)
 				continue
 			}
-			w.ProcessOneBlock(tx)
+			if len(w.filters) != 0 {
+				minAmount, ok := w.filters[tx.TokenId]
+				if !ok || tx.Amount.Cmp(&minAmount) < 0 {
+					continue
+				}
+			}
+			for _, block := range w.batch(tx) {
+				if w.throttle() || w.waitSnapshot() || w.waitOutstanding() {
+					break LOOP
+				}
+				w.ProcessOneBlock(block)
+			}
 			continue
 		}
 
-		w.isSleeping = true
 		w.log.Debug("start sleep")
-		select {
-		case <-w.newOnroadTxAlarm:
-			w.log.Info("start awake")
-		case <-w.breaker:
-			w.log.Info("worker broken")
+		if w.sleep() {
 			break LOOP
 		}
 	}
@@ -173,65 +691,223 @@ LOOP:
 	w.log.Info("startWork end")
 }
 
+func (w *AutoReceiveWorker) isBroken() bool {
+	select {
+	case <-w.breaker:
+		return true
+	default:
+		return false
+	}
+}
+
+// sleep waits for a new onroad tx alarm, return true if the worker is broken meanwhile
+func (w *AutoReceiveWorker) sleep() (broken bool) {
+	w.isSleeping = true
+	select {
+	case <-w.newOnroadTxAlarm:
+		w.log.Info("start awake")
+		return false
+	case <-w.breaker:
+		w.log.Info("worker broken")
+		return true
+	}
+}
+
 func (w *AutoReceiveWorker) Close() error {
 	w.Stop()
 	return nil
 }
 
-func (w AutoReceiveWorker) Status() int {
+func (w *AutoReceiveWorker) Status() int {
 	w.statusMutex.Lock()
 	defer w.statusMutex.Unlock()
 	return w.status
 }
 
+// NewOnroadTxAlarm never blocks the caller, a pending alarm in the buffer
+// already wakes the worker, so the extra ones are coalesced into it
 func (w *AutoReceiveWorker) NewOnroadTxAlarm() {
-	if w.isSleeping {
-		w.newOnroadTxAlarm <- struct{}{}
+	select {
+	case w.newOnroadTxAlarm <- struct{}{}:
+	default:
 	}
 }
 
 func (w *AutoReceiveWorker) ProcessOneBlock(sendBlock *ledger.AccountBlock) {
+	// the same send block may be fetched twice before the receive block is inserted into pool
+	if !w.recentReceived.add(sendBlock.Hash) {
+		w.log.Info("ProcessOneBlock received recently, skip", "hash", sendBlock.Hash)
+		return
+	}
+	var inserted bool
+	defer func() {
+		if !inserted {
+			w.recentReceived.remove(sendBlock.Hash)
+		}
+	}()
+
 	if w.manager.checkExistInPool(sendBlock.ToAddress, sendBlock.FromBlockHash) {
 		w.log.Info("ProcessOneBlock.checkExistInPool failed")
+		inserted = true
 		return
 	}
 
+	if err := w.manager.verifySendToken(sendBlock); err != nil {
+		w.log.Error("token of send block is not allowed", "hash", sendBlock.Hash, "token", sendBlock.TokenId, "error", err)
+		w.setLastError(err)
+		return
+	}
+
+	data, err := w.receiveData(sendBlock)
+	if err != nil {
+		w.log.Error("receiveData failed", "error", err)
+		w.setLastError(err)
+		return
+	}
+
+	for i := 0; i < maxRepackTimes; i++ {
+		blockList, err := w.pack(sendBlock, data)
+		if err != nil {
+			if _, ok := err.(*PrevHashConflictError); ok {
+				w.log.Info("head changed while packing, pack receive block again", "error", err)
+				continue
+			}
+			w.log.Error("pack receive block failed", "error", err)
+			return
+		}
+
+		if err = w.manager.verifyReceiveBlock(blockList[0].AccountBlock); err != nil {
+			w.log.Error("verify receive block failed", "error", err)
+			w.setLastError(err)
+			return
+		}
+
+		err = w.manager.insertCommonBlockToPool(blockList)
+		if err == nil {
+			inserted = true
+			atomic.AddUint64(&w.processed, 1)
+			w.addReceived(sendBlock)
+			return
+		}
+
+		if _, ok := err.(*PrevHashConflictError); !ok {
+			w.log.Error("insertCommonBlockToPool failed, ", "error", err)
+			return
+		}
+		w.log.Info("head changed, pack receive block again", "error", err)
+	}
+}
+
+var errNilSendBlock = errors.New("send block is nil")
+var errNoLatestSnapshot = errors.New("latest snapshot block not found")
+
+// EstimateReceiveCost return the quota the receive block of send will cost, and whether PoW is required
+// because the pledge quota of the address is not enough. Data of ReceiveDataFunc is counted, and the quota
+// used by the unconfirmed blocks of the address is not available
+func (w *AutoReceiveWorker) EstimateReceiveCost(send *ledger.AccountBlock) (quota uint64, needsPoW bool, err error) {
+	if send == nil {
+		return 0, false, errNilSendBlock
+	}
+
+	data, err := w.receiveData(send)
+	if err != nil {
+		return 0, false, err
+	}
+
+	quota, err = util.IntrinsicGasCost(data, false)
+	if err != nil {
+		return 0, false, err
+	}
+
+	pledged, err := w.pledgeQuota()
+	if err != nil {
+		return 0, false, err
+	}
+
+	var used uint64
+	for _, block := range w.manager.Chain().GetUnConfirmAccountBlocks(&w.address) {
+		used += block.Quota
+	}
+	if used < pledged {
+		pledged -= used
+	} else {
+		pledged = 0
+	}
+
+	return quota, pledged < quota, nil
+}
+
+func (w *AutoReceiveWorker) latestPledgeQuota() (uint64, error) {
+	sb := w.manager.Chain().GetLatestSnapshotBlock()
+	if sb == nil {
+		return 0, errNoLatestSnapshot
+	}
+	return w.manager.Chain().GetPledgeQuota(sb.Hash, w.address)
+}
+
+// accountHead return the prevHash and height of the next block of the account, packed on its latest block,
+// zero hash and height 1 if the account has no block yet
+func (w *AutoReceiveWorker) accountHead() (prevHash types.Hash, height uint64, err error) {
+	head, err := w.manager.Chain().GetLatestAccountBlock(&w.address)
+	if err != nil {
+		return types.ZERO_HASH, 0, err
+	}
+	if head == nil {
+		return types.ZERO_HASH, 1, nil
+	}
+	return head.Hash, head.Height + 1, nil
+}
+
+// generateReceiveBlock run the generator on the fittest snapshot block of sendBlock
+func (w *AutoReceiveWorker) generateReceiveBlock(sendBlock *ledger.AccountBlock, signFunc generator.SignFunc, data []byte) (*generator.GenResult, error) {
 	var referredSnapshotHashList []types.Hash
 	referredSnapshotHashList = append(referredSnapshotHashList, sendBlock.SnapshotHash)
 	_, fitestSnapshotBlockHash, err := generator.GetFittestGeneratorSnapshotHash(w.manager.Chain(), &sendBlock.ToAddress, referredSnapshotHashList, true)
 	if err != nil {
 		w.log.Info("GetFittestGeneratorSnapshotHash failed", "error", err)
-		return
+		return nil, err
 	}
 	gen, err := generator.NewGenerator(w.manager.Chain(), fitestSnapshotBlockHash, nil, &sendBlock.ToAddress)
 	if err != nil {
 		w.log.Error("NewGenerator failed", "error", err)
-		return
+		return nil, err
 	}
 
-	genResult, err := gen.GenerateWithOnroad(*sendBlock, nil,
-		func(addr types.Address, data []byte) (signedData, pubkey []byte, err error) {
-			manager, e := w.manager.wallet.GetEntropyStoreManager(w.entropystore)
-			if e != nil {
-				return nil, nil, e
-			}
-			return manager.SignData(addr, data)
-		}, w.powDifficulty)
+	genResult, err := gen.GenerateWithOnroadData(*sendBlock, nil, signFunc, w.getPowDifficulty(), data)
 	if err != nil {
 		w.log.Error("GenerateWithOnroad failed", "error", err)
-		return
+		return nil, err
+	}
+	return genResult, nil
+}
+
+// packReceiveBlock generate the receive block of sendBlock on the current head of the account,
+// return *PrevHashConflictError if the head changed while packing
+func (w *AutoReceiveWorker) packReceiveBlock(sendBlock *ledger.AccountBlock, data []byte) ([]*vm_context.VmAccountBlock, error) {
+	prevHash, height, err := w.accountHead()
+	if err != nil {
+		w.log.Error("accountHead failed", "error", err)
+		return nil, err
+	}
+
+	genResult, err := w.generate(sendBlock, generator.SignFunc(w.currentSigner()), data)
+	if err != nil {
+		return nil, err
 	}
 	if genResult.Err != nil {
 		w.log.Error("vm.Run error, ignore", "error", genResult.Err)
 	}
 	if len(genResult.BlockGenList) == 0 {
-		w.log.Error("GenerateWithOnroad failed, BlockGenList is nil")
-		return
+		return nil, errors.New("GenerateWithOnroad failed, BlockGenList is nil")
 	}
 
-	poolErr := w.manager.insertCommonBlockToPool(genResult.BlockGenList)
-	if poolErr != nil {
-		w.log.Error("insertCommonBlockToPool failed, ", "error", poolErr)
-		return
+	if block := genResult.BlockGenList[0].AccountBlock; block.PrevHash != prevHash || block.Height != height {
+		return nil, &PrevHashConflictError{
+			Address:  w.address,
+			PrevHash: block.PrevHash,
+			Head:     prevHash,
+		}
 	}
+
+	return genResult.BlockGenList, nil
 }
@@ -0,0 +1,1078 @@
+package onroad
+
+import (
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/vitelabs/go-vite/chain"
+	"github.com/vitelabs/go-vite/common/types"
+	"github.com/vitelabs/go-vite/generator"
+	"github.com/vitelabs/go-vite/ledger"
+	"github.com/vitelabs/go-vite/log15"
+	"github.com/vitelabs/go-vite/verifier"
+	"github.com/vitelabs/go-vite/vm/util"
+	"github.com/vitelabs/go-vite/vm_context"
+	"github.com/vitelabs/go-vite/wallet"
+	"github.com/vitelabs/go-vite/wallet/entropystore"
+)
+
+type mockCommonTxPool struct {
+	mu     sync.Mutex
+	blocks []*ledger.AccountBlock
+	cursor int
+	lis    func()
+
+	acquireErrs []error // AcquireFullOnroadBlocksCache return these errors in order
+	acquired    bool
+}
+
+func (p *mockCommonTxPool) AddCommonTxLis(addr types.Address, f func()) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.lis = f
+}
+
+func (p *mockCommonTxPool) RemoveCommonTxLis(addr types.Address) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.lis = nil
+}
+
+func (p *mockCommonTxPool) AcquireFullOnroadBlocksCache(addr types.Address) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.acquireErrs) > 0 {
+		err := p.acquireErrs[0]
+		p.acquireErrs = p.acquireErrs[1:]
+		return err
+	}
+	p.acquired = true
+	return nil
+}
+
+func (p *mockCommonTxPool) ReleaseFullOnroadBlocksCache(addr types.Address) error {
+	return nil
+}
+
+func (p *mockCommonTxPool) ResetCacheCursor(addr types.Address) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.cursor = 0
+}
+
+func (p *mockCommonTxPool) GetNextCommonTx(addr types.Address) *ledger.AccountBlock {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.acquired || p.cursor >= len(p.blocks) {
+		return nil
+	}
+	block := p.blocks[p.cursor]
+	p.cursor++
+	return block
+}
+
+func (p *mockCommonTxPool) add(blocks ...*ledger.AccountBlock) {
+	p.mu.Lock()
+	p.blocks = append(p.blocks, blocks...)
+	lis := p.lis
+	p.mu.Unlock()
+
+	if lis != nil {
+		lis()
+	}
+}
+
+// mockPool records every send block the worker tries to receive,
+// and reports it as existing so that ProcessOneBlock returns before generating
+type mockPool struct {
+	mu         sync.Mutex
+	received   []types.Hash
+	receivedAt []time.Time
+
+	missing bool // ExistInPool return false, so blocks are packed and added
+	added   []*ledger.AccountBlock
+	addErr  error // AddDirectAccountBlock return addErr without adding if it is not nil
+
+	gate chan struct{} // ExistInPool wait until gate is closed if it is not nil
+}
+
+func (p *mockPool) ExistInPool(address types.Address, fromBlockHash types.Hash) bool {
+	p.mu.Lock()
+	p.received = append(p.received, fromBlockHash)
+	p.receivedAt = append(p.receivedAt, time.Now())
+	gate := p.gate
+	p.mu.Unlock()
+
+	if gate != nil {
+		<-gate
+	}
+	return !p.missing
+}
+
+func (p *mockPool) AddDirectAccountBlock(address types.Address, vmAccountBlock *vm_context.VmAccountBlock) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.addErr != nil {
+		return p.addErr
+	}
+	p.added = append(p.added, vmAccountBlock.AccountBlock)
+	return nil
+}
+
+func (p *mockPool) AddDirectAccountBlocks(address types.Address, received *vm_context.VmAccountBlock, sendBlocks []*vm_context.VmAccountBlock) error {
+	return nil
+}
+
+func (p *mockPool) count() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.received)
+}
+
+var testWallet struct {
+	once sync.Once
+	wm   *wallet.Manager
+	em   *entropystore.Manager
+	err  error
+}
+
+// unlockedWallet create an unlocked entropy store only once, because scrypt is expensive
+func unlockedWallet(t *testing.T) (*wallet.Manager, *entropystore.Manager) {
+	testWallet.once.Do(func() {
+		dir, err := ioutil.TempDir("", "autoreceive")
+		if err != nil {
+			testWallet.err = err
+			return
+		}
+
+		testWallet.wm = wallet.New(&wallet.Config{DataDir: dir})
+		_, testWallet.em, err = testWallet.wm.NewMnemonicAndEntropyStore("123456")
+		if err != nil {
+			testWallet.err = err
+			return
+		}
+		testWallet.err = testWallet.em.Unlock("123456")
+	})
+
+	if testWallet.err != nil {
+		t.Fatal(testWallet.err)
+	}
+
+	return testWallet.wm, testWallet.em
+}
+
+func newTestAutoReceiveWorker(t *testing.T) (w *AutoReceiveWorker, txPool *mockCommonTxPool, pool *mockPool) {
+	wm, em := unlockedWallet(t)
+
+	pool = new(mockPool)
+	txPool = new(mockCommonTxPool)
+
+	manager := NewManager(nil, pool, nil, wm)
+	w = NewAutoReceiveWorker(manager, em.GetEntropyStoreFile(), em.GetPrimaryAddr(), nil, nil, nil)
+	w.onroadBlocksPool = txPool
+
+	return w, txPool, pool
+}
+
+func mockSendBlock(to types.Address, tti types.TokenTypeId, amount int64) *ledger.AccountBlock {
+	var hash types.Hash
+	hash[0] = byte(amount)
+	hash[1] = byte(amount >> 8)
+
+	return &ledger.AccountBlock{
+		BlockType: ledger.BlockTypeSendCall,
+		Hash:      hash,
+		ToAddress: to,
+		TokenId:   tti,
+		Amount:    big.NewInt(amount),
+	}
+}
+
+// wait until fn return true or timeout
+func waitFor(timeout time.Duration, fn func() bool) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if fn() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return fn()
+}
+
+func TestAutoReceiveWorker_NewOnroadTxAlarm(t *testing.T) {
+	w := &AutoReceiveWorker{
+		newOnroadTxAlarm: make(chan struct{}, 1),
+	}
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 1000; i++ {
+			w.NewOnroadTxAlarm()
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("NewOnroadTxAlarm blocked the caller")
+	}
+
+	if len(w.newOnroadTxAlarm) != 1 {
+		t.Errorf("alarms should be coalesced into one, got %d", len(w.newOnroadTxAlarm))
+	}
+}
+
+func TestAutoReceiveWorker_Pause(t *testing.T) {
+	w, txPool, pool := newTestAutoReceiveWorker(t)
+
+	w.Pause()
+	w.Start()
+	defer w.Stop()
+
+	txPool.add(mockSendBlock(w.address, types.TokenTypeId{}, 1), mockSendBlock(w.address, types.TokenTypeId{}, 2))
+
+	time.Sleep(200 * time.Millisecond)
+	if n := pool.count(); n != 0 {
+		t.Fatalf("paused worker should not receive, but received %d blocks", n)
+	}
+
+	w.Resume()
+	if !waitFor(2*time.Second, func() bool { return pool.count() == 2 }) {
+		t.Fatalf("resumed worker should receive 2 blocks, but received %d", pool.count())
+	}
+}
+
+func TestAutoReceiveWorker_acquireOnroadBlocks(t *testing.T) {
+	defer func(d time.Duration) {
+		fetchRetryInterval = d
+	}(fetchRetryInterval)
+	fetchRetryInterval = time.Millisecond
+
+	w, txPool, pool := newTestAutoReceiveWorker(t)
+	txPool.acquireErrs = []error{errors.New("db is busy")}
+	txPool.add(mockSendBlock(w.address, types.TokenTypeId{}, 1))
+
+	w.Start()
+	defer w.Stop()
+
+	if !waitFor(2*time.Second, func() bool { return pool.count() == 1 }) {
+		t.Fatalf("should receive the block after retry")
+	}
+	if err := w.LastError(); err != nil {
+		t.Errorf("should not give up, but got error %v", err)
+	}
+
+	w2, txPool2, _ := newTestAutoReceiveWorker(t)
+	txPool2.acquireErrs = make([]error, fetchRetryTimes)
+	for i := range txPool2.acquireErrs {
+		txPool2.acquireErrs[i] = errors.New("db is broken")
+	}
+
+	w2.acquireOnroadBlocks()
+	if err := w2.LastError(); err == nil {
+		t.Errorf("should give up with the last error")
+	}
+
+	// status is not locked while waiting for retry, and Stop break the retry
+	fetchRetryInterval = time.Hour
+	w3, txPool3, _ := newTestAutoReceiveWorker(t)
+	txPool3.acquireErrs = []error{errors.New("db is busy")}
+
+	done := make(chan struct{})
+	go func() {
+		w3.Start()
+		w3.Status()
+		w3.Stop()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("should not be blocked by the retry")
+	}
+}
+
+func TestAutoReceiveWorker_Stop(t *testing.T) {
+	w, _, _ := newTestAutoReceiveWorker(t)
+	w.Start()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w.Stop()
+		}()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("concurrent Stop blocked")
+	}
+
+	if s := w.Status(); s != Stop {
+		t.Errorf("worker should be stopped, but status is %d", s)
+	}
+}
+
+func TestAutoReceiveWorker_Stop_midBlock(t *testing.T) {
+	w, txPool, pool := newTestAutoReceiveWorker(t)
+	w.manager.chain = &mockChain{}
+	pool.missing = true
+	pool.gate = make(chan struct{})
+
+	w.SetReceiveDataFunc(func(sendBlock *ledger.AccountBlock) []byte {
+		return []byte("memo")
+	})
+	w.pack = func(sendBlock *ledger.AccountBlock, data []byte) ([]*vm_context.VmAccountBlock, error) {
+		w.currentSigner()
+		block := &ledger.AccountBlock{
+			BlockType:     ledger.BlockTypeReceive,
+			Hash:          types.Hash{1},
+			FromBlockHash: sendBlock.Hash,
+		}
+		return []*vm_context.VmAccountBlock{{AccountBlock: block}}, nil
+	}
+
+	w.Start()
+	txPool.add(mockSendBlock(w.address, types.TokenTypeId{}, 1))
+	if !waitFor(2*time.Second, func() bool { return pool.count() == 1 }) {
+		t.Fatal("worker should be processing the send block")
+	}
+
+	done := make(chan struct{})
+	go func() {
+		w.Stop()
+		close(done)
+	}()
+
+	// Stop is waiting for the worker, which reads the hooks after the pool returns
+	time.Sleep(50 * time.Millisecond)
+	close(pool.gate)
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Stop blocked by the worker processing a block")
+	}
+}
+
+func TestAutoReceiveWorker_batch(t *testing.T) {
+	w, txPool, pool := newTestAutoReceiveWorker(t)
+
+	tti := types.TokenTypeId{1}
+	w.ResetBatchThreshold(map[types.TokenTypeId]big.Int{tti: *big.NewInt(10)})
+	w.Start()
+	defer w.Stop()
+
+	// token without threshold is received at once
+	txPool.add(mockSendBlock(w.address, types.TokenTypeId{}, 100))
+	if !waitFor(2*time.Second, func() bool { return pool.count() == 1 }) {
+		t.Fatalf("should receive block without threshold, but received %d", pool.count())
+	}
+
+	txPool.add(mockSendBlock(w.address, tti, 3), mockSendBlock(w.address, tti, 4))
+	txPool.add(mockSendBlock(w.address, tti, 2))
+
+	time.Sleep(200 * time.Millisecond)
+	if n := pool.count(); n != 1 {
+		t.Fatalf("should hold blocks below threshold, but received %d", n-1)
+	}
+
+	txPool.add(mockSendBlock(w.address, tti, 1))
+	if !waitFor(2*time.Second, func() bool { return pool.count() == 5 }) {
+		t.Fatalf("should receive 4 held blocks after reaching threshold, but received %d", pool.count()-1)
+	}
+
+	// held blocks are dropped by Stop, they are fetched again after restart
+	txPool.add(mockSendBlock(w.address, tti, 5))
+	if !waitFor(2*time.Second, func() bool { return w.Queued() == 1 }) {
+		t.Fatalf("should hold 1 block, but held %d", w.Queued())
+	}
+	w.Stop()
+	if n := w.Queued(); n != 0 {
+		t.Errorf("held blocks should be dropped after stop, but got %d", n)
+	}
+}
+
+func TestAutoReceiveWorker_ProcessOneBlock_dedup(t *testing.T) {
+	w, _, pool := newTestAutoReceiveWorker(t)
+
+	block := mockSendBlock(w.address, types.TokenTypeId{}, 1)
+	w.ProcessOneBlock(block)
+	w.ProcessOneBlock(block)
+
+	if n := pool.count(); n != 1 {
+		t.Errorf("the same send block should be received once, but received %d times", n)
+	}
+
+	w.ProcessOneBlock(mockSendBlock(w.address, types.TokenTypeId{}, 2))
+	if n := pool.count(); n != 2 {
+		t.Errorf("another send block should be received, but received %d blocks", n)
+	}
+}
+
+func TestNewAutoReceiveWorker_log(t *testing.T) {
+	var records []string
+	log := log15.New("test", "worker")
+	log.SetHandler(log15.FuncHandler(func(r *log15.Record) error {
+		records = append(records, r.Msg)
+		return nil
+	}))
+
+	w := NewAutoReceiveWorker(&Manager{}, "", types.Address{}, nil, nil, log)
+	w.Pause()
+
+	if len(records) != 1 || records[0] != "Pause()" {
+		t.Errorf("should log with the injected logger, but got %v", records)
+	}
+
+	if w = NewAutoReceiveWorker(&Manager{}, "", types.Address{}, nil, nil, nil); w.log == nil {
+		t.Error("should use the default logger")
+	}
+}
+
+func TestAutoReceiveWorker_receiveData(t *testing.T) {
+	w := NewAutoReceiveWorker(&Manager{}, "", types.Address{}, nil, nil, nil)
+	block := mockSendBlock(types.Address{}, types.TokenTypeId{}, 1)
+
+	if data, err := w.receiveData(block); err != nil || data != nil {
+		t.Errorf("should have no data without hook, but got %v %v", data, err)
+	}
+
+	memo := []byte("memo")
+	w.SetReceiveDataFunc(func(sendBlock *ledger.AccountBlock) []byte {
+		if sendBlock != block {
+			t.Errorf("hook should be called with the send block")
+		}
+		return memo
+	})
+	if data, err := w.receiveData(block); err != nil || string(data) != "memo" {
+		t.Errorf("should carry data of hook, but got %v %v", data, err)
+	}
+
+	w.SetReceiveDataFunc(func(sendBlock *ledger.AccountBlock) []byte {
+		return make([]byte, MaxReceiveDataLength+1)
+	})
+	if _, err := w.receiveData(block); err != ErrReceiveDataTooLong {
+		t.Errorf("should fail with %v, but got %v", ErrReceiveDataTooLong, err)
+	}
+}
+
+// mockChain contains all blocks except the deleted ones
+type mockChain struct {
+	chain.Chain
+	mu      sync.Mutex
+	deleted map[types.Hash]bool
+	head    *ledger.AccountBlock
+
+	snapshots   map[types.Hash]uint64 // height of snapshot blocks
+	unconfirmed []*ledger.AccountBlock
+}
+
+func (c *mockChain) GetUnConfirmAccountBlocks(addr *types.Address) []*ledger.AccountBlock {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.unconfirmed
+}
+
+func (c *mockChain) GetSnapshotBlockByHash(hash *types.Hash) (*ledger.SnapshotBlock, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	height, ok := c.snapshots[*hash]
+	if !ok {
+		return nil, nil
+	}
+	return &ledger.SnapshotBlock{Hash: *hash, Height: height}, nil
+}
+
+func (c *mockChain) GetLatestAccountBlock(addr *types.Address) (*ledger.AccountBlock, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.head, nil
+}
+
+func (c *mockChain) setHead(hash types.Hash) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.head = &ledger.AccountBlock{Hash: hash}
+}
+
+func (c *mockChain) GetAccountBlockByHash(hash *types.Hash) (*ledger.AccountBlock, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.deleted[*hash] {
+		return nil, nil
+	}
+	return &ledger.AccountBlock{Hash: *hash}, nil
+}
+
+func TestAutoReceiveWorker_RevalidateQueued(t *testing.T) {
+	c := &mockChain{deleted: make(map[types.Hash]bool)}
+	w := NewAutoReceiveWorker(&Manager{chain: c, autoReceiveWorkers: make(map[types.Address]*AutoReceiveWorker)}, "", types.Address{}, nil, nil, nil)
+	w.manager.autoReceiveWorkers[w.address] = w
+
+	tti := types.TokenTypeId{1}
+	w.batchThresholds = map[types.TokenTypeId]big.Int{tti: *big.NewInt(10)}
+
+	blocks := []*ledger.AccountBlock{
+		mockSendBlock(w.address, tti, 1),
+		mockSendBlock(w.address, tti, 2),
+		mockSendBlock(w.address, tti, 3),
+	}
+	for _, b := range blocks {
+		if w.batch(b) != nil {
+			t.Fatal("blocks should be held")
+		}
+	}
+
+	// reorg removes the second send block
+	c.mu.Lock()
+	c.deleted[blocks[1].Hash] = true
+	c.mu.Unlock()
+	w.manager.revertAccountBlocksSuccess(map[types.Address][]*ledger.AccountBlock{
+		types.Address{}: {blocks[1]},
+	})
+
+	held := func() []*ledger.AccountBlock {
+		w.batchMutex.Lock()
+		defer w.batchMutex.Unlock()
+		return w.heldBlocks[tti]
+	}
+	if !waitFor(time.Second, func() bool { return len(held()) == 2 }) {
+		t.Fatalf("reverted block should be dropped, but %d blocks held", len(held()))
+	}
+	for _, b := range held() {
+		if b == blocks[1] {
+			t.Errorf("reverted block %s is still held", b.Hash)
+		}
+	}
+
+	w.batchMutex.Lock()
+	sum := w.heldAmounts[tti].Int64()
+	w.batchMutex.Unlock()
+	if sum != 4 {
+		t.Errorf("held amount should be 4, but got %d", sum)
+	}
+}
+
+func TestAutoReceiveWorker_SetReceiveInterval(t *testing.T) {
+	const interval = 50 * time.Millisecond
+
+	w, txPool, pool := newTestAutoReceiveWorker(t)
+	w.SetReceiveInterval(interval)
+	txPool.add(
+		mockSendBlock(w.address, types.TokenTypeId{}, 1),
+		mockSendBlock(w.address, types.TokenTypeId{}, 2),
+		mockSendBlock(w.address, types.TokenTypeId{}, 3),
+	)
+
+	w.Start()
+	defer w.Stop()
+
+	if !waitFor(2*time.Second, func() bool { return pool.count() == 3 }) {
+		t.Fatalf("should receive 3 blocks, but received %d", pool.count())
+	}
+
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	for i := 1; i < len(pool.receivedAt); i++ {
+		if d := pool.receivedAt[i].Sub(pool.receivedAt[i-1]); d < interval {
+			t.Errorf("receive %d is only %s after the previous one", i, d)
+		}
+	}
+}
+
+func TestAutoReceiveWorker_SetReceivesPerSnapshot(t *testing.T) {
+	w, txPool, pool := newTestAutoReceiveWorker(t)
+
+	// mock snapshot clock
+	var height uint64 = 1
+	w.snapshotHeight = func() uint64 { return atomic.LoadUint64(&height) }
+	w.snapshotPoll = 5 * time.Millisecond
+
+	w.SetReceivesPerSnapshot(2)
+	for i := int64(1); i <= 5; i++ {
+		txPool.add(mockSendBlock(w.address, types.TokenTypeId{}, i))
+	}
+
+	w.Start()
+	defer w.Stop()
+
+	for _, want := range []int{2, 4, 5} {
+		if !waitFor(time.Second, func() bool { return pool.count() == want }) {
+			t.Fatalf("should receive %d blocks at snapshot %d, but received %d", want, atomic.LoadUint64(&height), pool.count())
+		}
+
+		// no more receives until the next snapshot block
+		time.Sleep(50 * time.Millisecond)
+		if n := pool.count(); n != want {
+			t.Fatalf("should receive at most %d blocks at snapshot %d, but received %d", want, atomic.LoadUint64(&height), n)
+		}
+
+		atomic.AddUint64(&height, 1)
+	}
+}
+
+func TestAutoReceiveWorker_ProcessOneBlock_repack(t *testing.T) {
+	c := &mockChain{}
+	pool := &mockPool{missing: true}
+	w := NewAutoReceiveWorker(&Manager{chain: c, pool: pool}, "", types.Address{}, nil, nil, nil)
+
+	head1, head2 := types.Hash{1}, types.Hash{2}
+	c.setHead(head1)
+
+	var packed []types.Hash
+	w.pack = func(sendBlock *ledger.AccountBlock, data []byte) ([]*vm_context.VmAccountBlock, error) {
+		head, _ := c.GetLatestAccountBlock(&sendBlock.ToAddress)
+		block := &ledger.AccountBlock{
+			BlockType:     ledger.BlockTypeReceive,
+			Hash:          types.Hash{byte(len(packed) + 10)},
+			PrevHash:      head.Hash,
+			FromBlockHash: sendBlock.Hash,
+		}
+		packed = append(packed, head.Hash)
+
+		// another receive block landed after the first packing
+		if len(packed) == 1 {
+			c.setHead(head2)
+		}
+
+		return []*vm_context.VmAccountBlock{{AccountBlock: block}}, nil
+	}
+
+	w.ProcessOneBlock(mockSendBlock(w.address, types.TokenTypeId{}, 1))
+
+	if len(packed) != 2 || packed[0] != head1 || packed[1] != head2 {
+		t.Fatalf("should pack on %s then on %s, but packed on %v", head1, head2, packed)
+	}
+	if len(pool.added) != 1 || pool.added[0].PrevHash != head2 {
+		t.Fatalf("should add 1 block packed on the new head, but added %d", len(pool.added))
+	}
+
+	// inserting the head again is a no-op
+	err := w.manager.insertCommonBlockToPool([]*vm_context.VmAccountBlock{{AccountBlock: &ledger.AccountBlock{Hash: head2}}})
+	if err != nil || len(pool.added) != 1 {
+		t.Errorf("insert the same block again should be a no-op, but got %v", err)
+	}
+
+	// conflict is reported as PrevHashConflictError
+	err = w.manager.insertCommonBlockToPool([]*vm_context.VmAccountBlock{{AccountBlock: &ledger.AccountBlock{Hash: types.Hash{3}, PrevHash: head1}}})
+	if e, ok := err.(*PrevHashConflictError); !ok || e.Head != head2 {
+		t.Errorf("should return PrevHashConflictError, but got %v", err)
+	}
+}
+
+func TestAutoReceiveWorker_accountHead(t *testing.T) {
+	c := &mockChain{}
+	w := NewAutoReceiveWorker(&Manager{chain: c}, "", types.Address{}, nil, nil, nil)
+
+	// new account, the first block is at height 1
+	prevHash, height, err := w.accountHead()
+	if err != nil || prevHash != types.ZERO_HASH || height != 1 {
+		t.Errorf("should pack the first block on zero hash at height 1, but got %s %d %v", prevHash, height, err)
+	}
+
+	// existing account, the next block follows the latest one
+	head := &ledger.AccountBlock{Hash: types.Hash{1}, Height: 5}
+	c.head = head
+	prevHash, height, err = w.accountHead()
+	if err != nil || prevHash != head.Hash || height != head.Height+1 {
+		t.Errorf("should pack on %s at height %d, but got %s %d %v", head.Hash, head.Height+1, prevHash, height, err)
+	}
+}
+
+func TestAutoReceiveWorker_ProcessOneBlock_packConflict(t *testing.T) {
+	c := &mockChain{}
+	pool := &mockPool{missing: true}
+	w := NewAutoReceiveWorker(&Manager{chain: c, pool: pool}, "", types.Address{}, nil, nil, nil)
+
+	var packs int
+	w.pack = func(sendBlock *ledger.AccountBlock, data []byte) ([]*vm_context.VmAccountBlock, error) {
+		packs++
+		// head changed while the first packing
+		if packs == 1 {
+			return nil, &PrevHashConflictError{Address: w.address, PrevHash: types.Hash{1}}
+		}
+		block := &ledger.AccountBlock{
+			BlockType:     ledger.BlockTypeReceive,
+			Hash:          types.Hash{2},
+			FromBlockHash: sendBlock.Hash,
+		}
+		return []*vm_context.VmAccountBlock{{AccountBlock: block}}, nil
+	}
+
+	w.ProcessOneBlock(mockSendBlock(w.address, types.TokenTypeId{}, 1))
+
+	if packs != 2 || len(pool.added) != 1 {
+		t.Errorf("should pack again after conflict and add 1 block, but packed %d times and added %d", packs, len(pool.added))
+	}
+}
+
+func TestAutoReceiveWorker_ProcessOneBlock_verify(t *testing.T) {
+	c := &mockChain{}
+	pool := &mockPool{missing: true}
+	w := NewAutoReceiveWorker(&Manager{chain: c, pool: pool}, "", types.Address{}, nil, nil, nil)
+
+	w.pack = func(sendBlock *ledger.AccountBlock, data []byte) ([]*vm_context.VmAccountBlock, error) {
+		block := &ledger.AccountBlock{
+			BlockType:     ledger.BlockTypeReceive,
+			Hash:          types.Hash{1},
+			FromBlockHash: sendBlock.Hash,
+		}
+		return []*vm_context.VmAccountBlock{{AccountBlock: block}}, nil
+	}
+
+	errVerify := errors.New("verify failed")
+	var verified []types.Hash
+	w.manager.SetAccountBlockVerifier(func(block *ledger.AccountBlock) error {
+		verified = append(verified, block.Hash)
+		return errVerify
+	})
+
+	w.ProcessOneBlock(mockSendBlock(w.address, types.TokenTypeId{}, 1))
+
+	if len(verified) != 1 || verified[0] != (types.Hash{1}) {
+		t.Fatalf("should verify the receive block packed, but verified %v", verified)
+	}
+	if len(pool.added) != 0 || w.LastError() != errVerify {
+		t.Fatalf("block failed verification should not be added, but added %d, last error %v", len(pool.added), w.LastError())
+	}
+
+	w.manager.SetAccountBlockVerifier(func(block *ledger.AccountBlock) error {
+		return nil
+	})
+
+	// the send block isn`t remembered as received after the failure
+	w.ProcessOneBlock(mockSendBlock(w.address, types.TokenTypeId{}, 1))
+
+	if len(pool.added) != 1 {
+		t.Errorf("verified block should be added, but added %d", len(pool.added))
+	}
+}
+
+func TestManager_SetAllowedTokens(t *testing.T) {
+	c := &mockChain{}
+	pool := &mockPool{missing: true}
+	manager := &Manager{chain: c, pool: pool}
+	manager.SetTokenVerifier(verifier.VerifyTokenAllowed)
+	w := NewAutoReceiveWorker(manager, "", types.Address{}, nil, nil, nil)
+
+	var packed int
+	w.pack = func(sendBlock *ledger.AccountBlock, data []byte) ([]*vm_context.VmAccountBlock, error) {
+		packed++
+		block := &ledger.AccountBlock{
+			BlockType:     ledger.BlockTypeReceive,
+			Hash:          types.Hash{byte(packed)},
+			FromBlockHash: sendBlock.Hash,
+		}
+		return []*vm_context.VmAccountBlock{{AccountBlock: block}}, nil
+	}
+
+	allowed := map[types.TokenTypeId]bool{ledger.ViteTokenId: true, {2}: false}
+	manager.SetAllowedTokens(allowed)
+	// the whitelist is copied
+	allowed[types.TokenTypeId{1}] = true
+
+	for i, tti := range []types.TokenTypeId{{1}, {2}} {
+		w.ProcessOneBlock(mockSendBlock(w.address, tti, int64(i+1)))
+		if packed != 0 || len(pool.added) != 0 {
+			t.Fatalf("token %s should not be received, but packed %d and added %d", tti, packed, len(pool.added))
+		}
+		if err := w.LastError(); err != verifier.ErrVerifyTokenNotAllowed {
+			t.Errorf("should fail with %v, but got %v", verifier.ErrVerifyTokenNotAllowed, err)
+		}
+	}
+
+	w.ProcessOneBlock(mockSendBlock(w.address, ledger.ViteTokenId, 3))
+	if packed != 1 || len(pool.added) != 1 {
+		t.Fatalf("allowed token should be received, but packed %d and added %d", packed, len(pool.added))
+	}
+
+	// nil allows any token
+	manager.SetAllowedTokens(nil)
+	w.ProcessOneBlock(mockSendBlock(w.address, types.TokenTypeId{1}, 4))
+	if len(pool.added) != 2 {
+		t.Errorf("any token should be received without whitelist, but added %d", len(pool.added))
+	}
+}
+
+func TestAutoReceiveWorker_SetAllowedBlockTypes(t *testing.T) {
+	w, txPool, pool := newTestAutoReceiveWorker(t)
+
+	transfer := mockSendBlock(w.address, types.TokenTypeId{}, 1)
+	contractSend := mockSendBlock(w.address, types.TokenTypeId{}, 2)
+	contractSend.BlockType = ledger.BlockTypeSendCreate
+
+	if !w.isAllowedType(transfer.BlockType) || w.isAllowedType(contractSend.BlockType) {
+		t.Fatal("should allow transfer only by default")
+	}
+
+	txPool.add(contractSend, transfer)
+
+	w.Start()
+	defer w.Stop()
+
+	if !waitFor(2*time.Second, func() bool { return pool.count() == 1 }) {
+		t.Fatalf("should receive the transfer, but received %d blocks", pool.count())
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n := pool.count(); n != 1 {
+		t.Fatalf("should not receive the contract send, but received %d blocks", n)
+	}
+
+	w.SetAllowedBlockTypes(ledger.BlockTypeSendCreate)
+	if w.isAllowedType(transfer.BlockType) || !w.isAllowedType(contractSend.BlockType) {
+		t.Error("allowed types should be replaced")
+	}
+}
+
+func TestAutoReceiveWorker_ReceivedByToken(t *testing.T) {
+	c := &mockChain{}
+	c.setHead(types.Hash{1})
+
+	w := NewAutoReceiveWorker(&Manager{chain: c, pool: &mockPool{missing: true}}, "", types.Address{}, nil, nil, nil)
+	w.pack = func(sendBlock *ledger.AccountBlock, data []byte) ([]*vm_context.VmAccountBlock, error) {
+		head, _ := c.GetLatestAccountBlock(&sendBlock.ToAddress)
+		block := &ledger.AccountBlock{
+			BlockType:     ledger.BlockTypeReceive,
+			Hash:          types.Hash{sendBlock.Hash[0], 0xff},
+			PrevHash:      head.Hash,
+			FromBlockHash: sendBlock.Hash,
+		}
+		c.setHead(block.Hash)
+		return []*vm_context.VmAccountBlock{{AccountBlock: block}}, nil
+	}
+
+	vite, other := types.TokenTypeId{1}, types.TokenTypeId{2}
+	w.ProcessOneBlock(mockSendBlock(w.address, vite, 1))
+	w.ProcessOneBlock(mockSendBlock(w.address, vite, 2))
+	w.ProcessOneBlock(mockSendBlock(w.address, other, 4))
+
+	received := w.ReceivedByToken()
+	if len(received) != 2 || received[vite].Int64() != 3 || received[other].Int64() != 4 {
+		t.Fatalf("should receive 3 of %s and 4 of %s, but got %v", vite, other, received)
+	}
+
+	// the copy can be modified without affecting the worker
+	received[vite].SetInt64(100)
+	if n := w.ReceivedByToken()[vite].Int64(); n != 3 {
+		t.Errorf("accumulator should not be modified through the copy, but got %d", n)
+	}
+}
+
+func TestAutoReceiveWorker_EstimateReceiveCost(t *testing.T) {
+	c := &mockChain{}
+	w := NewAutoReceiveWorker(&Manager{chain: c}, "", types.Address{}, nil, nil, nil)
+	send := mockSendBlock(w.address, types.TokenTypeId{}, 1)
+
+	// mock quota oracle
+	var pledged uint64
+	errQuota := errors.New("quota error")
+	var oracleErr error
+	w.pledgeQuota = func() (uint64, error) {
+		return pledged, oracleErr
+	}
+
+	pledged = util.TxGas
+	quota, needsPoW, err := w.EstimateReceiveCost(send)
+	if err != nil || quota != util.TxGas || needsPoW {
+		t.Errorf("should cost %d without PoW, but got %d %v %v", util.TxGas, quota, needsPoW, err)
+	}
+
+	// data of hook costs more quota than pledged
+	w.SetReceiveDataFunc(func(sendBlock *ledger.AccountBlock) []byte {
+		return []byte{1, 0}
+	})
+	want, _ := util.IntrinsicGasCost([]byte{1, 0}, false)
+	quota, needsPoW, err = w.EstimateReceiveCost(send)
+	if err != nil || quota != want || !needsPoW {
+		t.Errorf("should cost %d with PoW, but got %d %v %v", want, quota, needsPoW, err)
+	}
+
+	// pledged quota is enough, but part of it is used by unconfirmed blocks
+	pledged = want
+	if _, needsPoW, _ = w.EstimateReceiveCost(send); needsPoW {
+		t.Errorf("should not need PoW with %d pledged", pledged)
+	}
+	c.unconfirmed = []*ledger.AccountBlock{{Quota: 1}}
+	if _, needsPoW, _ = w.EstimateReceiveCost(send); !needsPoW {
+		t.Error("should need PoW if unconfirmed blocks used the quota")
+	}
+	c.unconfirmed = []*ledger.AccountBlock{{Quota: want}, {Quota: want}}
+	if _, needsPoW, _ = w.EstimateReceiveCost(send); !needsPoW {
+		t.Error("should need PoW if unconfirmed blocks used more than pledged")
+	}
+
+	oracleErr = errQuota
+	if _, _, err = w.EstimateReceiveCost(send); err != errQuota {
+		t.Errorf("should return error of oracle, but got %v", err)
+	}
+
+	if _, _, err = w.EstimateReceiveCost(nil); err != errNilSendBlock {
+		t.Errorf("should return %v, but got %v", errNilSendBlock, err)
+	}
+}
+
+func TestAutoReceiveWorker_Rekey(t *testing.T) {
+	wm, em := unlockedWallet(t)
+
+	c := &mockChain{}
+	c.setHead(types.Hash{1})
+
+	pool := &mockPool{missing: true}
+	w := NewAutoReceiveWorker(&Manager{chain: c, pool: pool, wallet: wm}, em.GetEntropyStoreFile(), em.GetPrimaryAddr(), nil, nil, nil)
+	// the generator needs a real chain, sign by the SignFunc packReceiveBlock passed to it
+	w.generate = func(sendBlock *ledger.AccountBlock, signFunc generator.SignFunc, data []byte) (*generator.GenResult, error) {
+		head, _ := c.GetLatestAccountBlock(&sendBlock.ToAddress)
+		block := &ledger.AccountBlock{
+			BlockType:     ledger.BlockTypeReceive,
+			Hash:          types.Hash{sendBlock.Hash[0], 0xff},
+			PrevHash:      head.Hash,
+			Height:        head.Height + 1,
+			FromBlockHash: sendBlock.Hash,
+		}
+		signature, pubkey, err := signFunc(sendBlock.ToAddress, block.Hash.Bytes())
+		if err != nil {
+			return nil, err
+		}
+		block.Signature, block.PublicKey = signature, pubkey
+		return &generator.GenResult{BlockGenList: []*vm_context.VmAccountBlock{{AccountBlock: block}}}, nil
+	}
+
+	w.ProcessOneBlock(mockSendBlock(w.address, types.TokenTypeId{}, 1))
+
+	newKey := []byte("new public key")
+	var signed []types.Address
+	w.Rekey(func(addr types.Address, data []byte) (signedData, pubkey []byte, err error) {
+		signed = append(signed, addr)
+		return []byte("signature"), newKey, nil
+	})
+	w.ProcessOneBlock(mockSendBlock(w.address, types.TokenTypeId{}, 2))
+
+	if len(pool.added) != 2 {
+		t.Fatalf("should add 2 receive blocks, but added %d", len(pool.added))
+	}
+	if old := pool.added[0].PublicKey; len(old) == 0 || string(old) == string(newKey) {
+		t.Errorf("block packed before Rekey should be signed by the entropystore, but got pubkey %x", old)
+	}
+	if key := pool.added[1].PublicKey; string(key) != string(newKey) {
+		t.Errorf("block packed after Rekey should be signed by the new signer, but got pubkey %x", key)
+	}
+	if len(signed) != 1 || signed[0] != w.address {
+		t.Errorf("new signer should sign once for %s, but signed %v", w.address, signed)
+	}
+}
+
+func TestAutoReceiveWorker_SetMinSnapshotHeight(t *testing.T) {
+	w, txPool, pool := newTestAutoReceiveWorker(t)
+
+	old, recent := types.Hash{1}, types.Hash{2}
+	w.manager.chain = &mockChain{snapshots: map[types.Hash]uint64{old: 10, recent: 100}}
+	w.SetMinSnapshotHeight(50)
+
+	var blocks, want []*ledger.AccountBlock
+	for i := int64(1); i <= 6; i++ {
+		block := mockSendBlock(w.address, types.TokenTypeId{}, i)
+		switch i % 3 {
+		case 0:
+			block.SnapshotHash = old
+		case 1:
+			block.SnapshotHash = recent
+			want = append(want, block)
+		default:
+			block.SnapshotHash = types.Hash{9} // unknown
+		}
+		txPool.add(block)
+		blocks = append(blocks, block)
+	}
+
+	w.Start()
+	defer w.Stop()
+
+	if !waitFor(time.Second, func() bool { return pool.count() == len(want) }) {
+		t.Fatalf("should receive %d recent blocks, but received %d", len(want), pool.count())
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := pool.count(); n != len(want) {
+		t.Fatalf("should receive only %d recent blocks, but received %d", len(want), n)
+	}
+
+	// received blocks are recorded as recent
+	for _, block := range blocks {
+		received := !w.recentReceived.add(block.Hash)
+		if wantReceived := block.SnapshotHash == recent; received != wantReceived {
+			t.Errorf("block %s refers snapshot %s, received: %t", block.Hash, block.SnapshotHash, received)
+		}
+	}
+}
+
+func TestAutoReceiveWorker_SetMaxOutstanding(t *testing.T) {
+	w, txPool, pool := newTestAutoReceiveWorker(t)
+
+	// the address is at the cap
+	var outstanding int64 = 2
+	w.outstanding = func() int { return int(atomic.LoadInt64(&outstanding)) }
+	w.snapshotPoll = 5 * time.Millisecond
+
+	w.SetMaxOutstanding(2)
+	for i := int64(1); i <= 3; i++ {
+		txPool.add(mockSendBlock(w.address, types.TokenTypeId{}, i))
+	}
+
+	w.Start()
+	defer w.Stop()
+
+	time.Sleep(50 * time.Millisecond)
+	if n := pool.count(); n != 0 {
+		t.Fatalf("should pause at the cap, but received %d blocks", n)
+	}
+
+	// one receive block confirmed
+	atomic.StoreInt64(&outstanding, 1)
+	if !waitFor(time.Second, func() bool { return pool.count() == 3 }) {
+		t.Fatalf("should resume after confirmation, but received %d blocks", pool.count())
+	}
+}
+
+func TestAutoReceiveWorker_SetEagerFetch(t *testing.T) {
+	w, txPool, pool := newTestAutoReceiveWorker(t)
+	w.SetEagerFetch(false)
+
+	for i := int64(1); i <= 3; i++ {
+		txPool.add(mockSendBlock(w.address, types.TokenTypeId{}, i))
+	}
+
+	w.Start()
+	defer w.Stop()
+
+	time.Sleep(50 * time.Millisecond)
+	if n := pool.count(); n != 0 {
+		t.Fatalf("should not fetch before alarm, but received %d blocks", n)
+	}
+
+	w.NewOnroadTxAlarm()
+	if !waitFor(time.Second, func() bool { return pool.count() == 3 }) {
+		t.Fatalf("should fetch the backlog after alarm, but received %d blocks", pool.count())
+	}
+}
@@ -235,9 +235,16 @@ func (w *ContractWorker) getAndSortAllAddrQuota() {
 	heap.Init(&w.contractTaskPQueue)
 }
 
+// NewOnroadTxAlarm may be called by ledger callback after Stop, newOnroadTxAlarm is closed then,
+// the late alarm is ignored rather than panic the callback goroutine
 func (w *ContractWorker) NewOnroadTxAlarm() {
 	w.log.Info("NewOnroadTxAlarm", "isSleep", w.isSleep)
 	if w.isSleep {
+		defer func() {
+			if err := recover(); err != nil {
+				w.log.Info("ignore NewOnroadTxAlarm after stopped", "err", err)
+			}
+		}()
 		w.newOnroadTxAlarm <- struct{}{}
 	}
 }
@@ -0,0 +1,34 @@
+package onroad
+
+import (
+	"testing"
+
+	"github.com/vitelabs/go-vite/log15"
+	"github.com/vitelabs/go-vite/onroad/model"
+)
+
+func TestContractWorker_NewOnroadTxAlarm_afterStop(t *testing.T) {
+	w := &ContractWorker{
+		uBlocksPool:            model.NewOnroadBlocksPool(nil),
+		status:                 Start,
+		newOnroadTxAlarm:       make(chan struct{}),
+		breaker:                make(chan struct{}),
+		stopDispatcherListener: make(chan struct{}),
+		log:                    log15.New("worker", "c"),
+	}
+
+	// stand in for waitingNewBlock
+	go func() {
+		<-w.breaker
+		w.stopDispatcherListener <- struct{}{}
+	}()
+
+	w.Stop()
+
+	defer func() {
+		if err := recover(); err != nil {
+			t.Fatalf("alarm after stop should be ignored, but panic: %v", err)
+		}
+	}()
+	w.NewOnroadTxAlarm()
+}
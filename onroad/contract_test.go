@@ -23,7 +23,7 @@ import (
 )
 
 func TestContractWorker_Start(t *testing.T) {
-	manager, _ := startManager()
+	manager, _, _ := startManager(t)
 	//worker := onroad.NewContractWorker(manager)
 
 	//event := producerevent.AccountStartEvent{
@@ -2,6 +2,7 @@ package onroad
 
 import (
 	"github.com/vitelabs/go-vite/common/types"
+	"github.com/vitelabs/go-vite/ledger"
 	"github.com/vitelabs/go-vite/producer/producerevent"
 	"github.com/vitelabs/go-vite/vite/net"
 	"github.com/vitelabs/go-vite/vm_context"
@@ -21,4 +22,14 @@ type Net interface {
 	SubscribeSyncStatus(fn func(net.SyncState)) (subId int)
 	UnsubscribeSyncStatus(subId int)
 	SyncState() net.SyncState
-}
\ No newline at end of file
+}
+
+// commonTxPool is the part of model.OnroadBlocksPool which AutoReceiveWorker relies on
+type commonTxPool interface {
+	AddCommonTxLis(addr types.Address, f func())
+	RemoveCommonTxLis(addr types.Address)
+	AcquireFullOnroadBlocksCache(addr types.Address) error
+	ReleaseFullOnroadBlocksCache(addr types.Address) error
+	ResetCacheCursor(addr types.Address)
+	GetNextCommonTx(addr types.Address) *ledger.AccountBlock
+}
@@ -1,15 +1,20 @@
 package onroad
 
 import (
+	"bytes"
 	"errors"
+	"fmt"
 	"math/big"
+	"sort"
 	"sync"
 	"time"
 
 	"github.com/vitelabs/go-vite/chain"
 	"github.com/vitelabs/go-vite/common"
 	"github.com/vitelabs/go-vite/common/types"
+	"github.com/vitelabs/go-vite/ledger"
 	"github.com/vitelabs/go-vite/log15"
+	"github.com/vitelabs/go-vite/monitor"
 	"github.com/vitelabs/go-vite/onroad/model"
 	"github.com/vitelabs/go-vite/producer/producerevent"
 	"github.com/vitelabs/go-vite/vite/net"
@@ -21,8 +26,22 @@ import (
 var (
 	slog           = log15.New("module", "onroad")
 	ErrNotSyncDone = errors.New("network synchronization is not complete")
+
+	ErrReceiveDataTooLong = errors.New("receive data is too long")
 )
 
+// PrevHashConflictError means the head of the account has changed since the block was packed,
+// eg. another receive block is inserted concurrently, the block should be packed again
+type PrevHashConflictError struct {
+	Address  types.Address
+	PrevHash types.Hash
+	Head     types.Hash
+}
+
+func (e *PrevHashConflictError) Error() string {
+	return fmt.Sprintf("prevHash %s of block of %s doesn't match head %s", e.PrevHash, e.Address, e.Head)
+}
+
 type Manager struct {
 	pool     Pool
 	net      Net
@@ -34,17 +53,32 @@ type Manager struct {
 	onroadBlocksPool *model.OnroadBlocksPool
 
 	autoReceiveWorkers map[types.Address]*AutoReceiveWorker
+	workersMutex       sync.RWMutex
 	contractWorkers    map[types.Gid]*ContractWorker
 
+	// filters registered for addresses, override the filter passed to StartAutoReceiveWorker
+	autoReceiveFilters map[types.Address]map[types.TokenTypeId]big.Int
+	filtersMutex       sync.RWMutex
+
 	unlockLid       int
 	netStateLid     int
 	writeOnRoadLid  uint64
 	deleteOnRoadLid uint64
 	writeSuccLid    uint64
 	deleteSuccLid   uint64
+	revertLid       uint64
 
 	lastProducerAccEvent *producerevent.AccountStartEvent
 
+	// verify the receive blocks of AutoReceiveWorker before they are inserted into pool, nil skips it
+	verifyAccountBlock func(block *ledger.AccountBlock) error
+
+	// tokens AutoReceiveWorker are allowed to receive, nil allows any token. The send blocks are checked
+	// by verifyTokenAllowed before packing, nil skips it
+	allowedTokens      map[types.TokenTypeId]bool
+	tokensMutex        sync.RWMutex
+	verifyTokenAllowed func(block *ledger.AccountBlock, allowed map[types.TokenTypeId]bool) error
+
 	log log15.Logger
 }
 
@@ -56,6 +90,7 @@ func NewManager(net Net, pool Pool, producer Producer, wallet *wallet.Manager) *
 		wallet:             wallet,
 		autoReceiveWorkers: make(map[types.Address]*AutoReceiveWorker),
 		contractWorkers:    make(map[types.Gid]*ContractWorker),
+		autoReceiveFilters: make(map[types.Address]map[types.TokenTypeId]big.Int),
 		log:                slog.New("w", "manager"),
 	}
 	m.uAccess = model.NewUAccess()
@@ -68,6 +103,52 @@ func (manager *Manager) Init(chain chain.Chain) {
 	manager.chain = chain
 }
 
+// SetAccountBlockVerifier set the verification of receive blocks packed by AutoReceiveWorker, it`s
+// verifier.VerifyAccountBlock on the chain, which onroad can`t import. It should be set before Start
+func (manager *Manager) SetAccountBlockVerifier(verify func(block *ledger.AccountBlock) error) {
+	manager.verifyAccountBlock = verify
+}
+
+// verifyReceiveBlock verify the receive block by the verifier set, pass if there is none
+func (manager *Manager) verifyReceiveBlock(block *ledger.AccountBlock) error {
+	if manager.verifyAccountBlock == nil {
+		return nil
+	}
+	return manager.verifyAccountBlock(block)
+}
+
+// SetTokenVerifier set the check of the whitelist of tokens, it`s verifier.VerifyTokenAllowed. It should be set before Start
+func (manager *Manager) SetTokenVerifier(verify func(block *ledger.AccountBlock, allowed map[types.TokenTypeId]bool) error) {
+	manager.verifyTokenAllowed = verify
+}
+
+// SetAllowedTokens set the whitelist of tokens AutoReceiveWorker receive, it`s a hard rule in case the
+// filters of workers are misconfigured. nil allows any token
+func (manager *Manager) SetAllowedTokens(allowed map[types.TokenTypeId]bool) {
+	var tokens map[types.TokenTypeId]bool
+	if allowed != nil {
+		tokens = make(map[types.TokenTypeId]bool, len(allowed))
+		for tti, ok := range allowed {
+			tokens[tti] = ok
+		}
+	}
+
+	manager.tokensMutex.Lock()
+	defer manager.tokensMutex.Unlock()
+	manager.allowedTokens = tokens
+}
+
+// verifySendToken check the token of the send block to receive against the whitelist
+func (manager *Manager) verifySendToken(sendBlock *ledger.AccountBlock) error {
+	if manager.verifyTokenAllowed == nil {
+		return nil
+	}
+
+	manager.tokensMutex.RLock()
+	defer manager.tokensMutex.RUnlock()
+	return manager.verifyTokenAllowed(sendBlock, manager.allowedTokens)
+}
+
 func (manager *Manager) Start() {
 	manager.netStateLid = manager.Net().SubscribeSyncStatus(manager.netStateChangedFunc)
 	manager.unlockLid = manager.wallet.AddLockEventListener(manager.addressLockStateChangeFunc)
@@ -80,6 +161,8 @@ func (manager *Manager) Start() {
 
 	manager.deleteSuccLid = manager.Chain().RegisterDeleteAccountBlocksSuccess(manager.onroadBlocksPool.RevertOnroadSuccess)
 	manager.deleteOnRoadLid = manager.Chain().RegisterDeleteAccountBlocks(manager.onroadBlocksPool.RevertOnroad)
+
+	manager.revertLid = manager.Chain().RegisterDeleteAccountBlocksSuccess(manager.revertAccountBlocksSuccess)
 }
 
 func (manager *Manager) Stop() {
@@ -94,6 +177,7 @@ func (manager *Manager) Stop() {
 	manager.Chain().UnRegister(manager.deleteOnRoadLid)
 	manager.Chain().UnRegister(manager.writeSuccLid)
 	manager.Chain().UnRegister(manager.deleteSuccLid)
+	manager.Chain().UnRegister(manager.revertLid)
 
 	manager.stopAllWorks()
 	manager.log.Info("Close end")
@@ -119,7 +203,7 @@ func (manager *Manager) addressLockStateChangeFunc(event entropystore.UnlockEven
 	manager.log.Info("addressLockStateChangeFunc ", "event", event)
 
 	if !event.Unlocked() {
-		for _, w := range manager.autoReceiveWorkers {
+		for _, w := range manager.listAutoReceiveWorkers() {
 			if w.GetEntropystore() == event.EntropyStoreFile {
 				common.Go(w.Stop)
 			}
@@ -173,7 +257,7 @@ func (manager *Manager) producerStartEventFunc(accevent producerevent.AccountEve
 func (manager *Manager) stopAllWorks() {
 	manager.log.Info("stopAllWorks called")
 	var wg = sync.WaitGroup{}
-	for _, v := range manager.autoReceiveWorkers {
+	for _, v := range manager.listAutoReceiveWorkers() {
 		wg.Add(1)
 		common.Go(func() {
 			v.Stop()
@@ -209,8 +293,33 @@ func (manager *Manager) resumeContractWorks() {
 	manager.log.Info("end resumeContractWorks")
 }
 
+// insertCommonBlockToPool return *PrevHashConflictError if the block isn`t packed on the current head,
+// inserting the same block again is a no-op
 func (manager *Manager) insertCommonBlockToPool(blockList []*vm_context.VmAccountBlock) error {
-	return manager.pool.AddDirectAccountBlock(blockList[0].AccountBlock.AccountAddress, blockList[0])
+	block := blockList[0].AccountBlock
+
+	head, err := manager.Chain().GetLatestAccountBlock(&block.AccountAddress)
+	if err != nil {
+		return err
+	}
+
+	headHash := types.ZERO_HASH
+	if head != nil {
+		headHash = head.Hash
+	}
+
+	if headHash == block.Hash {
+		return nil
+	}
+	if headHash != block.PrevHash {
+		return &PrevHashConflictError{
+			Address:  block.AccountAddress,
+			PrevHash: block.PrevHash,
+			Head:     headHash,
+		}
+	}
+
+	return manager.pool.AddDirectAccountBlock(block.AccountAddress, blockList[0])
 }
 
 func (manager *Manager) insertContractBlocksToPool(blockList []*vm_context.VmAccountBlock) error {
@@ -221,16 +330,75 @@ func (manager *Manager) insertContractBlocksToPool(blockList []*vm_context.VmAcc
 	}
 }
 
+// revertAccountBlocksSuccess let the workers receiving the deleted send blocks revalidate their queued blocks
+func (manager *Manager) revertAccountBlocksSuccess(subLedger map[types.Address][]*ledger.AccountBlock) {
+	addrs := make(map[types.Address]struct{})
+	for _, blocks := range subLedger {
+		for _, v := range blocks {
+			if v.IsSendBlock() {
+				addrs[v.ToAddress] = struct{}{}
+			}
+		}
+	}
+
+	for addr := range addrs {
+		if w, ok := manager.getAutoReceiveWorker(addr); ok {
+			common.Go(w.RevalidateQueued)
+		}
+	}
+}
+
 func (manager *Manager) checkExistInPool(addr types.Address, fromBlockHash types.Hash) bool {
 	return manager.pool.ExistInPool(addr, fromBlockHash)
 }
 
 func (manager *Manager) ResetAutoReceiveFilter(addr types.Address, filter map[types.TokenTypeId]big.Int) {
-	if w, ok := manager.autoReceiveWorkers[addr]; ok {
+	if w, ok := manager.getAutoReceiveWorker(addr); ok {
 		w.ResetAutoReceiveFilter(filter)
 	}
 }
 
+// RegisterAutoReceiveFilter set the filter of addr, which is used instead of the one passed to
+// StartAutoReceiveWorker, it`s applied to the running worker of addr immediately
+func (manager *Manager) RegisterAutoReceiveFilter(addr types.Address, filter map[types.TokenTypeId]big.Int) {
+	manager.filtersMutex.Lock()
+	manager.autoReceiveFilters[addr] = filter
+	manager.filtersMutex.Unlock()
+
+	manager.ResetAutoReceiveFilter(addr, filter)
+}
+
+// UnregisterAutoReceiveFilter remove the filter registered for addr, the running worker keeps its filter
+func (manager *Manager) UnregisterAutoReceiveFilter(addr types.Address) {
+	manager.filtersMutex.Lock()
+	defer manager.filtersMutex.Unlock()
+
+	delete(manager.autoReceiveFilters, addr)
+}
+
+// autoReceiveFilter return the filter registered for addr, or filter if there is none
+func (manager *Manager) autoReceiveFilter(addr types.Address, filter map[types.TokenTypeId]big.Int) map[types.TokenTypeId]big.Int {
+	manager.filtersMutex.RLock()
+	defer manager.filtersMutex.RUnlock()
+
+	if registered, ok := manager.autoReceiveFilters[addr]; ok {
+		return registered
+	}
+	return filter
+}
+
+func (manager *Manager) ResetAutoReceiveBatchThreshold(addr types.Address, thresholds map[types.TokenTypeId]big.Int) {
+	if w, ok := manager.getAutoReceiveWorker(addr); ok {
+		w.ResetBatchThreshold(thresholds)
+	}
+}
+
+func (manager *Manager) SetAutoReceiveInterval(addr types.Address, interval time.Duration) {
+	if w, ok := manager.getAutoReceiveWorker(addr); ok {
+		w.SetReceiveInterval(interval)
+	}
+}
+
 //func (manager *Manager) StartPrimaryAutoReceiveWorker(primaryAddr types.Address, filter map[types.TokenTypeId]big.Int) error {
 //	return manager.StartAutoReceiveWorker(primaryAddr.String(), primaryAddr, filter)
 //}
@@ -252,31 +420,66 @@ func (manager *Manager) StartAutoReceiveWorker(entropystore string, addr types.A
 		return e
 	}
 
+	manager.autoReceiveWorker(entropyStoreManager.GetEntropyStoreFile(), addr, filter, powDifficulty).Start()
+	return nil
+}
+
+// autoReceiveWorker return the worker of addr, create one if not found, the filter registered for addr
+// is used instead of filter
+func (manager *Manager) autoReceiveWorker(entropystore string, addr types.Address, filter map[types.TokenTypeId]big.Int, powDifficulty *big.Int) *AutoReceiveWorker {
+	filter = manager.autoReceiveFilter(addr, filter)
+
+	manager.workersMutex.Lock()
 	w, found := manager.autoReceiveWorkers[addr]
 	if !found {
-		w = NewAutoReceiveWorker(manager, entropyStoreManager.GetEntropyStoreFile(), addr, filter, powDifficulty)
+		w = NewAutoReceiveWorker(manager, entropystore, addr, filter, powDifficulty, nil)
 		manager.log.Info("Manager get event new Worker")
 		manager.autoReceiveWorkers[addr] = w
 	}
+	manager.workersMutex.Unlock()
+
 	w.ResetPowDifficulty(powDifficulty)
 	w.ResetAutoReceiveFilter(filter)
-	w.Start()
-	return nil
+	return w
 }
 
 func (manager *Manager) StopAutoReceiveWorker(addr types.Address) error {
 	manager.log.Info("StopAutoReceiveWorker ", "addr", addr)
+	manager.workersMutex.Lock()
 	w, found := manager.autoReceiveWorkers[addr]
+	delete(manager.autoReceiveWorkers, addr)
+	manager.workersMutex.Unlock()
+
 	if found {
 		w.Stop()
-		delete(manager.autoReceiveWorkers, addr)
 	}
 	return nil
 }
 
-func (manager Manager) ListWorkingAutoReceiveWorker() []types.Address {
+// getAutoReceiveWorker return the worker of addr
+func (manager *Manager) getAutoReceiveWorker(addr types.Address) (*AutoReceiveWorker, bool) {
+	manager.workersMutex.RLock()
+	defer manager.workersMutex.RUnlock()
+
+	w, ok := manager.autoReceiveWorkers[addr]
+	return w, ok
+}
+
+// listAutoReceiveWorkers return a snapshot of all workers, so they can be operated without holding workersMutex
+func (manager *Manager) listAutoReceiveWorkers() []*AutoReceiveWorker {
+	manager.workersMutex.RLock()
+	defer manager.workersMutex.RUnlock()
+
+	workers := make([]*AutoReceiveWorker, 0, len(manager.autoReceiveWorkers))
+	for _, w := range manager.autoReceiveWorkers {
+		workers = append(workers, w)
+	}
+	return workers
+}
+
+func (manager *Manager) ListWorkingAutoReceiveWorker() []types.Address {
 	addr := make([]types.Address, 0)
-	for _, v := range manager.autoReceiveWorkers {
+	for _, v := range manager.listAutoReceiveWorkers() {
 		if v != nil && v.Status() == Start {
 			addr = append(addr, v.address)
 		}
@@ -285,22 +488,90 @@ func (manager Manager) ListWorkingAutoReceiveWorker() []types.Address {
 	return addr
 }
 
-func (manager Manager) GetOnroadBlocksPool() *model.OnroadBlocksPool {
+// WorkerReport is the state of the auto receive worker of an address
+type WorkerReport struct {
+	Address   types.Address
+	Status    int
+	Queued    int    // send blocks held until the batch threshold is reached
+	Processed uint64 // receive blocks inserted into pool
+	LastError error
+}
+
+// Report return the state of all auto receive workers, sorted by address
+func (manager *Manager) Report() []WorkerReport {
+	workers := manager.listAutoReceiveWorkers()
+
+	reports := make([]WorkerReport, 0, len(workers))
+	for _, w := range workers {
+		if w == nil {
+			continue
+		}
+
+		reports = append(reports, WorkerReport{
+			Address:   w.address,
+			Status:    w.Status(),
+			Queued:    w.Queued(),
+			Processed: w.Processed(),
+			LastError: w.LastError(),
+		})
+	}
+
+	sort.Slice(reports, func(i, j int) bool {
+		return bytes.Compare(reports[i].Address[:], reports[j].Address[:]) < 0
+	})
+
+	return reports
+}
+
+// RegisterMetrics expose the summed state of auto receive workers by reg, the values are sampled when collected
+func (manager *Manager) RegisterMetrics(reg monitor.Registerer) error {
+	sum := func(fn func(r WorkerReport) float64) func() float64 {
+		return func() (n float64) {
+			for _, r := range manager.Report() {
+				n += fn(r)
+			}
+			return
+		}
+	}
+
+	err := reg.RegisterGauge("onroad_auto_receive_workers", "auto receive workers started", sum(func(r WorkerReport) float64 {
+		if r.Status == Start {
+			return 1
+		}
+		return 0
+	}))
+	if err != nil {
+		return err
+	}
+
+	err = reg.RegisterGauge("onroad_auto_receive_queued", "send blocks held until the batch threshold is reached", sum(func(r WorkerReport) float64 {
+		return float64(r.Queued)
+	}))
+	if err != nil {
+		return err
+	}
+
+	return reg.RegisterCounter("onroad_auto_receive_processed_total", "receive blocks inserted into pool by auto receive workers", sum(func(r WorkerReport) float64 {
+		return float64(r.Processed)
+	}))
+}
+
+func (manager *Manager) GetOnroadBlocksPool() *model.OnroadBlocksPool {
 	return manager.onroadBlocksPool
 }
 
-func (manager Manager) Chain() chain.Chain {
+func (manager *Manager) Chain() chain.Chain {
 	return manager.chain
 }
 
-func (manager Manager) Net() Net {
+func (manager *Manager) Net() Net {
 	return manager.net
 }
 
-func (manager Manager) Producer() Producer {
+func (manager *Manager) Producer() Producer {
 	return manager.producer
 }
 
-func (manager Manager) DbAccess() *model.UAccess {
+func (manager *Manager) DbAccess() *model.UAccess {
 	return manager.uAccess
 }
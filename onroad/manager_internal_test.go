@@ -0,0 +1,188 @@
+package onroad
+
+import (
+	"errors"
+	"math/big"
+	"sync"
+	"testing"
+
+	"github.com/vitelabs/go-vite/common/types"
+	"github.com/vitelabs/go-vite/ledger"
+	"github.com/vitelabs/go-vite/monitor"
+	"github.com/vitelabs/go-vite/vm_context"
+)
+
+func TestManager_Report(t *testing.T) {
+	manager := &Manager{
+		autoReceiveWorkers: make(map[types.Address]*AutoReceiveWorker),
+	}
+
+	addr1, addr2 := types.Address{1}, types.Address{2}
+	errFetch := errors.New("fetch error")
+
+	w1 := NewAutoReceiveWorker(manager, "", addr1, nil, nil, nil)
+	w1.status = Start
+	w1.processed = 3
+	w1.heldBlocks[types.TokenTypeId{}] = []*ledger.AccountBlock{{}, {}}
+
+	w2 := NewAutoReceiveWorker(manager, "", addr2, nil, nil, nil)
+	w2.setLastError(errFetch)
+
+	manager.autoReceiveWorkers[addr2] = w2
+	manager.autoReceiveWorkers[addr1] = w1
+
+	reports := manager.Report()
+	if len(reports) != 2 {
+		t.Fatalf("should report 2 workers, but got %d", len(reports))
+	}
+
+	want := []WorkerReport{
+		{Address: addr1, Status: Start, Queued: 2, Processed: 3},
+		{Address: addr2, Status: Create, LastError: errFetch},
+	}
+	for i, r := range reports {
+		if r != want[i] {
+			t.Errorf("report %d should be %+v, but got %+v", i, want[i], r)
+		}
+	}
+}
+
+func TestManager_RegisterAutoReceiveFilter(t *testing.T) {
+	manager := NewManager(nil, nil, nil, nil)
+
+	addr1, addr2, addr3 := types.Address{1}, types.Address{2}, types.Address{3}
+	vite, other := types.TokenTypeId{1}, types.TokenTypeId{2}
+
+	manager.RegisterAutoReceiveFilter(addr1, map[types.TokenTypeId]big.Int{vite: *big.NewInt(0)})
+	manager.RegisterAutoReceiveFilter(addr2, map[types.TokenTypeId]big.Int{other: *big.NewInt(10)})
+
+	global := map[types.TokenTypeId]big.Int{}
+	w1 := manager.autoReceiveWorker("", addr1, global, nil)
+	w2 := manager.autoReceiveWorker("", addr2, global, nil)
+	w3 := manager.autoReceiveWorker("", addr3, global, nil)
+
+	if _, ok := w1.filters[vite]; !ok || len(w1.filters) != 1 {
+		t.Errorf("worker of %s should apply its own filter, but got %v", addr1, w1.filters)
+	}
+	if min, ok := w2.filters[other]; !ok || len(w2.filters) != 1 || min.Int64() != 10 {
+		t.Errorf("worker of %s should apply its own filter, but got %v", addr2, w2.filters)
+	}
+	if len(w3.filters) != 0 {
+		t.Errorf("worker of %s should apply the global filter, but got %v", addr3, w3.filters)
+	}
+
+	// registered filter is applied to the running worker
+	manager.RegisterAutoReceiveFilter(addr3, map[types.TokenTypeId]big.Int{other: *big.NewInt(1)})
+	if _, ok := w3.filters[other]; !ok {
+		t.Errorf("registered filter should be applied to the worker of %s, but got %v", addr3, w3.filters)
+	}
+
+	manager.UnregisterAutoReceiveFilter(addr1)
+	if w := manager.autoReceiveWorker("", addr1, global, nil); len(w.filters) != 0 {
+		t.Errorf("worker of %s should apply the global filter after unregistered, but got %v", addr1, w.filters)
+	}
+}
+
+// workers are added and removed while being reported, run with -race
+func TestManager_workersConcurrent(t *testing.T) {
+	manager := NewManager(nil, nil, nil, nil)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			addr := types.Address{byte(i)}
+			manager.autoReceiveWorker("", addr, nil, nil)
+			manager.StopAutoReceiveWorker(addr)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			manager.Report()
+			manager.ListWorkingAutoReceiveWorker()
+		}
+	}()
+	wg.Wait()
+
+	if n := len(manager.Report()); n != 0 {
+		t.Errorf("all workers should be removed, but got %d", n)
+	}
+}
+
+func TestManager_RegisterMetrics(t *testing.T) {
+	manager := &Manager{
+		autoReceiveWorkers: make(map[types.Address]*AutoReceiveWorker),
+	}
+
+	reg := make(monitor.MapRegisterer)
+	if err := manager.RegisterMetrics(reg); err != nil {
+		t.Fatal(err)
+	}
+
+	w1 := NewAutoReceiveWorker(manager, "", types.Address{1}, nil, nil, nil)
+	w1.status = Start
+	w1.processed = 3
+	w1.heldBlocks[types.TokenTypeId{}] = []*ledger.AccountBlock{{}, {}}
+	w2 := NewAutoReceiveWorker(manager, "", types.Address{2}, nil, nil, nil)
+	w2.processed = 4
+	manager.autoReceiveWorkers[w1.address] = w1
+	manager.autoReceiveWorkers[w2.address] = w2
+
+	want := map[string]float64{
+		"onroad_auto_receive_workers":         1,
+		"onroad_auto_receive_queued":          2,
+		"onroad_auto_receive_processed_total": 7,
+	}
+	if len(reg) != len(want) {
+		t.Errorf("should register %d metrics, but got %d", len(want), len(reg))
+	}
+	for name, v := range want {
+		fn, ok := reg[name]
+		if !ok {
+			t.Errorf("%s should be registered", name)
+			continue
+		}
+		if got := fn(); got != v {
+			t.Errorf("%s should be %v, but got %v", name, v, got)
+		}
+	}
+
+	if err := manager.RegisterMetrics(reg); err == nil {
+		t.Error("should fail to register twice")
+	}
+}
+
+func TestManager_insertCommonBlockToPool(t *testing.T) {
+	c := &mockChain{}
+	pool := &mockPool{}
+	manager := &Manager{chain: c, pool: pool}
+
+	head := types.Hash{1}
+	c.setHead(head)
+
+	block := &ledger.AccountBlock{BlockType: ledger.BlockTypeReceive, Hash: types.Hash{2}, PrevHash: head}
+	if err := manager.insertCommonBlockToPool([]*vm_context.VmAccountBlock{{AccountBlock: block}}); err != nil {
+		t.Fatalf("block on the head should be submitted: %v", err)
+	}
+	if len(pool.added) != 1 || pool.added[0] != block {
+		t.Fatalf("should submit the block to pool, but added %d blocks", len(pool.added))
+	}
+
+	// not chained to the head
+	mismatch := &ledger.AccountBlock{BlockType: ledger.BlockTypeReceive, Hash: types.Hash{3}, PrevHash: types.Hash{9}}
+	err := manager.insertCommonBlockToPool([]*vm_context.VmAccountBlock{{AccountBlock: mismatch}})
+	if e, ok := err.(*PrevHashConflictError); !ok || e.Head != head || e.PrevHash != mismatch.PrevHash {
+		t.Errorf("should reject with PrevHashConflictError, but got %v", err)
+	}
+	if len(pool.added) != 1 {
+		t.Errorf("mismatched block should not be submitted, but added %d blocks", len(pool.added))
+	}
+
+	// error of pool is returned
+	pool.addErr = errors.New("pool is full")
+	if err := manager.insertCommonBlockToPool([]*vm_context.VmAccountBlock{{AccountBlock: block}}); err != pool.addErr {
+		t.Errorf("should return %v of pool, but got %v", pool.addErr, err)
+	}
+}
@@ -12,11 +12,7 @@ import (
 	"time"
 )
 
-var twallet = wallet.New(&wallet.Config{
-	DataDir: common.GoViteTestDataDir(),
-})
-
-func generateAddress() types.Address {
+func generateAddress(twallet *wallet.Manager) types.Address {
 	mnemonic, em, _ := twallet.NewMnemonicAndEntropyStore("123456")
 	em.Unlock("123456")
 	fmt.Println(mnemonic)
@@ -25,8 +21,11 @@ func generateAddress() types.Address {
 	return em.GetPrimaryAddr()
 }
 
-func startManager() (*onroad.Manager, types.Address) {
-	addr := generateAddress()
+func startManager(t *testing.T) (*onroad.Manager, types.Address, *wallet.Manager) {
+	twallet := wallet.New(&wallet.Config{
+		DataDir: t.TempDir(),
+	})
+	addr := generateAddress(twallet)
 
 	c := chain.NewChain(&config.Config{
 		Net:     nil,
@@ -47,12 +46,12 @@ func startManager() (*onroad.Manager, types.Address) {
 	manager.Start()
 	c.Start()
 
-	return manager, addr
+	return manager, addr, twallet
 }
 
 func TestManager_StartAutoReceiveWorker(t *testing.T) {
 
-	manager, addr := startManager()
+	manager, addr, twallet := startManager(t)
 	fmt.Println("test a stop1 ")
 	manager.StartAutoReceiveWorker(addr.String(), addr, nil, nil)
 
@@ -134,7 +134,7 @@ func (p *OnroadBlocksPool) loadFullCacheFromDb(addr types.Address) error {
 	return nil
 }
 
-func (p *OnroadBlocksPool) AcquireFullOnroadBlocksCache(addr types.Address) {
+func (p *OnroadBlocksPool) AcquireFullOnroadBlocksCache(addr types.Address) error {
 	log := p.log.New("AcquireFullOnroadBlocksCache", addr)
 	if t, ok := p.fullCacheDeadTimer.Load(addr); ok {
 		if t != nil {
@@ -146,13 +146,15 @@ func (p *OnroadBlocksPool) AcquireFullOnroadBlocksCache(addr types.Address) {
 	if c, ok := p.fullCache.Load(addr); ok {
 		c.(*onroadBlocksCache).addReferenceCount()
 		log.Debug("found in cache", "ref", c.(*onroadBlocksCache).getReferenceCount())
-		return
+		return nil
 	}
 
 	// second load in db
 	if e := p.loadFullCacheFromDb(addr); e != nil {
 		log.Error(e.Error())
+		return e
 	}
+	return nil
 }
 
 func (p *OnroadBlocksPool) GetNextCommonTx(addr types.Address) *ledger.AccountBlock {
@@ -0,0 +1,49 @@
+package onroad
+
+import (
+	"sync"
+	"time"
+
+	"github.com/vitelabs/go-vite/common/types"
+)
+
+// recentHashes is a small set of hashes, every hash expires after ttl
+type recentHashes struct {
+	ttl   time.Duration
+	items map[types.Hash]time.Time
+	mu    sync.Mutex
+}
+
+func newRecentHashes(ttl time.Duration) *recentHashes {
+	return &recentHashes{
+		ttl:   ttl,
+		items: make(map[types.Hash]time.Time),
+	}
+}
+
+// add return false if hash is already in the set
+func (r *recentHashes) add(hash types.Hash) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	for h, t := range r.items {
+		if now.Sub(t) > r.ttl {
+			delete(r.items, h)
+		}
+	}
+
+	if _, ok := r.items[hash]; ok {
+		return false
+	}
+
+	r.items[hash] = now
+	return true
+}
+
+func (r *recentHashes) remove(hash types.Hash) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.items, hash)
+}
@@ -527,6 +527,26 @@ type PeerInfo struct {
 }
 
 // @section ConnProperty
+// Direction tell the connection is dialed by local or accepted from remote
+type Direction uint8
+
+const (
+	DirUnknown Direction = iota
+	DirInbound
+	DirOutbound
+)
+
+func (d Direction) String() string {
+	switch d {
+	case DirInbound:
+		return "inbound"
+	case DirOutbound:
+		return "outbound"
+	default:
+		return "unknown"
+	}
+}
+
 type ConnProperty struct {
 	LocalID    string `json:"localID"`
 	LocalIP    net.IP `json:"localIP"`
@@ -534,6 +554,8 @@ type ConnProperty struct {
 	RemoteID   string `json:"remoteID"`
 	RemoteIP   net.IP `json:"remoteIP"`
 	RemotePort uint16 `json:"remotePort"`
+	// DirUnknown if the connection property is reported by an old node
+	Direction Direction `json:"direction,omitempty"`
 }
 
 func (cp *ConnProperty) Serialize() ([]byte, error) {
@@ -559,6 +581,7 @@ func (cp *ConnProperty) Proto() *protos.ConnProperty {
 		RemoteID:   cp.RemoteID,
 		RemoteIP:   cp.RemoteIP,
 		RemotePort: uint32(cp.RemotePort),
+		Direction:  uint32(cp.Direction),
 	}
 }
 
@@ -570,9 +593,16 @@ func (cp *ConnProperty) Deproto(pb *protos.ConnProperty) {
 	cp.RemoteID = pb.RemoteID
 	cp.RemoteIP = pb.RemoteIP
 	cp.RemotePort = uint16(pb.RemotePort)
+
+	cp.Direction = Direction(pb.Direction)
 }
 
 func (p *Peer) GetConnProperty() *ConnProperty {
+	dir := DirOutbound
+	if p.ts.is(inbound) {
+		dir = DirInbound
+	}
+
 	return &ConnProperty{
 		LocalID:    p.ts.localID.String(),
 		LocalIP:    p.ts.localIP,
@@ -580,5 +610,6 @@ func (p *Peer) GetConnProperty() *ConnProperty {
 		RemoteID:   p.ts.remoteID.String(),
 		RemoteIP:   p.ts.remoteIP,
 		RemotePort: p.ts.remotePort,
+		Direction:  dir,
 	}
 }
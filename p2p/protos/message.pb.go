@@ -106,6 +106,7 @@ type ConnProperty struct {
 	RemoteID             string   `protobuf:"bytes,4,opt,name=RemoteID,proto3" json:"RemoteID,omitempty"`
 	RemoteIP             []byte   `protobuf:"bytes,5,opt,name=RemoteIP,proto3" json:"RemoteIP,omitempty"`
 	RemotePort           uint32   `protobuf:"varint,6,opt,name=RemotePort,proto3" json:"RemotePort,omitempty"`
+	Direction            uint32   `protobuf:"varint,7,opt,name=Direction,proto3" json:"Direction,omitempty"`
 	XXX_NoUnkeyedLiteral struct{} `json:"-"`
 	XXX_unrecognized     []byte   `json:"-"`
 	XXX_sizecache        int32    `json:"-"`
@@ -178,10 +179,20 @@ func (m *ConnProperty) GetRemotePort() uint32 {
 	return 0
 }
 
+func (m *ConnProperty) GetDirection() uint32 {
+	if m != nil {
+		return m.Direction
+	}
+	return 0
+}
+
 type Topo struct {
 	Pivot                string          `protobuf:"bytes,1,opt,name=Pivot,proto3" json:"Pivot,omitempty"`
 	Peers                []*ConnProperty `protobuf:"bytes,2,rep,name=Peers,proto3" json:"Peers,omitempty"`
 	Time                 int64           `protobuf:"varint,3,opt,name=Time,proto3" json:"Time,omitempty"`
+	TimeNano             int64           `protobuf:"varint,4,opt,name=TimeNano,proto3" json:"TimeNano,omitempty"`
+	Truncated            bool            `protobuf:"varint,5,opt,name=Truncated,proto3" json:"Truncated,omitempty"`
+	Formats              bool            `protobuf:"varint,6,opt,name=Formats,proto3" json:"Formats,omitempty"`
 	XXX_NoUnkeyedLiteral struct{}        `json:"-"`
 	XXX_unrecognized     []byte          `json:"-"`
 	XXX_sizecache        int32           `json:"-"`
@@ -233,6 +244,27 @@ func (m *Topo) GetTime() int64 {
 	return 0
 }
 
+func (m *Topo) GetTimeNano() int64 {
+	if m != nil {
+		return m.TimeNano
+	}
+	return 0
+}
+
+func (m *Topo) GetTruncated() bool {
+	if m != nil {
+		return m.Truncated
+	}
+	return false
+}
+
+func (m *Topo) GetFormats() bool {
+	if m != nil {
+		return m.Formats
+	}
+	return false
+}
+
 func init() {
 	proto.RegisterType((*Handshake)(nil), "protos.Handshake")
 	proto.RegisterType((*ConnProperty)(nil), "protos.ConnProperty")
@@ -242,23 +274,26 @@ func init() {
 func init() { proto.RegisterFile("message.proto", fileDescriptor_33c57e4bae7b9afd) }
 
 var fileDescriptor_33c57e4bae7b9afd = []byte{
-	// 280 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x7c, 0x91, 0xbf, 0x4a, 0xc4, 0x40,
-	0x10, 0xc6, 0xd9, 0xfc, 0xd3, 0x8c, 0x17, 0x8b, 0xe5, 0x8a, 0x45, 0x44, 0x42, 0xaa, 0x60, 0x71,
-	0x85, 0x3e, 0xc2, 0xa5, 0x30, 0x20, 0xb2, 0xac, 0x57, 0xda, 0x44, 0x6f, 0xd0, 0x43, 0x93, 0x09,
-	0xd9, 0x45, 0xf0, 0x51, 0x7c, 0x13, 0x1f, 0x4f, 0x32, 0x49, 0xee, 0xa2, 0xc5, 0x55, 0xf9, 0xbe,
-	0x9d, 0x61, 0xe6, 0xf7, 0x65, 0x20, 0xa9, 0xd1, 0xda, 0xea, 0x15, 0x57, 0x6d, 0x47, 0x8e, 0x64,
-	0xc4, 0x1f, 0x9b, 0x7d, 0x0b, 0x88, 0xef, 0xaa, 0x66, 0x6b, 0xdf, 0xaa, 0x77, 0x94, 0x12, 0x82,
-	0x87, 0xaa, 0x46, 0x25, 0x52, 0x91, 0xc7, 0x86, 0xb5, 0x3c, 0x07, 0xaf, 0x2c, 0x94, 0x97, 0x8a,
-	0x7c, 0x61, 0xbc, 0xb2, 0x90, 0x0a, 0x4e, 0xd6, 0xf5, 0xf6, 0x11, 0x9d, 0x55, 0x7e, 0xea, 0xe7,
-	0x89, 0x99, 0xac, 0xbc, 0x80, 0x53, 0x83, 0x35, 0x39, 0x2c, 0xb5, 0x0a, 0xb8, 0x7f, 0xef, 0xe5,
-	0x15, 0xc0, 0xa0, 0x35, 0x75, 0x4e, 0x85, 0xa9, 0xc8, 0x13, 0x33, 0x7b, 0xe9, 0x37, 0x73, 0x25,
-	0xe2, 0x0a, 0xeb, 0xec, 0x47, 0xc0, 0x62, 0x4d, 0x4d, 0xa3, 0x3b, 0x6a, 0xb1, 0x73, 0x5f, 0xfd,
-	0xea, 0x7b, 0x7a, 0xa9, 0x3e, 0xca, 0x62, 0x24, 0x9c, 0xec, 0xa1, 0xa2, 0x47, 0xd2, 0xc9, 0xca,
-	0x4b, 0x88, 0x59, 0xf2, 0x74, 0x9f, 0xa7, 0x1f, 0x1e, 0x66, 0xc8, 0x05, 0x23, 0xc7, 0x7b, 0xe4,
-	0xe2, 0x4f, 0x9c, 0xf0, 0x68, 0x9c, 0xe8, 0x7f, 0x9c, 0xec, 0x09, 0x82, 0x0d, 0xb5, 0x24, 0x97,
-	0x10, 0xea, 0xdd, 0x27, 0xb9, 0x91, 0x77, 0x30, 0xf2, 0x1a, 0x42, 0x8d, 0xd8, 0x59, 0xe5, 0xa5,
-	0x7e, 0x7e, 0x76, 0xb3, 0x1c, 0x6e, 0x62, 0x57, 0xf3, 0xb0, 0x66, 0x68, 0xe9, 0x7f, 0xcc, 0x66,
-	0x57, 0x23, 0xa3, 0xfb, 0x86, 0xf5, 0xf3, 0x70, 0xbc, 0xdb, 0xdf, 0x00, 0x00, 0x00, 0xff, 0xff,
-	0xa7, 0x39, 0xee, 0x30, 0xd4, 0x01, 0x00, 0x00,
+	// 330 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x7c, 0x92, 0x51, 0x4a, 0xc3, 0x40,
+	0x10, 0x86, 0x49, 0xd2, 0xb4, 0xcd, 0xd8, 0xfa, 0xb0, 0xf4, 0x61, 0x91, 0x22, 0xa1, 0x4f, 0xc1,
+	0x87, 0x3e, 0xe8, 0x11, 0x1a, 0xc4, 0x80, 0x94, 0xb0, 0xf6, 0x02, 0x6b, 0x3b, 0x68, 0xd0, 0x64,
+	0xca, 0xee, 0x2a, 0x78, 0x14, 0x6f, 0xe1, 0x69, 0x3c, 0x8f, 0xec, 0xa4, 0x49, 0x2b, 0x82, 0x4f,
+	0xfb, 0xff, 0x33, 0xcb, 0xce, 0xff, 0x4d, 0x02, 0xd3, 0x1a, 0xad, 0xd5, 0x4f, 0xb8, 0xdc, 0x1b,
+	0x72, 0x24, 0x86, 0x7c, 0xd8, 0xc5, 0x67, 0x00, 0xc9, 0x9d, 0x6e, 0x76, 0xf6, 0x59, 0xbf, 0xa0,
+	0x10, 0x30, 0x58, 0xeb, 0x1a, 0x65, 0x90, 0x06, 0x59, 0xa2, 0x58, 0x8b, 0x73, 0x08, 0x8b, 0x5c,
+	0x86, 0x69, 0x90, 0x4d, 0x54, 0x58, 0xe4, 0x42, 0xc2, 0x68, 0x55, 0xef, 0x1e, 0xd0, 0x59, 0x19,
+	0xa5, 0x51, 0x36, 0x55, 0x9d, 0x15, 0x17, 0x30, 0x56, 0x58, 0x93, 0xc3, 0xa2, 0x94, 0x03, 0xbe,
+	0xdf, 0x7b, 0x71, 0x09, 0xd0, 0xea, 0x92, 0x8c, 0x93, 0x71, 0x1a, 0x64, 0x53, 0x75, 0x52, 0xf1,
+	0x93, 0xb9, 0x33, 0xe4, 0x0e, 0xeb, 0xc5, 0x77, 0x00, 0x93, 0x15, 0x35, 0x4d, 0x69, 0x68, 0x8f,
+	0xc6, 0x7d, 0xf8, 0xd1, 0xf7, 0xb4, 0xd5, 0xaf, 0x45, 0x7e, 0x48, 0xd8, 0xd9, 0x63, 0xa7, 0x3c,
+	0x24, 0xed, 0xac, 0x98, 0x43, 0xc2, 0x92, 0x5f, 0x8f, 0xf8, 0xf5, 0x63, 0xe1, 0x24, 0x72, 0xce,
+	0x91, 0x93, 0x3e, 0x72, 0xfe, 0x0b, 0x27, 0xfe, 0x17, 0x67, 0xf8, 0x07, 0x67, 0x0e, 0x49, 0x5e,
+	0x19, 0xdc, 0xba, 0x8a, 0x1a, 0x39, 0x6a, 0xa7, 0xf6, 0x85, 0xc5, 0x57, 0x00, 0x83, 0x0d, 0xed,
+	0x49, 0xcc, 0x20, 0x2e, 0xab, 0x77, 0x72, 0x07, 0x9c, 0xd6, 0x88, 0x2b, 0x88, 0x4b, 0x44, 0x63,
+	0x65, 0x98, 0x46, 0xd9, 0xd9, 0xf5, 0xac, 0xfd, 0x64, 0x76, 0x79, 0xba, 0x0b, 0xd5, 0x5e, 0xf1,
+	0x7b, 0xdb, 0x54, 0x35, 0x32, 0x59, 0xa4, 0x58, 0xfb, 0xe0, 0xfe, 0x5c, 0xeb, 0x86, 0x18, 0x2a,
+	0x52, 0xbd, 0xf7, 0xc1, 0x36, 0xe6, 0xad, 0xd9, 0x6a, 0x87, 0x3b, 0xa6, 0x1a, 0xab, 0x63, 0xc1,
+	0xaf, 0xf1, 0x96, 0x4c, 0xad, 0x9d, 0x65, 0xa6, 0xb1, 0xea, 0xec, 0x63, 0xfb, 0xbf, 0xdc, 0xfc,
+	0x0c, 0x00, 0x22, 0xbe, 0x2f, 0x58, 0x47, 0x02, 0x00, 0x00,
 }
@@ -58,6 +58,22 @@ func (verifier *AccountVerifier) VerifyNetAb(block *ledger.AccountBlock) error {
 		return err
 	}
 
+	if verifier.chain.IsGenesisAccountBlock(block) {
+		return nil
+	}
+
+	// the account may not be synced yet, whether the block is signed depends on its type, leave it to pool
+	accType, err := verifier.chain.AccountType(&block.AccountAddress)
+	if err != nil || accType == ledger.AccountTypeNotExist {
+		return nil
+	}
+
+	// so does the snapshot block referred, only blocks fail the checks not depending on chain are rejected
+	switch err := VerifyAccountBlock(block, verifier.chain); err {
+	case ErrVerifyHashFailed, ErrVerifySignatureFailed, ErrVerifyNonceFailed:
+		return err
+	}
+
 	return nil
 }
 
@@ -166,6 +182,176 @@ func (verifier *AccountVerifier) VerifySnapshotOfReferredBlock(thisBlock *ledger
 	return FAIL, ErrVerifySnapshotOfReferredBlockFailed
 }
 
+// VerifyReceiveAgainstSend check recv receives send: send is addressed to the account of recv,
+// and recv carries the same amount and token, or zero amount and token as packed after smart fork
+func VerifyReceiveAgainstSend(recv, send *ledger.AccountBlock) error {
+	if !recv.IsReceiveBlock() || !send.IsSendBlock() {
+		return ErrVerifyReceiveNotMatchSend
+	}
+
+	if recv.FromBlockHash != send.Hash || recv.AccountAddress != send.ToAddress {
+		return ErrVerifyReceiveNotMatchSend
+	}
+
+	if recv.TokenId == types.ZERO_TOKENID && (recv.Amount == nil || recv.Amount.Sign() == 0) {
+		return nil
+	}
+
+	if recv.TokenId != send.TokenId {
+		return ErrVerifyReceiveNotMatchSend
+	}
+
+	sendAmount := send.Amount
+	if sendAmount == nil {
+		sendAmount = big.NewInt(0)
+	}
+	if recv.Amount == nil || recv.Amount.Cmp(sendAmount) != 0 {
+		return ErrVerifyReceiveNotMatchSend
+	}
+
+	return nil
+}
+
+// VerifyTokenAllowed check the token of block is in allowed, it`s a hard rule of auto receive in case the
+// filter of worker is misconfigured, so block should be the send block to receive. nil allowed allows any token
+func VerifyTokenAllowed(block *ledger.AccountBlock, allowed map[types.TokenTypeId]bool) error {
+	if allowed == nil {
+		return nil
+	}
+	if !allowed[block.TokenId] {
+		return ErrVerifyTokenNotAllowed
+	}
+	return nil
+}
+
+// VerifyContext supplies the chain state VerifyAccountBlock looks up, chain.Chain implements it
+type VerifyContext interface {
+	AccountType(address *types.Address) (uint64, error)
+	GetSnapshotBlockByHash(hash *types.Hash) (*ledger.SnapshotBlock, error)
+	GetLatestSnapshotBlock() *ledger.SnapshotBlock
+}
+
+// stateless verifies what doesn`t depend on chain
+var stateless = &AccountVerifier{
+	log: log15.New("module", "AccountVerifier"),
+}
+
+// VerifyAccountBlock check hash, signature, nonce, the snapshot block referred and the existence of the account in order,
+// return the sentinel error of the first failed check, or the error of ctx lookups
+func VerifyAccountBlock(block *ledger.AccountBlock, ctx VerifyContext) error {
+	accType, err := ctx.AccountType(&block.AccountAddress)
+	if err != nil {
+		return err
+	}
+
+	if stateless.VerifyHash(block) != nil {
+		return ErrVerifyHashFailed
+	}
+
+	// send blocks of contract are generated by vm, not signed
+	if block.IsReceiveBlock() || accType != ledger.AccountTypeContract {
+		if stateless.VerifySigature(block) != nil {
+			return ErrVerifySignatureFailed
+		}
+		if accType != ledger.AccountTypeContract && types.PubkeyToAddress(block.PublicKey) != block.AccountAddress {
+			return ErrVerifySignatureFailed
+		}
+	}
+
+	if stateless.VerifyNonce(block, accType) != nil {
+		return ErrVerifyNonceFailed
+	}
+
+	sb, err := ctx.GetSnapshotBlockByHash(&block.SnapshotHash)
+	if err != nil {
+		return err
+	}
+	if sb == nil {
+		return ErrVerifySnapshotNotExist
+	}
+	if latest := ctx.GetLatestSnapshotBlock(); latest != nil && latest.Height > sb.Height+TimeOutHeight {
+		return ErrVerifySnapshotTimeout
+	}
+
+	// account is created by its first receive block
+	if accType == ledger.AccountTypeNotExist && !block.IsReceiveBlock() {
+		return ErrVerifyAccountAddrFailed
+	}
+
+	return nil
+}
+
+// cachedVerifyContext remember the lookups of the underlying VerifyContext within a batch verification.
+// Accounts not exist are not cached, they may be created by a receive block of the batch.
+// It`s not safe for concurrent use.
+type cachedVerifyContext struct {
+	ctx       VerifyContext
+	accTypes  map[types.Address]uint64
+	snapshots map[types.Hash]*ledger.SnapshotBlock
+	latest    *ledger.SnapshotBlock
+}
+
+// NewCachedVerifyContext wrap ctx, so blocks of the same account or referring the same snapshot block
+// don`t look up the chain repeatedly, it should be discarded after the batch
+func NewCachedVerifyContext(ctx VerifyContext) VerifyContext {
+	return &cachedVerifyContext{
+		ctx:       ctx,
+		accTypes:  make(map[types.Address]uint64),
+		snapshots: make(map[types.Hash]*ledger.SnapshotBlock),
+	}
+}
+
+func (c *cachedVerifyContext) AccountType(address *types.Address) (uint64, error) {
+	if accType, ok := c.accTypes[*address]; ok {
+		return accType, nil
+	}
+
+	accType, err := c.ctx.AccountType(address)
+	if err != nil {
+		return accType, err
+	}
+	if accType != ledger.AccountTypeNotExist {
+		c.accTypes[*address] = accType
+	}
+	return accType, nil
+}
+
+func (c *cachedVerifyContext) GetSnapshotBlockByHash(hash *types.Hash) (*ledger.SnapshotBlock, error) {
+	if sb, ok := c.snapshots[*hash]; ok {
+		return sb, nil
+	}
+
+	sb, err := c.ctx.GetSnapshotBlockByHash(hash)
+	if err != nil {
+		return nil, err
+	}
+	if sb != nil {
+		c.snapshots[*hash] = sb
+	}
+	return sb, nil
+}
+
+func (c *cachedVerifyContext) GetLatestSnapshotBlock() *ledger.SnapshotBlock {
+	if c.latest == nil {
+		c.latest = c.ctx.GetLatestSnapshotBlock()
+	}
+	return c.latest
+}
+
+// VerifyAccountBlocks verify blocks in order by VerifyAccountBlock, the lookups of ctx are cached across the blocks,
+// return the index and the error of the first failed block, or -1 and nil
+func VerifyAccountBlocks(blocks []*ledger.AccountBlock, ctx VerifyContext) (int, error) {
+	cached := NewCachedVerifyContext(ctx)
+
+	for i, block := range blocks {
+		if err := VerifyAccountBlock(block, cached); err != nil {
+			return i, err
+		}
+	}
+
+	return -1, nil
+}
+
 func (verifier *AccountVerifier) VerifyIsReceivedSucceed(block *ledger.AccountBlock) bool {
 	return verifier.chain.IsSuccessReceived(&block.AccountAddress, &block.FromBlockHash)
 }
@@ -12,4 +12,8 @@ var (
 	ErrVerifySnapshotOfReferredBlockFailed = errors.New("verify snapshotBlock of the referredBlock failed")
 	ErrVerifyForVmGeneratorFailed          = errors.New("generator in verifier failed")
 	ErrVerifyWithVmResultFailed            = errors.New("verify with vm result failed")
+	ErrVerifyReceiveNotMatchSend           = errors.New("receive block doesn't match its send block")
+	ErrVerifySnapshotNotExist              = errors.New("snapshot block referred doesn't exist")
+	ErrVerifySnapshotTimeout               = errors.New("snapshot block referred is timeout")
+	ErrVerifyTokenNotAllowed               = errors.New("token of block is not allowed")
 )
@@ -3,6 +3,7 @@ package verifier
 import (
 	"github.com/vitelabs/go-vite/common/types"
 	"github.com/vitelabs/go-vite/ledger"
+	"github.com/vitelabs/go-vite/vite/net/message"
 )
 
 type VerifyResult int
@@ -30,6 +31,25 @@ type verifier struct {
 type NetVerifier interface {
 	VerifyNetSb(block *ledger.SnapshotBlock) error
 	VerifyNetAb(block *ledger.AccountBlock) error
+	VerifySubLedger(sl *message.SubLedger) SubLedgerVerifyReport
+}
+
+// BlockVerifyError records the hash of a block which failed verification and the reason
+type BlockVerifyError struct {
+	Hash types.Hash
+	Err  error
+}
+
+// SubLedgerVerifyReport is the result of verifying every block of a SubLedger
+type SubLedgerVerifyReport struct {
+	SnapshotBlocks int
+	AccountBlocks  int
+	Failed         []BlockVerifyError
+}
+
+// OK reports whether all blocks of the SubLedger passed verification
+func (r SubLedgerVerifyReport) OK() bool {
+	return len(r.Failed) == 0
 }
 
 func NewNetVerifier(sv *SnapshotVerifier, av *AccountVerifier) NetVerifier {
@@ -46,3 +66,35 @@ func (v *verifier) VerifyNetSb(block *ledger.SnapshotBlock) error {
 func (v *verifier) VerifyNetAb(block *ledger.AccountBlock) error {
 	return v.Av.VerifyNetAb(block)
 }
+
+func (v *verifier) VerifySubLedger(sl *message.SubLedger) (report SubLedgerVerifyReport) {
+	if sl == nil {
+		return
+	}
+
+	report.SnapshotBlocks = len(sl.SBlocks)
+	report.AccountBlocks = len(sl.ABlocks)
+	report.Failed = append(v.verifyNetSbs(sl.SBlocks), v.verifyNetAbs(sl.ABlocks)...)
+
+	return
+}
+
+// verifyNetSbs verify a batch of snapshot blocks, return all failures
+func (v *verifier) verifyNetSbs(blocks []*ledger.SnapshotBlock) (failed []BlockVerifyError) {
+	for _, block := range blocks {
+		if err := v.VerifyNetSb(block); err != nil {
+			failed = append(failed, BlockVerifyError{block.Hash, err})
+		}
+	}
+	return
+}
+
+// verifyNetAbs verify a batch of account blocks, return all failures
+func (v *verifier) verifyNetAbs(blocks []*ledger.AccountBlock) (failed []BlockVerifyError) {
+	for _, block := range blocks {
+		if err := v.VerifyNetAb(block); err != nil {
+			failed = append(failed, BlockVerifyError{block.Hash, err})
+		}
+	}
+	return
+}
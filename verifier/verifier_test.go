@@ -0,0 +1,297 @@
+package verifier
+
+import (
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/vitelabs/go-vite/chain"
+	"github.com/vitelabs/go-vite/common/types"
+	"github.com/vitelabs/go-vite/crypto/ed25519"
+	"github.com/vitelabs/go-vite/ledger"
+	"github.com/vitelabs/go-vite/vite/net/message"
+)
+
+// mockChain treat no block as genesis and every account as accType, no snapshot block is synced,
+// other methods are not used by net verification
+type mockChain struct {
+	chain.Chain
+	accType uint64
+}
+
+func (c *mockChain) AccountType(address *types.Address) (uint64, error) {
+	return c.accType, nil
+}
+
+func (c *mockChain) GetSnapshotBlockByHash(hash *types.Hash) (*ledger.SnapshotBlock, error) {
+	return nil, nil
+}
+
+func (c *mockChain) GetLatestSnapshotBlock() *ledger.SnapshotBlock {
+	return nil
+}
+
+func (c *mockChain) IsGenesisSnapshotBlock(block *ledger.SnapshotBlock) bool {
+	return false
+}
+
+func (c *mockChain) IsGenesisAccountBlock(block *ledger.AccountBlock) bool {
+	return false
+}
+
+func mockNetSb(height uint64) *ledger.SnapshotBlock {
+	now := time.Now()
+	block := &ledger.SnapshotBlock{
+		Height:    height,
+		Timestamp: &now,
+		PublicKey: addr1PubKey,
+	}
+	block.Hash = block.ComputeHash()
+	block.Signature = ed25519.Sign(addr1PrivKey, block.Hash.Bytes())
+	return block
+}
+
+func mockNetAb(height uint64) *ledger.AccountBlock {
+	now := time.Now()
+	block := &ledger.AccountBlock{
+		BlockType:      ledger.BlockTypeSendCall,
+		Height:         height,
+		AccountAddress: addr1,
+		ToAddress:      addr2,
+		Amount:         big.NewInt(1),
+		Fee:            big.NewInt(0),
+		Timestamp:      &now,
+		PublicKey:      addr1PubKey,
+	}
+	block.Hash = block.ComputeHash()
+	block.Signature = ed25519.Sign(addr1PrivKey, block.Hash.Bytes())
+	return block
+}
+
+func TestVerifier_VerifySubLedger(t *testing.T) {
+	c := &mockChain{accType: ledger.AccountTypeGeneral}
+	v := NewNetVerifier(NewSnapshotVerifier(c, nil), NewAccountVerifier(c, nil))
+
+	sl := &message.SubLedger{
+		SBlocks: []*ledger.SnapshotBlock{mockNetSb(2), mockNetSb(3)},
+		ABlocks: []*ledger.AccountBlock{mockNetAb(1), mockNetAb(2), mockNetAb(3)},
+	}
+
+	report := v.VerifySubLedger(sl)
+	if !report.OK() {
+		t.Fatalf("valid sub ledger should pass: %v", report.Failed)
+	}
+	if report.SnapshotBlocks != 2 || report.AccountBlocks != 3 {
+		t.Fatalf("wrong counts: %d/%d", report.SnapshotBlocks, report.AccountBlocks)
+	}
+
+	// sign the hash of another block
+	bad := sl.ABlocks[1]
+	bad.Signature = sl.ABlocks[0].Signature
+
+	report = v.VerifySubLedger(sl)
+	if len(report.Failed) != 1 {
+		t.Fatalf("should report 1 failed block, but got %d", len(report.Failed))
+	}
+	if report.Failed[0].Hash != bad.Hash {
+		t.Errorf("should report block %s, but got %s", bad.Hash, report.Failed[0].Hash)
+	}
+	if report.Failed[0].Err != ErrVerifySignatureFailed {
+		t.Errorf("should fail with %v, but got %v", ErrVerifySignatureFailed, report.Failed[0].Err)
+	}
+}
+
+func TestAccountVerifier_VerifyNetAb(t *testing.T) {
+	c := &mockChain{accType: ledger.AccountTypeGeneral}
+	v := NewAccountVerifier(c, nil)
+
+	// the snapshot block referred is not synced yet
+	if err := v.VerifyNetAb(mockNetAb(1)); err != nil {
+		t.Errorf("valid block should pass before its snapshot block is synced: %v", err)
+	}
+
+	badNonce := mockNetAb(1)
+	badNonce.Nonce = []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	badNonce.Difficulty = new(big.Int).Lsh(big.NewInt(1), 60)
+	badNonce.Hash = badNonce.ComputeHash()
+	badNonce.Signature = ed25519.Sign(addr1PrivKey, badNonce.Hash.Bytes())
+	if err := v.VerifyNetAb(badNonce); err != ErrVerifyNonceFailed {
+		t.Errorf("should fail with %v, but got %v", ErrVerifyNonceFailed, err)
+	}
+
+	// send block of a contract not synced yet isn`t signed
+	unsigned := mockNetAb(1)
+	unsigned.PublicKey = nil
+	unsigned.Hash = unsigned.ComputeHash()
+	unsigned.Signature = nil
+	if err := v.VerifyNetAb(unsigned); err != ErrVerifySignatureFailed {
+		t.Errorf("unsigned block of general account should fail with %v, but got %v", ErrVerifySignatureFailed, err)
+	}
+	c.accType = ledger.AccountTypeNotExist
+	if err := v.VerifyNetAb(unsigned); err != nil {
+		t.Errorf("block of account not synced should be left to pool, but got %v", err)
+	}
+}
+
+func TestVerifyReceiveAgainstSend(t *testing.T) {
+	send := mockNetAb(1)
+	send.TokenId = ledger.ViteTokenId
+
+	mockRecv := func() *ledger.AccountBlock {
+		return &ledger.AccountBlock{
+			BlockType:      ledger.BlockTypeReceive,
+			AccountAddress: send.ToAddress,
+			FromBlockHash:  send.Hash,
+			Amount:         new(big.Int).Set(send.Amount),
+			TokenId:        send.TokenId,
+		}
+	}
+
+	if err := VerifyReceiveAgainstSend(mockRecv(), send); err != nil {
+		t.Errorf("matching pair should pass: %v", err)
+	}
+
+	// packed after smart fork
+	recv := mockRecv()
+	recv.Amount = big.NewInt(0)
+	recv.TokenId = types.ZERO_TOKENID
+	if err := VerifyReceiveAgainstSend(recv, send); err != nil {
+		t.Errorf("receive of zero amount and token should pass: %v", err)
+	}
+
+	cases := map[string]func(recv *ledger.AccountBlock){
+		"amount":    func(recv *ledger.AccountBlock) { recv.Amount = big.NewInt(2) },
+		"token":     func(recv *ledger.AccountBlock) { recv.TokenId = types.TokenTypeId{1} },
+		"recipient": func(recv *ledger.AccountBlock) { recv.AccountAddress = addr1 },
+		"fromHash":  func(recv *ledger.AccountBlock) { recv.FromBlockHash = types.Hash{1} },
+	}
+	for name, modify := range cases {
+		recv := mockRecv()
+		modify(recv)
+		if err := VerifyReceiveAgainstSend(recv, send); err != ErrVerifyReceiveNotMatchSend {
+			t.Errorf("mismatched %s should return ErrVerifyReceiveNotMatchSend, but got %v", name, err)
+		}
+	}
+}
+
+type mockVerifyContext struct {
+	accType uint64
+	sb      *ledger.SnapshotBlock
+	latest  *ledger.SnapshotBlock
+
+	// count of lookups
+	accLookups    int
+	sbLookups     int
+	latestLookups int
+}
+
+func (c *mockVerifyContext) AccountType(address *types.Address) (uint64, error) {
+	c.accLookups++
+	return c.accType, nil
+}
+
+func (c *mockVerifyContext) GetSnapshotBlockByHash(hash *types.Hash) (*ledger.SnapshotBlock, error) {
+	c.sbLookups++
+	if c.sb == nil || c.sb.Hash != *hash {
+		return nil, nil
+	}
+	return c.sb, nil
+}
+
+func (c *mockVerifyContext) GetLatestSnapshotBlock() *ledger.SnapshotBlock {
+	c.latestLookups++
+	return c.latest
+}
+
+func TestVerifyAccountBlock(t *testing.T) {
+	sb := mockNetSb(10)
+
+	// mock return a valid send block of general account referring sb, mod is applied before signing
+	mock := func(mod func(b *ledger.AccountBlock)) *ledger.AccountBlock {
+		b := mockNetAb(1)
+		b.SnapshotHash = sb.Hash
+		if mod != nil {
+			mod(b)
+		}
+		b.Hash = b.ComputeHash()
+		b.Signature = ed25519.Sign(addr1PrivKey, b.Hash.Bytes())
+		return b
+	}
+
+	ctx := func(accType uint64, latest uint64) *mockVerifyContext {
+		return &mockVerifyContext{accType: accType, sb: sb, latest: mockNetSb(latest)}
+	}
+
+	tamperedHash := mock(nil)
+	tamperedHash.Amount = big.NewInt(2)
+
+	tamperedSig := mock(nil)
+	tamperedSig.Signature[0]++
+
+	_, otherKey, _ := ed25519.GenerateKey(nil)
+	otherSigner := mock(func(b *ledger.AccountBlock) {
+		b.PublicKey = otherKey.PubByte()
+	})
+	otherSigner.Signature = ed25519.Sign(otherKey, otherSigner.Hash.Bytes())
+
+	cases := []struct {
+		name  string
+		block *ledger.AccountBlock
+		ctx   *mockVerifyContext
+		err   error
+	}{
+		{"valid", mock(nil), ctx(ledger.AccountTypeGeneral, 11), nil},
+		{"hash", tamperedHash, ctx(ledger.AccountTypeGeneral, 11), ErrVerifyHashFailed},
+		{"signature", tamperedSig, ctx(ledger.AccountTypeGeneral, 11), ErrVerifySignatureFailed},
+		{"signer", otherSigner, ctx(ledger.AccountTypeGeneral, 11), ErrVerifySignatureFailed},
+		{"nonce", mock(func(b *ledger.AccountBlock) {
+			b.Nonce = []byte{1, 2, 3, 4, 5, 6, 7, 8}
+			b.Difficulty = new(big.Int).Lsh(big.NewInt(1), 60)
+		}), ctx(ledger.AccountTypeGeneral, 11), ErrVerifyNonceFailed},
+		{"snapshot not exist", mock(func(b *ledger.AccountBlock) {
+			b.SnapshotHash = types.Hash{1}
+		}), ctx(ledger.AccountTypeGeneral, 11), ErrVerifySnapshotNotExist},
+		{"snapshot timeout", mock(nil), ctx(ledger.AccountTypeGeneral, 11+TimeOutHeight), ErrVerifySnapshotTimeout},
+		{"account not exist", mock(nil), ctx(ledger.AccountTypeNotExist, 11), ErrVerifyAccountAddrFailed},
+		{"first receive", mock(func(b *ledger.AccountBlock) {
+			b.BlockType = ledger.BlockTypeReceive
+			b.FromBlockHash = types.Hash{2}
+		}), ctx(ledger.AccountTypeNotExist, 11), nil},
+	}
+
+	for _, c := range cases {
+		if err := VerifyAccountBlock(c.block, c.ctx); err != c.err {
+			t.Errorf("%s: should return %v, but got %v", c.name, c.err, err)
+		}
+	}
+}
+
+func TestVerifyAccountBlocks_cached(t *testing.T) {
+	sb := mockNetSb(10)
+
+	var blocks []*ledger.AccountBlock
+	for i := uint64(1); i <= 5; i++ {
+		b := mockNetAb(1)
+		b.Height = i
+		b.SnapshotHash = sb.Hash
+		b.Hash = b.ComputeHash()
+		b.Signature = ed25519.Sign(addr1PrivKey, b.Hash.Bytes())
+		blocks = append(blocks, b)
+	}
+
+	ctx := &mockVerifyContext{accType: ledger.AccountTypeGeneral, sb: sb, latest: mockNetSb(11)}
+	if i, err := VerifyAccountBlocks(blocks, ctx); i != -1 || err != nil {
+		t.Fatalf("should pass, but block %d failed: %v", i, err)
+	}
+
+	if ctx.accLookups != 1 || ctx.sbLookups != 1 || ctx.latestLookups != 1 {
+		t.Errorf("should look up once, but look up account %d, snapshot %d, latest %d times",
+			ctx.accLookups, ctx.sbLookups, ctx.latestLookups)
+	}
+
+	// account not exist is looked up every time, it may be created in the batch
+	ctx = &mockVerifyContext{accType: ledger.AccountTypeNotExist, sb: sb, latest: mockNetSb(11)}
+	if i, err := VerifyAccountBlocks(blocks[:2], ctx); i != 0 || err != ErrVerifyAccountAddrFailed {
+		t.Errorf("block 0 should fail with %v, but block %d failed: %v", ErrVerifyAccountAddrFailed, i, err)
+	}
+}
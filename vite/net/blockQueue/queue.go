@@ -1,29 +1,113 @@
 package blockQueue
 
 import (
+	"sort"
 	"sync"
 
+	"github.com/vitelabs/go-vite/common/types"
+	"github.com/vitelabs/go-vite/ledger"
+	"github.com/vitelabs/go-vite/log15"
 	"github.com/vitelabs/go-vite/p2p/list"
 )
 
+var logQueue = log15.New("module", "net/blockQueue")
+
+// FullPolicy decide which item is dropped when Enqueue to a bounded queue at capacity
+type FullPolicy byte
+
+const (
+	DropNew     FullPolicy = iota // the incoming item is dropped
+	EvictOldest                   // the front item is evicted to make room for the incoming one
+)
+
+// BlockQueue should be created by NewBlockQueue, the zero value is also usable, its state is initialized lazily
 type BlockQueue struct {
-	mu     *sync.Mutex
+	mu     sync.Mutex
 	cond   *sync.Cond
 	list   list.List
 	closed bool
+
+	// use for Enqueue, 0 means unbounded
+	capacity int
+	policy   FullPolicy
+
+	// use for EnqueueBatch, drop AccountBlocks conflict with the PrevHash chain of their account
+	hashChain bool
+
+	// use for PushAccountBlock
+	tails    map[types.Address]uint64 // height of the last AccountBlock pushed of each account
+	deferred map[types.Address]map[uint64]*ledger.AccountBlock
+}
+
+// Option configure the queue created by NewBlockQueue
+type Option func(q *BlockQueue)
+
+// WithCapacity bound the items can be Enqueue, capacity <= 0 means unbounded
+func WithCapacity(capacity int) Option {
+	return func(q *BlockQueue) {
+		q.capacity = capacity
+	}
+}
+
+// WithFullPolicy decide which item is dropped when Enqueue at capacity, default DropNew
+func WithFullPolicy(policy FullPolicy) Option {
+	return func(q *BlockQueue) {
+		q.policy = policy
+	}
+}
+
+// WithHashChainCheck enable the PrevHash check of EnqueueBatch
+func WithHashChainCheck() Option {
+	return func(q *BlockQueue) {
+		q.hashChain = true
+	}
+}
+
+// NewBlockQueue create a queue with all state initialized, configured by opts
+func NewBlockQueue(opts ...Option) *BlockQueue {
+	q := new(BlockQueue)
+	q.init()
+
+	for _, opt := range opts {
+		opt(q)
+	}
+
+	return q
 }
 
 func New() *BlockQueue {
-	mu := new(sync.Mutex)
-	return &BlockQueue{
-		mu:   mu,
-		cond: &sync.Cond{L: mu},
-		list: list.New(),
+	return NewBlockQueue()
+}
+
+// NewBounded create a queue holds at most capacity items, policy decide which item is dropped
+// when Enqueue at capacity, capacity <= 0 means unbounded
+func NewBounded(capacity int, policy FullPolicy) *BlockQueue {
+	return NewBlockQueue(WithCapacity(capacity), WithFullPolicy(policy))
+}
+
+func (q *BlockQueue) init() {
+	if q.cond == nil {
+		q.cond = sync.NewCond(&q.mu)
+	}
+	if q.list == nil {
+		q.list = list.New()
+	}
+	if q.tails == nil {
+		q.tails = make(map[types.Address]uint64)
+	}
+	if q.deferred == nil {
+		q.deferred = make(map[types.Address]map[uint64]*ledger.AccountBlock)
 	}
 }
 
-func (q *BlockQueue) Pop() interface{} {
+// lock q and initialize the state of zero value
+func (q *BlockQueue) lock() {
 	q.mu.Lock()
+	q.init()
+}
+
+func (q *BlockQueue) Pop() interface{} {
+	q.lock()
 	defer q.mu.Unlock()
 
 	for q.list.Size() == 0 && !q.closed {
@@ -34,7 +118,7 @@ func (q *BlockQueue) Pop() interface{} {
 }
 
 func (q *BlockQueue) Push(v interface{}) {
-	q.mu.Lock()
+	q.lock()
 	defer q.mu.Unlock()
 
 	if !q.closed {
@@ -43,15 +127,339 @@ func (q *BlockQueue) Push(v interface{}) {
 	}
 }
 
+// Enqueue append v, if the queue is bounded and at capacity, drop an item according to the FullPolicy.
+// Return the dropped item, v itself if it is refused, nil if nothing is dropped.
+// Push, PushAccountBlock and EnqueueBatch are not bounded.
+func (q *BlockQueue) Enqueue(v interface{}) (dropped interface{}) {
+	q.lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return v
+	}
+
+	if q.capacity > 0 && q.list.Size() >= q.capacity {
+		if q.policy != EvictOldest {
+			return v
+		}
+		dropped = q.list.Shift()
+	}
+
+	q.list.Append(v)
+	q.cond.Broadcast()
+
+	return dropped
+}
+
+// SetHashChainCheck enable or disable the PrevHash check of EnqueueBatch
+func (q *BlockQueue) SetHashChainCheck(enabled bool) {
+	q.lock()
+	defer q.mu.Unlock()
+
+	q.hashChain = enabled
+}
+
+// EnqueueBatch append blocks and sort the AccountBlocks in queue by height once, under a single lock,
+// other items keep their positions.
+// If hash chain check is enabled, a block is dropped if it forks from the preceding block of the same account:
+// at the same height, or at the next height but PrevHash doesn`t match. Blocks after a gap are not checked
+func (q *BlockQueue) EnqueueBatch(blocks []*ledger.AccountBlock) {
+	q.lock()
+	defer q.mu.Unlock()
+
+	if q.closed || len(blocks) == 0 {
+		return
+	}
+
+	items := make([]interface{}, 0, q.list.Size()+len(blocks))
+	q.list.Traverse(func(value interface{}) bool {
+		items = append(items, value)
+		return true
+	})
+	for _, block := range blocks {
+		items = append(items, block)
+	}
+
+	// sort AccountBlocks within their own positions
+	var positions []int
+	var sorted []*ledger.AccountBlock
+	for i, item := range items {
+		if block, ok := item.(*ledger.AccountBlock); ok {
+			positions = append(positions, i)
+			sorted = append(sorted, block)
+		}
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Height < sorted[j].Height
+	})
+	if q.hashChain {
+		sorted = checkHashChain(sorted)
+	}
+
+	// positions not filled are of the dropped blocks
+	for i, pos := range positions {
+		if i < len(sorted) {
+			items[pos] = sorted[i]
+		} else {
+			items[pos] = nil
+		}
+	}
+
+	q.list.Clear()
+	for _, item := range items {
+		if item != nil {
+			q.list.Append(item)
+		}
+	}
+
+	q.cond.Broadcast()
+}
+
+// checkHashChain return blocks without the ones fork from the preceding block of the same account,
+// blocks must be sorted by height
+func checkHashChain(blocks []*ledger.AccountBlock) []*ledger.AccountBlock {
+	prev := make(map[types.Address]*ledger.AccountBlock)
+
+	kept := blocks[:0]
+	for _, block := range blocks {
+		if p, ok := prev[block.AccountAddress]; ok {
+			if block.Height == p.Height || (block.Height == p.Height+1 && block.PrevHash != p.Hash) {
+				logQueue.Warn("drop AccountBlock conflicts with queued one", "address", block.AccountAddress,
+					"height", block.Height, "hash", block.Hash, "prevHash", block.PrevHash, "queued", p.Hash)
+				continue
+			}
+		}
+
+		prev[block.AccountAddress] = block
+		kept = append(kept, block)
+	}
+
+	return kept
+}
+
+// Reserve take out the front item if it is an AccountBlock, so concurrent Pop or Reserve can`t get it.
+// commit drop the block, rollback put it back to the front, only the first call of them takes effect.
+// Return nil block and no-op closures if queue is empty or the front item isn`t an AccountBlock.
+func (q *BlockQueue) Reserve() (block *ledger.AccountBlock, commit func(), rollback func()) {
+	q.lock()
+	defer q.mu.Unlock()
+
+	nop := func() {}
+
+	if q.list.Size() == 0 {
+		return nil, nop, nop
+	}
+
+	var ok bool
+	q.list.Traverse(func(value interface{}) bool {
+		block, ok = value.(*ledger.AccountBlock)
+		return false
+	})
+	if !ok {
+		return nil, nop, nop
+	}
+
+	q.list.Shift()
+
+	var once sync.Once
+	commit = func() {
+		once.Do(nop)
+	}
+	rollback = func() {
+		once.Do(func() {
+			q.lock()
+			defer q.mu.Unlock()
+
+			q.list.UnShift(block)
+			q.cond.Broadcast()
+		})
+	}
+
+	return block, commit, rollback
+}
+
+// PushAccountBlock push block only if it is the next one of the account chain, head is the current height
+// of the account chain. Block leaves a gap will be deferred, and pushed automatically once the gap is filled.
+// Return false if block is deferred or refused because it is not higher than pushed ones.
+func (q *BlockQueue) PushAccountBlock(block *ledger.AccountBlock, head uint64) bool {
+	q.lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return false
+	}
+
+	addr := block.AccountAddress
+	tail := q.tails[addr]
+	if tail < head {
+		tail = head
+	}
+
+	if block.Height <= tail {
+		return false
+	}
+
+	if block.Height > tail+1 {
+		if q.deferred[addr] == nil {
+			q.deferred[addr] = make(map[uint64]*ledger.AccountBlock)
+		}
+		q.deferred[addr][block.Height] = block
+		return false
+	}
+
+	q.list.Append(block)
+	tail = block.Height
+
+	// the gap may be filled, push deferred blocks
+	if blocks, ok := q.deferred[addr]; ok {
+		for {
+			next, ok := blocks[tail+1]
+			if !ok {
+				break
+			}
+			q.list.Append(next)
+			delete(blocks, tail+1)
+			tail++
+		}
+
+		// blocks not higher than tail will never be pushed
+		for height := range blocks {
+			if height <= tail {
+				delete(blocks, height)
+			}
+		}
+		if len(blocks) == 0 {
+			delete(q.deferred, addr)
+		}
+	}
+
+	q.tails[addr] = tail
+	q.cond.Broadcast()
+
+	return true
+}
+
+// Deferred return the count of AccountBlocks waiting for the gap to be filled
+func (q *BlockQueue) Deferred() (n int) {
+	q.lock()
+	defer q.mu.Unlock()
+
+	for _, blocks := range q.deferred {
+		n += len(blocks)
+	}
+	return
+}
+
+// Drain remove all items and return the AccountBlocks of them in height order, other items are discarded.
+// The deferred AccountBlocks are discarded and the account chains pushed are forgotten, so PushAccountBlock
+// starts over from the head
+func (q *BlockQueue) Drain() []*ledger.AccountBlock {
+	q.lock()
+	defer q.mu.Unlock()
+
+	blocks := make([]*ledger.AccountBlock, 0, q.list.Size())
+	q.list.Traverse(func(value interface{}) bool {
+		if block, ok := value.(*ledger.AccountBlock); ok {
+			blocks = append(blocks, block)
+		}
+		return true
+	})
+	q.list.Clear()
+
+	q.tails = make(map[types.Address]uint64)
+	q.deferred = make(map[types.Address]map[uint64]*ledger.AccountBlock)
+
+	sort.SliceStable(blocks, func(i, j int) bool {
+		return blocks[i].Height < blocks[j].Height
+	})
+
+	return blocks
+}
+
+// ForEach call fn with every queued AccountBlock in height order, other items are skipped,
+// stop when fn return false.
+// fn is called with the queue locked, so it must not mutate the queue or the blocks
+func (q *BlockQueue) ForEach(fn func(*ledger.AccountBlock) bool) {
+	q.lock()
+	defer q.mu.Unlock()
+
+	var blocks []*ledger.AccountBlock
+	q.list.Traverse(func(value interface{}) bool {
+		if block, ok := value.(*ledger.AccountBlock); ok {
+			blocks = append(blocks, block)
+		}
+		return true
+	})
+
+	sort.SliceStable(blocks, func(i, j int) bool {
+		return blocks[i].Height < blocks[j].Height
+	})
+
+	for _, block := range blocks {
+		if !fn(block) {
+			return
+		}
+	}
+}
+
+// Get return the queued or deferred AccountBlock of hash h, the block is not removed
+func (q *BlockQueue) Get(h types.Hash) (block *ledger.AccountBlock, ok bool) {
+	q.lock()
+	defer q.mu.Unlock()
+
+	q.list.Traverse(func(value interface{}) bool {
+		if b, isBlock := value.(*ledger.AccountBlock); isBlock && b.Hash == h {
+			block, ok = b, true
+			return false
+		}
+		return true
+	})
+	if ok {
+		return
+	}
+
+	for _, blocks := range q.deferred {
+		for _, b := range blocks {
+			if b.Hash == h {
+				return b, true
+			}
+		}
+	}
+
+	return nil, false
+}
+
+// Front return the queued AccountBlock of the lowest height without removing it, the earliest queued one
+// if heights are equal, return nil and false if there is no AccountBlock in queue
+func (q *BlockQueue) Front() (block *ledger.AccountBlock, ok bool) {
+	q.lock()
+	defer q.mu.Unlock()
+
+	q.list.Traverse(func(value interface{}) bool {
+		if b, isBlock := value.(*ledger.AccountBlock); isBlock && (!ok || b.Height < block.Height) {
+			block, ok = b, true
+		}
+		return true
+	})
+
+	return
+}
+
+// Contains return true if the AccountBlock of hash h is queued or deferred
+func (q *BlockQueue) Contains(h types.Hash) bool {
+	_, ok := q.Get(h)
+	return ok
+}
+
 func (q *BlockQueue) Size() int {
-	q.mu.Lock()
+	q.lock()
 	defer q.mu.Unlock()
 
 	return q.list.Size()
 }
 
 func (q *BlockQueue) Close() {
-	q.mu.Lock()
+	q.lock()
 	defer q.mu.Unlock()
 
 	if !q.closed {
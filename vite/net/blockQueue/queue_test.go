@@ -1,8 +1,13 @@
 package blockQueue
 
 import (
+	"math/big"
+	"math/rand"
 	"testing"
 	"time"
+
+	"github.com/vitelabs/go-vite/common/types"
+	"github.com/vitelabs/go-vite/ledger"
 )
 
 func TestBlockQueue_Push(t *testing.T) {
@@ -51,3 +56,463 @@ func TestBlockQueue_Close(t *testing.T) {
 
 	<-pending
 }
+
+// queued return the items of q in queue order without removing them
+func queued(q *BlockQueue) (items []interface{}) {
+	q.lock()
+	defer q.mu.Unlock()
+
+	q.list.Traverse(func(value interface{}) bool {
+		items = append(items, value)
+		return true
+	})
+	return
+}
+
+func TestBlockQueue_Drain(t *testing.T) {
+	q := New()
+
+	const total = 5
+	for _, h := range []uint64{3, 1, 5, 2, 4} {
+		q.Push(&ledger.AccountBlock{Height: h})
+	}
+	q.Push("item")
+
+	blocks := q.Drain()
+	if len(blocks) != total {
+		t.Fatalf("should drain %d blocks, but got %d", total, len(blocks))
+	}
+	for i, block := range blocks {
+		if block.Height != uint64(i+1) {
+			t.Errorf("block %d should be of height %d, but got %d", i, i+1, block.Height)
+		}
+	}
+
+	if q.Size() != 0 {
+		t.Errorf("queue should be empty after drain")
+	}
+
+	if blocks = q.Drain(); len(blocks) != 0 {
+		t.Errorf("drain empty queue should return nothing")
+	}
+}
+
+func TestBlockQueue_Drain_accountBlocks(t *testing.T) {
+	q := New()
+	b1 := &ledger.AccountBlock{Hash: types.Hash{1}, Height: 1}
+	b3 := &ledger.AccountBlock{Hash: types.Hash{3}, Height: 3}
+
+	q.PushAccountBlock(b1, 0)
+	q.PushAccountBlock(b3, 0)
+
+	if items := q.Drain(); len(items) != 1 || items[0] != b1 {
+		t.Fatalf("should drain block 1, but got %v", items)
+	}
+	if q.Deferred() != 0 || q.Contains(b3.Hash) {
+		t.Error("deferred block should be discarded")
+	}
+
+	// the account chain starts over from the head
+	if !q.PushAccountBlock(b1, 0) {
+		t.Error("should push block 1 again after drain")
+	}
+}
+
+func mockAccountBlocks(q *BlockQueue, heights ...uint64) {
+	for _, h := range heights {
+		q.Push(&ledger.AccountBlock{
+			Height: h,
+			Amount: new(big.Int).SetUint64(h),
+		})
+	}
+}
+
+func TestBlockQueue_ForEach(t *testing.T) {
+	q := New()
+	mockAccountBlocks(q, 3, 1, 4, 2)
+	q.Push("not a block")
+
+	sum := new(big.Int)
+	var last uint64
+	q.ForEach(func(block *ledger.AccountBlock) bool {
+		if block.Height < last {
+			t.Errorf("block %d is visited after block %d", block.Height, last)
+		}
+		last = block.Height
+		sum.Add(sum, block.Amount)
+		return true
+	})
+
+	if sum.Int64() != 10 {
+		t.Errorf("sum should be 10, but got %s", sum)
+	}
+	if q.Size() != 5 {
+		t.Errorf("ForEach should not remove items")
+	}
+}
+
+func TestBlockQueue_ForEach_stop(t *testing.T) {
+	q := New()
+	mockAccountBlocks(q, 3, 1, 4, 2)
+
+	var visited []uint64
+	q.ForEach(func(block *ledger.AccountBlock) bool {
+		visited = append(visited, block.Height)
+		return block.Height < 2
+	})
+
+	if len(visited) != 2 || visited[0] != 1 || visited[1] != 2 {
+		t.Errorf("should stop after block 2, but visited %v", visited)
+	}
+}
+
+func TestBlockQueue_PushAccountBlock(t *testing.T) {
+	q := New()
+
+	var addr types.Address
+	block := func(height uint64) *ledger.AccountBlock {
+		return &ledger.AccountBlock{
+			AccountAddress: addr,
+			Height:         height,
+		}
+	}
+
+	const head = 5
+
+	if q.PushAccountBlock(block(5), head) {
+		t.Error("block not higher than head should be refused")
+	}
+
+	if q.PushAccountBlock(block(8), head) || q.PushAccountBlock(block(7), head) {
+		t.Error("block leaves a gap should be deferred")
+	}
+	if q.Size() != 0 || q.Deferred() != 2 {
+		t.Fatalf("should defer 2 blocks, but queued %d deferred %d", q.Size(), q.Deferred())
+	}
+
+	if !q.PushAccountBlock(block(6), head) {
+		t.Error("the next block should be pushed")
+	}
+	if q.Size() != 3 || q.Deferred() != 0 {
+		t.Fatalf("deferred blocks should be pushed, but queued %d deferred %d", q.Size(), q.Deferred())
+	}
+
+	for i, block := range q.Drain() {
+		if h := block.Height; h != uint64(6+i) {
+			t.Errorf("item %d should be block %d, but got %d", i, 6+i, h)
+		}
+	}
+
+	// drained blocks are forgotten, the account chain continues from the head passed
+	if q.PushAccountBlock(block(9), head) {
+		t.Error("block leaves a gap to head should be deferred after drain")
+	}
+	if !q.PushAccountBlock(block(9), 8) {
+		t.Error("should continue from the head")
+	}
+}
+
+func TestBlockQueue_Reserve(t *testing.T) {
+	q := New()
+
+	if block, commit, rollback := q.Reserve(); block != nil {
+		t.Fatal("should reserve nothing from empty queue")
+	} else {
+		commit()
+		rollback()
+	}
+
+	b1 := &ledger.AccountBlock{Height: 1}
+	b2 := &ledger.AccountBlock{Height: 2}
+	q.Push(b1)
+	q.Push(b2)
+
+	// rollback
+	block, _, rollback := q.Reserve()
+	if block != b1 {
+		t.Fatalf("should reserve the front block")
+	}
+	if q.Size() != 1 {
+		t.Fatalf("reserved block should not be visible, but size is %d", q.Size())
+	}
+	if v := q.Pop(); v != b2 {
+		t.Fatalf("concurrent Pop should get the next block, but got %v", v)
+	}
+	q.Push(b2)
+
+	rollback()
+	rollback()
+	if q.Size() != 2 {
+		t.Fatalf("rollback should put the block back once, but size is %d", q.Size())
+	}
+
+	// commit
+	block, commit, rollback := q.Reserve()
+	if block != b1 {
+		t.Fatalf("rolled back block should be at the front again")
+	}
+	commit()
+	rollback()
+	if q.Size() != 1 || q.Pop() != b2 {
+		t.Fatalf("commit should remove the block")
+	}
+
+	// front is not an AccountBlock
+	q.Push(1)
+	if block, _, _ := q.Reserve(); block != nil || q.Size() != 1 {
+		t.Errorf("should not reserve item other than AccountBlock")
+	}
+}
+
+func TestBlockQueue_Get(t *testing.T) {
+	q := New()
+
+	queued := &ledger.AccountBlock{Hash: types.Hash{1}, Height: 1}
+	deferred := &ledger.AccountBlock{Hash: types.Hash{3}, Height: 3}
+	q.PushAccountBlock(queued, 0)
+	q.PushAccountBlock(deferred, 0)
+	q.Push(1)
+
+	for _, block := range []*ledger.AccountBlock{queued, deferred} {
+		if b, ok := q.Get(block.Hash); !ok || b != block {
+			t.Errorf("should get block %s", block.Hash)
+		}
+		if !q.Contains(block.Hash) {
+			t.Errorf("should contain block %s", block.Hash)
+		}
+	}
+
+	absent := types.Hash{2}
+	if b, ok := q.Get(absent); ok || b != nil {
+		t.Errorf("should not get absent block")
+	}
+	if q.Contains(absent) {
+		t.Errorf("should not contain absent block")
+	}
+
+	if q.Size() != 2 || q.Deferred() != 1 {
+		t.Errorf("Get should not remove blocks")
+	}
+}
+
+func TestBlockQueue_zeroValue(t *testing.T) {
+	for name, q := range map[string]*BlockQueue{"New": NewBlockQueue(), "zero": new(BlockQueue)} {
+		b1 := &ledger.AccountBlock{Hash: types.Hash{1}, Height: 1}
+		b3 := &ledger.AccountBlock{Hash: types.Hash{3}, Height: 3}
+
+		if !q.PushAccountBlock(b1, 0) || q.PushAccountBlock(b3, 0) {
+			t.Fatalf("%s: should push block 1 and defer block 3", name)
+		}
+		q.Push(2)
+
+		if q.Size() != 2 || q.Deferred() != 1 {
+			t.Fatalf("%s: should queue 2 items and defer 1 block", name)
+		}
+		if !q.Contains(b1.Hash) || !q.Contains(b3.Hash) {
+			t.Errorf("%s: should contain block 1 and 3", name)
+		}
+		if b, ok := q.Get(b1.Hash); !ok || b != b1 {
+			t.Errorf("%s: should get block 1", name)
+		}
+
+		var n int
+		q.ForEach(func(*ledger.AccountBlock) bool {
+			n++
+			return true
+		})
+		if n != 1 {
+			t.Errorf("%s: should iterate 1 block, but got %d", name, n)
+		}
+
+		block, _, rollback := q.Reserve()
+		if block != b1 {
+			t.Fatalf("%s: should reserve block 1", name)
+		}
+		rollback()
+
+		if v := q.Pop(); v != b1 {
+			t.Errorf("%s: should pop block 1, but got %v", name, v)
+		}
+		if items := queued(q); len(items) != 1 || items[0] != 2 {
+			t.Errorf("%s: should keep the rest item, but got %v", name, items)
+		}
+		if blocks := q.Drain(); len(blocks) != 0 || q.Size() != 0 {
+			t.Errorf("%s: should drain no block but the rest item, but got %v", name, blocks)
+		}
+
+		q.Close()
+		if v := q.Pop(); v != nil {
+			t.Errorf("%s: closed queue should pop nil, but got %v", name, v)
+		}
+	}
+}
+
+func TestBlockQueue_EnqueueBatch(t *testing.T) {
+	q := New()
+	mockAccountBlocks(q, 5)
+	q.Push(1)
+
+	var blocks []*ledger.AccountBlock
+	for _, h := range rand.Perm(100) {
+		blocks = append(blocks, &ledger.AccountBlock{Height: uint64(h + 10)})
+	}
+	q.EnqueueBatch(blocks)
+
+	if q.Size() != 102 {
+		t.Fatalf("should queue 102 items, but got %d", q.Size())
+	}
+
+	items := queued(q)
+	if items[1] != 1 {
+		t.Errorf("item other than AccountBlock should keep its position")
+	}
+
+	var last uint64
+	for i, item := range items {
+		if block, ok := item.(*ledger.AccountBlock); ok {
+			if block.Height < last {
+				t.Fatalf("item %d of height %d is after height %d", i, block.Height, last)
+			}
+			last = block.Height
+		}
+	}
+}
+
+func TestBlockQueue_EnqueueBatch_hashChain(t *testing.T) {
+	q := New()
+	q.SetHashChainCheck(true)
+
+	addr, other := types.Address{1}, types.Address{2}
+	b1 := &ledger.AccountBlock{AccountAddress: addr, Height: 1, Hash: types.Hash{1}}
+	q.Push(b1)
+	q.Push("item")
+
+	b2 := &ledger.AccountBlock{AccountAddress: addr, Height: 2, Hash: types.Hash{2}, PrevHash: b1.Hash}
+	fork := &ledger.AccountBlock{AccountAddress: addr, Height: 2, Hash: types.Hash{3}, PrevHash: b1.Hash}
+	// next to b2, but not chained to it
+	orphan := &ledger.AccountBlock{AccountAddress: addr, Height: 3, Hash: types.Hash{4}, PrevHash: fork.Hash}
+	// after a gap, can`t be checked
+	gapped := &ledger.AccountBlock{AccountAddress: addr, Height: 5, Hash: types.Hash{5}, PrevHash: types.Hash{9}}
+	// another account at the same height
+	b2other := &ledger.AccountBlock{AccountAddress: other, Height: 2, Hash: types.Hash{6}}
+
+	q.EnqueueBatch([]*ledger.AccountBlock{b2, fork, orphan, gapped, b2other})
+
+	items := queued(q)
+	want := []interface{}{b1, "item", b2, b2other, gapped}
+	if len(items) != len(want) {
+		t.Fatalf("should retain %d items, but got %d", len(want), len(items))
+	}
+	for i := range want {
+		if items[i] != want[i] {
+			t.Errorf("item %d should be %v, but got %v", i, want[i], items[i])
+		}
+	}
+
+	// without check, both blocks of the same height are queued
+	q = New()
+	q.EnqueueBatch([]*ledger.AccountBlock{b2, fork})
+	if n := q.Size(); n != 2 {
+		t.Errorf("should queue 2 blocks without check, but got %d", n)
+	}
+}
+
+func TestBlockQueue_Enqueue_dropNew(t *testing.T) {
+	q := NewBounded(2, DropNew)
+	b1, b2, b3 := &ledger.AccountBlock{Height: 1}, &ledger.AccountBlock{Height: 2}, &ledger.AccountBlock{Height: 3}
+
+	if dropped := q.Enqueue(b1); dropped != nil {
+		t.Errorf("should not drop, but dropped %v", dropped)
+	}
+	if dropped := q.Enqueue(b2); dropped != nil {
+		t.Errorf("should not drop, but dropped %v", dropped)
+	}
+	if dropped := q.Enqueue(b3); dropped != b3 {
+		t.Errorf("should drop the new block at capacity, but dropped %v", dropped)
+	}
+
+	items := q.Drain()
+	if len(items) != 2 || items[0] != b1 || items[1] != b2 {
+		t.Errorf("should keep the old blocks, but got %v", items)
+	}
+}
+
+func TestBlockQueue_Enqueue_evictOldest(t *testing.T) {
+	q := NewBounded(2, EvictOldest)
+	b1, b2, b3 := &ledger.AccountBlock{Height: 1}, &ledger.AccountBlock{Height: 2}, &ledger.AccountBlock{Height: 3}
+
+	q.Enqueue(b1)
+	q.Enqueue(b2)
+	if dropped := q.Enqueue(b3); dropped != b1 {
+		t.Errorf("should evict the oldest block at capacity, but dropped %v", dropped)
+	}
+
+	items := q.Drain()
+	if len(items) != 2 || items[0] != b2 || items[1] != b3 {
+		t.Errorf("should keep the recent blocks, but got %v", items)
+	}
+
+	// unbounded and closed
+	q = New()
+	for i := 0; i < 10; i++ {
+		if dropped := q.Enqueue(i); dropped != nil {
+			t.Fatalf("unbounded queue should not drop, but dropped %v", dropped)
+		}
+	}
+	q.Close()
+	if dropped := q.Enqueue(b1); dropped != b1 {
+		t.Errorf("closed queue should refuse the block, but dropped %v", dropped)
+	}
+}
+
+func TestNewBlockQueue(t *testing.T) {
+	q := NewBlockQueue(WithCapacity(2), WithFullPolicy(EvictOldest), WithHashChainCheck())
+	b1 := &ledger.AccountBlock{Hash: types.Hash{1}, Height: 1}
+	b2 := &ledger.AccountBlock{Hash: types.Hash{2}, Height: 2, PrevHash: b1.Hash}
+	fork := &ledger.AccountBlock{Hash: types.Hash{3}, Height: 2}
+
+	q.Enqueue(1)
+	q.Enqueue(2)
+	if dropped := q.Enqueue(3); dropped != 1 {
+		t.Errorf("should evict the oldest item at capacity, but dropped %v", dropped)
+	}
+	q.Drain()
+
+	q.EnqueueBatch([]*ledger.AccountBlock{b1, b2, fork})
+	if q.Size() != 2 || !q.Contains(b2.Hash) || q.Contains(fork.Hash) {
+		t.Errorf("should drop the forked block")
+	}
+
+	// options are not applied by default
+	q = NewBlockQueue()
+	for i := 0; i < 3; i++ {
+		if dropped := q.Enqueue(i); dropped != nil {
+			t.Fatalf("unbounded queue should not drop, but dropped %v", dropped)
+		}
+	}
+}
+
+func TestBlockQueue_Front(t *testing.T) {
+	q := New()
+
+	if block, ok := q.Front(); block != nil || ok {
+		t.Errorf("front of empty queue should be nil and false, but got %v %v", block, ok)
+	}
+
+	q.Push(1)
+	if block, ok := q.Front(); block != nil || ok {
+		t.Errorf("front of queue without AccountBlock should be nil and false, but got %v %v", block, ok)
+	}
+
+	b3, b1, b1dup := &ledger.AccountBlock{Height: 3}, &ledger.AccountBlock{Height: 1}, &ledger.AccountBlock{Height: 1}
+	q.Push(b3)
+	q.Push(b1)
+	q.Push(b1dup)
+
+	if block, ok := q.Front(); block != b1 || !ok {
+		t.Errorf("front should be the earliest block of the lowest height, but got %v %v", block, ok)
+	}
+	if q.Size() != 4 {
+		t.Errorf("front should not remove the block, but size is %d", q.Size())
+	}
+}
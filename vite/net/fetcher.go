@@ -5,7 +5,9 @@ import (
 	"fmt"
 	"math/rand"
 	"sync/atomic"
+	"time"
 
+	"github.com/vitelabs/go-vite/common"
 	"github.com/vitelabs/go-vite/common/types"
 	"github.com/vitelabs/go-vite/ledger"
 	"github.com/vitelabs/go-vite/log15"
@@ -15,6 +17,9 @@ import (
 
 var errNoSuitablePeer = errors.New("no suitable peer")
 
+// a fetch is given up if none of the peers respond in fetchReplyTimeout
+var fetchReplyTimeout = 10 * time.Second
+
 type gid struct {
 	index uint64 // atomic
 }
@@ -92,22 +97,38 @@ type fPolicy interface {
 }
 
 type fetcher struct {
-	filter Filter
-	policy fPolicy
-	pool   MsgIder
-	ready  int32 // atomic
-	log    log15.Logger
+	filter  Filter
+	policy  fPolicy
+	pool    MsgIder
+	replies *replyTable // responses are routed back by RequestID
+	ready   int32       // atomic
+	log     log15.Logger
 }
 
-func newFetcher(filter Filter, peers *peerSet, pool MsgIder) *fetcher {
+func newFetcher(filter Filter, peers *peerSet, pool MsgIder, replies *replyTable) *fetcher {
 	return &fetcher{
-		filter: filter,
-		policy: &fetchPolicy{peers},
-		pool:   pool,
-		log:    log15.New("module", "net/fetcher"),
+		filter:  filter,
+		policy:  &fetchPolicy{peers},
+		pool:    pool,
+		replies: replies,
+		log:     log15.New("module", "net/fetcher"),
 	}
 }
 
+// waitReply wait the response of req in background, the blocks responded are received by receiver,
+// only the time of the response or timeout is recorded
+func (f *fetcher) waitReply(id uint64, reply <-chan message.Message, req fmt.Stringer) {
+	start, timeout := time.Now(), fetchReplyTimeout
+	common.Go(func() {
+		if _, err := f.replies.wait(id, reply, timeout); err != nil {
+			f.log.Warn(fmt.Sprintf("%s: %v", req, err))
+			monitor.LogEvent("net/fetch", "Reply_Timeout")
+			return
+		}
+		monitor.LogTime("net/fetch", "Reply_Time", start)
+	})
+}
+
 func (f *fetcher) FetchSnapshotBlocks(start types.Hash, count uint64) {
 	monitor.LogEvent("net/fetch", "GetSnapshotBlocks")
 
@@ -130,11 +151,15 @@ func (f *fetcher) FetchSnapshotBlocks(start types.Hash, count uint64) {
 		}
 
 		id := f.pool.MsgID()
+		rid, reply := f.replies.add()
+		m.RequestID = rid
 
 		if err := p.Send(GetSnapshotBlocksCode, id, m); err != nil {
 			f.log.Error(fmt.Sprintf("send %s to %s error: %v", m, p, err))
+			f.replies.del(rid)
 		} else {
 			f.log.Info(fmt.Sprintf("send %s to %s done", m, p))
+			f.waitReply(rid, reply, m)
 		}
 		monitor.LogEvent("net/fetch", "GetSnapshotBlocks_Send")
 	} else {
@@ -171,15 +196,26 @@ func (f *fetcher) FetchAccountBlocks(start types.Hash, count uint64, address *ty
 		}
 
 		id := f.pool.MsgID()
+		// the first response of the peers is routed, the later ones are dropped by replyTable
+		rid, reply := f.replies.add()
+		m.RequestID = rid
 
+		var sent bool
 		for _, p := range peerList {
 			if err := p.Send(GetAccountBlocksCode, id, m); err != nil {
 				f.log.Error(fmt.Sprintf("send %s to %s error: %v", m, p, err))
 			} else {
 				f.log.Info(fmt.Sprintf("send %s to %s done", m, p))
+				sent = true
 			}
 			monitor.LogEvent("net/fetch", "GetAccountBlocks_Send")
 		}
+
+		if sent {
+			f.waitReply(rid, reply, m)
+		} else {
+			f.replies.del(rid)
+		}
 	} else {
 		f.log.Error(errNoSuitablePeer.Error())
 	}
@@ -214,15 +250,26 @@ func (f *fetcher) FetchAccountBlocksWithHeight(start types.Hash, count uint64, a
 		}
 
 		id := f.pool.MsgID()
+		// the first response of the peers is routed, the later ones are dropped by replyTable
+		rid, reply := f.replies.add()
+		m.RequestID = rid
 
+		var sent bool
 		for _, p := range peerList {
 			if err := p.Send(GetAccountBlocksCode, id, m); err != nil {
 				f.log.Error(fmt.Sprintf("send %s to %s error: %v", m, p, err))
 			} else {
 				f.log.Info(fmt.Sprintf("send %s to %s done", m, p))
+				sent = true
 			}
 			monitor.LogEvent("net/fetch", "GetAccountBlocks_Send")
 		}
+
+		if sent {
+			f.waitReply(rid, reply, m)
+		} else {
+			f.replies.del(rid)
+		}
 	} else {
 		f.log.Error(errNoSuitablePeer.Error())
 	}
@@ -15,6 +15,7 @@ type Chain interface {
 
 	// query chunk
 	GetConfirmSubLedger(start, end uint64) ([]*ledger.SnapshotBlock, map[types.Address][]*ledger.AccountBlock, error)
+	GetConfirmSubLedgerBySnapshotBlocks(snapshotBlocks []*ledger.SnapshotBlock) (map[types.Address][]*ledger.AccountBlock, error)
 
 	// single
 	GetSnapshotBlockByHeight(height uint64) (*ledger.SnapshotBlock, error)
@@ -123,18 +123,30 @@ func (s _statusHandler) Handle(msg *p2p.Msg, sender Peer) error {
 }
 
 // @section queryHandler
+const defaultMaxInFlightRequests = 10
+
 type queryHandler struct {
-	lock     sync.RWMutex
-	queue    list.List
-	handlers map[ViteCmd]MsgHandler
-	term     chan struct{}
-	wg       sync.WaitGroup
-}
+	lock        sync.RWMutex
+	queue       list.List
+	handlers    map[ViteCmd]MsgHandler
+	term        chan struct{}
+	wg          sync.WaitGroup
+	maxInFlight int
+	inFlight    map[string]int // requests of each peer are queued or being handled, protected by lock
+}
+
+// newQueryHandler serve at most maxInFlight requests of one peer at the same time,
+// use defaultMaxInFlightRequests if maxInFlight is 0
+func newQueryHandler(chain Chain, maxInFlight int) *queryHandler {
+	if maxInFlight <= 0 {
+		maxInFlight = defaultMaxInFlightRequests
+	}
 
-func newQueryHandler(chain Chain) *queryHandler {
 	q := &queryHandler{
-		handlers: make(map[ViteCmd]MsgHandler),
-		queue:    list.New(),
+		handlers:    make(map[ViteCmd]MsgHandler),
+		queue:       list.New(),
+		maxInFlight: maxInFlight,
+		inFlight:    make(map[string]int),
 	}
 
 	q.addHandler(&getSubLedgerHandler{chain})
@@ -203,15 +215,25 @@ func newMsgEvent() *queryTask {
 }
 
 func (q *queryHandler) Handle(msg *p2p.Msg, sender Peer) error {
+	id := sender.ID()
+
+	q.lock.Lock()
+	if q.inFlight[id] >= q.maxInFlight {
+		q.lock.Unlock()
+		netLog.Warn(fmt.Sprintf("too many requests in flight from %s, reject %s", sender.RemoteAddr(), ViteCmd(msg.Cmd)))
+		return sender.Send(ExceptionCode, msg.Id, message.TooManyRequests)
+	}
+
 	e := newMsgEvent()
 	e.Msg = msg
 	e.Sender = sender
 
-	q.lock.Lock()
+	q.inFlight[id]++
 	q.queue.Append(e)
+	size := q.queue.Size()
 	q.lock.Unlock()
 
-	netLog.Info(fmt.Sprintf("put message %s into queue, rest %d query tasks in queue", ViteCmd(msg.Cmd), q.queue.Size()))
+	netLog.Info(fmt.Sprintf("put message %s into queue, rest %d query tasks in queue", ViteCmd(msg.Cmd), size))
 
 	return nil
 }
@@ -254,11 +276,25 @@ func (q *queryHandler) loop() {
 						event.Sender.Report(err)
 					}
 				}
+				q.done(event.Sender)
 			}
 		}
 	}
 }
 
+func (q *queryHandler) done(sender Peer) {
+	id := sender.ID()
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if q.inFlight[id] <= 1 {
+		delete(q.inFlight, id)
+	} else {
+		q.inFlight[id]--
+	}
+}
+
 // @section getSubLedgerHandler
 type getSubLedgerHandler struct {
 	chain Chain
@@ -281,6 +317,10 @@ func (s *getSubLedgerHandler) Handle(msg *p2p.Msg, sender Peer) (err error) {
 		return
 	}
 
+	if err = req.Validate(); err != nil {
+		return
+	}
+
 	netLog.Info(fmt.Sprintf("receive %s from %s", req, sender.RemoteAddr()))
 
 	var files []*ledger.CompressedFileMeta
@@ -334,6 +374,10 @@ func (s *getSnapshotBlocksHandler) Handle(msg *p2p.Msg, sender Peer) (err error)
 		return
 	}
 
+	if err = req.Validate(); err != nil {
+		return
+	}
+
 	netLog.Info(fmt.Sprintf("receive %s from %s", req, sender.RemoteAddr()))
 
 	var block *ledger.SnapshotBlock
@@ -348,20 +392,13 @@ func (s *getSnapshotBlocksHandler) Handle(msg *p2p.Msg, sender Peer) (err error)
 		return sender.Send(ExceptionCode, msg.Id, message.Missing)
 	}
 
-	// use for split
-	var from, to uint64
-	if req.Forward {
-		from = block.Height
-		to = from + req.Count - 1
-	} else {
-		to = block.Height
-		if to >= req.Count {
-			from = to - req.Count + 1
-		} else {
-			from = 0
-		}
+	// use for split, snapshot blocks with content are much larger, split into small chunks as sub ledger
+	from, to := req.Range(block.Height)
+	size := uint64(maxBlocksOneTrip)
+	if req.IncludeContent {
+		size = maxContentBlocksOneTrip
 	}
-	chunks := splitChunk(from, to, maxBlocksOneTrip)
+	chunks := splitChunk(from, to, size)
 
 	var blocks []*ledger.SnapshotBlock
 	for _, c := range chunks {
@@ -373,7 +410,23 @@ func (s *getSnapshotBlocksHandler) Handle(msg *p2p.Msg, sender Peer) (err error)
 		}
 		monitor.LogEvent("net/handle", "GetSnapshotBlocks_Success")
 
-		if err = sender.SendSnapshotBlocks(blocks, msg.Id); err != nil {
+		var content []*ledger.AccountBlock
+		if req.IncludeContent {
+			var mblocks accountBlockMap
+			mblocks, err = s.chain.GetConfirmSubLedgerBySnapshotBlocks(blocks)
+			if err != nil {
+				netLog.Warn(fmt.Sprintf("handle %s from %s error: %v", req, sender.RemoteAddr(), err))
+				return sender.Send(ExceptionCode, msg.Id, message.Missing)
+			}
+			content = mapToSlice(mblocks)
+		}
+
+		err = sender.Send(SnapshotBlocksCode, msg.Id, &message.SnapshotBlocks{
+			Blocks:    blocks,
+			RequestID: req.RequestID,
+			Content:   content,
+		})
+		if err != nil {
 			netLog.Error(fmt.Sprintf("send %d SnapshotBlocks to %s error: %v", len(blocks), sender.RemoteAddr(), err))
 			return
 		} else {
@@ -409,6 +462,10 @@ func (a *getAccountBlocksHandler) Handle(msg *p2p.Msg, sender Peer) (err error)
 		return
 	}
 
+	if err = req.Validate(); err != nil {
+		return
+	}
+
 	netLog.Info(fmt.Sprintf("receive %s from %s", req, sender.RemoteAddr()))
 
 	var block *ledger.AccountBlock
@@ -432,18 +489,7 @@ func (a *getAccountBlocksHandler) Handle(msg *p2p.Msg, sender Peer) (err error)
 	address := block.AccountAddress
 
 	// use for split
-	var from, to uint64
-	if req.Forward {
-		from = block.Height
-		to = from + req.Count - 1
-	} else {
-		to = block.Height
-		if to >= req.Count {
-			from = to - req.Count + 1
-		} else {
-			from = 0
-		}
-	}
+	from, to := req.Range(block.Height)
 
 	chunks := splitChunk(from, to, maxBlocksOneTrip)
 
@@ -458,7 +504,12 @@ func (a *getAccountBlocksHandler) Handle(msg *p2p.Msg, sender Peer) (err error)
 
 		monitor.LogEvent("net/handle", "GetAccountBlocks_Success")
 
-		if err = sender.SendAccountBlocks(blocks, msg.Id); err != nil {
+		err = sender.Send(AccountBlocksCode, msg.Id, &message.AccountBlocks{
+			Blocks:    blocks,
+			RequestID: req.RequestID,
+			Version:   sender.BlocksVersion(),
+		})
+		if err != nil {
 			netLog.Error(fmt.Sprintf("send %d AccountBlocks to %s error: %v", len(blocks), sender.RemoteAddr(), err))
 			return
 		} else {
@@ -1,22 +1,53 @@
 package message
 
 import (
+	"bytes"
 	"github.com/golang/protobuf/proto"
 	"github.com/pkg/errors"
 	"github.com/vitelabs/go-vite/common/types"
 	"github.com/vitelabs/go-vite/ledger"
 	"github.com/vitelabs/go-vite/vitepb"
+	"sort"
 	"strconv"
+	"sync"
 )
 
 var errDeserialize = errors.New("deserialize error")
+var errZeroCount = errors.New("count must be larger than 0")
+
+// checkLength return error if the fixed-size field is truncated or overlong
+func checkLength(field string, data []byte, size int) error {
+	if len(data) != size {
+		return errors.Errorf("%s: %s should be %d bytes, but got %d", errDeserialize, field, size, len(data))
+	}
+	return nil
+}
+
+// blockRange return the inclusive height range of count blocks start from height,
+// the block at height is always included, backward range stops at height 0
+func blockRange(height, count uint64, forward bool) (from, to uint64) {
+	if forward {
+		return height, height + count - 1
+	}
+
+	if height >= count {
+		return height - count + 1, height
+	}
+	return 0, height
+}
 
 // @section GetSnapshotBlocks
 
+// GetSnapshotBlocks request Count blocks include the From block,
+// the other Count-1 blocks are after From if Forward, else before From
 type GetSnapshotBlocks struct {
 	From    ledger.HashHeight
 	Count   uint64
 	Forward bool
+	// echoed by the response, so it can be routed to the waiting caller
+	RequestID uint64
+	// the account blocks referred by SnapshotContent of the snapshot blocks are responded too, for fast sync
+	IncludeContent bool
 }
 
 func (b *GetSnapshotBlocks) String() string {
@@ -30,6 +61,18 @@ func (b *GetSnapshotBlocks) String() string {
 	return "GetSnapshotBlocks<" + from + "/" + strconv.FormatUint(b.Count, 10) + "/" + strconv.FormatBool(b.Forward) + ">"
 }
 
+func (b *GetSnapshotBlocks) Validate() error {
+	if b.Count == 0 {
+		return errZeroCount
+	}
+	return nil
+}
+
+// Range return the inclusive height range of the request, height is the height of the From block
+func (b *GetSnapshotBlocks) Range(height uint64) (from, to uint64) {
+	return blockRange(height, b.Count, b.Forward)
+}
+
 func (b *GetSnapshotBlocks) Serialize() ([]byte, error) {
 	pb := new(vitepb.GetSnapshotBlocks)
 	pb.From = &vitepb.BlockID{
@@ -38,6 +81,8 @@ func (b *GetSnapshotBlocks) Serialize() ([]byte, error) {
 	}
 	pb.Count = b.Count
 	pb.Forward = b.Forward
+	pb.RequestID = b.RequestID
+	pb.IncludeContent = b.IncludeContent
 
 	return proto.Marshal(pb)
 }
@@ -61,6 +106,8 @@ func (b *GetSnapshotBlocks) Deserialize(buf []byte) error {
 
 	b.Count = pb.Count
 	b.Forward = pb.Forward
+	b.RequestID = pb.RequestID
+	b.IncludeContent = pb.IncludeContent
 
 	return nil
 }
@@ -68,7 +115,10 @@ func (b *GetSnapshotBlocks) Deserialize(buf []byte) error {
 // @section SnapshotBlocks
 
 type SnapshotBlocks struct {
-	Blocks []*ledger.SnapshotBlock
+	Blocks    []*ledger.SnapshotBlock
+	RequestID uint64 // the same as GetSnapshotBlocks
+	// account blocks referred by SnapshotContent of Blocks, only if GetSnapshotBlocks.IncludeContent
+	Content []*ledger.AccountBlock
 }
 
 func (b *SnapshotBlocks) String() string {
@@ -83,6 +133,14 @@ func (b *SnapshotBlocks) Serialize() ([]byte, error) {
 	for i, block := range b.Blocks {
 		pb.Blocks[i] = block.Proto()
 	}
+	pb.RequestID = b.RequestID
+
+	if len(b.Content) > 0 {
+		pb.Content = make([]*vitepb.AccountBlock, len(b.Content))
+		for i, block := range b.Content {
+			pb.Content[i] = block.Proto()
+		}
+	}
 
 	return proto.Marshal(pb)
 }
@@ -101,10 +159,30 @@ func (b *SnapshotBlocks) Deserialize(buf []byte) error {
 		block.DeProto(bp)
 		b.Blocks[i] = block
 	}
+	b.RequestID = pb.RequestID
+
+	b.Content = nil
+	if len(pb.Content) > 0 {
+		b.Content = make([]*ledger.AccountBlock, len(pb.Content))
+		for i, abp := range pb.Content {
+			block := new(ledger.AccountBlock)
+			block.DeProto(abp)
+			b.Content[i] = block
+		}
+	}
 
 	return nil
 }
 
+// SubLedger bundle the snapshot blocks and the account blocks they refer
+func (b *SnapshotBlocks) SubLedger() *SubLedger {
+	return &SubLedger{
+		SBlocks:   b.Blocks,
+		ABlocks:   b.Content,
+		AblockNum: uint64(len(b.Content)),
+	}
+}
+
 // @section SubLedger
 
 type SubLedger struct {
@@ -163,11 +241,13 @@ func (s *SubLedger) Deserialize(buf []byte) error {
 
 // @section GetAccountBlocks
 
+// GetAccountBlocks request Count blocks include the From block, same as GetSnapshotBlocks
 type GetAccountBlocks struct {
-	Address types.Address
-	From    ledger.HashHeight
-	Count   uint64
-	Forward bool
+	Address   types.Address
+	From      ledger.HashHeight
+	Count     uint64
+	Forward   bool
+	RequestID uint64
 }
 
 func (b *GetAccountBlocks) String() string {
@@ -181,6 +261,33 @@ func (b *GetAccountBlocks) String() string {
 	return "GetAccountBlocks<" + from + "/" + strconv.FormatUint(b.Count, 10) + "/" + strconv.FormatBool(b.Forward) + ">"
 }
 
+func (b *GetAccountBlocks) Validate() error {
+	if b.Count == 0 {
+		return errZeroCount
+	}
+	return nil
+}
+
+// Range return the inclusive height range of the request, height is the height of the From block
+func (b *GetAccountBlocks) Range(height uint64) (from, to uint64) {
+	return blockRange(height, b.Count, b.Forward)
+}
+
+// CanServe check whether the From block is available locally before scanning the chain,
+// head is the height of the latest block of the account, hasHash report whether the block of hash exists.
+// From is looked up by hash if the hash is set, otherwise by height, invalid request can`t be served
+func (b *GetAccountBlocks) CanServe(head uint64, hasHash func(types.Hash) bool) bool {
+	if b.Validate() != nil {
+		return false
+	}
+
+	if b.From.Hash != types.ZERO_HASH {
+		return hasHash(b.From.Hash)
+	}
+
+	return b.From.Height <= head
+}
+
 func (b *GetAccountBlocks) Serialize() ([]byte, error) {
 	pb := new(vitepb.GetAccountBlocks)
 	pb.Address = b.Address[:]
@@ -190,6 +297,7 @@ func (b *GetAccountBlocks) Serialize() ([]byte, error) {
 	}
 	pb.Count = b.Count
 	pb.Forward = b.Forward
+	pb.RequestID = b.RequestID
 
 	return proto.Marshal(pb)
 }
@@ -205,6 +313,12 @@ func (b *GetAccountBlocks) Deserialize(buf []byte) error {
 	if pb.From == nil {
 		return errDeserialize
 	}
+	if err = checkLength("From.Hash", pb.From.Hash, types.HashSize); err != nil {
+		return err
+	}
+	if err = checkLength("Address", pb.Address, types.AddressSize); err != nil {
+		return err
+	}
 
 	b.From = ledger.HashHeight{
 		Height: pb.From.Height,
@@ -213,6 +327,7 @@ func (b *GetAccountBlocks) Deserialize(buf []byte) error {
 
 	b.Count = pb.Count
 	b.Forward = pb.Forward
+	b.RequestID = pb.RequestID
 	copy(b.Address[:], pb.Address)
 
 	return nil
@@ -220,27 +335,174 @@ func (b *GetAccountBlocks) Deserialize(buf []byte) error {
 
 // @section AccountBlocks
 
+// AccountBlocks of nil and empty Blocks are the same, Deserialize always return non-nil Blocks
 type AccountBlocks struct {
-	Blocks []*ledger.AccountBlock
+	Blocks    []*ledger.AccountBlock
+	RequestID uint64 // the same as GetAccountBlocks
+	// encoding version negotiated with peer in handshake, 0 is the bare protobuf understood by all nodes
+	Version byte
 }
 
 func (a *AccountBlocks) String() string {
 	return "AccountBlocks<" + strconv.FormatInt(int64(len(a.Blocks)), 10) + ">"
 }
 
-func (a *AccountBlocks) Serialize() ([]byte, error) {
+// proto skip nil blocks, they can`t be encoded
+func (a *AccountBlocks) proto() *vitepb.AccountBlocks {
 	pb := new(vitepb.AccountBlocks)
 
-	pb.Blocks = make([]*vitepb.AccountBlock, len(a.Blocks))
+	pb.Blocks = make([]*vitepb.AccountBlock, 0, len(a.Blocks))
+
+	for _, block := range a.Blocks {
+		if block != nil {
+			pb.Blocks = append(pb.Blocks, block.Proto())
+		}
+	}
+	pb.RequestID = a.RequestID
+
+	return pb
+}
+
+// Clone deep copy the blocks, so the clone can be forwarded or cached and mutated without affecting a
+func (a *AccountBlocks) Clone() *AccountBlocks {
+	c := &AccountBlocks{
+		Blocks:    make([]*ledger.AccountBlock, len(a.Blocks)),
+		RequestID: a.RequestID,
+		Version:   a.Version,
+	}
 
 	for i, block := range a.Blocks {
-		pb.Blocks[i] = block.Proto()
+		if block != nil {
+			c.Blocks[i] = block.Copy()
+		}
 	}
 
-	return proto.Marshal(pb)
+	return c
+}
+
+// ByAddress group the blocks by AccountAddress, blocks of each address are sorted by height ascending,
+// nil blocks are skipped
+func (a *AccountBlocks) ByAddress() map[types.Address][]*ledger.AccountBlock {
+	m := make(map[types.Address][]*ledger.AccountBlock)
+	for _, block := range a.Blocks {
+		if block != nil {
+			m[block.AccountAddress] = append(m[block.AccountAddress], block)
+		}
+	}
+
+	for _, blocks := range m {
+		sort.SliceStable(blocks, func(i, j int) bool {
+			return blocks[i].Height < blocks[j].Height
+		})
+	}
+
+	return m
+}
+
+var errHashMismatch = errors.New("hash of block mismatch")
+var errNilBlock = errors.New("nil block")
+
+// VerifyHashes recompute the hash of each block by concurrency goroutines, the result has the same length as
+// Blocks, error of the block whose hash mismatch is at the same index, nil means the hash is right
+func (a *AccountBlocks) VerifyHashes(concurrency int) []error {
+	errs := make([]error, len(a.Blocks))
+
+	if concurrency > len(a.Blocks) {
+		concurrency = len(a.Blocks)
+	}
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	indexes := make(chan int, len(a.Blocks))
+	for i := range a.Blocks {
+		indexes <- i
+	}
+	close(indexes)
+
+	var wg sync.WaitGroup
+	wg.Add(concurrency)
+	for i := 0; i < concurrency; i++ {
+		go func() {
+			defer wg.Done()
+
+			// every goroutine write different indexes of errs
+			for i := range indexes {
+				block := a.Blocks[i]
+				if block == nil {
+					errs[i] = errNilBlock
+				} else if hash := block.ComputeHash(); hash != block.Hash {
+					errs[i] = errors.Wrapf(errHashMismatch, "block %s should be %s", block.Hash, hash)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	return errs
+}
+
+// AccountBlocksVersion is the latest version of AccountBlocks, written as the leading byte of serialized
+// AccountBlocks of version above 0, increase it when the encoding of AccountBlock changes.
+// Version is announced in handshake, peers announced nothing get version 0, the bare protobuf
+const AccountBlocksVersion byte = 1
+
+var errUnknownVersion = errors.New("unknown AccountBlocks version")
+
+func (a *AccountBlocks) Serialize() ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if err := a.SerializeTo(buf); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// SerializeTo is the same as Serialize but write the bytes to buf, nothing is written if error
+func (a *AccountBlocks) SerializeTo(buf *bytes.Buffer) error {
+	if a.Version > AccountBlocksVersion {
+		return errors.Wrapf(errUnknownVersion, "version %d", a.Version)
+	}
+
+	start := buf.Len()
+	if a.Version > 0 {
+		buf.WriteByte(a.Version)
+	}
+
+	if err := MarshalTo(a.proto(), buf); err != nil {
+		buf.Truncate(start)
+		return err
+	}
+
+	return nil
 }
 
+// Deserialize treat empty buf as AccountBlocks of no blocks, which is encoded to nothing by protobuf.
+// A leading byte of field number 0 can`t start protobuf, so it`s the version, else buf is version 0,
+// the protobuf from peers not negotiated version, starting with a field tag, 0x0a of Blocks mostly
 func (a *AccountBlocks) Deserialize(buf []byte) error {
+	if len(buf) == 0 {
+		a.Blocks = []*ledger.AccountBlock{}
+		a.RequestID = 0
+		a.Version = 0
+		return nil
+	}
+
+	if buf[0]>>3 != 0 {
+		a.Version = 0
+		return a.deserializeProto(buf)
+	}
+
+	switch buf[0] {
+	case 1:
+		a.Version = 1
+		return a.deserializeProto(buf[1:])
+	default:
+		return errors.Wrapf(errUnknownVersion, "version %d", buf[0])
+	}
+}
+
+func (a *AccountBlocks) deserializeProto(buf []byte) error {
 	pb := new(vitepb.AccountBlocks)
 
 	err := proto.Unmarshal(buf, pb)
@@ -254,6 +516,7 @@ func (a *AccountBlocks) Deserialize(buf []byte) error {
 		block.DeProto(bp)
 		a.Blocks[i] = block
 	}
+	a.RequestID = pb.RequestID
 
 	return nil
 }
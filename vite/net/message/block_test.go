@@ -1,11 +1,15 @@
 package message
 
 import (
+	"bytes"
 	crand "crypto/rand"
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
 	"github.com/vitelabs/go-vite/common/types"
 	"github.com/vitelabs/go-vite/ledger"
 	"math/big"
 	mrand "math/rand"
+	"runtime"
 	"testing"
 	"time"
 )
@@ -21,6 +25,7 @@ func mockGetAccountBlocks() GetAccountBlocks {
 	ga.Forward = mrand.Intn(10) > 5
 
 	crand.Read(ga.Address[:])
+	ga.RequestID = mrand.Uint64()
 
 	return ga
 }
@@ -46,6 +51,10 @@ func equalGetAccountBlocks(g, g2 GetAccountBlocks) bool {
 		return false
 	}
 
+	if g.RequestID != g2.RequestID {
+		return false
+	}
+
 	return true
 }
 
@@ -68,6 +77,59 @@ func TestGetAccountBlocks_Serialize(t *testing.T) {
 	}
 }
 
+func TestGetAccountBlocks_Deserialize_truncated(t *testing.T) {
+	ga := mockGetAccountBlocks()
+	buf, err := ga.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// prefix can`t hold both the address and the hash must return error, other prefixes must not panic
+	for i := 0; i < len(buf); i++ {
+		var g GetAccountBlocks
+		if err = g.Deserialize(buf[:i]); err == nil && i < types.AddressSize+types.HashSize {
+			t.Errorf("truncated buffer of %d/%d bytes should return error", i, len(buf))
+		}
+	}
+}
+
+func FuzzGetAccountBlocksDeserialize(f *testing.F) {
+	for i := 0; i < 3; i++ {
+		ga := mockGetAccountBlocks()
+		buf, err := ga.Serialize()
+		if err != nil {
+			f.Fatal(err)
+		}
+
+		f.Add(buf)
+		f.Add(buf[:len(buf)/2])
+		f.Add(buf[:len(buf)-1])
+	}
+	f.Add([]byte{})
+	f.Add([]byte{0xff, 0xff, 0xff, 0xff})
+	f.Add([]byte{0x0a, 0x05, 0x0a, 0x03, 1, 2, 3})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var g GetAccountBlocks
+		if err := g.Deserialize(data); err != nil {
+			return
+		}
+
+		// accepted message should survive the round-trip
+		buf, err := g.Serialize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var g2 GetAccountBlocks
+		if err = g2.Deserialize(buf); err != nil {
+			t.Fatal(err)
+		}
+		if !equalGetAccountBlocks(g, g2) {
+			t.Errorf("GetAccountBlocks changed after round-trip")
+		}
+	})
+}
+
 func mockGetSnapshotBlocks() GetSnapshotBlocks {
 	var ga GetSnapshotBlocks
 
@@ -76,6 +138,8 @@ func mockGetSnapshotBlocks() GetSnapshotBlocks {
 
 	ga.Count = mrand.Uint64()
 	ga.Forward = mrand.Intn(10) > 5
+	ga.RequestID = mrand.Uint64()
+	ga.IncludeContent = mrand.Intn(10) > 5
 
 	return ga
 }
@@ -97,6 +161,14 @@ func equalGetSnapshotBlocks(g, g2 GetSnapshotBlocks) bool {
 		return false
 	}
 
+	if g.RequestID != g2.RequestID {
+		return false
+	}
+
+	if g.IncludeContent != g2.IncludeContent {
+		return false
+	}
+
 	return true
 }
 
@@ -151,6 +223,7 @@ func mockAccountBlocks() AccountBlocks {
 			Signature:      nil,
 		}
 	}
+	ga.RequestID = mrand.Uint64()
 
 	return ga
 }
@@ -160,6 +233,10 @@ func equalAccountBlocks(g, g2 AccountBlocks) bool {
 		return false
 	}
 
+	if g.RequestID != g2.RequestID {
+		return false
+	}
+
 	return true
 }
 
@@ -182,6 +259,223 @@ func TestAccountBlocks_Deserialize(t *testing.T) {
 	}
 }
 
+func TestAccountBlocks_Deserialize_version(t *testing.T) {
+	a := mockAccountBlocks()
+
+	// v0 payload is the bare protobuf sent by nodes don`t know version
+	data, err := proto.Marshal(a.proto())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data[0] != 0x0a {
+		t.Fatalf("v0 payload should start with the tag of Blocks, but got %#x", data[0])
+	}
+	// v1 payload is the version byte followed by protobuf
+	v1 := append([]byte{1}, data...)
+
+	for version, payload := range map[byte][]byte{0: data, 1: v1} {
+		var a2 AccountBlocks
+		if err = a2.Deserialize(payload); err != nil {
+			t.Fatal(err)
+		}
+		if !equalAccountBlocks(a, a2) || a2.Version != version {
+			t.Errorf("AccountBlocks changed after decoding v%d payload", version)
+		}
+	}
+
+	// version byte is written only if it`s negotiated
+	buf, err := a.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, data) {
+		t.Errorf("should write bare protobuf of version 0")
+	}
+
+	a.Version = AccountBlocksVersion
+	if buf, err = a.Serialize(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, v1) {
+		t.Errorf("should write version %d followed by protobuf", AccountBlocksVersion)
+	}
+
+	if err = new(AccountBlocks).Deserialize(append([]byte{AccountBlocksVersion + 1}, data...)); errors.Cause(err) != errUnknownVersion {
+		t.Errorf("should return errUnknownVersion, but got %v", err)
+	}
+
+	a.Version = AccountBlocksVersion + 1
+	w := bytes.NewBufferString("prefix")
+	if err = a.SerializeTo(w); errors.Cause(err) != errUnknownVersion || w.String() != "prefix" {
+		t.Errorf("should return errUnknownVersion and write nothing, but got %v", err)
+	}
+}
+
+func TestAccountBlocks_Clone(t *testing.T) {
+	now := time.Now()
+	a := &AccountBlocks{
+		Blocks: []*ledger.AccountBlock{
+			{
+				Height:    1,
+				Amount:    big.NewInt(10),
+				Data:      []byte{1, 2, 3},
+				PublicKey: []byte{4, 5, 6},
+				Timestamp: &now,
+			},
+			nil,
+		},
+		RequestID: 7,
+	}
+
+	c := a.Clone()
+	if c.RequestID != a.RequestID || len(c.Blocks) != len(a.Blocks) || c.Blocks[1] != nil {
+		t.Fatalf("clone should be the same as origin")
+	}
+
+	b := c.Blocks[0]
+	if b == a.Blocks[0] {
+		t.Fatal("blocks should not be shared")
+	}
+	b.Height = 2
+	b.Amount.SetInt64(20)
+	b.Data[0] = 9
+	b.PublicKey[0] = 9
+	*b.Timestamp = now.Add(time.Hour)
+	c.Blocks[1] = b
+
+	origin := a.Blocks[0]
+	if origin.Height != 1 || origin.Amount.Int64() != 10 || origin.Data[0] != 1 || origin.PublicKey[0] != 4 || !origin.Timestamp.Equal(now) {
+		t.Errorf("origin block changed after mutating the clone")
+	}
+	if a.Blocks[1] != nil {
+		t.Errorf("origin blocks changed after mutating the clone")
+	}
+}
+
+func TestAccountBlocks_SerializeTo(t *testing.T) {
+	buf := new(bytes.Buffer)
+
+	for i := 0; i < 3; i++ {
+		a := mockAccountBlocks()
+
+		data, err := a.Serialize()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		buf.Reset()
+		if err = a.SerializeTo(buf); err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(data, buf.Bytes()) {
+			t.Fatal("SerializeTo should write the same bytes as Serialize")
+		}
+
+		var a2 AccountBlocks
+		if err = a2.Deserialize(buf.Bytes()); err != nil {
+			t.Fatal(err)
+		}
+		if !equalAccountBlocks(a, a2) {
+			t.Fatal("AccountBlocks changed after SerializeTo")
+		}
+	}
+}
+
+func BenchmarkAccountBlocks_Serialize(b *testing.B) {
+	// use the same blocks, mockAccountBlocks returns random count of blocks
+	a := mockAccountBlocks()
+
+	b.Run("Serialize", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := a.Serialize(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("SerializeTo", func(b *testing.B) {
+		buf := new(bytes.Buffer)
+
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			buf.Reset()
+			if err := a.SerializeTo(buf); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func mockHashedAccountBlocks(n int) *AccountBlocks {
+	a := &AccountBlocks{Blocks: make([]*ledger.AccountBlock, n)}
+	for i := range a.Blocks {
+		block := &ledger.AccountBlock{
+			Height:    uint64(i + 1),
+			Amount:    big.NewInt(int64(i)),
+			Fee:       new(big.Int),
+			Data:      []byte{byte(i)},
+			Timestamp: &time.Time{},
+		}
+		block.Hash = block.ComputeHash()
+		a.Blocks[i] = block
+	}
+	return a
+}
+
+func TestAccountBlocks_VerifyHashes(t *testing.T) {
+	a := mockHashedAccountBlocks(20)
+
+	const tampered = 7
+	a.Blocks[tampered].Data = []byte("tampered")
+
+	for _, concurrency := range []int{0, 1, 4, 100} {
+		errs := a.VerifyHashes(concurrency)
+		if len(errs) != len(a.Blocks) {
+			t.Fatalf("should return %d errors, but got %d", len(a.Blocks), len(errs))
+		}
+
+		for i, err := range errs {
+			if i == tampered {
+				if errors.Cause(err) != errHashMismatch {
+					t.Errorf("concurrency %d: tampered block should fail with errHashMismatch, but got %v", concurrency, err)
+				}
+			} else if err != nil {
+				t.Errorf("concurrency %d: block %d should pass, but got %v", concurrency, i, err)
+			}
+		}
+	}
+
+	if errs := (&AccountBlocks{Blocks: []*ledger.AccountBlock{nil}}).VerifyHashes(1); errs[0] != errNilBlock {
+		t.Errorf("nil block should fail with errNilBlock, but got %v", errs[0])
+	}
+	if errs := new(AccountBlocks).VerifyHashes(4); len(errs) != 0 {
+		t.Errorf("empty blocks should return no errors, but got %d", len(errs))
+	}
+}
+
+func BenchmarkAccountBlocks_VerifyHashes(b *testing.B) {
+	a := mockHashedAccountBlocks(1000)
+
+	b.Run("serial", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for _, block := range a.Blocks {
+				if block.ComputeHash() != block.Hash {
+					b.Fatal("hash mismatch")
+				}
+			}
+		}
+	})
+
+	b.Run("concurrent", func(b *testing.B) {
+		concurrency := runtime.NumCPU()
+		for i := 0; i < b.N; i++ {
+			a.VerifyHashes(concurrency)
+		}
+	})
+}
+
 func TestSubLedger_Serialize(t *testing.T) {
 	s := new(SubLedger)
 	buf, err := s.Serialize()
@@ -195,3 +489,199 @@ func TestSubLedger_Serialize(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func TestSnapshotBlocks_Content(t *testing.T) {
+	addr1, addr2 := types.Address{1}, types.Address{2}
+
+	// account chains of addr1 and addr2
+	var content []*ledger.AccountBlock
+	for _, addr := range []types.Address{addr1, addr2} {
+		var prev types.Hash
+		for h := uint64(1); h <= 2; h++ {
+			block := &ledger.AccountBlock{
+				AccountAddress: addr,
+				Height:         h,
+				PrevHash:       prev,
+				Amount:         new(big.Int),
+				Fee:            new(big.Int),
+				Timestamp:      &time.Time{},
+			}
+			block.Hash = block.ComputeHash()
+			prev = block.Hash
+			content = append(content, block)
+		}
+	}
+
+	now := time.Now()
+	sb := &ledger.SnapshotBlock{
+		Height:    10,
+		Timestamp: &now,
+		SnapshotContent: ledger.SnapshotContent{
+			addr1: {Height: 2, Hash: content[1].Hash},
+			addr2: {Height: 2, Hash: content[3].Hash},
+		},
+	}
+	sb.Hash = sb.ComputeHash()
+
+	b := &SnapshotBlocks{Blocks: []*ledger.SnapshotBlock{sb}, RequestID: 7, Content: content}
+	buf, err := b.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b2 := new(SnapshotBlocks)
+	if err = b2.Deserialize(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if b2.RequestID != 7 || len(b2.Blocks) != 1 || b2.Blocks[0].Hash != sb.Hash {
+		t.Fatalf("snapshot blocks changed after round trip")
+	}
+	for addr, hh := range sb.SnapshotContent {
+		if got := b2.Blocks[0].SnapshotContent[addr]; got == nil || *got != *hh {
+			t.Errorf("snapshot content of %s should be %v, but got %v", addr, hh, got)
+		}
+	}
+
+	sub := b2.SubLedger()
+	if len(sub.SBlocks) != 1 || sub.AblockNum != 4 || len(sub.ABlocks) != 4 {
+		t.Fatalf("should bundle 1 snapshot block and 4 account blocks, but got %s", sub)
+	}
+	for i, block := range sub.ABlocks {
+		if block.Hash != content[i].Hash || block.AccountAddress != content[i].AccountAddress || block.Height != content[i].Height {
+			t.Errorf("account block %d changed after round trip", i)
+		}
+	}
+
+	// no content is responded without IncludeContent
+	buf, _ = (&SnapshotBlocks{Blocks: b.Blocks}).Serialize()
+	if err = b2.Deserialize(buf); err != nil || b2.Content != nil {
+		t.Errorf("should have no content, but got %d blocks, %v", len(b2.Content), err)
+	}
+}
+
+func TestGetSnapshotBlocks_Range(t *testing.T) {
+	cases := []struct {
+		height   uint64
+		count    uint64
+		forward  bool
+		from, to uint64
+	}{
+		{10, 1, true, 10, 10},
+		{10, 5, true, 10, 14},
+		{10, 1, false, 10, 10},
+		{10, 5, false, 6, 10},
+		{3, 5, false, 0, 3},
+	}
+
+	for _, c := range cases {
+		req := &GetSnapshotBlocks{Count: c.count, Forward: c.forward}
+		from, to := req.Range(c.height)
+
+		if from != c.from || to != c.to {
+			t.Errorf("%d/%d/%v: should be [%d, %d], but got [%d, %d]", c.height, c.count, c.forward, c.from, c.to, from, to)
+		}
+		if from > c.height || to < c.height {
+			t.Errorf("%d/%d/%v: should include the From block", c.height, c.count, c.forward)
+		}
+		if total := to - from + 1; total != c.count && from != 0 {
+			t.Errorf("%d/%d/%v: should have %d blocks, but got %d", c.height, c.count, c.forward, c.count, total)
+		}
+	}
+}
+
+func TestGetSnapshotBlocks_Validate(t *testing.T) {
+	if err := (&GetSnapshotBlocks{Count: 0}).Validate(); err == nil {
+		t.Error("zero count should be invalid")
+	}
+	if err := (&GetSnapshotBlocks{Count: 1}).Validate(); err != nil {
+		t.Error(err)
+	}
+	if err := (&GetAccountBlocks{Count: 0}).Validate(); err == nil {
+		t.Error("zero count should be invalid")
+	}
+}
+
+func TestAccountBlocks_ByAddress(t *testing.T) {
+	addr1, addr2 := types.Address{1}, types.Address{2}
+	a := &AccountBlocks{
+		Blocks: []*ledger.AccountBlock{
+			{AccountAddress: addr1, Height: 3},
+			{AccountAddress: addr2, Height: 1},
+			nil,
+			{AccountAddress: addr1, Height: 1},
+			{AccountAddress: addr2, Height: 2},
+			{AccountAddress: addr1, Height: 2},
+		},
+	}
+
+	m := a.ByAddress()
+	if len(m) != 2 {
+		t.Fatalf("should group into 2 addresses, but got %d", len(m))
+	}
+
+	for addr, n := range map[types.Address]int{addr1: 3, addr2: 2} {
+		blocks := m[addr]
+		if len(blocks) != n {
+			t.Fatalf("%s should have %d blocks, but got %d", addr, n, len(blocks))
+		}
+		for i, block := range blocks {
+			if block.AccountAddress != addr || block.Height != uint64(i+1) {
+				t.Errorf("block %d of %s should be at height %d, but got %s at %d", i, addr, i+1, block.AccountAddress, block.Height)
+			}
+		}
+	}
+}
+
+func TestGetAccountBlocks_CanServe(t *testing.T) {
+	known := types.Hash{1}
+	hasHash := func(hash types.Hash) bool {
+		return hash == known
+	}
+
+	cases := []struct {
+		name string
+		req  GetAccountBlocks
+		can  bool
+	}{
+		{"by height", GetAccountBlocks{From: ledger.HashHeight{Height: 10}, Count: 5}, true},
+		{"by hash", GetAccountBlocks{From: ledger.HashHeight{Hash: known, Height: 100}, Count: 5}, true},
+		{"height above head", GetAccountBlocks{From: ledger.HashHeight{Height: 11}, Count: 5}, false},
+		{"unknown hash", GetAccountBlocks{From: ledger.HashHeight{Hash: types.Hash{2}, Height: 1}, Count: 5}, false},
+		{"zero count", GetAccountBlocks{From: ledger.HashHeight{Height: 1}}, false},
+	}
+
+	for _, c := range cases {
+		if can := c.req.CanServe(10, hasHash); can != c.can {
+			t.Errorf("%s: CanServe should be %v", c.name, c.can)
+		}
+	}
+}
+
+func TestAccountBlocks_empty(t *testing.T) {
+	for _, blocks := range [][]*ledger.AccountBlock{nil, {}, {nil}} {
+		a := &AccountBlocks{Blocks: blocks, RequestID: 3}
+
+		buf, err := a.Serialize()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		a2 := new(AccountBlocks)
+		if err = a2.Deserialize(buf); err != nil {
+			t.Fatal(err)
+		}
+		if a2.Blocks == nil || len(a2.Blocks) != 0 || a2.RequestID != 3 {
+			t.Errorf("%v should be decoded to empty blocks, but got %v", blocks, a2.Blocks)
+		}
+
+		if c := a.Clone(); c.Blocks == nil || len(c.Blocks) != len(blocks) {
+			t.Errorf("clone of %v should have non-nil blocks", blocks)
+		}
+	}
+
+	a := &AccountBlocks{RequestID: 1}
+	if err := a.Deserialize(nil); err != nil || a.Blocks == nil || len(a.Blocks) != 0 || a.RequestID != 0 {
+		t.Errorf("empty payload should be decoded to empty blocks, but got %v %v", a.Blocks, err)
+	}
+}
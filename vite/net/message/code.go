@@ -0,0 +1,70 @@
+package message
+
+import (
+	"fmt"
+
+	"github.com/vitelabs/go-vite/p2p"
+)
+
+// Cmd is the code of a message, values must be the same as ViteCmd of package net
+type Cmd = p2p.Cmd
+
+const (
+	GetSnapshotBlocksCode Cmd = 4
+	GetAccountBlocksCode  Cmd = 10
+	SubLedgerCode         Cmd = 15
+	SnapshotBlocksCode    Cmd = 17
+	AccountBlocksCode     Cmd = 20
+)
+
+// Message can tell its code, so the receiver can decode it without knowing the type out of band
+type Message interface {
+	p2p.Serializable
+	Code() Cmd
+}
+
+func (b *GetSnapshotBlocks) Code() Cmd {
+	return GetSnapshotBlocksCode
+}
+
+func (b *GetAccountBlocks) Code() Cmd {
+	return GetAccountBlocksCode
+}
+
+func (s *SubLedger) Code() Cmd {
+	return SubLedgerCode
+}
+
+func (b *SnapshotBlocks) Code() Cmd {
+	return SnapshotBlocksCode
+}
+
+func (a *AccountBlocks) Code() Cmd {
+	return AccountBlocksCode
+}
+
+// Decode construct the message of cmd, and deserialize data into it
+func Decode(cmd Cmd, data []byte) (Message, error) {
+	var msg Message
+
+	switch cmd {
+	case GetSnapshotBlocksCode:
+		msg = new(GetSnapshotBlocks)
+	case GetAccountBlocksCode:
+		msg = new(GetAccountBlocks)
+	case SubLedgerCode:
+		msg = new(SubLedger)
+	case SnapshotBlocksCode:
+		msg = new(SnapshotBlocks)
+	case AccountBlocksCode:
+		msg = new(AccountBlocks)
+	default:
+		return nil, fmt.Errorf("unknown message code %d", cmd)
+	}
+
+	if err := msg.Deserialize(data); err != nil {
+		return nil, err
+	}
+
+	return msg, nil
+}
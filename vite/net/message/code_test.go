@@ -0,0 +1,68 @@
+package message
+
+import (
+	"testing"
+	"time"
+
+	"github.com/vitelabs/go-vite/ledger"
+)
+
+func TestDecode(t *testing.T) {
+	gs := mockGetSnapshotBlocks()
+	ga := mockGetAccountBlocks()
+	ab := mockAccountBlocks()
+	now := time.Now()
+	sl := &SubLedger{
+		SBlocks:   []*ledger.SnapshotBlock{{Height: 10, Timestamp: &now}},
+		ABlocks:   ab.Blocks,
+		AblockNum: uint64(len(ab.Blocks)),
+	}
+	sb := &SnapshotBlocks{
+		Blocks: []*ledger.SnapshotBlock{{Height: 10, Timestamp: &now}, {Height: 11, Timestamp: &now}},
+	}
+
+	msgs := []Message{&gs, &ga, &ab, sl, sb}
+
+	for _, msg := range msgs {
+		buf, err := msg.Serialize()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		m, err := Decode(msg.Code(), buf)
+		if err != nil {
+			t.Fatalf("decode %T error: %v", msg, err)
+		}
+
+		if m.Code() != msg.Code() {
+			t.Fatalf("decode %T as %T", msg, m)
+		}
+
+		switch m := m.(type) {
+		case *GetSnapshotBlocks:
+			if !equalGetSnapshotBlocks(gs, *m) {
+				t.Errorf("GetSnapshotBlocks not equal")
+			}
+		case *GetAccountBlocks:
+			if !equalGetAccountBlocks(ga, *m) {
+				t.Errorf("GetAccountBlocks not equal")
+			}
+		case *AccountBlocks:
+			if !equalAccountBlocks(ab, *m) {
+				t.Errorf("AccountBlocks not equal")
+			}
+		case *SubLedger:
+			if len(m.SBlocks) != 1 || len(m.ABlocks) != len(ab.Blocks) || m.AblockNum != sl.AblockNum {
+				t.Errorf("SubLedger not equal: %s", m)
+			}
+		case *SnapshotBlocks:
+			if len(m.Blocks) != 2 || m.Blocks[1].Height != 11 {
+				t.Errorf("SnapshotBlocks not equal: %s", m)
+			}
+		}
+	}
+
+	if _, err := Decode(127, nil); err == nil {
+		t.Error("should fail to decode unknown code")
+	}
+}
@@ -18,6 +18,7 @@ const (
 	UnMatchedMsgVersion
 	UnIdenticalGenesis
 	FileTransDone
+	TooManyRequests // too many requests of you are being served
 )
 
 var exception = [...]string{
@@ -31,6 +32,7 @@ var exception = [...]string{
 	UnMatchedMsgVersion: "UnMatchedMsgVersion",
 	UnIdenticalGenesis:  "UnIdenticalGenesis",
 	FileTransDone:       "FileTransDone",
+	TooManyRequests:     "TooManyRequests",
 }
 
 func (exp Exception) String() string {
@@ -54,7 +56,7 @@ func (exp Exception) Deserialize(buf []byte) error {
 var errDesExpIncpData = errors.New("parse incomplete data")
 
 func DeserializeException(buf []byte) (e Exception, err error) {
-	u64, n := binary.Varint(buf)
+	u64, n := binary.Uvarint(buf)
 	if n != len(buf) {
 		err = errDesExpIncpData
 		return
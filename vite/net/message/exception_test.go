@@ -17,3 +17,21 @@ func TestException_Deserialize(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestDeserializeException(t *testing.T) {
+	for _, e := range []Exception{Missing, FileTransDone, TooManyRequests} {
+		buf, err := e.Serialize()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		exp, err := DeserializeException(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if exp != e {
+			t.Errorf("should be %s, but got %s", e, exp)
+		}
+	}
+}
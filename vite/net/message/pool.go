@@ -0,0 +1,45 @@
+package message
+
+import (
+	"bytes"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// MaxPooledBufferSize is the capacity limit of the encoding buffers kept in pool,
+// a buffer grown beyond it by a huge message will be dropped, so it won`t pin memory
+var MaxPooledBufferSize = 1 << 20
+
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		return proto.NewBuffer(make([]byte, 0, 1024))
+	},
+}
+
+func getBuffer() *proto.Buffer {
+	return bufferPool.Get().(*proto.Buffer)
+}
+
+func putBuffer(buf *proto.Buffer) {
+	if cap(buf.Bytes()) > MaxPooledBufferSize {
+		return
+	}
+
+	buf.Reset()
+	bufferPool.Put(buf)
+}
+
+// MarshalTo encode pb with a pooled buffer and write the bytes to buf,
+// so the caller can reuse buf across messages instead of allocating a new slice every time
+func MarshalTo(pb proto.Message, buf *bytes.Buffer) error {
+	pbuf := getBuffer()
+	defer putBuffer(pbuf)
+
+	if err := pbuf.Marshal(pb); err != nil {
+		return err
+	}
+
+	_, err := buf.Write(pbuf.Bytes())
+	return err
+}
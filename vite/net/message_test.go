@@ -15,6 +15,7 @@ import (
 	"math/rand"
 	net2 "net"
 	"path/filepath"
+	"sync"
 	"testing"
 	"time"
 )
@@ -210,10 +211,88 @@ func (m *mock_Peer) Send(code ViteCmd, msgId uint64, payload p2p.Serializable) (
 	return nil
 }
 
+func (m *mock_Peer) BlocksVersion() byte {
+	return 0
+}
+
 func (m *mock_Peer) RemoteAddr() *net2.TCPAddr {
 	return nil
 }
 
+func (m *mock_Peer) Disconnect(reason p2p.DiscReason) {
+	panic("implement me")
+}
+
+// limitPeer records exceptions sent to it
+type limitPeer struct {
+	Peer
+	id         string
+	mu         sync.Mutex
+	exceptions []message.Exception
+}
+
+func (p *limitPeer) ID() string {
+	return p.id
+}
+
+func (p *limitPeer) RemoteAddr() *net2.TCPAddr {
+	return nil
+}
+
+func (p *limitPeer) Send(code ViteCmd, msgId uint64, payload p2p.Serializable) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if code == ExceptionCode {
+		p.exceptions = append(p.exceptions, payload.(message.Exception))
+	}
+	return nil
+}
+
+func TestQueryHandler_maxInFlight(t *testing.T) {
+	const limit = 3
+	q := newQueryHandler(nil, limit)
+
+	msg := &p2p.Msg{
+		CmdSet: CmdSet,
+		Cmd:    p2p.Cmd(GetAccountBlocksCode),
+	}
+	p1 := &limitPeer{id: "p1"}
+	p2 := &limitPeer{id: "p2"}
+
+	var wg sync.WaitGroup
+	for i := 0; i < limit*2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			q.Handle(msg, p1)
+		}()
+	}
+	wg.Wait()
+
+	if n := len(p1.exceptions); n != limit {
+		t.Errorf("should reject %d requests, but rejected %d", limit, n)
+	}
+	for _, e := range p1.exceptions {
+		if e != message.TooManyRequests {
+			t.Errorf("should reject with %s, but got %s", message.TooManyRequests, e)
+		}
+	}
+
+	// other peers are not affected
+	q.Handle(msg, p2)
+	if len(p2.exceptions) != 0 {
+		t.Errorf("requests of p2 should not be rejected")
+	}
+
+	// accept again after earlier requests done
+	q.done(p1)
+	q.Handle(msg, p1)
+	if n := len(p1.exceptions); n != limit {
+		t.Errorf("should accept after earlier request done, but rejected %d", n-limit)
+	}
+}
+
 // mock GetAccountBlocksMsg
 func chooseAccountHash() (types.Address, types.Hash) {
 	actIndex := rand.Intn(len(accounts))
@@ -250,11 +329,10 @@ func mockGetAccountBlocksMsg() *p2p.Msg {
 	}
 }
 
-var gaHandler = getAccountBlocksHandler{
-	chain: getChain(),
-}
-
 func TestGetAccountBlocksHandler_Handle(t *testing.T) {
+	gaHandler := getAccountBlocksHandler{
+		chain: getChain(),
+	}
 	gaHandler.Handle(mockGetAccountBlocksMsg(), &mock_Peer{})
 }
 
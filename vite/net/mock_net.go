@@ -45,12 +45,14 @@ func mock() Net {
 	filter := &filter{
 		records: make(map[types.Hash]*record),
 	}
+	replies := newReplyTable()
 	receiver := &receiver{
 		ready:       0,
 		sFeed:       newSnapshotBlockFeed(),
 		aFeed:       newAccountBlockFeed(),
 		broadcaster: broadcaster,
 		filter:      filter,
+		replies:     replies,
 	}
 
 	return &mockNet{
@@ -65,10 +67,11 @@ func mock() Net {
 			running: 1,
 		},
 		fetcher: &fetcher{
-			filter: filter,
-			policy: &fetchPolicy{peers},
-			pool:   pool,
-			ready:  1,
+			filter:  filter,
+			policy:  &fetchPolicy{peers},
+			pool:    pool,
+			replies: replies,
+			ready:   1,
 		},
 		broadcaster: broadcaster,
 		receiver:    receiver,
@@ -29,6 +29,11 @@ type Config struct {
 	Topic      string
 	Interval   int64 // second
 	TopoEnable bool
+	TopoFormat topo.Format // JSON is readable for debug, used only if peer prefer it too
+	TopoPivot  string      // externally reachable url of this node, for nodes behind NAT
+
+	// max requests of one peer can be served at the same time, default 10
+	MaxInFlightRequests int
 }
 
 const DefaultPort uint16 = 8484
@@ -68,9 +73,10 @@ func New(cfg *Config) Net {
 
 	broadcaster := newBroadcaster(peers)
 	filter := newFilter()
-	receiver := newReceiver(cfg.Verifier, broadcaster, filter, nil)
+	replies := newReplyTable()
+	receiver := newReceiver(cfg.Verifier, broadcaster, filter, nil, replies)
 	syncer := newSyncer(cfg.Chain, peers, g, receiver)
-	fetcher := newFetcher(filter, peers, g)
+	fetcher := newFetcher(filter, peers, g, replies)
 
 	syncer.feed.Sub(receiver.listen) // subscribe sync status
 	syncer.feed.Sub(fetcher.listen)  // subscribe sync status
@@ -89,7 +95,7 @@ func New(cfg *Config) Net {
 	}
 
 	n.addHandler(_statusHandler(statusHandler))
-	n.query = newQueryHandler(cfg.Chain)
+	n.query = newQueryHandler(cfg.Chain, cfg.MaxInFlightRequests)
 	n.addHandler(n.query)
 	n.addHandler(syncer)   // FileListCode, SubLedgerCode, ExceptionCode
 	n.addHandler(receiver) // NewSnapshotBlockCode, NewAccountBlockCode, SnapshotBlocksCode, AccountBlocksCode
@@ -107,9 +113,11 @@ func New(cfg *Config) Net {
 	// topo
 	if cfg.TopoEnable {
 		n.topo = topo.New(&topo.Config{
-			Addrs:    cfg.Topology,
-			Interval: cfg.Interval,
-			Topic:    cfg.Topic,
+			Addrs:          cfg.Topology,
+			Interval:       cfg.Interval,
+			Topic:          cfg.Topic,
+			Format:         cfg.TopoFormat,
+			AdvertisePivot: cfg.TopoPivot,
 		})
 		n.protocols = append(n.protocols, n.topo.Protocol())
 	}
@@ -206,6 +214,8 @@ func (n *net) handlePeer(p *peer) error {
 		Port:    n.Port,
 		Current: current.Hash,
 		Genesis: genesis.Hash,
+
+		BlocksVersion: message.AccountBlocksVersion,
 	})
 
 	if err != nil {
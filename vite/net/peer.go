@@ -33,6 +33,7 @@ type Peer interface {
 	SendNewSnapshotBlock(b *ledger.SnapshotBlock) (err error)
 	SendNewAccountBlock(b *ledger.AccountBlock) (err error)
 	Send(code ViteCmd, msgId uint64, payload p2p.Serializable) (err error)
+	BlocksVersion() byte
 	Report(err error)
 	ID() string
 	Height() uint64
@@ -50,6 +51,8 @@ type peer struct {
 	filePort uint16     // fileServer port, for request file
 	CmdSet   p2p.CmdSet // which cmdSet it belongs
 
+	blocksVersion byte // AccountBlocks version negotiated in handshake
+
 	mu          sync.RWMutex
 	KnownBlocks *cuckoofilter.CuckooFilter
 
@@ -122,6 +125,12 @@ func (p *peer) Handshake(our *message.HandShake) error {
 		p.filePort = DefaultPort
 	}
 
+	// the lower of the latest versions of both sides
+	p.blocksVersion = their.BlocksVersion
+	if p.blocksVersion > our.BlocksVersion {
+		p.blocksVersion = our.BlocksVersion
+	}
+
 	return nil
 }
 
@@ -160,11 +169,16 @@ func (p *peer) SeeBlock(hash types.Hash) {
 // send
 
 func (p *peer) SendSnapshotBlocks(bs []*ledger.SnapshotBlock, msgId uint64) (err error) {
-	return p.Send(SnapshotBlocksCode, msgId, &message.SnapshotBlocks{bs})
+	return p.Send(SnapshotBlocksCode, msgId, &message.SnapshotBlocks{Blocks: bs})
 }
 
 func (p *peer) SendAccountBlocks(bs []*ledger.AccountBlock, msgId uint64) (err error) {
-	return p.Send(AccountBlocksCode, msgId, &message.AccountBlocks{bs})
+	return p.Send(AccountBlocksCode, msgId, &message.AccountBlocks{Blocks: bs, Version: p.blocksVersion})
+}
+
+// BlocksVersion return the AccountBlocks version negotiated in handshake
+func (p *peer) BlocksVersion() byte {
+	return p.blocksVersion
 }
 
 func (p *peer) SendNewSnapshotBlock(b *ledger.SnapshotBlock) (err error) {
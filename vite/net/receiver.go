@@ -37,12 +37,13 @@ type receiver struct {
 	log         log15.Logger
 	batchSource types.BlockSource // report to pool
 	p2p         p2p.Server
+	replies     *replyTable // route responses to the fetcher waiting for them
 
 	mu          sync.RWMutex
 	KnownBlocks *cuckoofilter.CuckooFilter
 }
 
-func newReceiver(verifier Verifier, broadcaster Broadcaster, filter Filter, p2p p2p.Server) *receiver {
+func newReceiver(verifier Verifier, broadcaster Broadcaster, filter Filter, p2p p2p.Server, replies *replyTable) *receiver {
 	return &receiver{
 		newSBlocks:  make([]*ledger.SnapshotBlock, 0, cacheSBlockTotal),
 		newABlocks:  make([]*ledger.AccountBlock, 0, cacheABlockTotal),
@@ -54,6 +55,7 @@ func newReceiver(verifier Verifier, broadcaster Broadcaster, filter Filter, p2p
 		log:         log15.New("module", "net/receiver"),
 		batchSource: types.RemoteSync,
 		p2p:         p2p,
+		replies:     replies,
 		KnownBlocks: cuckoofilter.NewCuckooFilter(filterCap),
 	}
 }
@@ -98,6 +100,8 @@ func (s *receiver) Handle(msg *p2p.Msg, sender Peer) (err error) {
 			return err
 		}
 
+		s.reply(bs.RequestID, bs)
+
 		return s.ReceiveSnapshotBlocks(bs.Blocks, sender)
 
 	case AccountBlocksCode:
@@ -106,12 +110,23 @@ func (s *receiver) Handle(msg *p2p.Msg, sender Peer) (err error) {
 			return err
 		}
 
+		s.reply(bs.RequestID, bs)
+
 		return s.ReceiveAccountBlocks(bs.Blocks, sender)
 	}
 
 	return nil
 }
 
+// reply route the response to the request waiting for it, the blocks are received either way.
+// Responses of requests without RequestID, e.g. from sync, are not routed
+func (s *receiver) reply(id uint64, msg message.Message) {
+	if id == 0 || s.replies == nil {
+		return
+	}
+	s.replies.reply(id, msg)
+}
+
 func (s *receiver) mark(hash types.Hash) {
 	s.filter.done(hash)
 }
@@ -0,0 +1,80 @@
+package net
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/vitelabs/go-vite/vite/net/message"
+)
+
+var errReplyTimeout = errors.New("wait reply timeout")
+
+// replyTable route a response to the caller waiting for it by the RequestID carried in both messages
+type replyTable struct {
+	mu      sync.Mutex
+	id      uint64
+	waiting map[uint64]chan message.Message
+}
+
+func newReplyTable() *replyTable {
+	return &replyTable{
+		waiting: make(map[uint64]chan message.Message),
+	}
+}
+
+// add allocate a RequestID, the caller should set it to the request, then wait the reply
+func (t *replyTable) add() (id uint64, reply <-chan message.Message) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.id++
+	// buffered, so reply never blocks even if the caller has given up
+	ch := make(chan message.Message, 1)
+	t.waiting[t.id] = ch
+
+	return t.id, ch
+}
+
+// wait the reply of id until timeout, the id is released either way
+func (t *replyTable) wait(id uint64, reply <-chan message.Message, timeout time.Duration) (message.Message, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case msg := <-reply:
+		return msg, nil
+	case <-timer.C:
+		t.del(id)
+		return nil, errReplyTimeout
+	}
+}
+
+// reply deliver msg to the caller waiting for id, return false if nobody is waiting,
+// eg. the response is late or unsolicited
+func (t *replyTable) reply(id uint64, msg message.Message) bool {
+	t.mu.Lock()
+	ch, ok := t.waiting[id]
+	delete(t.waiting, id)
+	t.mu.Unlock()
+
+	if ok {
+		ch <- msg
+	}
+
+	return ok
+}
+
+func (t *replyTable) del(id uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.waiting, id)
+}
+
+func (t *replyTable) size() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return len(t.waiting)
+}
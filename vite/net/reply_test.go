@@ -0,0 +1,191 @@
+package net
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/vitelabs/go-vite/common/types"
+	"github.com/vitelabs/go-vite/ledger"
+	"github.com/vitelabs/go-vite/p2p"
+	"github.com/vitelabs/go-vite/vite/net/message"
+)
+
+func TestReplyTable_reply(t *testing.T) {
+	table := newReplyTable()
+
+	id1, reply1 := table.add()
+	id2, reply2 := table.add()
+	if id1 == id2 {
+		t.Fatalf("RequestID should be unique")
+	}
+
+	req := &message.GetAccountBlocks{Count: 1, RequestID: id2}
+
+	// the response is decoded from wire, only RequestID is shared with the request
+	data, err := (&message.AccountBlocks{
+		Blocks:    []*ledger.AccountBlock{},
+		RequestID: req.RequestID,
+	}).Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := message.Decode(message.AccountBlocksCode, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go table.reply(res.(*message.AccountBlocks).RequestID, res)
+
+	msg, err := table.wait(id2, reply2, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.(*message.AccountBlocks).RequestID != req.RequestID {
+		t.Errorf("response should be routed to request %d", req.RequestID)
+	}
+
+	// reply only once
+	if table.reply(id2, res) {
+		t.Errorf("should not route response to request %d twice", id2)
+	}
+
+	table.del(id1)
+	if n := table.size(); n != 0 {
+		t.Errorf("table should be empty, but got %d", n)
+	}
+	select {
+	case <-reply1:
+		t.Errorf("request %d should not receive response", id1)
+	default:
+	}
+}
+
+func TestReplyTable_timeout(t *testing.T) {
+	table := newReplyTable()
+
+	id, reply := table.add()
+
+	if _, err := table.wait(id, reply, 10*time.Millisecond); err != errReplyTimeout {
+		t.Fatalf("should return errReplyTimeout, but got %v", err)
+	}
+
+	if n := table.size(); n != 0 {
+		t.Errorf("timeout request should be released, but got %d", n)
+	}
+
+	// the late response is dropped
+	if table.reply(id, &message.AccountBlocks{RequestID: id}) {
+		t.Errorf("late response should not be routed")
+	}
+}
+
+// replyPeer records the requests sent to it
+type replyPeer struct {
+	Peer
+	mu   sync.Mutex
+	sent []p2p.Serializable
+}
+
+func (p *replyPeer) Send(code ViteCmd, msgId uint64, payload p2p.Serializable) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.sent = append(p.sent, payload)
+	return nil
+}
+
+func (p *replyPeer) SeeBlock(hash types.Hash) {}
+
+type replyPolicy struct {
+	peer Peer
+}
+
+func (p *replyPolicy) pickAccount(height uint64) []Peer {
+	return []Peer{p.peer}
+}
+
+func (p *replyPolicy) pickSnap() Peer {
+	return p.peer
+}
+
+// wait until fn return true or timeout
+func waitFor(timeout time.Duration, fn func() bool) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if fn() {
+			return true
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	return fn()
+}
+
+func newReplyFetcher() (*fetcher, *receiver, *replyPeer) {
+	replies := newReplyTable()
+	filter := newFilter()
+	peer := new(replyPeer)
+
+	f := newFetcher(filter, nil, new(gid), replies)
+	f.policy = &replyPolicy{peer}
+	f.ready = 1
+
+	r := newReceiver(nil, nil, filter, nil, replies)
+	return f, r, peer
+}
+
+func TestFetcher_reply(t *testing.T) {
+	f, r, peer := newReplyFetcher()
+
+	f.FetchAccountBlocks(types.Hash{1}, 1, nil)
+
+	if len(peer.sent) != 1 {
+		t.Fatalf("should send 1 request, but sent %d", len(peer.sent))
+	}
+	req := peer.sent[0].(*message.GetAccountBlocks)
+	if req.RequestID == 0 {
+		t.Fatal("request should carry a RequestID")
+	}
+	if n := f.replies.size(); n != 1 {
+		t.Fatalf("request should wait for its reply, but %d are waiting", n)
+	}
+
+	data, err := (&message.AccountBlocks{Blocks: []*ledger.AccountBlock{}, RequestID: req.RequestID}).Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = r.Handle(&p2p.Msg{Cmd: p2p.Cmd(AccountBlocksCode), Payload: data}, peer); err != nil {
+		t.Fatal(err)
+	}
+
+	if !waitFor(time.Second, func() bool { return f.replies.size() == 0 }) {
+		t.Errorf("response should be routed to request %d", req.RequestID)
+	}
+}
+
+func TestFetcher_reply_timeout(t *testing.T) {
+	old := fetchReplyTimeout
+	fetchReplyTimeout = 10 * time.Millisecond
+	defer func() { fetchReplyTimeout = old }()
+
+	f, r, peer := newReplyFetcher()
+
+	f.FetchSnapshotBlocks(types.Hash{1}, 1)
+
+	if len(peer.sent) != 1 {
+		t.Fatalf("should send 1 request, but sent %d", len(peer.sent))
+	}
+	req := peer.sent[0].(*message.GetSnapshotBlocks)
+
+	if !waitFor(time.Second, func() bool { return f.replies.size() == 0 }) {
+		t.Fatalf("request %d should be released after timeout", req.RequestID)
+	}
+
+	// the late response is dropped, but its blocks are received all the same
+	data, err := (&message.SnapshotBlocks{Blocks: []*ledger.SnapshotBlock{}, RequestID: req.RequestID}).Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = r.Handle(&p2p.Msg{Cmd: p2p.Cmd(SnapshotBlocksCode), Payload: data}, peer); err != nil {
+		t.Errorf("late response should be handled: %v", err)
+	}
+}
@@ -84,6 +84,9 @@ const minSubLedger = 1000
 const chunk = 20
 const maxBlocksOneTrip = 1000
 
+// snapshot blocks requested with the account blocks they confirmed, same as the chunk of sub ledger
+const maxContentBlocksOneTrip = 50
+
 func splitChunk(from, to uint64, chunk uint64) (chunks [][2]uint64) {
 	// chunks may be only one block, then from == to
 	if from > to || to == 0 {
@@ -154,7 +157,7 @@ func newChunkPool(peers *peerSet, gid MsgIder, handler blockReceiver) *chunkPool
 		queue:    list.New(),
 		chunks:   new(sync.Map),
 		handler:  handler,
-		resQueue: blockQueue.New(),
+		resQueue: blockQueue.NewBlockQueue(),
 	}
 }
 
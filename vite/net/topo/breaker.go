@@ -0,0 +1,116 @@
+package topo
+
+import (
+	"sync"
+	"time"
+)
+
+type breakerState byte
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerClosed:
+		return "closed"
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+// breaker opens after threshold consecutive failures within window, then drops everything for cooldown,
+// after cooldown it is half-open, the next success closes it, the next failure opens it again
+type breaker struct {
+	threshold int
+	window    time.Duration
+	cooldown  time.Duration
+
+	mu        sync.Mutex
+	state     breakerState
+	failures  int
+	firstFail time.Time
+	openedAt  time.Time
+	dropped   uint64
+
+	now func() time.Time // replaced in tests
+}
+
+func newBreaker(threshold int, window, cooldown time.Duration) *breaker {
+	return &breaker{
+		threshold: threshold,
+		window:    window,
+		cooldown:  cooldown,
+		now:       time.Now,
+	}
+}
+
+// allow return false and count the drop if the breaker is open
+func (b *breaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == breakerOpen {
+		if b.now().Sub(b.openedAt) < b.cooldown {
+			b.dropped++
+			return false
+		}
+		b.state = breakerHalfOpen
+	}
+
+	return true
+}
+
+func (b *breaker) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.state = breakerClosed
+	b.failures = 0
+}
+
+func (b *breaker) failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.now()
+
+	switch b.state {
+	case breakerOpen:
+		return
+	case breakerHalfOpen:
+		b.open(now)
+		return
+	}
+
+	if b.failures == 0 || now.Sub(b.firstFail) > b.window {
+		b.failures = 0
+		b.firstFail = now
+	}
+
+	b.failures++
+	if b.failures >= b.threshold {
+		b.open(now)
+	}
+}
+
+// open must be called with mu held
+func (b *breaker) open(now time.Time) {
+	b.state = breakerOpen
+	b.openedAt = now
+	b.failures = 0
+}
+
+func (b *breaker) status() (state breakerState, dropped uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.state, b.dropped
+}
@@ -0,0 +1,179 @@
+package topo
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gopkg.in/Shopify/sarama.v1"
+)
+
+// resultProducer report the results of writes through Errors and Successes
+type resultProducer struct {
+	mockProducer
+	errs  chan *sarama.ProducerError
+	succs chan *sarama.ProducerMessage
+}
+
+func (p *resultProducer) Errors() <-chan *sarama.ProducerError {
+	return p.errs
+}
+
+func (p *resultProducer) Successes() <-chan *sarama.ProducerMessage {
+	return p.succs
+}
+
+func TestTopology_breaker(t *testing.T) {
+	tp := New(&Config{BreakerThreshold: 3, BreakerWindow: 10, BreakerCooldown: 30})
+
+	now := time.Now()
+	tp.breaker.now = func() time.Time { return now }
+
+	prod := &resultProducer{
+		mockProducer: mockProducer{input: make(chan *sarama.ProducerMessage, 10)},
+		errs:         make(chan *sarama.ProducerError),
+		succs:        make(chan *sarama.ProducerMessage),
+	}
+	tp.prod = prod
+
+	done := make(chan struct{})
+	go func() {
+		tp.watchProducer(prod)
+		close(done)
+	}()
+
+	for i := 0; i < 3; i++ {
+		prod.errs <- &sarama.ProducerError{Err: errors.New("broker down")}
+	}
+	if !waitFor(time.Second, func() bool { return tp.Metrics().Breaker == "open" }) {
+		t.Fatalf("breaker should open after 3 errors, but is %s", tp.Metrics().Breaker)
+	}
+
+	tp.write("topic", []byte("a"))
+	tp.write("topic", []byte("b"))
+	if n := len(prod.events("topic")); n != 0 {
+		t.Errorf("writes should be dropped while open, but %d written", n)
+	}
+	if m := tp.Metrics(); m.Dropped != 2 {
+		t.Errorf("should drop 2 writes, but dropped %d", m.Dropped)
+	}
+
+	// half-open after cooldown, the write is let through to test recovery
+	now = now.Add(31 * time.Second)
+	tp.write("topic", []byte("c"))
+	if n := len(prod.events("topic")); n != 1 {
+		t.Errorf("write should be tried after cooldown, but %d written", n)
+	}
+	if s := tp.Metrics().Breaker; s != "half-open" {
+		t.Errorf("breaker should be half-open, but is %s", s)
+	}
+
+	prod.succs <- new(sarama.ProducerMessage)
+	if !waitFor(time.Second, func() bool { return tp.Metrics().Breaker == "closed" }) {
+		t.Errorf("breaker should close after success, but is %s", tp.Metrics().Breaker)
+	}
+
+	close(prod.errs)
+	close(prod.succs)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("watchProducer should return after the producer closed")
+	}
+}
+
+func TestBreaker_window(t *testing.T) {
+	b := newBreaker(3, 10*time.Second, 30*time.Second)
+
+	now := time.Now()
+	b.now = func() time.Time { return now }
+
+	// errors spread out of the window don`t open the breaker
+	for i := 0; i < 5; i++ {
+		b.failure()
+		now = now.Add(6 * time.Second)
+	}
+	if state, _ := b.status(); state != breakerClosed {
+		t.Errorf("breaker should be closed, but is %s", state)
+	}
+
+	// failure while half-open opens it again
+	b.failure()
+	b.failure()
+	b.failure()
+	now = now.Add(30 * time.Second)
+	if !b.allow() {
+		t.Fatal("breaker should allow after cooldown")
+	}
+	b.failure()
+	if state, _ := b.status(); state != breakerOpen {
+		t.Errorf("breaker should open again, but is %s", state)
+	}
+}
+
+// closingProducer close the result channels when closed, so watchProducer returns
+type closingProducer struct {
+	resultProducer
+	closed chan struct{}
+}
+
+func newClosingProducer() *closingProducer {
+	return &closingProducer{
+		resultProducer: resultProducer{
+			mockProducer: mockProducer{input: make(chan *sarama.ProducerMessage, 10)},
+			errs:         make(chan *sarama.ProducerError),
+			succs:        make(chan *sarama.ProducerMessage),
+		},
+		closed: make(chan struct{}),
+	}
+}
+
+func (p *closingProducer) Close() error {
+	close(p.closed)
+	close(p.errs)
+	close(p.succs)
+	return nil
+}
+
+func TestTopology_ProducerMaxLifetime(t *testing.T) {
+	tp := New(&Config{ProducerMaxLifetime: 1})
+
+	old, fresh := newClosingProducer(), newClosingProducer()
+	tp.prod = old
+	tp.prodBorn = time.Now().Add(-2 * time.Second)
+
+	var created int32
+	release := make(chan struct{})
+	tp.newProd = func(addrs []string) (sarama.AsyncProducer, error) {
+		atomic.AddInt32(&created, 1)
+		<-release
+		return fresh, nil
+	}
+
+	// writes go on with the old producer while the new one is being created
+	for i := 0; i < 3; i++ {
+		tp.write("topic", []byte("topo"))
+	}
+	close(release)
+
+	select {
+	case <-old.closed:
+	case <-time.After(time.Second):
+		t.Fatal("old producer should be closed")
+	}
+
+	if n := atomic.LoadInt32(&created); n != 1 {
+		t.Errorf("producer should be recreated once, but created %d times", n)
+	}
+	if n := len(old.events("topic")); n != 3 {
+		t.Errorf("should write 3 events by the old producer, but got %d", n)
+	}
+
+	tp.write("topic", []byte("topo"))
+	if n := len(fresh.events("topic")); n != 1 {
+		t.Errorf("should write by the new producer, but got %d events", n)
+	}
+
+	fresh.Close()
+}
@@ -0,0 +1,255 @@
+package topo
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var errGraphItemTooLarge = errors.New("graph item is too large")
+
+// maxGraphItemSize limit a single persisted topo, avoid allocate huge memory from corrupted data
+const maxGraphItemSize = 16 << 20
+
+type Edge struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// TopoGraph collect topo messages from the whole network, keep the latest topo of each pivot,
+// nodes and edges are derived from these topos
+type TopoGraph struct {
+	mu    sync.RWMutex
+	topos map[string]*Topo // key is pivot
+
+	// times each edge is observed, decayed by Prune, stable links weigh more than transient ones
+	weights map[Edge]int
+}
+
+func NewTopoGraph() *TopoGraph {
+	return &TopoGraph{
+		topos:   make(map[string]*Topo),
+		weights: make(map[Edge]int),
+	}
+}
+
+// AddTopo record topo, older topo of the same pivot will be replaced,
+// weight of the edges reported by topo increase if it`s recorded,
+// and weight of the edges reported by the replaced topo but not by topo are deleted
+func (g *TopoGraph) AddTopo(topo *Topo) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	old, ok := g.topos[topo.Pivot]
+	if ok && time.Time(old.Time).After(time.Time(topo.Time)) {
+		return
+	}
+
+	g.topos[topo.Pivot] = topo
+
+	current := make(map[Edge]struct{}, len(topo.Peers))
+	for _, cp := range topo.Peers {
+		e := Edge{cp.LocalID, cp.RemoteID}
+		current[e] = struct{}{}
+		g.weights[e]++
+	}
+
+	if ok {
+		for _, cp := range old.Peers {
+			e := Edge{cp.LocalID, cp.RemoteID}
+			if _, reported := current[e]; !reported {
+				delete(g.weights, e)
+			}
+		}
+	}
+}
+
+// Prune halve the weight of every edge, edges not observed any more fade out to 0
+func (g *TopoGraph) Prune() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for e, w := range g.weights {
+		if w /= 2; w == 0 {
+			delete(g.weights, e)
+		} else {
+			g.weights[e] = w
+		}
+	}
+}
+
+// EdgeWeight return the decayed count of the edge from node a to node b observed, 0 if never
+func (g *TopoGraph) EdgeWeight(a, b string) int {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	return g.weights[Edge{a, b}]
+}
+
+func (g *TopoGraph) Size() int {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	return len(g.topos)
+}
+
+// Topos return the latest topo of every pivot, sorted by pivot
+func (g *TopoGraph) Topos() []*Topo {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	topos := make([]*Topo, 0, len(g.topos))
+	for _, topo := range g.topos {
+		topos = append(topos, topo)
+	}
+
+	sort.Slice(topos, func(i, j int) bool {
+		return topos[i].Pivot < topos[j].Pivot
+	})
+
+	return topos
+}
+
+// Nodes return sorted node ids appeared in the graph
+func (g *TopoGraph) Nodes() []string {
+	set := make(map[string]struct{})
+	for _, e := range g.Edges() {
+		set[e.From] = struct{}{}
+		set[e.To] = struct{}{}
+	}
+
+	nodes := make([]string, 0, len(set))
+	for id := range set {
+		nodes = append(nodes, id)
+	}
+	sort.Strings(nodes)
+
+	return nodes
+}
+
+// Edges return sorted connections reported by all topos, duplicated ones are merged
+func (g *TopoGraph) Edges() []Edge {
+	seen := g.edgeSeen()
+
+	edges := make([]Edge, 0, len(seen))
+	for e := range seen {
+		edges = append(edges, e)
+	}
+	sort.Slice(edges, func(i, j int) bool {
+		if edges[i].From == edges[j].From {
+			return edges[i].To < edges[j].To
+		}
+		return edges[i].From < edges[j].From
+	})
+
+	return edges
+}
+
+// edgeSeen return the time of the latest topo reported each edge
+func (g *TopoGraph) edgeSeen() map[Edge]time.Time {
+	seen := make(map[Edge]time.Time)
+	for _, topo := range g.Topos() {
+		t := time.Time(topo.Time)
+		for _, cp := range topo.Peers {
+			e := Edge{cp.LocalID, cp.RemoteID}
+			if last, ok := seen[e]; !ok || t.After(last) {
+				seen[e] = t
+			}
+		}
+	}
+
+	return seen
+}
+
+// edgeColor tell how long ago an edge was last seen
+func edgeColor(age time.Duration) string {
+	switch {
+	case age < time.Minute:
+		return "green"
+	case age < 10*time.Minute:
+		return "orange"
+	default:
+		return "red"
+	}
+}
+
+// DOT return the graph in GraphViz DOT language, edges are labeled and colored by the age since last seen
+func (g *TopoGraph) DOT() string {
+	now := time.Now()
+	seen := g.edgeSeen()
+
+	var buf bytes.Buffer
+	buf.WriteString("digraph topo {\n")
+
+	for _, id := range g.Nodes() {
+		fmt.Fprintf(&buf, "\t%q;\n", id)
+	}
+
+	for _, e := range g.Edges() {
+		age := now.Sub(seen[e]).Truncate(time.Second)
+		fmt.Fprintf(&buf, "\t%q -> %q [label=%q, color=%s];\n", e.From, e.To, age.String(), edgeColor(age))
+	}
+
+	buf.WriteString("}\n")
+
+	return buf.String()
+}
+
+// SaveGraph write all topos to w, every topo is encoded by MarshalBinary and prefixed with 4 bytes length
+func (g *TopoGraph) SaveGraph(w io.Writer) error {
+	var head [4]byte
+
+	for _, topo := range g.Topos() {
+		data, err := topo.MarshalBinary()
+		if err != nil {
+			return err
+		}
+
+		binary.BigEndian.PutUint32(head[:], uint32(len(data)))
+		if _, err = w.Write(head[:]); err != nil {
+			return err
+		}
+		if _, err = w.Write(data); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// LoadGraph read topos written by SaveGraph and add them to the graph
+func (g *TopoGraph) LoadGraph(r io.Reader) error {
+	var head [4]byte
+
+	for {
+		if _, err := io.ReadFull(r, head[:]); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+
+		size := binary.BigEndian.Uint32(head[:])
+		if size > maxGraphItemSize {
+			return errGraphItemTooLarge
+		}
+
+		data := make([]byte, size)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return err
+		}
+
+		topo := new(Topo)
+		if err := topo.UnmarshalBinary(data); err != nil {
+			return err
+		}
+
+		g.AddTopo(topo)
+	}
+}
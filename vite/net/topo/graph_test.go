@@ -0,0 +1,178 @@
+package topo
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vitelabs/go-vite/p2p"
+)
+
+func mockGraph(nodes int) *TopoGraph {
+	g := NewTopoGraph()
+
+	for i := 0; i < nodes; i++ {
+		topo := &Topo{
+			Pivot: fmt.Sprintf("vnode://%064x@127.0.0.1:%d", i, 8483+i),
+			Time:  UnixTime(time.Unix(int64(1000+i), 0)),
+		}
+
+		// connect to the next two nodes
+		for j := 1; j <= 2; j++ {
+			topo.Peers = append(topo.Peers, &p2p.ConnProperty{
+				LocalID:    fmt.Sprintf("node%d", i),
+				LocalIP:    net.IPv4(127, 0, 0, 1),
+				LocalPort:  uint16(8483 + i),
+				RemoteID:   fmt.Sprintf("node%d", (i+j)%nodes),
+				RemoteIP:   net.IPv4(127, 0, 0, 1),
+				RemotePort: uint16(8483 + (i+j)%nodes),
+			})
+		}
+
+		g.AddTopo(topo)
+	}
+
+	return g
+}
+
+func TestTopoGraph_AddTopo(t *testing.T) {
+	g := mockGraph(5)
+	if g.Size() != 5 {
+		t.Fatalf("graph should have 5 topos, but got %d", g.Size())
+	}
+	if n := len(g.Nodes()); n != 5 {
+		t.Errorf("graph should have 5 nodes, but got %d", n)
+	}
+	if n := len(g.Edges()); n != 10 {
+		t.Errorf("graph should have 10 edges, but got %d", n)
+	}
+
+	// older topo should not replace the newer one
+	pivot := g.Topos()[0].Pivot
+	g.AddTopo(&Topo{
+		Pivot: pivot,
+		Time:  UnixTime(time.Unix(1, 0)),
+	})
+	if len(g.Topos()[0].Peers) != 2 {
+		t.Error("older topo should be ignored")
+	}
+}
+
+func TestTopoGraph_EdgeWeight(t *testing.T) {
+	g := NewTopoGraph()
+
+	edge := func(from, to string) *p2p.ConnProperty {
+		return &p2p.ConnProperty{LocalID: from, RemoteID: to}
+	}
+
+	for i := 0; i < 8; i++ {
+		topo := &Topo{
+			Pivot: "pivot",
+			Time:  UnixTime(time.Unix(int64(1000+i), 0)),
+			Peers: []*p2p.ConnProperty{edge("a", "b")},
+		}
+		// a transient link observed only once
+		if i == 3 {
+			topo.Peers = append(topo.Peers, edge("a", "c"))
+		}
+		g.AddTopo(topo)
+	}
+
+	// the transient link is not reported by the topo replaced the one reported it
+	stable, transient := g.EdgeWeight("a", "b"), g.EdgeWeight("a", "c")
+	if stable != 8 || transient != 0 {
+		t.Fatalf("weight of stable and transient edges should be 8 and 0, but got %d and %d", stable, transient)
+	}
+	if w := g.EdgeWeight("b", "a"); w != 0 {
+		t.Errorf("edge is directed, weight of reversed edge should be 0, but got %d", w)
+	}
+
+	// older topo is not recorded, so not counted
+	g.AddTopo(&Topo{Pivot: "pivot", Time: UnixTime(time.Unix(1, 0)), Peers: []*p2p.ConnProperty{edge("a", "b")}})
+	if w := g.EdgeWeight("a", "b"); w != 8 {
+		t.Errorf("older topo should not be counted, but weight is %d", w)
+	}
+
+	g.Prune()
+	if stable, transient = g.EdgeWeight("a", "b"), g.EdgeWeight("a", "c"); stable != 4 || transient != 0 {
+		t.Errorf("weights should be halved to 4 and 0, but got %d and %d", stable, transient)
+	}
+}
+
+func TestTopoGraph_SaveGraph(t *testing.T) {
+	g := mockGraph(5)
+
+	buf := new(bytes.Buffer)
+	if err := g.SaveGraph(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	g2 := NewTopoGraph()
+	if err := g2.LoadGraph(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	topos, topos2 := g.Topos(), g2.Topos()
+	if len(topos) != len(topos2) {
+		t.Fatalf("should load %d topos, but got %d", len(topos), len(topos2))
+	}
+	for i := range topos {
+		if !bytes.Equal(topos[i].Json(), topos2[i].Json()) {
+			t.Errorf("topo %d not equal: %s %s", i, topos[i].Json(), topos2[i].Json())
+		}
+	}
+
+	edges, edges2 := g.Edges(), g2.Edges()
+	if len(edges) != len(edges2) {
+		t.Fatalf("should load %d edges, but got %d", len(edges), len(edges2))
+	}
+	for i := range edges {
+		if edges[i] != edges2[i] {
+			t.Errorf("edge %d not equal: %v %v", i, edges[i], edges2[i])
+		}
+	}
+}
+
+func TestTopoGraph_LoadGraph_truncated(t *testing.T) {
+	buf := new(bytes.Buffer)
+	if err := mockGraph(3).SaveGraph(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	data := buf.Bytes()
+	if err := NewTopoGraph().LoadGraph(bytes.NewReader(data[:len(data)-1])); err == nil {
+		t.Error("should fail to load truncated data")
+	}
+}
+
+func TestTopoGraph_DOT(t *testing.T) {
+	g := NewTopoGraph()
+	g.AddTopo(&Topo{
+		Pivot: "a",
+		Peers: []*p2p.ConnProperty{{LocalID: "a", RemoteID: "b"}},
+		Time:  UnixTime(time.Now().Add(-10 * time.Second)),
+	})
+	g.AddTopo(&Topo{
+		Pivot: "b",
+		Peers: []*p2p.ConnProperty{{LocalID: "b", RemoteID: "c"}},
+		Time:  UnixTime(time.Now().Add(-time.Hour)),
+	})
+
+	dot := g.DOT()
+
+	for _, s := range []string{
+		"digraph topo {",
+		`"a";`,
+		`"b";`,
+		`"c";`,
+		`"a" -> "b" [label="10s", color=green];`,
+		`"b" -> "c" [label="1h0m0s", color=red];`,
+	} {
+		if !strings.Contains(dot, s) {
+			t.Errorf("DOT should contain %s, but got:\n%s", s, dot)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package topo
+
+import "sync"
+
+// peerSet is a map guarded by RWMutex, it has no dirty/read copies like sync.Map,
+// so memory is bounded by the peak count of peers under high churn
+type peerSet struct {
+	m  map[string]*Peer
+	mu sync.RWMutex
+}
+
+func newPeerSet() *peerSet {
+	return &peerSet{
+		m: make(map[string]*Peer),
+	}
+}
+
+func (s *peerSet) add(p *Peer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.m[p.id] = p
+}
+
+// tryAdd add p only if there are less than max peers, max 0 means no limit,
+// the check and the insertion are done under the same lock
+func (s *peerSet) tryAdd(p *Peer, max int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.m[p.id]; !ok && max > 0 && len(s.m) >= max {
+		return false
+	}
+
+	s.m[p.id] = p
+	return true
+}
+
+func (s *peerSet) remove(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.m, id)
+}
+
+func (s *peerSet) get(id string) *Peer {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.m[id]
+}
+
+func (s *peerSet) size() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return len(s.m)
+}
+
+// snapshot return all peers, peers can be used without holding the lock
+func (s *peerSet) snapshot() []*Peer {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	peers := make([]*Peer, 0, len(s.m))
+	for _, p := range s.m {
+		peers = append(peers, p)
+	}
+
+	return peers
+}
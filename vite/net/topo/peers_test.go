@@ -0,0 +1,75 @@
+package topo
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestPeerSet(t *testing.T) {
+	s := newPeerSet()
+	s.add(mockPeer("a"))
+	s.add(mockPeer("b"))
+
+	if s.size() != 2 || len(s.snapshot()) != 2 {
+		t.Fatalf("should have 2 peers, but got %d", s.size())
+	}
+	if p := s.get("a"); p == nil || p.id != "a" {
+		t.Errorf("should get peer a")
+	}
+
+	s.remove("a")
+	if s.get("a") != nil || s.size() != 1 {
+		t.Errorf("peer a should be removed")
+	}
+}
+
+func TestPeerSet_tryAdd(t *testing.T) {
+	s := newPeerSet()
+
+	if !s.tryAdd(mockPeer("a"), 2) || !s.tryAdd(mockPeer("b"), 2) {
+		t.Fatal("should add 2 peers")
+	}
+	if s.tryAdd(mockPeer("c"), 2) || s.get("c") != nil {
+		t.Error("should not add peer beyond max")
+	}
+	if !s.tryAdd(mockPeer("a"), 2) {
+		t.Error("should replace the existing peer")
+	}
+	if !s.tryAdd(mockPeer("c"), 0) || s.size() != 3 {
+		t.Error("max 0 should mean no limit")
+	}
+}
+
+// peers connect and disconnect continuously, only a few peers are alive at the same time
+const churnAlive = 50
+
+func BenchmarkPeerSet_churn(b *testing.B) {
+	b.ReportAllocs()
+
+	s := newPeerSet()
+	p := mockPeer("")
+
+	for i := 0; i < b.N; i++ {
+		p.id = strconv.Itoa(i)
+		s.add(p)
+		if i >= churnAlive {
+			s.remove(strconv.Itoa(i - churnAlive))
+		}
+	}
+}
+
+func BenchmarkSyncMap_churn(b *testing.B) {
+	b.ReportAllocs()
+
+	var m sync.Map
+	p := mockPeer("")
+
+	for i := 0; i < b.N; i++ {
+		id := strconv.Itoa(i)
+		m.Store(id, p)
+		if i >= churnAlive {
+			m.Delete(strconv.Itoa(i - churnAlive))
+		}
+	}
+}
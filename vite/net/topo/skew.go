@@ -0,0 +1,56 @@
+package topo
+
+import (
+	"sync"
+	"time"
+)
+
+// SkewSummary is the distribution of local receive time minus Topo.Time, in millisecond,
+// positive means the topo was generated in the past, it includes the propagation delay
+type SkewSummary struct {
+	Count uint64  `json:"count"`
+	Mean  float64 `json:"mean"`
+	Min   float64 `json:"min"`
+	Max   float64 `json:"max"`
+}
+
+type skewRecorder struct {
+	mu       sync.Mutex
+	count    uint64
+	sum      time.Duration
+	min, max time.Duration
+}
+
+func (r *skewRecorder) observe(skew time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.count == 0 || skew < r.min {
+		r.min = skew
+	}
+	if r.count == 0 || skew > r.max {
+		r.max = skew
+	}
+	r.count++
+	r.sum += skew
+}
+
+func (r *skewRecorder) summary() (s SkewSummary) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.count == 0 {
+		return
+	}
+
+	ms := func(d time.Duration) float64 {
+		return float64(d) / float64(time.Millisecond)
+	}
+
+	return SkewSummary{
+		Count: r.count,
+		Mean:  ms(r.sum) / float64(r.count),
+		Min:   ms(r.min),
+		Max:   ms(r.max),
+	}
+}
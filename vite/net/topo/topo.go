@@ -1,8 +1,13 @@
 package topo
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
+	"net"
+	"sort"
 	"strconv"
 	"sync"
 	"sync/atomic"
@@ -16,31 +21,193 @@ import (
 	"github.com/vitelabs/go-vite/log15"
 	"github.com/vitelabs/go-vite/monitor"
 	"github.com/vitelabs/go-vite/p2p"
+	"github.com/vitelabs/go-vite/p2p/discovery"
 	"github.com/vitelabs/go-vite/p2p/protos"
+	"github.com/vitelabs/go-vite/vite/net/message"
 	"gopkg.in/Shopify/sarama.v1"
 )
 
+// default name and ID of the protocol
 const Name = "Topo"
 const CmdSet = 3
-const topoCmd = 1
+
+// sub commands of the topo protocol
+const (
+	topoCmd p2p.Cmd = iota + 1
+	formatCmd
+	getTopoCmd   // ask peer for its current topology, payload is the request id
+	topoReplyCmd // answer getTopoCmd, payload is the request id followed by the topo message
+)
+
+// CmdHandler handle a message of sub command received from peer, msg is owned by the handler,
+// it should be recycled when it`s done. Handle of the peer return if error is returned
+type CmdHandler func(msg *p2p.Msg, peer *Peer) error
+
+var errUnknownTopoCmd = errors.New("unknown topo cmd")
+
+const defaultMaxTopoMsgSize = 1 << 20
+
+// Format is the encoding of topo body on the wire, written as a selector byte after the hash.
+// The selector is only sent to peers announced formatCmd, nodes don`t know formats send and expect
+// the protobuf body right after the hash, whose first byte is a field tag and never a known format
+type Format byte
+
+const (
+	FormatProto Format = iota
+	FormatJSON
+)
+
+// formatLegacy is the protobuf body without selector, used until peer announced formatCmd
+const formatLegacy Format = 0xff
+
+func knownFormat(b byte) bool {
+	return Format(b) == FormatProto || Format(b) == FormatJSON
+}
+
+// bodyFormat return the format of body after the hash
+func bodyFormat(body []byte) Format {
+	if len(body) > 0 && knownFormat(body[0]) {
+		return Format(body[0])
+	}
+	return formatLegacy
+}
+
+var errUnknownFormat = errors.New("unknown topo format")
+
+// record filter will be rotated when it is this full, insertion of cuckoo filter fails frequently near full
+const recordCapacity = 1000
+const maxRecordLoad = 0.9
+
+// recordFilter is implemented by *cuckoofilter.CuckooFilter
+type recordFilter interface {
+	Insert(data []byte) bool
+	Lookup(data []byte) bool
+	Count() uint
+}
+
+func newRecordFilter() recordFilter {
+	return cuckoofilter.NewCuckooFilter(recordCapacity)
+}
 
 type Config struct {
 	Addrs    []string
 	Interval int64 // second
 	Topic    string
+	// topology exceed this size will be truncated, default 1MB
+	MaxTopoMsgSize int
+	// how many peers can be written concurrently when broadcast topology, default 1
+	SendConcurrency int
+	// peers haven`t sent topo message in StaleThreshold will be disconnected,
+	// check every StalePruneInterval, 0 means never prune
+	StalePruneInterval int64 // second
+	StaleThreshold     int64 // second
+	// use this logger if not nil, so verbosity can be controlled by the embedding node
+	Logger log15.Logger
+	// externally reachable node url, override the pivot reported by p2p server, use for nodes behind NAT
+	AdvertisePivot string
+	// how many topos broadcast recently are retained, the latest one is used to compute diff, default 1
+	TopoHistory int
+	// preferred format, announced to peers after they announced formatCmd, peers not announced are sent
+	// the legacy protobuf body without selector. JSON is used only if both sides prefer it, otherwise protobuf
+	Format Format
+	// received topo older than MaxTopoAge is rejected even if it`s not in the record filter, default 60
+	MaxTopoAge int64 // second
+	// kafka writes are dropped for BreakerCooldown after BreakerThreshold consecutive producer errors
+	// within BreakerWindow, default 5 errors in 10s, cooldown 30s
+	BreakerThreshold int
+	BreakerWindow    int64 // second
+	BreakerCooldown  int64 // second
+	// new peers are rejected when MaxPeers peers are being handled, 0 means no limit
+	MaxPeers int
+	// topo is not reported to kafka until it has MinPeersToReport peers, it`s still broadcast
+	MinPeersToReport int
+	// at most MaxPeersInTopo peers are listed in the topo of self, 0 means no limit
+	MaxPeersInTopo int
+	// RequestTopo fails if peer doesn`t answer in RequestTimeout, default 10
+	RequestTimeout int64 // second
+	// broadcast to a peer fails if it`s not written in WriteTimeout, then the peer is disconnected, default 10
+	WriteTimeout int64 // second
+	// topo of self is reported to kafka only if it`s not Equal to the previous one, still broadcast every Interval
+	ReportOnChange bool
+	// kafka producer is recreated in background after ProducerMaxLifetime, 0 means never
+	ProducerMaxLifetime int64 // second
+	// name and ID of the protocol, instances run in one process should have different ones, default Name and CmdSet
+	ProtocolName string
+	ProtocolID   p2p.CmdSet
+	// topos of self reported within ReportWindow are coalesced into one kafka write of the latest,
+	// the diff is against the topo before the window, 0 means every topo is written
+	ReportWindow int64 // second
+	// received topo of clock skew beyond SkewWarnThreshold is logged, default 10
+	SkewWarnThreshold int64 // second
+	// received topos are recorded and reported but not forwarded to other peers, for collector nodes
+	NoForward bool
+	// peer is disconnected after MaxWriteFailures consecutive failed writes, default 3
+	MaxWriteFailures int
+	// peer is reported to p2p for blocking and disconnected after MaxMalformedTopos topo messages
+	// failed to deserialize, the ones before are dropped, default 3
+	MaxMalformedTopos int
+	// weights of the edges in graph are halved every GraphDecayInterval, default 60
+	GraphDecayInterval int64 // second
 }
 
 type Topology struct {
 	*Config
-	p2p       p2p.Server
-	peers     *sync.Map
-	peerCount int32 // atomic
-	prod      sarama.AsyncProducer
-	log       log15.Logger
-	term      chan struct{}
-	rec       chan *Event
-	record    *cuckoofilter.CuckooFilter
-	wg        sync.WaitGroup
+	p2p    p2p.Server
+	peers  *peerSet
+	prod   sarama.AsyncProducer
+	log    log15.Logger
+	term   chan struct{}
+	rec    chan *Event
+	record recordFilter
+	newRec func() recordFilter
+	recMu  sync.Mutex
+	graph  *TopoGraph
+	wg     sync.WaitGroup
+
+	onRotate func(inserted uint) // guarded by recMu
+
+	onError func(stage string, err error)
+	hookMu  sync.RWMutex
+
+	// guard kafka writes from a degraded broker
+	breaker *breaker
+
+	newProd    func(addrs []string) (sarama.AsyncProducer, error)
+	prodBorn   time.Time    // when prod is created, zero if unknown
+	prodMu     sync.RWMutex // guard prod and prodBorn, held while writing so prod is not closed in use
+	recreating int32        // atomic, 1 if prod is being recreated
+
+	history []*Topo // topos broadcast recently, the oldest first
+	histMu  sync.Mutex
+
+	// the latest topo to be reported at the end of ReportWindow, nil if no window is open,
+	// and the topo before the window
+	coalesced *Topo
+	coalPrev  *Topo
+	coalMu    sync.Mutex
+
+	// handlers of sub commands, keyed by msg.Cmd
+	cmds map[p2p.Cmd]CmdHandler
+
+	skew          skewRecorder
+	selfLoops     uint64 // received topos of self, atomic
+	writeTimeouts uint64 // broadcast writes timeout, atomic
+
+	started int32 // 1 after Start succeeded, atomic
+
+	// ticks of sendLoop, and tickHook is called at the end of each tick, replaced in tests before Start
+	newTicker func(d time.Duration) (c <-chan time.Time, stop func())
+	tickHook  func()
+
+	reqID   uint64                  // id of the last getTopoCmd sent, atomic
+	pending map[uint64]*topoRequest // RequestTopo waiting for reply, keyed by request id
+	pendMu  sync.Mutex
+}
+
+// topoRequest is a RequestTopo waiting for the reply of peer
+type topoRequest struct {
+	peer string
+	ch   chan *Topo
 }
 
 type Event struct {
@@ -52,20 +219,98 @@ func New(cfg *Config) *Topology {
 	if cfg.Topic == "" {
 		cfg.Topic = "p2p_status_event"
 	}
+	if cfg.ProtocolName == "" {
+		cfg.ProtocolName = Name
+	}
+	if cfg.ProtocolID == 0 {
+		cfg.ProtocolID = CmdSet
+	}
 	if cfg.Interval == 0 {
 		cfg.Interval = 5
 	}
+	if cfg.MaxTopoMsgSize == 0 {
+		cfg.MaxTopoMsgSize = defaultMaxTopoMsgSize
+	}
+	if cfg.SendConcurrency <= 0 {
+		cfg.SendConcurrency = 1
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = log15.New("module", "Topo")
+	}
+	if cfg.TopoHistory <= 0 {
+		cfg.TopoHistory = 1
+	}
+	if cfg.MaxTopoAge <= 0 {
+		cfg.MaxTopoAge = defaultMaxTopoAge
+	}
+	if cfg.BreakerThreshold <= 0 {
+		cfg.BreakerThreshold = 5
+	}
+	if cfg.BreakerWindow <= 0 {
+		cfg.BreakerWindow = 10
+	}
+	if cfg.BreakerCooldown <= 0 {
+		cfg.BreakerCooldown = 30
+	}
+	if cfg.RequestTimeout <= 0 {
+		cfg.RequestTimeout = 10
+	}
+	if cfg.WriteTimeout <= 0 {
+		cfg.WriteTimeout = 10
+	}
+	if cfg.SkewWarnThreshold <= 0 {
+		cfg.SkewWarnThreshold = 10
+	}
+	if cfg.MaxWriteFailures <= 0 {
+		cfg.MaxWriteFailures = 3
+	}
+	if cfg.MaxMalformedTopos <= 0 {
+		cfg.MaxMalformedTopos = 3
+	}
+	if cfg.GraphDecayInterval <= 0 {
+		cfg.GraphDecayInterval = 60
+	}
 
-	return &Topology{
-		Config: cfg,
-		peers:  new(sync.Map),
-		log:    log15.New("module", "Topo"),
-		rec:    make(chan *Event, 10),
-		record: cuckoofilter.NewCuckooFilter(1000),
+	window := time.Duration(cfg.BreakerWindow) * time.Second
+	cooldown := time.Duration(cfg.BreakerCooldown) * time.Second
+
+	t := &Topology{
+		Config:  cfg,
+		peers:   newPeerSet(),
+		log:     cfg.Logger,
+		rec:     make(chan *Event, 10),
+		record:  newRecordFilter(),
+		newRec:  newRecordFilter,
+		graph:   NewTopoGraph(),
+		breaker: newBreaker(cfg.BreakerThreshold, window, cooldown),
+		pending: make(map[uint64]*topoRequest),
+		cmds:    make(map[p2p.Cmd]CmdHandler),
+		newProd: newProducer,
+
+		newTicker: newTicker,
 	}
+
+	t.Register(topoCmd, t.handleTopo)
+	t.Register(formatCmd, t.handleFormat)
+	t.Register(getTopoCmd, t.handleGetTopo)
+	t.Register(topoReplyCmd, t.handleTopoReply)
+
+	return t
+}
+
+// Register set fn as the handler of messages of cmd, replace the previous one,
+// it must be called before any peer is handled
+func (t *Topology) Register(cmd p2p.Cmd, fn CmdHandler) {
+	t.cmds[cmd] = fn
+}
+
+// Graph return the collector of all topos received
+func (t *Topology) Graph() *TopoGraph {
+	return t.graph
 }
 
 var errMissingP2P = errors.New("missing p2p server")
+var errTopoTooLarge = errors.New("topo message is too large")
 
 func (t *Topology) Start(p2p p2p.Server) error {
 	t.term = make(chan struct{})
@@ -75,9 +320,13 @@ func (t *Topology) Start(p2p p2p.Server) error {
 	}
 	t.p2p = p2p
 
+	if err := validPivot(t.pivot()); err != nil {
+		t.log.Error(fmt.Sprintf("invalid self pivot %s: %v", t.pivot(), err))
+		return err
+	}
+
 	if len(t.Config.Addrs) > 0 {
-		config := sarama.NewConfig()
-		prod, err := sarama.NewAsyncProducer(t.Config.Addrs, config)
+		prod, err := t.newProd(t.Config.Addrs)
 
 		if err != nil {
 			t.log.Error(fmt.Sprintf("create topo producer error: %v", err))
@@ -85,7 +334,14 @@ func (t *Topology) Start(p2p p2p.Server) error {
 		}
 
 		t.log.Info("topo producer created")
+		t.prodMu.Lock()
 		t.prod = prod
+		t.prodBorn = time.Now()
+		t.prodMu.Unlock()
+
+		common.Go(func() {
+			t.watchProducer(prod)
+		})
 	}
 
 	t.wg.Add(1)
@@ -94,274 +350,1727 @@ func (t *Topology) Start(p2p p2p.Server) error {
 	t.wg.Add(1)
 	common.Go(t.handleLoop)
 
+	if t.StalePruneInterval > 0 && t.StaleThreshold > 0 {
+		t.wg.Add(1)
+		common.Go(t.pruneLoop)
+	}
+
+	t.wg.Add(1)
+	common.Go(t.decayLoop)
+
+	atomic.StoreInt32(&t.started, 1)
+
 	return nil
 }
 
+// pivot is AdvertisePivot if configured, else the url of p2p server, empty if neither is known before Start
+func (t *Topology) pivot() string {
+	if t.AdvertisePivot != "" {
+		return t.AdvertisePivot
+	}
+	if t.p2p == nil {
+		return ""
+	}
+	return t.p2p.URL()
+}
+
+// isSelf return true if pivot is the url of self, false if self url is unknown yet
+func (t *Topology) isSelf(pivot string) bool {
+	self := t.pivot()
+	return self != "" && pivot == self
+}
+
+// validPivot check the pivot is a valid node url, malformed pivot will pollute the topology graph
+func validPivot(pivot string) error {
+	_, err := discovery.ParseNode(pivot)
+	return err
+}
+
 func (t *Topology) Stop() {
+	if err := t.Shutdown(context.Background()); err != nil {
+		t.log.Error(fmt.Sprintf("topo shutdown error: %v", err))
+	}
+}
+
+// Shutdown stop sending and handling topo, disconnect all peers, then flush and close the kafka producer,
+// return error if ctx is done before all the steps finished, the remaining steps continue in background
+func (t *Topology) Shutdown(ctx context.Context) error {
 	if t.term == nil {
-		return
+		return nil
 	}
 
 	select {
 	case <-t.term:
+		return nil
 	default:
-		t.log.Info("topo stop")
+	}
+
+	t.log.Info("topo stop")
+	close(t.term)
+
+	for _, p := range t.peers.snapshot() {
+		p.disconnect(p2p.DiscQuitting)
+	}
+
+	if err := waitContext(ctx, t.wg.Wait); err != nil {
+		return errors.Wrap(err, "wait topo loops")
+	}
 
-		close(t.term)
+	t.prodMu.RLock()
+	prod := t.prod
+	t.prodMu.RUnlock()
 
-		if t.prod != nil {
-			t.prod.Close()
+	if prod != nil {
+		err := waitContext(ctx, func() {
+			if err := prod.Close(); err != nil {
+				t.log.Error(fmt.Sprintf("close topo producer error: %v", err))
+			}
+		})
+		if err != nil {
+			return errors.Wrap(err, "flush topo producer")
 		}
+	}
+
+	t.log.Info("topo stopped")
+	return nil
+}
 
-		t.wg.Wait()
+// waitContext run fn in another goroutine, return ctx.Err() if ctx is done before fn returned
+func waitContext(ctx context.Context, fn func()) error {
+	done := make(chan struct{})
+	common.Go(func() {
+		fn()
+		close(done)
+	})
 
-		t.log.Info("topo stopped")
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
 }
 
+// a topo message received from or forwarded to a peer will not be forwarded to it again in this window
+const dupForwardWindow = 30 * time.Second
+
 type Peer struct {
 	*p2p.Peer
+	id    string
 	rw    p2p.MsgReadWriter
 	errch chan error // async handle msg, error report to this channel
+
+	cancel     chan struct{} // closed by DisconnectPeer or when handle returns, stop handling this peer only
+	cancelOnce sync.Once
+
+	disconnect func(reason p2p.DiscReason)
+	property   func() *p2p.ConnProperty
+	remote     func() (discovery.NodeID, net.IP)
+	created    time.Time
+
+	mu       sync.Mutex
+	lastHash []byte // hash of the last topo message received from or forwarded to this peer
+	lastTime time.Time
+	lastRecv time.Time // the last time receive topo message from this peer
+	recvs    uint64    // topo messages received from this peer
+	forwards uint64    // topo messages broadcast or forwarded to this peer
+	failures int       // consecutive failed writes to this peer, reset by a successful one
+	badTopos int       // topo messages from this peer failed to deserialize
+	format   Format    // format negotiated with this peer, formatLegacy until peer announced formatCmd
+	announce bool      // formatCmd has been sent to this peer
+	answered time.Time // the last time getTopoCmd from this peer was answered
 }
 
-func (t *Topology) Handle(p *p2p.Peer, rw *p2p.ProtoFrame) error {
-	peer := &Peer{p, rw, make(chan error)}
-	t.peers.Store(p.String(), peer)
-	defer t.peers.Delete(p.String())
+func newPeer(p *p2p.Peer, rw p2p.MsgReadWriter) *Peer {
+	return &Peer{
+		Peer:       p,
+		id:         p.String(),
+		rw:         rw,
+		errch:      make(chan error),
+		cancel:     make(chan struct{}),
+		disconnect: p.Disconnect,
+		property:   p.GetConnProperty,
+		remote: func() (discovery.NodeID, net.IP) {
+			return p.ID(), p.RemoteAddr().IP
+		},
+		created: time.Now(),
+		format:  formatLegacy,
+	}
+}
 
-	atomic.AddInt32(&t.peerCount, 1)
-	defer atomic.AddInt32(&t.peerCount, ^int32(0))
+func (p *Peer) stop() {
+	p.cancelOnce.Do(func() {
+		close(p.cancel)
+	})
+}
 
-	for {
-		select {
-		case <-t.term:
-			return nil
-		case err := <-peer.errch:
-			return err
-		default:
-			msg, err := rw.ReadMsg()
-			if err != nil {
-				t.log.Error(fmt.Sprintf("read msg error: %v", err))
-				return err
-			}
+func (p *Peer) received() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
 
-			if msg.Cmd != topoCmd {
-				t.log.Error(fmt.Sprintf("not topoMsg cmd: %d", msg.Cmd))
-				return nil
-			}
+	p.lastRecv = time.Now()
+	p.recvs++
+}
 
-			length := len(msg.Payload)
+func (p *Peer) forwarded() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
 
-			if length < 32 {
-				return fmt.Errorf("receive invalid topoMsg from %s", p)
-			}
+	p.forwards++
+	p.failures = 0
+}
 
-			t.rec <- &Event{
-				msg:    msg,
-				sender: peer,
-			}
-		}
+// writeFailed return the count of consecutive failed writes include this one
+func (p *Peer) writeFailed() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.failures++
+	return p.failures
+}
+
+// malformedTopo return the count of topo messages failed to deserialize include this one
+func (p *Peer) malformedTopo() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.badTopos++
+	return p.badTopos
+}
+
+// PeerStat is the count of topo messages exchanged with a peer
+type PeerStat struct {
+	Received  uint64 `json:"received"`
+	Forwarded uint64 `json:"forwarded"`
+}
+
+func (p *Peer) stat() PeerStat {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return PeerStat{
+		Received:  p.recvs,
+		Forwarded: p.forwards,
 	}
 }
 
-func (t *Topology) handleLoop() {
-	defer t.wg.Done()
+// stale means peer hasn`t sent topo message in threshold since connected
+func (p *Peer) stale(threshold time.Duration) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
 
-	for {
-		select {
-		case <-t.term:
-			return
-		case e := <-t.rec:
-			t.Receive(e.msg, e.sender)
-		}
+	last := p.created
+	if p.lastRecv.After(last) {
+		last = p.lastRecv
 	}
+
+	return time.Now().Sub(last) > threshold
 }
 
-func (t *Topology) sendLoop() {
-	defer t.wg.Done()
+func (p *Peer) setFormat(format Format) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
 
-	ticker := time.NewTicker(time.Duration(t.Config.Interval * int64(time.Second)))
-	defer ticker.Stop()
+	p.format = format
+}
 
-	for {
-		select {
-		case <-t.term:
-			return
+func (p *Peer) getFormat() Format {
+	p.mu.Lock()
+	defer p.mu.Unlock()
 
-		case <-ticker.C:
-			monitor.LogEvent("topo", "send")
-			topo := t.Topology()
+	return p.format
+}
 
-			data, err := topo.Serialize()
-			if err != nil {
-				t.log.Error(fmt.Sprintf("serialize topo error: %v", err))
-			} else {
-				t.peers.Range(func(key, value interface{}) bool {
-					peer := value.(*Peer)
-					peer.rw.WriteMsg(&p2p.Msg{
-						CmdSet:  CmdSet,
-						Cmd:     topoCmd,
-						Payload: data,
-					})
-					return true
-				})
-
-				t.write(t.Topic, topo.Json())
-			}
-		}
+// announced return false if formatCmd has been sent to peer, else mark it sent and return true
+func (p *Peer) announced() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.announce {
+		return false
 	}
+	p.announce = true
+	return true
 }
 
-// the first item is self url
-func (t *Topology) Topology() *Topo {
-	topo := &Topo{
-		Pivot: t.p2p.URL(),
-		Peers: make([]*p2p.ConnProperty, 0, 10),
-		Time:  UnixTime(time.Now()),
+// answerable return false if getTopoCmd from peer has been answered within interval, else mark it answered now
+func (p *Peer) answerable(interval time.Duration) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(p.answered) < interval {
+		return false
 	}
+	p.answered = now
+	return true
+}
 
-	t.peers.Range(func(key, value interface{}) bool {
-		p := value.(*Peer)
-		topo.Peers = append(topo.Peers, p.GetConnProperty())
-		return true
-	})
+// seen record the peer has the topo message
+func (p *Peer) seen(hash []byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
 
-	return topo
+	p.lastHash = hash
+	p.lastTime = time.Now()
 }
 
-func (t *Topology) Receive(msg *p2p.Msg, sender *Peer) {
-	defer msg.Recycle()
+func (p *Peer) hasSeen(hash []byte) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
 
-	if len(msg.Payload) < 32 {
-		return
-	}
+	return bytes.Equal(p.lastHash, hash) && time.Now().Sub(p.lastTime) < dupForwardWindow
+}
 
-	hash := msg.Payload[:32]
-	if t.record.Lookup(hash) {
-		return
-	}
+func (t *Topology) Handle(p *p2p.Peer, rw *p2p.ProtoFrame) error {
+	return t.handle(newPeer(p, rw))
+}
 
-	topo := new(Topo)
-	err := topo.Deserialize(msg.Payload[32:])
-	if err != nil {
-		t.log.Error(fmt.Sprintf("deserialize topoMsg error: %v", err))
-		sender.errch <- err
-		return
+// DisconnectPeer stop handling the peer, Handle of the peer will return p2p.DiscRequested
+func (t *Topology) DisconnectPeer(id string) {
+	if peer := t.peers.get(id); peer != nil {
+		peer.stop()
 	}
+}
 
-	monitor.LogEvent("topo", "receive")
+type readResult struct {
+	msg *p2p.Msg
+	err error
+}
 
-	t.record.InsertUnique(hash)
-	// broadcast to other peer
-	var count int32 = 0
-	t.peers.Range(func(key, value interface{}) bool {
-		id := key.(string)
-		p := value.(*Peer)
-		if id != sender.String() {
-			p.rw.WriteMsg(msg)
-			count++
+// readLoop read messages into ch, so handle can select on them together with cancel
+func (p *Peer) readLoop(ch chan<- readResult, done <-chan struct{}) {
+	for {
+		msg, err := p.rw.ReadMsg()
+
+		select {
+		case ch <- readResult{msg, err}:
+		case <-done:
+			return
 		}
 
-		// just broadcast to 1/3 peers
-		//if count > t.peerCount/3 {
-		//	return false
-		//}
+		if err != nil {
+			return
+		}
+	}
+}
 
-		return true
+func (t *Topology) handle(peer *Peer) error {
+	if !t.peers.tryAdd(peer, t.MaxPeers) {
+		t.log.Warn(fmt.Sprintf("reject peer %s, already handle %d peers", peer.id, t.MaxPeers))
+		return p2p.DiscTooManyPeers
+	}
+	defer t.peers.remove(peer.id)
+	// nobody receives from errch any more, unblock the senders
+	defer peer.stop()
+
+	// formatCmd is not sent until peer announced it, nodes don`t know it will disconnect
+	done := make(chan struct{})
+	defer close(done)
+
+	reads := make(chan readResult)
+	common.Go(func() {
+		peer.readLoop(reads, done)
 	})
 
-	t.write("p2p_status_event", topo.Json())
-}
+	for {
+		select {
+		case <-t.term:
+			return nil
+		case <-peer.cancel:
+			return p2p.DiscRequested
+		case err := <-peer.errch:
+			return err
+		case res := <-reads:
+			msg, err := res.msg, res.err
+			if err != nil {
+				t.log.Error(fmt.Sprintf("read msg error: %v", err))
+				return err
+			}
 
-func (t *Topology) write(topic string, data []byte) {
-	if t.prod == nil {
-		return
-	}
+			fn, ok := t.cmds[msg.Cmd]
+			if !ok {
+				t.log.Error(fmt.Sprintf("not topoMsg cmd: %d", msg.Cmd))
+				msg.Recycle()
+				return errors.Wrapf(errUnknownTopoCmd, "cmd %d from %s", msg.Cmd, peer.id)
+			}
 
-	t.prod.Input() <- &sarama.ProducerMessage{
-		Topic:     topic,
-		Value:     sarama.ByteEncoder(data),
-		Timestamp: time.Now(),
+			if err = fn(msg, peer); err != nil {
+				return err
+			}
+		}
 	}
-
-	monitor.LogEvent("topo", "report")
 }
 
-func (t *Topology) Protocol() *p2p.Protocol {
-	return &p2p.Protocol{
-		Name:   Name,
-		ID:     CmdSet,
-		Handle: t.Handle,
+// handleTopo hand topo message to handleLoop, it will be received and forwarded
+func (t *Topology) handleTopo(msg *p2p.Msg, peer *Peer) error {
+	if len(msg.Payload) < 32 {
+		return fmt.Errorf("receive invalid topoMsg from %s", peer.id)
 	}
-}
 
-// @section topo
-type UnixTime time.Time
+	peer.seen(msg.Payload[:32])
+	peer.received()
 
-func (t UnixTime) MarshalJSON() ([]byte, error) {
-	stamp := fmt.Sprintf("%d", t.Unix())
-	return []byte(stamp), nil
+	select {
+	case t.rec <- &Event{
+		msg:    msg,
+		sender: peer,
+	}:
+	case <-t.term:
+		// handle will return when term is checked again
+	case <-peer.cancel:
+		return p2p.DiscRequested
+	}
+
+	return nil
 }
 
-func (t *UnixTime) UnmarshalJSON(data []byte) (err error) {
-	i64, err := strconv.ParseInt(string(data), 10, 64)
-	if err != nil {
-		return
-	}
+func (t *Topology) handleFormat(msg *p2p.Msg, peer *Peer) error {
+	defer msg.Recycle()
 
-	*t = UnixTime(time.Unix(i64, 0))
+	t.negotiate(peer, msg.Payload)
+	t.announce(peer)
 	return nil
 }
 
-func (t UnixTime) Unix() int64 {
-	return time.Time(t).Unix()
+func (t *Topology) handleGetTopo(msg *p2p.Msg, peer *Peer) error {
+	defer msg.Recycle()
+
+	return t.answer(peer, msg.Payload)
 }
 
-type Topo struct {
-	Pivot string              `json:"pivot,omitempty"`
-	Peers []*p2p.ConnProperty `json:"peers,omitempty"`
-	Time  UnixTime            `json:"time,omitempty"`
+func (t *Topology) handleTopoReply(msg *p2p.Msg, peer *Peer) error {
+	defer msg.Recycle()
+
+	return t.resolve(peer, msg.Payload)
 }
 
-// add Hash(32bit) to Front, use for determine if it has been received
-func (t *Topo) Serialize() ([]byte, error) {
-	pbs := make([]*protos.ConnProperty, len(t.Peers))
+var errPeerNotFound = errors.New("peer not found")
+var errTopoRequestTimeout = errors.New("topo request timeout")
+var errInvalidTopoRequest = errors.New("invalid topo request")
+var errTopoRequestUnsupported = errors.New("peer can`t answer topo request")
+var errTopologyStopped = errors.New("topology stopped")
+
+// RequestTopo ask the peer for its current topology and wait for the reply,
+// so a fresh node can learn the topology without waiting for the next broadcast.
+// the reply is added to the graph, but not recorded or forwarded as a broadcast topo.
+// peer hasn`t announced formatCmd may not know getTopoCmd, and will disconnect when receive it, so it`s not asked.
+func (t *Topology) RequestTopo(peerID string) (*Topo, error) {
+	peer := t.peers.get(peerID)
+	if peer == nil {
+		return nil, errPeerNotFound
+	}
 
-	for i, cp := range t.Peers {
-		pbs[i] = cp.Proto()
+	if peer.getFormat() == formatLegacy {
+		return nil, errors.Wrapf(errTopoRequestUnsupported, "request topo from %s", peerID)
 	}
 
-	data, err := proto.Marshal(&protos.Topo{
-		Pivot: t.Pivot,
-		Peers: pbs,
-		Time:  t.Time.Unix(),
-	})
+	id := atomic.AddUint64(&t.reqID, 1)
+	ch := make(chan *Topo, 1)
 
-	if err != nil {
-		return nil, err
-	}
+	t.pendMu.Lock()
+	t.pending[id] = &topoRequest{peer: peer.id, ch: ch}
+	t.pendMu.Unlock()
 
-	hash := crypto.Hash(32, data)
+	defer func() {
+		t.pendMu.Lock()
+		delete(t.pending, id)
+		t.pendMu.Unlock()
+	}()
 
-	return append(hash, data...), nil
-}
+	payload := make([]byte, 8)
+	binary.BigEndian.PutUint64(payload, id)
 
-func (t *Topo) Deserialize(buf []byte) error {
-	pb := new(protos.Topo)
-	err := proto.Unmarshal(buf, pb)
+	err := peer.rw.WriteMsg(&p2p.Msg{
+		CmdSet:  t.ProtocolID,
+		Cmd:     getTopoCmd,
+		Payload: payload,
+	})
 	if err != nil {
-		return err
+		return nil, errors.Wrapf(err, "request topo from %s", peerID)
 	}
 
-	for _, cpb := range pb.Peers {
-		cp := new(p2p.ConnProperty)
+	timer := time.NewTimer(time.Duration(t.RequestTimeout * int64(time.Second)))
+	defer timer.Stop()
+
+	select {
+	case topo := <-ch:
+		return topo, nil
+	case <-peer.cancel:
+		return nil, errors.Wrapf(p2p.DiscRequested, "request topo from %s", peerID)
+	case <-t.term:
+		return nil, errTopologyStopped
+	case <-timer.C:
+		return nil, errors.Wrapf(errTopoRequestTimeout, "request topo from %s", peerID)
+	}
+}
+
+// answer getTopoCmd with current topology of self, in the format negotiated with peer,
+// at most one request of each peer is answered every Interval, the others are dropped
+func (t *Topology) answer(peer *Peer, payload []byte) error {
+	if len(payload) != 8 {
+		return errInvalidTopoRequest
+	}
+
+	if !peer.answerable(time.Duration(t.Config.Interval * int64(time.Second))) {
+		t.log.Warn(fmt.Sprintf("receive topo request from %s too frequently, drop it", peer.id))
+		return nil
+	}
+
+	data, err := t.serialize(t.Topology(), peer.getFormat())
+	if err != nil {
+		t.log.Error(fmt.Sprintf("serialize topo to %s error: %v", peer.id, err))
+		return nil
+	}
+
+	return peer.rw.WriteMsg(&p2p.Msg{
+		CmdSet:  t.ProtocolID,
+		Cmd:     topoReplyCmd,
+		Payload: append(append(make([]byte, 0, 8+len(data)), payload...), data...),
+	})
+}
+
+// resolve hand the reply of topoReplyCmd to the RequestTopo waiting for it,
+// unsolicited reply and reply from other peers than the requested one are dropped
+func (t *Topology) resolve(peer *Peer, payload []byte) error {
+	if len(payload) < 8+32 || len(payload) > 8+t.MaxTopoMsgSize {
+		return errInvalidTopoRequest
+	}
+
+	id := binary.BigEndian.Uint64(payload)
+
+	t.pendMu.Lock()
+	req, ok := t.pending[id]
+	t.pendMu.Unlock()
+
+	if !ok || req.peer != peer.id {
+		t.log.Warn(fmt.Sprintf("receive unsolicited topo reply %d from %s", id, peer.id))
+		return nil
+	}
+
+	topo := new(Topo)
+	if err := topo.Deserialize(payload[8+32:]); err != nil {
+		return err
+	}
+
+	if err := validPivot(topo.Pivot); err != nil {
+		t.log.Warn(fmt.Sprintf("receive topo reply of invalid pivot %s from %s: %v", topo.Pivot, peer.id, err))
+		return nil
+	}
+
+	if t.isSelf(topo.Pivot) {
+		t.log.Warn(fmt.Sprintf("receive topo reply of self from %s", peer.id))
+		return nil
+	}
+
+	if err := t.checkTime(topo); err != nil {
+		t.log.Warn(fmt.Sprintf("receive topo reply of %s from %s: %v", topo.Pivot, peer.id, err))
+		return nil
+	}
+
+	t.graph.AddTopo(topo)
+
+	select {
+	case req.ch <- topo:
+	default:
+	}
+
+	return nil
+}
+
+const defaultMaxTopoAge = 60
+
+// topo generated later than now + maxTopoClockSkew is considered forged
+const maxTopoClockSkew = 30 * time.Second
+
+var errTopoExpired = errors.New("topo expired")
+var errTopoFuture = errors.New("topo time is in the future")
+
+// checkTime reject replayed stale topo, which may be evicted from the record filter already,
+// and topo dated in the future, which will be kept as the latest one of its pivot
+func (t *Topology) checkTime(topo *Topo) error {
+	now := time.Now()
+	tt := time.Time(topo.Time)
+
+	if now.Sub(tt) > time.Duration(t.MaxTopoAge*int64(time.Second)) {
+		return errTopoExpired
+	}
+	if tt.Sub(now) > maxTopoClockSkew {
+		return errTopoFuture
+	}
+
+	return nil
+}
+
+// negotiate the format will be sent to peer, according to the announcement from peer
+func (t *Topology) negotiate(peer *Peer, payload []byte) {
+	if len(payload) == 1 && t.Format == FormatJSON && Format(payload[0]) == FormatJSON {
+		peer.setFormat(FormatJSON)
+	} else {
+		peer.setFormat(FormatProto)
+	}
+}
+
+// announce send the preferred format to peer once, it`s called after peer announced formatCmd,
+// by sending formatCmd or its own topo marked Formats, peer use legacy format until then
+func (t *Topology) announce(peer *Peer) {
+	if !peer.announced() {
+		return
+	}
+
+	err := peer.rw.WriteMsg(&p2p.Msg{
+		CmdSet:  t.ProtocolID,
+		Cmd:     formatCmd,
+		Payload: []byte{byte(t.Format)},
+	})
+	if err != nil {
+		t.log.Warn(fmt.Sprintf("announce format to %s error: %v", peer.id, err))
+		t.writeFailed(peer, err)
+	}
+}
+
+// fromPivot return true if topo is sent by its pivot, not forwarded
+func fromPivot(topo *Topo, sender *Peer) bool {
+	node, err := discovery.ParseNode(topo.Pivot)
+	if err != nil {
+		return false
+	}
+
+	id, _ := sender.remote()
+	return node.ID == id
+}
+
+// Peers return a snapshot of the peers running topo protocol
+func (t *Topology) Peers() []*Peer {
+	return t.peers.snapshot()
+}
+
+// observeSkew record the clock skew of topo, include the propagation delay
+func (t *Topology) observeSkew(topo *Topo, sender *Peer) {
+	skew := time.Since(time.Time(topo.Time))
+	t.skew.observe(skew)
+
+	threshold := time.Duration(t.SkewWarnThreshold * int64(time.Second))
+	if skew > threshold || skew < -threshold {
+		t.log.Warn(fmt.Sprintf("receive topo of %s from %s, clock skew %s", topo.Pivot, sender.id, skew))
+	}
+}
+
+func (t *Topology) handleLoop() {
+	defer t.wg.Done()
+
+	for {
+		select {
+		case <-t.term:
+			return
+		case e := <-t.rec:
+			t.Receive(e.msg, e.sender)
+		}
+	}
+}
+
+func (t *Topology) pruneLoop() {
+	defer t.wg.Done()
+
+	ticker := time.NewTicker(time.Duration(t.StalePruneInterval * int64(time.Second)))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-t.term:
+			return
+		case <-ticker.C:
+			t.pruneStale()
+		}
+	}
+}
+
+// decayLoop prune the graph every GraphDecayInterval, so edges not observed any more fade out
+func (t *Topology) decayLoop() {
+	defer t.wg.Done()
+
+	ticker := time.NewTicker(time.Duration(t.GraphDecayInterval * int64(time.Second)))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-t.term:
+			return
+		case <-ticker.C:
+			t.graph.Prune()
+		}
+	}
+}
+
+// pruneStale disconnect peers haven`t sent topo message in StaleThreshold, they are likely dead
+func (t *Topology) pruneStale() {
+	threshold := time.Duration(t.StaleThreshold * int64(time.Second))
+
+	for _, p := range t.peers.snapshot() {
+		if p.stale(threshold) {
+			t.log.Warn(fmt.Sprintf("disconnect stale peer %s", p.id))
+			p.disconnect(p2p.DiscUselessPeer)
+		}
+	}
+}
+
+func (t *Topology) sendLoop() {
+	defer t.wg.Done()
+
+	ticks, stop := t.newTicker(time.Duration(t.Config.Interval * int64(time.Second)))
+	defer stop()
+
+	for {
+		select {
+		case <-t.term:
+			return
+
+		case <-ticks:
+			monitor.LogEvent("topo", "send")
+			t.send(t.Topology())
+
+			if t.tickHook != nil {
+				t.tickHook()
+			}
+		}
+	}
+}
+
+func newTicker(d time.Duration) (<-chan time.Time, func()) {
+	ticker := time.NewTicker(d)
+	return ticker.C, ticker.Stop
+}
+
+// ErrTopoNotStarted is returned by Flush before Start, self pivot is unknown yet
+var ErrTopoNotStarted = errors.New("topo is not started")
+
+// Flush report and broadcast the current topology now, instead of waiting for the next tick
+func (t *Topology) Flush() error {
+	if atomic.LoadInt32(&t.started) == 0 {
+		return ErrTopoNotStarted
+	}
+
+	select {
+	case <-t.term:
+		return errTopologyStopped
+	default:
+	}
+
+	t.send(t.Topology())
+	return nil
+}
+
+// send report topo, then broadcast it to peers
+func (t *Topology) send(topo *Topo) {
+	t.report(topo)
+
+	data, err := t.encode(topo)
+	if err != nil {
+		t.log.Error(fmt.Sprintf("serialize topo error: %v", err))
+		t.fireError("serialize", err)
+		return
+	}
+
+	for id, err := range t.broadcast(data) {
+		t.log.Warn(fmt.Sprintf("send topo to %s error: %v", id, err))
+		t.fireError("write", errors.Wrapf(err, "send topo to %s", id))
+	}
+}
+
+// RegisterMetrics expose Metrics and FilterLoad by reg, the values are sampled when collected
+func (t *Topology) RegisterMetrics(reg monitor.Registerer) error {
+	metrics := []struct {
+		name, help string
+		counter    bool
+		fn         func() float64
+	}{
+		{"topo_peers", "peers being handled", false, func() float64 {
+			return float64(t.peers.size())
+		}},
+		{"topo_breaker_open", "1 if kafka writes are dropped by the circuit breaker", false, func() float64 {
+			if state, _ := t.breaker.status(); state == breakerOpen {
+				return 1
+			}
+			return 0
+		}},
+		{"topo_filter_load", "occupancy fraction of the filter recording received topo", false, t.FilterLoad},
+		{"topo_kafka_dropped_total", "kafka writes dropped while the breaker is open", true, func() float64 {
+			return float64(t.Metrics().Dropped)
+		}},
+		{"topo_self_loops_total", "received topos of self", true, func() float64 {
+			return float64(atomic.LoadUint64(&t.selfLoops))
+		}},
+		{"topo_write_timeouts_total", "broadcast writes timeout", true, func() float64 {
+			return float64(atomic.LoadUint64(&t.writeTimeouts))
+		}},
+	}
+
+	for _, m := range metrics {
+		var err error
+		if m.counter {
+			err = reg.RegisterCounter(m.name, m.help, m.fn)
+		} else {
+			err = reg.RegisterGauge(m.name, m.help, m.fn)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "register %s", m.name)
+		}
+	}
+
+	return nil
+}
+
+// OnError set fn to be called when topo failed to be sent, stage is "serialize" or "write",
+// nil means no callback
+func (t *Topology) OnError(fn func(stage string, err error)) {
+	t.hookMu.Lock()
+	defer t.hookMu.Unlock()
+
+	t.onError = fn
+}
+
+func (t *Topology) fireError(stage string, err error) {
+	t.hookMu.RLock()
+	fn := t.onError
+	t.hookMu.RUnlock()
+
+	if fn != nil {
+		fn(stage, err)
+	}
+}
+
+const topoDiffTopic = "p2p_topo_diff"
+
+// report write the whole topo, and the diff from the last one if anything changed,
+// nothing is written until topo has MinPeersToReport peers, but topo is still retained
+func (t *Topology) report(topo *Topo) {
+	prev := t.retain(topo)
+
+	if len(topo.Peers) < t.MinPeersToReport {
+		return
+	}
+
+	if t.ReportOnChange && prev != nil && prev.Equal(topo) {
+		return
+	}
+
+	if t.ReportWindow > 0 {
+		t.coalesce(prev, topo)
+		return
+	}
+
+	t.writeTopo(prev, topo)
+}
+
+// coalesce keep topo as the latest one to be reported, open a window if there is none
+func (t *Topology) coalesce(prev, topo *Topo) {
+	t.coalMu.Lock()
+	defer t.coalMu.Unlock()
+
+	if t.coalesced == nil {
+		t.coalPrev = prev
+
+		// report is called by sendLoop, so the WaitGroup is not zero
+		t.wg.Add(1)
+		common.Go(func() {
+			defer t.wg.Done()
+
+			timer := time.NewTimer(time.Duration(t.ReportWindow * int64(time.Second)))
+			defer timer.Stop()
+
+			select {
+			case <-timer.C:
+				t.flushCoalesced()
+			case <-t.term:
+			}
+		})
+	}
+
+	t.coalesced = topo
+}
+
+func (t *Topology) flushCoalesced() {
+	t.coalMu.Lock()
+	prev, topo := t.coalPrev, t.coalesced
+	t.coalPrev, t.coalesced = nil, nil
+	t.coalMu.Unlock()
+
+	if topo != nil {
+		t.writeTopo(prev, topo)
+	}
+}
+
+// writeTopo write topo and the diff from prev to kafka
+func (t *Topology) writeTopo(prev, topo *Topo) {
+	t.write(t.Topic, topo.Json())
+
+	if prev != nil {
+		if diff := DiffTopo(prev, topo); !diff.Empty() {
+			t.write(topoDiffTopic, diff.Json())
+		}
+	}
+}
+
+// retain topo into history, return the previous one, nil if history is empty
+func (t *Topology) retain(topo *Topo) (prev *Topo) {
+	t.histMu.Lock()
+	defer t.histMu.Unlock()
+
+	if n := len(t.history); n > 0 {
+		prev = t.history[n-1]
+	}
+
+	t.history = append(t.history, topo)
+	if len(t.history) > t.TopoHistory {
+		t.history = t.history[len(t.history)-t.TopoHistory:]
+	}
+
+	return
+}
+
+// History return at most TopoHistory topos broadcast recently, the oldest first
+func (t *Topology) History() []*Topo {
+	t.histMu.Lock()
+	defer t.histMu.Unlock()
+
+	history := make([]*Topo, len(t.history))
+	copy(history, t.history)
+
+	return history
+}
+
+// encode topo in protobuf with and without selector, and in JSON if it is preferred. JSON is encoded first,
+// because it is larger and may truncate more peers, so all encodings carry the same peers and the same hash
+func (t *Topology) encode(topo *Topo) (map[Format][]byte, error) {
+	data := make(map[Format][]byte, 3)
+
+	if t.Format == FormatJSON {
+		buf, err := t.serialize(topo, FormatJSON)
+		if err != nil {
+			return nil, err
+		}
+		data[FormatJSON] = buf
+	}
+
+	buf, err := t.serialize(topo, FormatProto)
+	if err != nil {
+		return nil, err
+	}
+	data[FormatProto] = buf
+	data[formatLegacy] = stripSelector(buf)
+
+	return data, nil
+}
+
+// stripSelector return the legacy message of data in FormatProto, the hash is kept
+func stripSelector(data []byte) []byte {
+	legacy := make([]byte, 0, len(data)-1)
+	legacy = append(legacy, data[:32]...)
+	return append(legacy, data[33:]...)
+}
+
+// broadcast write topo message to all peers in the format negotiated with each peer, protobuf if absent,
+// at most SendConcurrency peers are written at the same time, return errors keyed by peer id
+func (t *Topology) broadcast(data map[Format][]byte) map[string]error {
+	var errs = make(map[string]error)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, t.SendConcurrency)
+
+	for _, peer := range t.peers.snapshot() {
+		peer := peer
+		payload, ok := data[peer.getFormat()]
+		if !ok {
+			payload = data[FormatProto]
+		}
+
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			err := t.writeMsg(peer, &p2p.Msg{
+				CmdSet:  t.ProtocolID,
+				Cmd:     topoCmd,
+				Payload: payload,
+			})
+
+			if err == errWriteTimeout {
+				atomic.AddUint64(&t.writeTimeouts, 1)
+				peer.disconnect(p2p.DiscNetworkError)
+			} else if err != nil {
+				t.writeFailed(peer, err)
+			}
+
+			if err != nil {
+				mu.Lock()
+				errs[peer.id] = err
+				mu.Unlock()
+				return
+			}
+
+			peer.forwarded()
+		}()
+	}
+
+	wg.Wait()
+
+	return errs
+}
+
+// malformed drop the topo message failed to deserialize, report sender to p2p for blocking
+// and disconnect it at the MaxMalformedTopos one, later ones before disconnected are dropped only
+func (t *Topology) malformed(peer *Peer, err error) {
+	n := peer.malformedTopo()
+	if n != t.MaxMalformedTopos {
+		return
+	}
+
+	t.log.Warn(fmt.Sprintf("block %s after %d malformed topos: %v", peer.id, n, err))
+	if t.p2p != nil {
+		id, ip := peer.remote()
+		t.p2p.Block(id, ip, err)
+	}
+
+	// handle of peer may have returned, it closed cancel then
+	select {
+	case peer.errch <- err:
+	case <-peer.cancel:
+	case <-t.term:
+	}
+}
+
+var errWriteTimeout = errors.New("write topo timeout")
+
+// writeFailed disconnect peer and stop handling it after MaxWriteFailures consecutive failed writes
+func (t *Topology) writeFailed(peer *Peer, err error) {
+	if n := peer.writeFailed(); n >= t.MaxWriteFailures {
+		t.log.Warn(fmt.Sprintf("disconnect %s after %d failed writes: %v", peer.id, n, err))
+		peer.disconnect(p2p.DiscNetworkError)
+		t.peers.remove(peer.id)
+	}
+}
+
+// writeMsg return errWriteTimeout if msg can`t be written to peer in WriteTimeout,
+// the stalled write is left behind, it will return when the connection is closed
+func (t *Topology) writeMsg(peer *Peer, msg *p2p.Msg) error {
+	errch := make(chan error, 1)
+	common.Go(func() {
+		errch <- peer.rw.WriteMsg(msg)
+	})
+
+	timer := time.NewTimer(time.Duration(t.WriteTimeout * int64(time.Second)))
+	defer timer.Stop()
+
+	select {
+	case err := <-errch:
+		return err
+	case <-timer.C:
+		return errWriteTimeout
+	}
+}
+
+// serialize topo, if the message exceed MaxTopoMsgSize, peers will be truncated
+// until it fits, the pivot is always kept
+func (t *Topology) serialize(topo *Topo, format Format) (data []byte, err error) {
+	if format == formatLegacy {
+		if data, err = t.serialize(topo, FormatProto); err != nil {
+			return nil, err
+		}
+		return stripSelector(data), nil
+	}
+
+	// truncate a shallow copy, topo may be kept in history
+	topo = &Topo{
+		Pivot:     topo.Pivot,
+		Peers:     topo.Peers,
+		Time:      topo.Time,
+		Truncated: topo.Truncated,
+		Formats:   topo.Formats,
+	}
+
+	for {
+		if data, err = topo.SerializeFormat(format); err != nil {
+			return nil, err
+		}
+
+		if len(data) <= t.MaxTopoMsgSize {
+			return data, nil
+		}
+
+		if len(topo.Peers) == 0 {
+			return nil, errTopoTooLarge
+		}
+
+		t.log.Warn(fmt.Sprintf("topo message is %d bytes with %d peers, truncate peers", len(data), len(topo.Peers)))
+		topo.Peers = topo.Peers[:len(topo.Peers)/2]
+		topo.Truncated = true
+	}
+}
+
+// the first item is self url, it`s empty before Start if AdvertisePivot is not configured
+func (t *Topology) Topology() *Topo {
+	peers := t.peers.snapshot()
+
+	topo := &Topo{
+		Pivot:   t.pivot(),
+		Peers:   make([]*p2p.ConnProperty, 0, len(peers)),
+		Time:    UnixTime(time.Now()),
+		Formats: true,
+	}
+
+	for _, p := range peers {
+		topo.Peers = append(topo.Peers, p.property())
+	}
+
+	if t.MaxPeersInTopo > 0 {
+		topo.truncate(t.MaxPeersInTopo)
+	}
+
+	return topo
+}
+
+// PeerStats return the count of topo messages received from and forwarded to each peer being handled
+func (t *Topology) PeerStats() map[string]PeerStat {
+	peers := t.peers.snapshot()
+
+	stats := make(map[string]PeerStat, len(peers))
+	for _, p := range peers {
+		stats[p.id] = p.stat()
+	}
+	return stats
+}
+
+// FilterLoad return the approximate occupancy fraction of the filter recording received topo messages
+func (t *Topology) FilterLoad() float64 {
+	t.recMu.Lock()
+	defer t.recMu.Unlock()
+
+	return t.filterLoad()
+}
+
+func (t *Topology) filterLoad() float64 {
+	return float64(t.record.Count()) / float64(filterCapacity(recordCapacity))
+}
+
+// filterCapacity is the real capacity of cuckoofilter.NewCuckooFilter(n), round up to power of 2
+func filterCapacity(n uint) uint {
+	c := uint(4) // bucket size
+	for c < n {
+		c <<= 1
+	}
+	return c
+}
+
+func (t *Topology) hasRecord(hash []byte) bool {
+	t.recMu.Lock()
+	defer t.recMu.Unlock()
+
+	return t.record.Lookup(hash)
+}
+
+// addRecord rotate the filter before it is too full, or if insertion failed then retry once,
+// return false if hash still can`t be recorded
+func (t *Topology) addRecord(hash []byte) bool {
+	t.recMu.Lock()
+	defer t.recMu.Unlock()
+
+	if load := t.filterLoad(); load >= maxRecordLoad {
+		t.rotateRecord(fmt.Sprintf("load %.2f", load))
+	}
+
+	if t.insertRecord(hash) {
+		return true
+	}
+
+	t.rotateRecord("insertion failed")
+	return t.insertRecord(hash)
+}
+
+// insertRecord return true if hash is recorded, include existed already
+func (t *Topology) insertRecord(hash []byte) bool {
+	return t.record.Lookup(hash) || t.record.Insert(hash)
+}
+
+// rotateRecord must be called with recMu held
+func (t *Topology) rotateRecord(reason string) {
+	t.log.Info(fmt.Sprintf("rotate topo record filter: %s", reason))
+
+	retired := t.record
+	t.record = t.newRec()
+
+	if t.onRotate != nil {
+		t.onRotate(retired.Count())
+	}
+}
+
+// OnFilterRotate set fn to be called at each rotation of the record filter with the count of entries
+// the retired filter held, nil means no callback.
+// fn is called with the filter locked, so it must return quickly and not call back into Topology
+func (t *Topology) OnFilterRotate(fn func(inserted uint)) {
+	t.recMu.Lock()
+	defer t.recMu.Unlock()
+
+	t.onRotate = fn
+}
+
+func (t *Topology) Receive(msg *p2p.Msg, sender *Peer) {
+	defer msg.Recycle()
+
+	if len(msg.Payload) < 32 {
+		return
+	}
+
+	if len(msg.Payload) > t.MaxTopoMsgSize {
+		t.log.Warn(fmt.Sprintf("receive topo of %d bytes from %s, drop it", len(msg.Payload), sender.id))
+		return
+	}
+
+	hash := msg.Payload[:32]
+	if t.hasRecord(hash) {
+		return
+	}
+
+	topo := new(Topo)
+	err := topo.Deserialize(msg.Payload[32:])
+	if err != nil {
+		t.log.Error(fmt.Sprintf("deserialize topoMsg from %s error: %v", sender.id, err))
+		t.malformed(sender, err)
+		return
+	}
+
+	if err = validPivot(topo.Pivot); err != nil {
+		t.log.Warn(fmt.Sprintf("receive topo of invalid pivot %s from %s: %v", topo.Pivot, sender.id, err))
+		return
+	}
+
+	// sender announced formatCmd by its own topo
+	if topo.Formats && fromPivot(topo, sender) {
+		t.announce(sender)
+	}
+
+	// topo of self is looped back or spoofed, pointless to forward
+	if t.isSelf(topo.Pivot) {
+		n := atomic.AddUint64(&t.selfLoops, 1)
+		t.log.Warn(fmt.Sprintf("receive topo of self from %s, dropped %d", sender.id, n))
+		return
+	}
+
+	// stale and future topos are recorded too, they are what the skew is monitored for
+	t.observeSkew(topo, sender)
+
+	if err = t.checkTime(topo); err != nil {
+		t.log.Warn(fmt.Sprintf("receive topo of %s from %s: %v", topo.Pivot, sender.id, err))
+		return
+	}
+
+	monitor.LogEvent("topo", "receive")
+
+	// unrecorded message will be received and forwarded again, may loop in the network
+	if !t.addRecord(hash) {
+		t.log.Warn(fmt.Sprintf("can`t record topo from %s, drop it", sender.id))
+		return
+	}
+
+	t.graph.AddTopo(topo)
+
+	if !t.NoForward {
+		t.forward(msg, topo, sender)
+	}
+
+	t.write("p2p_status_event", topo.Json())
+}
+
+// forward broadcast the received msg to other peers, re-encode if the format negotiated with peer is different,
+// the hash is kept so the message still can be deduplicated
+func (t *Topology) forward(msg *p2p.Msg, topo *Topo, sender *Peer) {
+	hash := msg.Payload[:32]
+
+	forward := map[Format]*p2p.Msg{
+		bodyFormat(msg.Payload[32:]): msg,
+	}
+	var count int32 = 0
+	for _, p := range t.peers.snapshot() {
+		if p.id != sender.id && !p.hasSeen(hash) {
+			m, ok := forward[p.getFormat()]
+			if !ok {
+				body, err := topo.encode(p.getFormat())
+				if err != nil {
+					t.log.Error(fmt.Sprintf("encode topo to %s error: %v", p.id, err))
+					continue
+				}
+				m = &p2p.Msg{
+					CmdSet:  t.ProtocolID,
+					Cmd:     topoCmd,
+					Payload: append(append([]byte{}, hash...), body...),
+				}
+				forward[p.getFormat()] = m
+			}
+
+			if err := p.rw.WriteMsg(m); err == nil {
+				p.forwarded()
+			} else {
+				t.writeFailed(p, err)
+			}
+			p.seen(hash)
+			count++
+		}
+
+		// just broadcast to 1/3 peers
+		//if count > int32(t.peers.size())/3 {
+		//	break
+		//}
+	}
+}
+
+func newProducer(addrs []string) (sarama.AsyncProducer, error) {
+	config := sarama.NewConfig()
+	config.Producer.Return.Successes = true
+	return sarama.NewAsyncProducer(addrs, config)
+}
+
+func (t *Topology) write(topic string, data []byte) {
+	t.prodMu.RLock()
+	defer t.prodMu.RUnlock()
+
+	if t.prod == nil {
+		return
+	}
+
+	if t.ProducerMaxLifetime > 0 && !t.prodBorn.IsZero() &&
+		time.Since(t.prodBorn) > time.Duration(t.ProducerMaxLifetime*int64(time.Second)) {
+		t.recreateProducer()
+	}
+
+	if !t.breaker.allow() {
+		return
+	}
+
+	msg := &sarama.ProducerMessage{
+		Topic:     topic,
+		Value:     sarama.ByteEncoder(data),
+		Timestamp: time.Now(),
+	}
+
+	// slow producer should not block shutdown
+	select {
+	case t.prod.Input() <- msg:
+	case <-t.term:
+		return
+	}
+
+	monitor.LogEvent("topo", "report")
+}
+
+// recreateProducer create a new producer in background, then replace the current one and close it,
+// the pending messages of the current one are flushed. It`s no-op if the recreation is in progress
+func (t *Topology) recreateProducer() {
+	if !atomic.CompareAndSwapInt32(&t.recreating, 0, 1) {
+		return
+	}
+
+	common.Go(func() {
+		defer atomic.StoreInt32(&t.recreating, 0)
+
+		prod, err := t.newProd(t.Config.Addrs)
+		if err != nil {
+			// keep using the current one, retry at the next write
+			t.log.Error(fmt.Sprintf("recreate topo producer error: %v", err))
+			return
+		}
+
+		// wait for writes in progress
+		t.prodMu.Lock()
+		select {
+		case <-t.term:
+			// Shutdown will close the current one
+			t.prodMu.Unlock()
+			prod.Close()
+			return
+		default:
+		}
+		old := t.prod
+		t.prod = prod
+		t.prodBorn = time.Now()
+		t.prodMu.Unlock()
+
+		t.log.Info("topo producer recreated")
+		common.Go(func() {
+			t.watchProducer(prod)
+		})
+
+		if err = old.Close(); err != nil {
+			t.log.Error(fmt.Sprintf("close topo producer error: %v", err))
+		}
+	})
+}
+
+// watchProducer feed the results of kafka writes into breaker, return after the producer closed
+func (t *Topology) watchProducer(prod sarama.AsyncProducer) {
+	errs, succs := prod.Errors(), prod.Successes()
+
+	for errs != nil || succs != nil {
+		select {
+		case err, ok := <-errs:
+			if !ok {
+				errs = nil
+				continue
+			}
+			t.log.Warn(fmt.Sprintf("write topo to kafka error: %v", err))
+			t.breaker.failure()
+		case _, ok := <-succs:
+			if !ok {
+				succs = nil
+				continue
+			}
+			t.breaker.success()
+		}
+	}
+}
+
+// Metrics is the runtime statistics of Topology
+type Metrics struct {
+	Peers   int    `json:"peers"`
+	Breaker string `json:"breaker"` // state of the circuit breaker of kafka writes
+	Dropped uint64 `json:"dropped"` // kafka writes dropped while the breaker is open
+	// received topos of self, looped back or spoofed
+	SelfLoops uint64 `json:"selfLoops"`
+	// broadcast writes timeout, the peers are disconnected
+	WriteTimeouts uint64 `json:"writeTimeouts"`
+	// clock skew of received topos
+	Skew SkewSummary `json:"skew"`
+}
+
+func (t *Topology) Metrics() Metrics {
+	state, dropped := t.breaker.status()
+
+	return Metrics{
+		Peers:   t.peers.size(),
+		Breaker: state.String(),
+		Dropped: dropped,
+
+		SelfLoops:     atomic.LoadUint64(&t.selfLoops),
+		WriteTimeouts: atomic.LoadUint64(&t.writeTimeouts),
+		Skew:          t.skew.summary(),
+	}
+}
+
+// debugDump is the state of Topology attached to bug reports
+type debugDump struct {
+	Time       UnixTime            `json:"time"`
+	Pivot      string              `json:"pivot,omitempty"` // empty before Start
+	Config     Config              `json:"config"`
+	Metrics    Metrics             `json:"metrics"`
+	FilterLoad float64             `json:"filterLoad"`
+	Peers      map[string]PeerStat `json:"peers"`
+	LastTopo   *Topo               `json:"lastTopo,omitempty"` // the latest topo of self broadcast
+}
+
+// DebugDump return the peers, counters, the latest topo of self and config in JSON for bug reports.
+// Every part is a consistent snapshot taken under its own lock, but the parts are taken one by one.
+// Logger of config is omitted
+func (t *Topology) DebugDump() []byte {
+	dump := debugDump{
+		Time:       UnixTime(time.Now()),
+		Config:     *t.Config,
+		Metrics:    t.Metrics(),
+		FilterLoad: t.FilterLoad(),
+		Peers:      t.PeerStats(),
+	}
+	dump.Config.Logger = nil
+
+	if atomic.LoadInt32(&t.started) == 1 {
+		dump.Pivot = t.pivot()
+	}
+	if history := t.History(); len(history) > 0 {
+		dump.LastTopo = history[len(history)-1]
+	}
+
+	data, err := json.Marshal(dump)
+	if err != nil {
+		t.log.Error(fmt.Sprintf("dump topo error: %v", err))
+		return nil
+	}
+
+	return data
+}
+
+func (t *Topology) Protocol() *p2p.Protocol {
+	return &p2p.Protocol{
+		Name:   t.ProtocolName,
+		ID:     t.ProtocolID,
+		Handle: t.Handle,
+	}
+}
+
+// @section topo
+type UnixTime time.Time
+
+func (t UnixTime) MarshalJSON() ([]byte, error) {
+	stamp := fmt.Sprintf("%d", t.Unix())
+	return []byte(stamp), nil
+}
+
+func (t *UnixTime) UnmarshalJSON(data []byte) (err error) {
+	i64, err := strconv.ParseInt(string(data), 10, 64)
+	if err != nil {
+		return
+	}
+
+	*t = UnixTime(time.Unix(i64, 0))
+	return nil
+}
+
+func (t UnixTime) Unix() int64 {
+	return time.Time(t).Unix()
+}
+
+type Topo struct {
+	Pivot string              `json:"pivot,omitempty"`
+	Peers []*p2p.ConnProperty `json:"peers,omitempty"`
+	Time  UnixTime            `json:"time,omitempty"`
+	// some peers are not listed, because of MaxPeersInTopo or MaxTopoMsgSize
+	Truncated bool `json:"truncated,omitempty"`
+	// pivot understands formatCmd, peers receive it from the pivot directly announce formats to the pivot
+	Formats bool `json:"formats,omitempty"`
+
+	// cache of PeerSet, and the Peers it built from, topo may be shared by goroutines, e.g. in graph
+	peerSet   map[string]struct{}
+	peerSetOf []*p2p.ConnProperty
+	peerSetMu sync.Mutex
+}
+
+// truncate keep the max peers of the least RemoteID, which is the same order as node url,
+// so the subset is deterministic
+func (t *Topo) truncate(max int) {
+	if len(t.Peers) <= max {
+		return
+	}
+
+	sort.Slice(t.Peers, func(i, j int) bool {
+		return t.Peers[i].RemoteID < t.Peers[j].RemoteID
+	})
+	t.Peers = t.Peers[:max]
+	t.Truncated = true
+}
+
+// Equal return true if t and o have the same pivot and the same peers, time is ignored
+func (t *Topo) Equal(o *Topo) bool {
+	if t.Pivot != o.Pivot || len(t.Peers) != len(o.Peers) {
+		return false
+	}
+
+	set, oset := t.PeerSet(), o.PeerSet()
+	if len(set) != len(oset) {
+		return false
+	}
+	for id := range set {
+		if _, ok := oset[id]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// PeerSet return RemoteID of all peers as a set, use for fast membership check.
+// The set is cached until Peers is reassigned, appended or truncated, it must not be modified.
+func (t *Topo) PeerSet() map[string]struct{} {
+	t.peerSetMu.Lock()
+	defer t.peerSetMu.Unlock()
+
+	if t.peerSet != nil && sameSlice(t.peerSetOf, t.Peers) {
+		return t.peerSet
+	}
+
+	set := make(map[string]struct{}, len(t.Peers))
+	for _, cp := range t.Peers {
+		set[cp.RemoteID] = struct{}{}
+	}
+
+	t.peerSet = set
+	t.peerSetOf = t.Peers
+
+	return set
+}
+
+func sameSlice(a, b []*p2p.ConnProperty) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	if len(a) == 0 {
+		return true
+	}
+	return &a[0] == &b[0] && a[len(a)-1] == b[len(b)-1]
+}
+
+// MarshalBinary return the bare protobuf bytes of Topo, without the hash prefix of Serialize,
+// use for persist Topo compactly
+func (t *Topo) MarshalBinary() ([]byte, error) {
+	return proto.Marshal(t.proto())
+}
+
+func (t *Topo) proto() *protos.Topo {
+	pbs := make([]*protos.ConnProperty, len(t.Peers))
+
+	for i, cp := range t.Peers {
+		pbs[i] = cp.Proto()
+	}
+
+	// Time in seconds is kept for nodes don`t know TimeNano
+	return &protos.Topo{
+		Pivot:     t.Pivot,
+		Peers:     pbs,
+		Time:      t.Time.Unix(),
+		TimeNano:  time.Time(t.Time).UnixNano(),
+		Truncated: t.Truncated,
+		Formats:   t.Formats,
+	}
+}
+
+func (t *Topo) UnmarshalBinary(data []byte) error {
+	return t.unmarshalProto(data)
+}
+
+// add Hash(32bit) to Front, use for determine if it has been received, body is encoded in protobuf
+func (t *Topo) Serialize() ([]byte, error) {
+	return t.SerializeFormat(FormatProto)
+}
+
+// SerializeFormat is the same as Serialize but encode body in format,
+// the hash is always computed over the protobuf bytes, so it doesn`t change with format
+func (t *Topo) SerializeFormat(format Format) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if err := t.SerializeTo(buf, format); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// SerializeTo is the same as SerializeFormat but write the bytes to buf,
+// the protobuf bytes are encoded in place after the hash and selector
+func (t *Topo) SerializeTo(buf *bytes.Buffer, format Format) error {
+	if format != FormatProto && format != FormatJSON {
+		return errUnknownFormat
+	}
+
+	// reserve hash and selector
+	start := buf.Len()
+	var head [33]byte
+	buf.Write(head[:])
+
+	if err := message.MarshalTo(t.proto(), buf); err != nil {
+		buf.Truncate(start)
+		return err
+	}
+
+	data := buf.Bytes()
+	copy(data[start:], crypto.Hash(32, data[start+33:]))
+	data[start+32] = byte(format)
+
+	if format == FormatJSON {
+		buf.Truncate(start + 33)
+
+		body, err := json.Marshal(t)
+		if err != nil {
+			buf.Truncate(start)
+			return err
+		}
+		buf.Write(body)
+	}
+
+	return nil
+}
+
+// encode return the format selector byte followed by the body, the body only in formatLegacy
+func (t *Topo) encode(format Format) ([]byte, error) {
+	var body []byte
+	var err error
+
+	switch format {
+	case formatLegacy:
+		return t.MarshalBinary()
+	case FormatProto:
+		body, err = t.MarshalBinary()
+	case FormatJSON:
+		body, err = json.Marshal(t)
+	default:
+		return nil, errUnknownFormat
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]byte{byte(format)}, body...), nil
+}
+
+// Deserialize buf without the hash, the first byte is format selector,
+// buf not starting with a known format is the protobuf body from nodes don`t know formats
+func (t *Topo) Deserialize(buf []byte) error {
+	var err error
+	switch bodyFormat(buf) {
+	case FormatProto:
+		err = t.unmarshalProto(buf[1:])
+	case FormatJSON:
+		err = json.Unmarshal(buf[1:], t)
+	default:
+		err = t.unmarshalProto(buf)
+	}
+
+	if err != nil {
+		return err
+	}
+	return t.validate()
+}
+
+// bounds of topo received from network
+const maxTopoPeers = 1024
+const maxPivotLength = 256
+
+var errTooManyTopoPeers = errors.New("too many peers in topo")
+var errTopoPivotTooLong = errors.New("topo pivot is too long")
+var errNilTopoPeer = errors.New("nil peer in topo")
+
+// validate the topo decoded from untrusted bytes
+func (t *Topo) validate() error {
+	if len(t.Pivot) > maxPivotLength {
+		return errTopoPivotTooLong
+	}
+	if len(t.Peers) > maxTopoPeers {
+		return errTooManyTopoPeers
+	}
+	for _, cp := range t.Peers {
+		if cp == nil {
+			return errNilTopoPeer
+		}
+	}
+
+	return nil
+}
+
+func (t *Topo) unmarshalProto(buf []byte) error {
+	pb := new(protos.Topo)
+	err := proto.Unmarshal(buf, pb)
+	if err != nil {
+		return err
+	}
+
+	for _, cpb := range pb.Peers {
+		cp := new(p2p.ConnProperty)
 		cp.Deproto(cpb)
 		t.Peers = append(t.Peers, cp)
 	}
 
 	t.Pivot = pb.Pivot
-	t.Time = UnixTime(time.Unix(pb.Time, 0))
+	t.Truncated = pb.Truncated
+	t.Formats = pb.Formats
+	if pb.TimeNano != 0 {
+		t.Time = UnixTime(time.Unix(0, pb.TimeNano))
+	} else {
+		t.Time = UnixTime(time.Unix(pb.Time, 0))
+	}
 
 	return nil
 }
@@ -371,3 +2080,46 @@ func (t *Topo) Json() []byte {
 	buf, _ := json.Marshal(t)
 	return buf
 }
+
+// TopoDiff is the change of peers between two topos of the same pivot
+type TopoDiff struct {
+	Pivot   string   `json:"pivot,omitempty"`
+	Added   []string `json:"added,omitempty"`
+	Removed []string `json:"removed,omitempty"`
+	Time    UnixTime `json:"time,omitempty"`
+}
+
+// DiffTopo return the peers in cur but not in prev as Added, and the reverse as Removed, both sorted
+func DiffTopo(prev, cur *Topo) *TopoDiff {
+	diff := &TopoDiff{
+		Pivot: cur.Pivot,
+		Time:  cur.Time,
+	}
+
+	prevSet, curSet := prev.PeerSet(), cur.PeerSet()
+
+	for id := range curSet {
+		if _, ok := prevSet[id]; !ok {
+			diff.Added = append(diff.Added, id)
+		}
+	}
+	for id := range prevSet {
+		if _, ok := curSet[id]; !ok {
+			diff.Removed = append(diff.Removed, id)
+		}
+	}
+
+	sort.Strings(diff.Added)
+	sort.Strings(diff.Removed)
+
+	return diff
+}
+
+func (d *TopoDiff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0
+}
+
+func (d *TopoDiff) Json() []byte {
+	buf, _ := json.Marshal(d)
+	return buf
+}
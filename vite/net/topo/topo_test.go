@@ -1,10 +1,28 @@
 package topo
 
 import (
+	"bytes"
+	"context"
+	"encoding"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+	"github.com/vitelabs/go-vite/log15"
+	"github.com/vitelabs/go-vite/monitor"
+	"github.com/vitelabs/go-vite/p2p"
+	"github.com/vitelabs/go-vite/p2p/discovery"
+	"github.com/vitelabs/go-vite/p2p/protos"
+	"gopkg.in/Shopify/sarama.v1"
 )
 
 var topo = Topo{
@@ -14,7 +32,7 @@ var topo = Topo{
 }
 
 func TestTopoJson(t *testing.T) {
-	buf, err := json.Marshal(topo)
+	buf, err := json.Marshal(&topo)
 	if err != nil {
 		t.Error(err)
 	}
@@ -32,3 +50,2097 @@ func TestTopoJson(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestValidTopoCmd(t *testing.T) {
+	tp := New(&Config{})
+
+	for _, cmd := range []p2p.Cmd{topoCmd, formatCmd, getTopoCmd, topoReplyCmd} {
+		if _, ok := tp.cmds[cmd]; !ok {
+			t.Errorf("cmd %d should be registered", cmd)
+		}
+	}
+
+	for _, cmd := range []p2p.Cmd{0, topoReplyCmd + 1, 255} {
+		if _, ok := tp.cmds[cmd]; ok {
+			t.Errorf("cmd %d should not be registered", cmd)
+		}
+	}
+}
+
+func TestTopology_Register(t *testing.T) {
+	tp := New(&Config{})
+
+	const diffCmd = topoReplyCmd + 1
+	dispatched := make(chan *p2p.Msg, 1)
+	tp.Register(diffCmd, func(msg *p2p.Msg, peer *Peer) error {
+		if peer.id != "a" {
+			t.Errorf("should dispatch with the sender, but got %s", peer.id)
+		}
+		dispatched <- msg
+		return nil
+	})
+
+	rw, remote := newPipe()
+	defer close(rw.term)
+
+	peer := mockPeer("a")
+	peer.rw = rw
+
+	errch := make(chan error, 1)
+	go func() {
+		errch <- tp.handle(peer)
+	}()
+
+	remote.WriteMsg(&p2p.Msg{CmdSet: CmdSet, Cmd: diffCmd, Payload: []byte("diff")})
+
+	select {
+	case msg := <-dispatched:
+		if string(msg.Payload) != "diff" {
+			t.Errorf("wrong payload %q", msg.Payload)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("registered cmd should be dispatched")
+	}
+
+	// unknown cmd end the handle of peer
+	remote.WriteMsg(&p2p.Msg{CmdSet: CmdSet, Cmd: diffCmd + 1})
+
+	select {
+	case err := <-errch:
+		if errors.Cause(err) != errUnknownTopoCmd {
+			t.Errorf("should return %v, but got %v", errUnknownTopoCmd, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("unknown cmd should end the handle")
+	}
+}
+
+func mockTopo(n int) *Topo {
+	t := &Topo{
+		Pivot: "vnode://6b7f8b2e1c3d4a5f6b7f8b2e1c3d4a5f6b7f8b2e1c3d4a5f6b7f8b2e1c3d4a5f@127.0.0.1:8483",
+		Peers: make([]*p2p.ConnProperty, n),
+		Time:  UnixTime(time.Now()),
+	}
+
+	for i := range t.Peers {
+		t.Peers[i] = &p2p.ConnProperty{
+			LocalID:    fmt.Sprintf("local%d", i),
+			LocalIP:    net.IPv4(127, 0, 0, 1),
+			LocalPort:  8483,
+			RemoteID:   fmt.Sprintf("remote%d", i),
+			RemoteIP:   net.IPv4(10, 0, byte(i>>8), byte(i)),
+			RemotePort: uint16(10000 + i),
+		}
+	}
+
+	return t
+}
+
+func TestTopo_MarshalBinary(t *testing.T) {
+	var _ encoding.BinaryMarshaler = new(Topo)
+	var _ encoding.BinaryUnmarshaler = new(Topo)
+
+	topo := mockTopo(10)
+
+	data, err := topo.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	topo2 := new(Topo)
+	if err = topo2.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+
+	if topo2.Pivot != topo.Pivot || topo2.Time.Unix() != topo.Time.Unix() || len(topo2.Peers) != len(topo.Peers) {
+		t.Fatalf("topo changed after round-trip: %s", topo2.Json())
+	}
+	for i, cp := range topo2.Peers {
+		if cp.RemoteID != topo.Peers[i].RemoteID || !cp.RemoteIP.Equal(topo.Peers[i].RemoteIP) {
+			t.Errorf("peer %d changed after round-trip", i)
+		}
+	}
+
+	if js := topo.Json(); len(data) >= len(js) {
+		t.Errorf("binary should be smaller than json: %d >= %d", len(data), len(js))
+	}
+}
+
+func TestTopology_serialize(t *testing.T) {
+	const max = 4 << 10
+
+	tp := New(&Config{
+		MaxTopoMsgSize: max,
+	})
+
+	topo := mockTopo(1000)
+	data, err := tp.serialize(topo, FormatProto)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(data) > max {
+		t.Errorf("message size %d exceed %d", len(data), max)
+	}
+
+	topo2 := new(Topo)
+	if err = topo2.Deserialize(data[32:]); err != nil {
+		t.Fatal(err)
+	}
+	if topo2.Pivot != topo.Pivot {
+		t.Errorf("pivot should be kept")
+	}
+	if len(topo2.Peers) == 0 || len(topo2.Peers) >= 1000 {
+		t.Errorf("peers should be truncated, but got %d peers", len(topo2.Peers))
+	}
+
+	// pivot itself is too large
+	tp.MaxTopoMsgSize = 10
+	if _, err = tp.serialize(mockTopo(10), FormatProto); err != errTopoTooLarge {
+		t.Errorf("should return errTopoTooLarge, but got %v", err)
+	}
+}
+
+func TestTopo_SerializeFormat(t *testing.T) {
+	topo := mockTopo(10)
+
+	pb, err := topo.SerializeFormat(FormatProto)
+	if err != nil {
+		t.Fatal(err)
+	}
+	js, err := topo.SerializeFormat(FormatJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(pb[:32], js[:32]) {
+		t.Errorf("hash should not change with format")
+	}
+
+	for _, data := range [][]byte{pb, js} {
+		topo2 := new(Topo)
+		if err = topo2.Deserialize(data[32:]); err != nil {
+			t.Fatalf("deserialize format %d error: %v", data[32], err)
+		}
+
+		if topo2.Pivot != topo.Pivot || topo2.Time.Unix() != topo.Time.Unix() || len(topo2.Peers) != len(topo.Peers) {
+			t.Fatalf("topo changed after round-trip of format %d: %s", data[32], topo2.Json())
+		}
+		for i, cp := range topo2.Peers {
+			if cp.RemoteID != topo.Peers[i].RemoteID || !cp.RemoteIP.Equal(topo.Peers[i].RemoteIP) {
+				t.Errorf("peer %d changed after round-trip of format %d", i, data[32])
+			}
+		}
+	}
+
+	if _, err = topo.SerializeFormat(Format(255)); err != errUnknownFormat {
+		t.Errorf("should return errUnknownFormat, but got %v", err)
+	}
+	// not a known format, decoded as protobuf body of legacy nodes
+	if err = new(Topo).Deserialize([]byte{255}); err == nil {
+		t.Errorf("malformed legacy body should fail")
+	}
+}
+
+// pivotOf return the pivot of the node behind mock peer
+func pivotOf(p *Peer) string {
+	id, _ := p.remote()
+	return fmt.Sprintf("vnode://%s@127.0.0.1:8483", id)
+}
+
+func formatCmds(p *Peer) (n int) {
+	rw := p.rw.(*mockRW)
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+
+	for _, msg := range rw.msgs {
+		if msg.Cmd == formatCmd {
+			n++
+		}
+	}
+	return
+}
+
+func TestTopology_legacy(t *testing.T) {
+	tp := New(&Config{})
+	tp.p2p = &mockServer{url: mockTopo(0).Pivot}
+	peers := tp.addMockPeers("legacy", "proto", "sender")
+	tp.negotiate(peers[1], []byte{byte(FormatProto)})
+
+	// message of legacy nodes, the protobuf body right after the hash
+	topo := mockTopo(3)
+	topo.Pivot = "vnode://7c8f9c3f2d4e5b6f7c8f9c3f2d4e5b6f7c8f9c3f2d4e5b6f7c8f9c3f2d4e5b6f@127.0.0.2:8483"
+	data, err := topo.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy := stripSelector(data)
+	if legacy[32] != 0x0a {
+		t.Fatalf("legacy body should start with the tag of pivot, but got %#x", legacy[32])
+	}
+
+	tp.Receive(&p2p.Msg{CmdSet: CmdSet, Cmd: topoCmd, Payload: legacy}, peers[2])
+
+	msgs := peers[0].rw.(*mockRW).msgs
+	if len(msgs) != 1 || !bytes.Equal(msgs[0].Payload, legacy) {
+		t.Fatalf("legacy peer should receive the legacy message")
+	}
+	msgs = peers[1].rw.(*mockRW).msgs
+	if len(msgs) != 1 || !bytes.Equal(msgs[0].Payload, data) {
+		t.Fatalf("negotiated peer should receive the message with selector")
+	}
+
+	// own topo is broadcast without selector to peers not announced formatCmd
+	payloads, err := tp.encode(tp.Topology())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tp.broadcast(payloads)
+	msgs = peers[0].rw.(*mockRW).msgs
+	if len(msgs) != 2 || !bytes.Equal(msgs[1].Payload, payloads[formatLegacy]) {
+		t.Fatalf("legacy peer should receive own topo without selector")
+	}
+	pb := new(protos.Topo)
+	if err = proto.Unmarshal(msgs[1].Payload[32:], pb); err != nil || !pb.Formats {
+		t.Errorf("legacy nodes should decode own topo as protobuf, marked Formats: %v", err)
+	}
+
+	if n := formatCmds(peers[0]) + formatCmds(peers[2]); n != 0 {
+		t.Errorf("formatCmd should not be sent before peer announced it, but sent %d", n)
+	}
+}
+
+func TestTopology_announce(t *testing.T) {
+	tp := New(&Config{Format: FormatJSON})
+	tp.p2p = &mockServer{url: mockTopo(0).Pivot}
+	peers := tp.addMockPeers("a", "b", "c")
+
+	// topo marked Formats forwarded by a, it`s not the announcement of a
+	topo := mockTopo(1)
+	topo.Pivot = pivotOf(peers[1])
+	topo.Formats = true
+	tp.Receive(mockTopoMsg(t, topo), peers[0])
+	if n := formatCmds(peers[0]); n != 0 {
+		t.Fatalf("formatCmd should not be sent to the forwarder, but sent %d", n)
+	}
+
+	// own topo of a marked Formats
+	topo = mockTopo(1)
+	topo.Pivot = pivotOf(peers[0])
+	topo.Formats = true
+	tp.Receive(mockTopoMsg(t, topo), peers[0])
+	if n := formatCmds(peers[0]); n != 1 {
+		t.Fatalf("formatCmd should be sent to a once, but sent %d", n)
+	}
+
+	// formatCmd of a answered already, b is answered with its own
+	tp.handleFormat(&p2p.Msg{Cmd: formatCmd, Payload: []byte{byte(FormatJSON)}}, peers[0])
+	tp.handleFormat(&p2p.Msg{Cmd: formatCmd, Payload: []byte{byte(FormatJSON)}}, peers[1])
+	if n := formatCmds(peers[0]); n != 1 {
+		t.Errorf("formatCmd should be sent to a only once, but sent %d", n)
+	}
+	if n := formatCmds(peers[1]); n != 1 {
+		t.Errorf("formatCmd should be sent to b once, but sent %d", n)
+	}
+	if peers[0].getFormat() != FormatJSON || peers[1].getFormat() != FormatJSON || peers[2].getFormat() != formatLegacy {
+		t.Errorf("wrong format negotiated: %d, %d, %d", peers[0].getFormat(), peers[1].getFormat(), peers[2].getFormat())
+	}
+}
+
+func TestTopo_SerializeTo(t *testing.T) {
+	topo := mockTopo(10)
+	buf := new(bytes.Buffer)
+
+	for _, format := range []Format{FormatProto, FormatJSON} {
+		data, err := topo.SerializeFormat(format)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// SerializeTo should append to the existing content of buf
+		buf.Reset()
+		buf.WriteString("prefix")
+		if err = topo.SerializeTo(buf, format); err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(buf.Bytes()[6:], data) {
+			t.Errorf("SerializeTo should write the same bytes as SerializeFormat %d", format)
+		}
+	}
+
+	buf.Reset()
+	if err := topo.SerializeTo(buf, Format(255)); err != errUnknownFormat || buf.Len() != 0 {
+		t.Errorf("should return errUnknownFormat and write nothing, but got %v", err)
+	}
+}
+
+func BenchmarkTopo_Serialize(b *testing.B) {
+	topo := mockTopo(50)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := topo.Serialize(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkTopo_SerializeTo(b *testing.B) {
+	topo := mockTopo(50)
+	buf := new(bytes.Buffer)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf.Reset()
+		if err := topo.SerializeTo(buf, FormatProto); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestTopo_Serialize_timeNano(t *testing.T) {
+	t1, t2 := mockTopo(1), mockTopo(1)
+	t1.Time = UnixTime(time.Unix(1000, 100))
+	t2.Time = UnixTime(time.Unix(1000, 200))
+
+	var decoded []*Topo
+	for _, topo := range []*Topo{t1, t2} {
+		data, err := topo.Serialize()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		topo2 := new(Topo)
+		if err = topo2.Deserialize(data[32:]); err != nil {
+			t.Fatal(err)
+		}
+		if !time.Time(topo2.Time).Equal(time.Time(topo.Time)) {
+			t.Errorf("time should be %d, but got %d", time.Time(topo.Time).UnixNano(), time.Time(topo2.Time).UnixNano())
+		}
+		decoded = append(decoded, topo2)
+	}
+
+	if !time.Time(decoded[1].Time).After(time.Time(decoded[0].Time)) {
+		t.Errorf("topos in the same second should be distinguishable")
+	}
+
+	// topo from nodes don`t know TimeNano
+	data, err := proto.Marshal(&protos.Topo{Pivot: t1.Pivot, Time: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	topo := new(Topo)
+	if err = topo.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	if !time.Time(topo.Time).Equal(time.Unix(1000, 0)) {
+		t.Errorf("should fall back to Time in seconds, but got %d", time.Time(topo.Time).UnixNano())
+	}
+}
+
+func TestTopo_truncate(t *testing.T) {
+	topo := mockTopo(10)
+	// reverse, so truncate must sort
+	for i, j := 0, len(topo.Peers)-1; i < j; i, j = i+1, j-1 {
+		topo.Peers[i], topo.Peers[j] = topo.Peers[j], topo.Peers[i]
+	}
+
+	topo.truncate(10)
+	if len(topo.Peers) != 10 || topo.Truncated {
+		t.Fatalf("topo within the cap should not be truncated")
+	}
+
+	topo.truncate(3)
+	if len(topo.Peers) != 3 || !topo.Truncated {
+		t.Fatalf("should truncate to 3 peers and set the flag, but got %d peers", len(topo.Peers))
+	}
+	for i, cp := range topo.Peers {
+		if want := fmt.Sprintf("remote%d", i); cp.RemoteID != want {
+			t.Errorf("peer %d should be %s, but got %s", i, want, cp.RemoteID)
+		}
+	}
+
+	for _, format := range []Format{FormatProto, FormatJSON} {
+		data, err := topo.SerializeFormat(format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		topo2 := new(Topo)
+		if err = topo2.Deserialize(data[32:]); err != nil {
+			t.Fatal(err)
+		}
+		if !topo2.Truncated {
+			t.Errorf("flag should be kept after round-trip of format %d", format)
+		}
+	}
+
+	// truncated to fit MaxTopoMsgSize
+	tp := New(&Config{MaxTopoMsgSize: 500})
+	topo = mockTopo(10)
+	data, err := tp.serialize(topo, FormatProto)
+	if err != nil {
+		t.Fatal(err)
+	}
+	topo2 := new(Topo)
+	if err = topo2.Deserialize(data[32:]); err != nil {
+		t.Fatal(err)
+	}
+	if len(topo2.Peers) == 10 || !topo2.Truncated {
+		t.Errorf("topo truncated by size should set the flag")
+	}
+	if len(topo.Peers) != 10 || topo.Truncated {
+		t.Errorf("topo serialized should not be changed, but got %d peers", len(topo.Peers))
+	}
+}
+
+func TestTopo_Deserialize_bounds(t *testing.T) {
+	long := mockTopo(1)
+	long.Pivot = string(make([]byte, maxPivotLength+1))
+
+	cases := map[string]struct {
+		topo   *Topo
+		format Format
+		err    error
+	}{
+		"pivot":      {long, FormatProto, errTopoPivotTooLong},
+		"peers":      {mockTopo(maxTopoPeers + 1), FormatProto, errTooManyTopoPeers},
+		"peers json": {mockTopo(maxTopoPeers + 1), FormatJSON, errTooManyTopoPeers},
+	}
+
+	for name, c := range cases {
+		data, err := c.topo.SerializeFormat(c.format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = new(Topo).Deserialize(data[32:]); err != c.err {
+			t.Errorf("%s: should return %v, but got %v", name, c.err, err)
+		}
+	}
+
+	data := append([]byte{byte(FormatJSON)}, `{"peers":[null]}`...)
+	if err := new(Topo).Deserialize(data); err != errNilTopoPeer {
+		t.Errorf("should return errNilTopoPeer, but got %v", err)
+	}
+}
+
+func TestTopology_Receive_tooLarge(t *testing.T) {
+	tp := New(&Config{MaxTopoMsgSize: 100})
+	peers := tp.addMockPeers("a", "b")
+
+	tp.Receive(mockTopoMsg(t, mockTopo(10)), peers[0])
+	if n := tp.Graph().Size(); n != 0 {
+		t.Errorf("topo exceed MaxTopoMsgSize should be dropped, but graph has %d topos", n)
+	}
+}
+
+func FuzzTopoDeserialize(f *testing.F) {
+	for _, n := range []int{0, 1, 10} {
+		for _, format := range []Format{FormatProto, FormatJSON} {
+			data, err := mockTopo(n).SerializeFormat(format)
+			if err != nil {
+				f.Fatal(err)
+			}
+
+			body := data[32:]
+			f.Add(body)
+			f.Add(body[:len(body)/2])
+		}
+	}
+	f.Add([]byte{})
+	f.Add([]byte{byte(FormatJSON)})
+	f.Add(append([]byte{byte(FormatJSON)}, `{"peers":[{}],"time":1}`...))
+	f.Add([]byte{byte(FormatProto), 0x12, 0xff, 0xff, 0xff, 0xff, 0x0f})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		topo := new(Topo)
+		if err := topo.Deserialize(data); err != nil {
+			return
+		}
+
+		if len(topo.Pivot) > maxPivotLength || len(topo.Peers) > maxTopoPeers {
+			t.Fatalf("topo out of bounds is accepted: pivot %d bytes, %d peers", len(topo.Pivot), len(topo.Peers))
+		}
+
+		// accepted topo can be used as the received ones
+		topo.PeerSet()
+		topo.Json()
+		g := NewTopoGraph()
+		g.AddTopo(topo)
+		g.Edges()
+	})
+}
+
+func TestTopology_negotiate(t *testing.T) {
+	tp := New(&Config{Format: FormatJSON})
+	peers := tp.addMockPeers("json", "proto", "sender")
+
+	tp.negotiate(peers[0], []byte{byte(FormatJSON)})
+	tp.negotiate(peers[1], []byte{byte(FormatProto)})
+	if peers[0].getFormat() != FormatJSON || peers[1].getFormat() != FormatProto {
+		t.Fatalf("wrong format negotiated: %d, %d", peers[0].getFormat(), peers[1].getFormat())
+	}
+
+	// forward in the format of each peer, with the same hash
+	msg := mockTopoMsg(t, mockTopo(3))
+	tp.Receive(msg, peers[2])
+
+	for i, f := range []Format{FormatJSON, FormatProto} {
+		rw := peers[i].rw.(*mockRW)
+		if rw.count() != 1 {
+			t.Fatalf("peer %s should receive topo once, but got %d", peers[i].id, rw.count())
+		}
+		payload := rw.msgs[0].Payload
+		if Format(payload[32]) != f {
+			t.Errorf("peer %s should receive format %d, but got %d", peers[i].id, f, payload[32])
+		}
+		if !bytes.Equal(payload[:32], msg.Payload[:32]) {
+			t.Errorf("hash should be kept when forward to %s", peers[i].id)
+		}
+	}
+
+	// JSON is used only if both sides prefer it
+	tp.Format = FormatProto
+	tp.negotiate(peers[0], []byte{byte(FormatJSON)})
+	if peers[0].getFormat() != FormatProto {
+		t.Errorf("should use protobuf if self doesn`t prefer JSON")
+	}
+}
+
+type mockRW struct {
+	mu   sync.Mutex
+	msgs []*p2p.Msg
+	err  error // returned by WriteMsg
+
+	disconnected p2p.DiscReason
+}
+
+func (rw *mockRW) ReadMsg() (*p2p.Msg, error) {
+	return nil, io.EOF
+}
+
+func (rw *mockRW) WriteMsg(msg *p2p.Msg) error {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	if rw.err != nil {
+		return rw.err
+	}
+	rw.msgs = append(rw.msgs, msg)
+	return nil
+}
+
+func (rw *mockRW) count() int {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	return len(rw.msgs)
+}
+
+func mockPeer(id string) *Peer {
+	p := &Peer{
+		id:      id,
+		rw:      new(mockRW),
+		errch:   make(chan error),
+		cancel:  make(chan struct{}),
+		created: time.Now(),
+		format:  formatLegacy,
+	}
+	p.disconnect = func(reason p2p.DiscReason) {
+		p.rw.(*mockRW).disconnected = reason
+	}
+	p.property = func() *p2p.ConnProperty {
+		return &p2p.ConnProperty{RemoteID: id}
+	}
+	p.remote = func() (discovery.NodeID, net.IP) {
+		var nid discovery.NodeID
+		copy(nid[:], id)
+		return nid, net.IPv4(127, 0, 0, 1)
+	}
+	return p
+}
+
+func (t *Topology) addMockPeers(ids ...string) (peers []*Peer) {
+	for _, id := range ids {
+		p := mockPeer(id)
+		t.peers.add(p)
+		peers = append(peers, p)
+	}
+	return
+}
+
+func BenchmarkTopology_Topology(b *testing.B) {
+	tp := New(&Config{})
+	tp.p2p = &mockServer{url: mockTopo(0).Pivot}
+	for i := 0; i < 500; i++ {
+		tp.addMockPeers(strconv.Itoa(i))
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tp.Topology()
+	}
+}
+
+func mockTopoMsg(t *testing.T, topo *Topo) *p2p.Msg {
+	data, err := topo.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &p2p.Msg{
+		CmdSet:  CmdSet,
+		Cmd:     topoCmd,
+		Payload: data,
+	}
+}
+
+func TestTopology_Receive_dupForward(t *testing.T) {
+	tp := New(&Config{})
+	peers := tp.addMockPeers("a", "b", "c")
+	a, b, c := peers[0], peers[1], peers[2]
+
+	msg := mockTopoMsg(t, mockTopo(3))
+
+	// the same topo arrived from a and b, b`s copy is read by Handle but not received yet
+	b.seen(msg.Payload[:32])
+	tp.Receive(msg, a)
+	tp.Receive(msg, b)
+
+	if n := a.rw.(*mockRW).count(); n != 0 {
+		t.Errorf("should not bounce back to a, but forward %d times", n)
+	}
+	if n := b.rw.(*mockRW).count(); n != 0 {
+		t.Errorf("should not bounce back to b, but forward %d times", n)
+	}
+	if n := c.rw.(*mockRW).count(); n != 1 {
+		t.Errorf("should forward to c once, but forward %d times", n)
+	}
+}
+
+func TestTopology_Receive_self(t *testing.T) {
+	tp := New(&Config{})
+	peers := tp.addMockPeers("a", "b")
+
+	topo := mockTopo(3)
+	tp.p2p = &mockServer{url: topo.Pivot}
+
+	tp.Receive(mockTopoMsg(t, topo), peers[0])
+
+	if n := peers[1].rw.(*mockRW).count(); n != 0 {
+		t.Errorf("topo of self should not be forwarded, but forward %d times", n)
+	}
+	if n := tp.Graph().Size(); n != 0 {
+		t.Errorf("topo of self should not be added to graph, but graph has %d topos", n)
+	}
+	if m := tp.Metrics(); m.SelfLoops != 1 {
+		t.Errorf("should count 1 topo of self, but got %d", m.SelfLoops)
+	}
+
+	// topo of others is still forwarded
+	tp.p2p = &mockServer{url: "vnode://7c8f9c3f2d4e5b6f7c8f9c3f2d4e5b6f7c8f9c3f2d4e5b6f7c8f9c3f2d4e5b6f@127.0.0.2:8483"}
+	tp.Receive(mockTopoMsg(t, mockTopo(3)), peers[0])
+
+	if n := peers[1].rw.(*mockRW).count(); n != 1 {
+		t.Errorf("topo of others should be forwarded once, but forward %d times", n)
+	}
+}
+
+func TestTopology_Receive_skew(t *testing.T) {
+	tp := New(&Config{})
+	peers := tp.addMockPeers("a")
+
+	topo := mockTopo(3)
+	topo.Time = UnixTime(time.Now().Add(-5 * time.Second))
+	tp.Receive(mockTopoMsg(t, topo), peers[0])
+
+	skew := tp.Metrics().Skew
+	if skew.Count != 1 {
+		t.Fatalf("should record 1 skew, but got %d", skew.Count)
+	}
+	if skew.Mean < 4000 || skew.Mean > 6500 {
+		t.Errorf("skew should be about 5000ms, but got %fms", skew.Mean)
+	}
+	if skew.Min != skew.Max || skew.Min != skew.Mean {
+		t.Errorf("skew of single topo should be min, max and mean: %+v", skew)
+	}
+}
+
+// stallRW block WriteMsg until released, like a stalled TCP connection
+type stallRW struct {
+	mockRW
+	release chan struct{}
+}
+
+func (rw *stallRW) WriteMsg(msg *p2p.Msg) error {
+	<-rw.release
+	return io.EOF
+}
+
+func TestTopology_broadcast_writeTimeout(t *testing.T) {
+	tp := New(&Config{WriteTimeout: 1, SendConcurrency: 1})
+	peers := tp.addMockPeers("a", "b")
+
+	rw := &stallRW{release: make(chan struct{})}
+	defer close(rw.release)
+
+	var disconnected p2p.DiscReason
+	peers[0].rw = rw
+	peers[0].disconnect = func(reason p2p.DiscReason) {
+		disconnected = reason
+	}
+
+	done := make(chan map[string]error)
+	go func() {
+		done <- tp.broadcast(map[Format][]byte{FormatProto: []byte("topo")})
+	}()
+
+	select {
+	case errs := <-done:
+		if len(errs) != 1 || errs["a"] != errWriteTimeout {
+			t.Errorf("write to a should timeout, but got %v", errs)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("broadcast should not hang on the stalled peer")
+	}
+
+	if disconnected != p2p.DiscNetworkError {
+		t.Errorf("stalled peer should be disconnected, but got %v", disconnected)
+	}
+	if n := peers[1].rw.(*mockRW).count(); n != 1 {
+		t.Errorf("should still write to b once, but write %d times", n)
+	}
+	if m := tp.Metrics(); m.WriteTimeouts != 1 {
+		t.Errorf("should count 1 write timeout, but got %d", m.WriteTimeouts)
+	}
+}
+
+func TestTopology_broadcast_MaxWriteFailures(t *testing.T) {
+	tp := New(&Config{MaxWriteFailures: 3})
+	peers := tp.addMockPeers("a")
+	rw := peers[0].rw.(*mockRW)
+	data := map[Format][]byte{FormatProto: []byte("topo")}
+
+	// fail N-1 times, then succeed
+	rw.err = io.ErrClosedPipe
+	for i := 0; i < 2; i++ {
+		tp.broadcast(data)
+	}
+	rw.err = nil
+	if errs := tp.broadcast(data); len(errs) != 0 {
+		t.Fatalf("should write to a, but got %v", errs)
+	}
+	if rw.disconnected != 0 || tp.peers.get("a") == nil {
+		t.Fatal("peer should not be disconnected before MaxWriteFailures")
+	}
+
+	// the counter is reset, so another N-1 failures don`t disconnect
+	rw.err = io.ErrClosedPipe
+	for i := 0; i < 2; i++ {
+		tp.broadcast(data)
+	}
+	if rw.disconnected != 0 || tp.peers.get("a") == nil {
+		t.Fatal("failures should be counted from the last successful write")
+	}
+
+	// the Nth consecutive failure
+	tp.broadcast(data)
+	if rw.disconnected != p2p.DiscNetworkError {
+		t.Errorf("peer should be disconnected after %d failures, but got %v", tp.MaxWriteFailures, rw.disconnected)
+	}
+	if tp.peers.get("a") != nil {
+		t.Error("peer should be removed")
+	}
+}
+
+func TestTopology_Receive_MaxMalformedTopos(t *testing.T) {
+	tp := New(&Config{MaxMalformedTopos: 3})
+	svr := &mockServer{url: mockTopo(0).Pivot}
+	tp.p2p = svr
+	peers := tp.addMockPeers("a", "b")
+
+	malformed := func(i int) *p2p.Msg {
+		payload := make([]byte, 32+1)
+		payload[0] = byte(i) // distinct hash, so it`s not filtered as a duplicate
+		payload[32] = 255    // malformed protobuf body
+		return &p2p.Msg{CmdSet: CmdSet, Cmd: topoCmd, Payload: payload}
+	}
+
+	rw := &blockRW{closed: make(chan struct{})}
+	defer close(rw.closed)
+	peers[0].rw = rw
+
+	handled := make(chan error, 1)
+	go func() {
+		handled <- tp.handle(peers[0])
+	}()
+	if !waitFor(time.Second, func() bool { return tp.peers.get("a") != nil }) {
+		t.Fatal("peer should be handled")
+	}
+
+	for i := 0; i < 2; i++ {
+		tp.Receive(malformed(i), peers[0])
+	}
+	if n := svr.blocks(); n != 0 {
+		t.Fatalf("peer should not be reported before MaxMalformedTopos, but reported %d times", n)
+	}
+	select {
+	case err := <-handled:
+		t.Fatalf("peer should not be disconnected before MaxMalformedTopos, but got %v", err)
+	default:
+	}
+
+	// malformed topos are counted per peer
+	tp.Receive(malformed(2), peers[1])
+	if n := svr.blocks(); n != 0 {
+		t.Fatalf("malformed topo of b should not report a, but reported %d times", n)
+	}
+
+	tp.Receive(malformed(3), peers[0])
+	if n := svr.blocks(); n != 1 {
+		t.Fatalf("peer should be reported once after %d malformed topos, but reported %d times", tp.MaxMalformedTopos, n)
+	}
+	if id, _ := peers[0].remote(); svr.blocked[0] != id {
+		t.Errorf("should report a, but reported %s", svr.blocked[0])
+	}
+	select {
+	case err := <-handled:
+		if err == nil {
+			t.Error("Handle should return the deserialize error")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("peer should be disconnected")
+	}
+
+	// dropped only until disconnected
+	tp.Receive(malformed(4), peers[0])
+	if n := svr.blocks(); n != 1 {
+		t.Errorf("peer should be reported only once, but reported %d times", n)
+	}
+
+	// handle of b returns at once since its rw is closed
+	if err := tp.handle(peers[1]); err == nil {
+		t.Fatal("handle should return the read error")
+	}
+
+	done := make(chan struct{})
+	go func() {
+		for i := 5; i < 7; i++ {
+			tp.Receive(malformed(i), peers[1])
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Receive should not be blocked by a peer no longer handled")
+	}
+	if n := svr.blocks(); n != 2 {
+		t.Errorf("b should be reported after %d malformed topos, but got %d reports in total", tp.MaxMalformedTopos, n)
+	}
+}
+
+func TestTopology_broadcast(t *testing.T) {
+	tp := New(&Config{SendConcurrency: 4})
+
+	var ids []string
+	for i := 0; i < 20; i++ {
+		ids = append(ids, strconv.Itoa(i))
+	}
+	peers := tp.addMockPeers(ids...)
+
+	errWrite := errors.New("write error")
+	peers[7].rw.(*mockRW).err = errWrite
+
+	errs := tp.broadcast(map[Format][]byte{FormatProto: []byte("topo")})
+
+	if len(errs) != 1 || errs["7"] != errWrite {
+		t.Errorf("should collect error of peer 7, but got %v", errs)
+	}
+
+	for i, p := range peers {
+		if i == 7 {
+			continue
+		}
+		if n := p.rw.(*mockRW).count(); n != 1 {
+			t.Errorf("peer %s should receive topo once, but got %d", p.id, n)
+		}
+	}
+}
+
+func TestTopology_pruneStale(t *testing.T) {
+	tp := New(&Config{StaleThreshold: 60})
+
+	peers := tp.addMockPeers("stale", "active", "fresh")
+	stale, active, fresh := peers[0], peers[1], peers[2]
+
+	stale.created = time.Now().Add(-2 * time.Minute)
+	active.created = time.Now().Add(-2 * time.Minute)
+	active.received()
+
+	tp.pruneStale()
+
+	if stale.rw.(*mockRW).disconnected == 0 {
+		t.Error("stale peer should be disconnected")
+	}
+	if active.rw.(*mockRW).disconnected != 0 {
+		t.Error("active peer should not be disconnected")
+	}
+	if fresh.rw.(*mockRW).disconnected != 0 {
+		t.Error("freshly connected peer should not be disconnected")
+	}
+}
+
+func TestValidPivot(t *testing.T) {
+	if err := validPivot(mockTopo(0).Pivot); err != nil {
+		t.Errorf("valid pivot should pass: %v", err)
+	}
+
+	malformed := []string{
+		"",
+		"whatever",
+		"enode://6b7f8b2e1c3d4a5f6b7f8b2e1c3d4a5f6b7f8b2e1c3d4a5f6b7f8b2e1c3d4a5f@127.0.0.1:8483",
+		"vnode://6b7f8b2e1c3d4a5f@127.0.0.1:8483",
+		"vnode://6b7f8b2e1c3d4a5f6b7f8b2e1c3d4a5f6b7f8b2e1c3d4a5f6b7f8b2e1c3d4a5f@localhost:8483",
+	}
+	for _, pivot := range malformed {
+		if err := validPivot(pivot); err == nil {
+			t.Errorf("malformed pivot %q should fail", pivot)
+		}
+	}
+}
+
+type mockServer struct {
+	p2p.Server
+	url string
+
+	mu      sync.Mutex
+	blocked []discovery.NodeID
+}
+
+func (s *mockServer) URL() string {
+	return s.url
+}
+
+func (s *mockServer) Block(id discovery.NodeID, ip net.IP, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.blocked = append(s.blocked, id)
+}
+
+func (s *mockServer) blocks() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.blocked)
+}
+
+func TestTopology_Start_invalidPivot(t *testing.T) {
+	tp := New(&Config{})
+	if err := tp.Start(&mockServer{url: "whatever"}); err == nil {
+		tp.Stop()
+		t.Error("should not start with malformed self pivot")
+	}
+}
+
+func TestTopology_Flush(t *testing.T) {
+	tp := New(&Config{})
+	peers := tp.addMockPeers("a")
+
+	if err := tp.Flush(); err != ErrTopoNotStarted {
+		t.Fatalf("should fail with %v before start, but got %v", ErrTopoNotStarted, err)
+	}
+	// self url is unknown before start
+	if pivot := tp.Topology().Pivot; pivot != "" {
+		t.Fatalf("pivot should be empty before start, but got %s", pivot)
+	}
+	if tp.isSelf("") {
+		t.Fatal("unknown self url should not match any pivot")
+	}
+	if n := peers[0].rw.(*mockRW).count(); n != 0 {
+		t.Fatalf("should not send before start, but sent %d times", n)
+	}
+
+	if err := tp.Start(&mockServer{url: mockTopo(0).Pivot}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tp.Flush(); err != nil {
+		t.Errorf("should flush after start: %v", err)
+	}
+	if n := peers[0].rw.(*mockRW).count(); n != 1 {
+		t.Errorf("should send topo once, but sent %d times", n)
+	}
+
+	tp.Stop()
+	if err := tp.Flush(); err != errTopologyStopped {
+		t.Errorf("should fail with %v after stop, but got %v", errTopologyStopped, err)
+	}
+}
+
+func TestTopology_tickHook(t *testing.T) {
+	tp := New(&Config{})
+	peers := tp.addMockPeers("a")
+
+	// fake clock, the ticks are driven by test
+	ticks := make(chan time.Time)
+	tp.newTicker = func(d time.Duration) (<-chan time.Time, func()) {
+		if d != time.Duration(tp.Interval)*time.Second {
+			t.Errorf("should tick every %d seconds, but got %s", tp.Interval, d)
+		}
+		return ticks, func() {}
+	}
+	ticked := make(chan struct{})
+	tp.tickHook = func() {
+		ticked <- struct{}{}
+	}
+
+	if err := tp.Start(&mockServer{url: mockTopo(0).Pivot}); err != nil {
+		t.Fatal(err)
+	}
+	defer tp.Stop()
+
+	for i := 1; i <= 3; i++ {
+		ticks <- time.Now()
+		<-ticked
+
+		// the topo has been broadcast when the hook fires
+		if n := peers[0].rw.(*mockRW).count(); n != i {
+			t.Fatalf("should broadcast %d times at tick %d, but got %d", i, i, n)
+		}
+	}
+
+	select {
+	case <-ticked:
+		t.Error("hook should fire once per tick")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestTopology_decayLoop(t *testing.T) {
+	tp := New(&Config{GraphDecayInterval: 1})
+	if tp.StalePruneInterval != 0 {
+		t.Fatal("graph should decay even stale peers are not pruned")
+	}
+
+	topo := mockTopo(1)
+	tp.graph.AddTopo(topo)
+	cp := topo.Peers[0]
+	if w := tp.graph.EdgeWeight(cp.LocalID, cp.RemoteID); w != 1 {
+		t.Fatalf("edge weight should be 1, but got %d", w)
+	}
+
+	if err := tp.Start(&mockServer{url: "vnode://7c8f9c3f2d4e5b6f7c8f9c3f2d4e5b6f7c8f9c3f2d4e5b6f7c8f9c3f2d4e5b6f@127.0.0.2:8483"}); err != nil {
+		t.Fatal(err)
+	}
+	defer tp.Stop()
+
+	if !waitFor(3*time.Second, func() bool { return tp.graph.EdgeWeight(cp.LocalID, cp.RemoteID) == 0 }) {
+		t.Error("edge weight should decay to 0")
+	}
+}
+
+func TestTopology_AdvertisePivot(t *testing.T) {
+	const internal = "vnode://6b7f8b2e1c3d4a5f6b7f8b2e1c3d4a5f6b7f8b2e1c3d4a5f6b7f8b2e1c3d4a5f@192.168.1.2:8483"
+	const external = "vnode://6b7f8b2e1c3d4a5f6b7f8b2e1c3d4a5f6b7f8b2e1c3d4a5f6b7f8b2e1c3d4a5f@1.2.3.4:8483"
+
+	tp := New(&Config{})
+	tp.p2p = &mockServer{url: internal}
+	if pivot := tp.Topology().Pivot; pivot != internal {
+		t.Errorf("should use p2p url %s, but got %s", internal, pivot)
+	}
+
+	tp = New(&Config{AdvertisePivot: external})
+	tp.p2p = &mockServer{url: internal}
+	if pivot := tp.Topology().Pivot; pivot != external {
+		t.Errorf("should use advertised pivot %s, but got %s", external, pivot)
+	}
+
+	tp = New(&Config{AdvertisePivot: "whatever"})
+	if err := tp.Start(&mockServer{url: internal}); err == nil {
+		tp.Stop()
+		t.Error("should not start with malformed advertised pivot")
+	}
+}
+
+func TestTopology_Receive_invalidPivot(t *testing.T) {
+	tp := New(&Config{})
+	peers := tp.addMockPeers("a", "b")
+
+	topo := mockTopo(3)
+	topo.Pivot = "whatever"
+	tp.Receive(mockTopoMsg(t, topo), peers[0])
+
+	if n := peers[1].rw.(*mockRW).count(); n != 0 {
+		t.Errorf("topo of malformed pivot should not be forwarded")
+	}
+
+	tp.Receive(mockTopoMsg(t, mockTopo(3)), peers[0])
+	if n := peers[1].rw.(*mockRW).count(); n != 1 {
+		t.Errorf("topo of valid pivot should be forwarded")
+	}
+}
+
+func TestTopo_PeerSet(t *testing.T) {
+	topo := mockTopo(5)
+
+	set := topo.PeerSet()
+	for i := 0; i < 5; i++ {
+		if _, ok := set[fmt.Sprintf("remote%d", i)]; !ok {
+			t.Errorf("remote%d should be in the set", i)
+		}
+	}
+	if _, ok := set["remote5"]; ok {
+		t.Error("remote5 should not be in the set")
+	}
+	if _, ok := set["local0"]; ok {
+		t.Error("local0 should not be in the set")
+	}
+
+	// cached
+	set["remote5"] = struct{}{}
+	if _, ok := topo.PeerSet()["remote5"]; !ok {
+		t.Error("the set should be cached")
+	}
+	delete(set, "remote5")
+
+	// invalidated
+	topo.Peers = append(topo.Peers, &p2p.ConnProperty{RemoteID: "remote5"})
+	if _, ok := topo.PeerSet()["remote5"]; !ok {
+		t.Error("remote5 should be in the set after appended")
+	}
+
+	topo.Peers = topo.Peers[:2]
+	if _, ok := topo.PeerSet()["remote3"]; ok {
+		t.Error("remote3 should not be in the set after truncated")
+	}
+}
+
+// topo in graph is read by Equal and DiffTopo from different goroutines, run with -race
+func TestTopo_PeerSet_concurrent(t *testing.T) {
+	topo, other := mockTopo(5), mockTopo(5)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if !topo.Equal(other) {
+				t.Error("topos should be equal")
+			}
+			if len(topo.PeerSet()) != 5 {
+				t.Error("set should have 5 peers")
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestNew_Logger(t *testing.T) {
+	var records []string
+	log := log15.New("test", "topo")
+	log.SetHandler(log15.FuncHandler(func(r *log15.Record) error {
+		records = append(records, r.Msg)
+		return nil
+	}))
+
+	tp := New(&Config{Logger: log})
+	sender := tp.addMockPeers("a")[0]
+
+	topo := mockTopo(1)
+	topo.Pivot = "whatever"
+	tp.Receive(mockTopoMsg(t, topo), sender)
+
+	if len(records) != 1 {
+		t.Errorf("should log with the injected logger, but got %v", records)
+	}
+}
+
+func TestTopology_FilterLoad(t *testing.T) {
+	tp := New(&Config{})
+
+	if load := tp.FilterLoad(); load != 0 {
+		t.Fatalf("load of empty filter should be 0, but got %f", load)
+	}
+
+	const n = 256
+	for i := 0; i < n; i++ {
+		tp.addRecord([]byte(strconv.Itoa(i)))
+	}
+
+	// some hashes may share fingerprint, so the load is approximate
+	expect := float64(n) / float64(filterCapacity(recordCapacity))
+	if load := tp.FilterLoad(); load > expect || load < expect*0.9 {
+		t.Errorf("load should be about %f, but got %f", expect, load)
+	}
+
+	// rotate when too full
+	for i := n; i < 2*recordCapacity; i++ {
+		tp.addRecord([]byte(strconv.Itoa(i)))
+	}
+	if load := tp.FilterLoad(); load >= maxRecordLoad {
+		t.Errorf("filter should be rotated, but load is %f", load)
+	}
+}
+
+type mockProducer struct {
+	sarama.AsyncProducer
+	input chan *sarama.ProducerMessage
+}
+
+func (p *mockProducer) Input() chan<- *sarama.ProducerMessage {
+	return p.input
+}
+
+// events return messages of topic written so far
+func (p *mockProducer) events(topic string) (values [][]byte) {
+	for {
+		select {
+		case msg := <-p.input:
+			if msg.Topic == topic {
+				data, _ := msg.Value.Encode()
+				values = append(values, data)
+			}
+		default:
+			return
+		}
+	}
+}
+
+func TestTopology_Receive_NoForward(t *testing.T) {
+	tp := New(&Config{NoForward: true})
+	prod := &mockProducer{input: make(chan *sarama.ProducerMessage, 10)}
+	tp.prod = prod
+	peers := tp.addMockPeers("a", "b", "c")
+
+	topo := mockTopo(3)
+	tp.Receive(mockTopoMsg(t, topo), peers[0])
+
+	for _, p := range peers[1:] {
+		if n := p.rw.(*mockRW).count(); n != 0 {
+			t.Errorf("should not forward to %s, but forward %d times", p.id, n)
+		}
+	}
+	if n := tp.Graph().Size(); n != 1 {
+		t.Errorf("topo should be added to graph, but graph has %d topos", n)
+	}
+	if events := prod.events("p2p_status_event"); len(events) != 1 {
+		t.Errorf("topo should be written to kafka once, but got %d writes", len(events))
+	}
+}
+
+func TestTopology_report(t *testing.T) {
+	tp := New(&Config{TopoHistory: 2})
+	prod := &mockProducer{input: make(chan *sarama.ProducerMessage, 10)}
+	tp.prod = prod
+
+	// tick 1: remote0, remote1, remote2
+	tp.report(mockTopo(3))
+	if events := prod.events(topoDiffTopic); len(events) != 0 {
+		t.Fatalf("should not report diff without previous topo, but got %s", events)
+	}
+
+	// tick 2: remote1 is gone, remote3 joined
+	topo := mockTopo(4)
+	topo.Peers = append(topo.Peers[:1], topo.Peers[2:]...)
+	tp.report(topo)
+
+	events := prod.events(topoDiffTopic)
+	if len(events) != 1 {
+		t.Fatalf("should report 1 diff, but got %d", len(events))
+	}
+
+	diff := new(TopoDiff)
+	if err := json.Unmarshal(events[0], diff); err != nil {
+		t.Fatal(err)
+	}
+	if len(diff.Added) != 1 || diff.Added[0] != "remote3" {
+		t.Errorf("added should be [remote3], but got %v", diff.Added)
+	}
+	if len(diff.Removed) != 1 || diff.Removed[0] != "remote1" {
+		t.Errorf("removed should be [remote1], but got %v", diff.Removed)
+	}
+
+	// tick 3: nothing changed
+	tp.report(topo)
+	if events := prod.events(topoDiffTopic); len(events) != 0 {
+		t.Errorf("should not report empty diff, but got %s", events)
+	}
+
+	if history := tp.History(); len(history) != 2 || history[1] != topo {
+		t.Errorf("should retain the last 2 topos, but got %d", len(history))
+	}
+}
+
+func TestTopology_report_MinPeersToReport(t *testing.T) {
+	tp := New(&Config{MinPeersToReport: 3})
+	prod := &mockProducer{input: make(chan *sarama.ProducerMessage, 10)}
+	tp.prod = prod
+
+	for n := 0; n < 3; n++ {
+		tp.report(mockTopo(n))
+		if events := prod.events(tp.Topic); len(events) != 0 {
+			t.Fatalf("topo of %d peers should not be reported", n)
+		}
+	}
+
+	tp.report(mockTopo(3))
+	if events := prod.events(tp.Topic); len(events) != 1 {
+		t.Fatalf("topo reaches the threshold should be reported, but got %d events", len(events))
+	}
+}
+
+func TestTopology_report_ReportOnChange(t *testing.T) {
+	tp := New(&Config{ReportOnChange: true})
+	prod := &mockProducer{input: make(chan *sarama.ProducerMessage, 10)}
+	tp.prod = prod
+
+	// tick 1: the first topo, tick 2: the same peers later, tick 3: a peer connected
+	tp.report(mockTopo(3))
+	later := mockTopo(3)
+	later.Time = UnixTime(time.Now().Add(5 * time.Second))
+	tp.report(later)
+	tp.report(mockTopo(4))
+
+	if events := prod.events(tp.Topic); len(events) != 2 {
+		t.Errorf("only changed topo should be reported, but got %d events", len(events))
+	}
+}
+
+func TestTopology_report_ReportWindow(t *testing.T) {
+	tp := New(&Config{ReportWindow: 1})
+	prod := &mockProducer{input: make(chan *sarama.ProducerMessage, 10)}
+	tp.prod = prod
+
+	tp.report(mockTopo(2))
+
+	// a flapping peer within the window
+	start := time.Now()
+	for _, n := range []int{3, 2, 3, 4} {
+		tp.report(mockTopo(n))
+	}
+
+	if events := prod.events(tp.Topic); len(events) != 0 {
+		t.Fatalf("should not report before the window closed, but got %d events", len(events))
+	}
+
+	var events [][]byte
+	if !waitFor(2*time.Second, func() bool {
+		events = append(events, prod.events(tp.Topic)...)
+		return len(events) > 0
+	}) {
+		t.Fatal("should report when the window closed")
+	}
+	if time.Since(start) < 900*time.Millisecond {
+		t.Errorf("should report at the end of the window")
+	}
+
+	// no more writes
+	time.Sleep(100 * time.Millisecond)
+	events = append(events, prod.events(tp.Topic)...)
+	if len(events) != 1 {
+		t.Fatalf("changes should be coalesced into 1 event, but got %d", len(events))
+	}
+
+	topo := new(Topo)
+	if err := json.Unmarshal(events[0], topo); err != nil {
+		t.Fatal(err)
+	}
+	if len(topo.Peers) != 4 {
+		t.Errorf("should report the latest topo of 4 peers, but got %d", len(topo.Peers))
+	}
+
+	tp.wg.Wait()
+}
+
+func TestTopo_Equal(t *testing.T) {
+	a, b := mockTopo(3), mockTopo(3)
+	b.Time = UnixTime(time.Now().Add(time.Hour))
+	b.Peers[0], b.Peers[2] = b.Peers[2], b.Peers[0]
+	if !a.Equal(b) {
+		t.Errorf("topos of the same peers should be equal")
+	}
+
+	// the same count but duplicated peer
+	b = mockTopo(3)
+	b.Peers[0] = b.Peers[1]
+	if a.Equal(b) {
+		t.Errorf("topos of different peers should not be equal")
+	}
+
+	b = mockTopo(3)
+	b.Pivot = "other"
+	if a.Equal(b) || a.Equal(mockTopo(2)) {
+		t.Errorf("topos of different pivot or peers count should not be equal")
+	}
+}
+
+func TestTopo_Direction(t *testing.T) {
+	topo := mockTopo(3)
+	topo.Peers[0].Direction = p2p.DirInbound
+	topo.Peers[1].Direction = p2p.DirOutbound
+	// Peers[2] is reported by old node, direction is unknown
+
+	for _, format := range []Format{FormatProto, FormatJSON} {
+		data, err := topo.SerializeFormat(format)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		topo2 := new(Topo)
+		if err = topo2.Deserialize(data[32:]); err != nil {
+			t.Fatal(err)
+		}
+
+		for i, cp := range topo2.Peers {
+			if cp.Direction != topo.Peers[i].Direction {
+				t.Errorf("direction of peer %d should be %s, but got %s in format %d", i, topo.Peers[i].Direction, cp.Direction, format)
+			}
+		}
+	}
+
+	// unknown direction is omitted from JSON
+	if bytes.Contains(topo.Json(), []byte(`"direction":0`)) {
+		t.Errorf("unknown direction should be omitted")
+	}
+}
+
+// fullFilter can`t record anything
+type fullFilter struct{}
+
+func (fullFilter) Insert(data []byte) bool { return false }
+func (fullFilter) Lookup(data []byte) bool { return false }
+func (fullFilter) Count() uint             { return recordCapacity }
+
+func TestTopology_Receive_unrecordable(t *testing.T) {
+	tp := New(&Config{})
+	peers := tp.addMockPeers("a", "b")
+
+	// rotate and retry
+	tp.record = fullFilter{}
+	msg := mockTopoMsg(t, mockTopo(3))
+	tp.Receive(msg, peers[0])
+
+	if n := peers[1].rw.(*mockRW).count(); n != 1 {
+		t.Fatalf("should forward after rotation, but forward %d times", n)
+	}
+	if !tp.hasRecord(msg.Payload[:32]) {
+		t.Fatalf("message should be recorded after rotation")
+	}
+
+	// still can`t record after rotation
+	tp.record = fullFilter{}
+	tp.newRec = func() recordFilter { return fullFilter{} }
+	msg = mockTopoMsg(t, mockTopo(4))
+	tp.Receive(msg, peers[0])
+
+	if n := peers[1].rw.(*mockRW).count(); n != 1 {
+		t.Errorf("unrecordable message should not be forwarded, but forward %d times", n-1)
+	}
+	if n := tp.Graph().Size(); n != 1 {
+		t.Errorf("unrecordable message should be dropped, but graph has %d topos", n)
+	}
+}
+
+func TestTopology_OnFilterRotate(t *testing.T) {
+	tp := New(&Config{})
+
+	// no-op when unset
+	tp.addRecord([]byte("first"))
+
+	var rotations []uint
+	tp.OnFilterRotate(func(inserted uint) {
+		rotations = append(rotations, inserted)
+	})
+
+	for i := 0; len(rotations) == 0 && i < 10*recordCapacity; i++ {
+		tp.addRecord([]byte(strconv.Itoa(i)))
+	}
+
+	if len(rotations) != 1 {
+		t.Fatalf("should rotate once, but rotate %d times", len(rotations))
+	}
+
+	// rotated at maxRecordLoad, or earlier if insertion failed
+	if n := rotations[0]; n < recordCapacity/2 || n > filterCapacity(recordCapacity) {
+		t.Errorf("retired filter should hold about %d entries, but got %d", recordCapacity, n)
+	}
+
+	tp.OnFilterRotate(nil)
+	tp.rotateRecord("test")
+	if len(rotations) != 1 {
+		t.Errorf("callback should be removed")
+	}
+}
+
+func TestTopology_Receive_expired(t *testing.T) {
+	tp := New(&Config{MaxTopoAge: 10})
+	peers := tp.addMockPeers("a", "b")
+
+	stale := mockTopo(3)
+	stale.Time = UnixTime(time.Now().Add(-time.Minute))
+	future := mockTopo(4)
+	future.Time = UnixTime(time.Now().Add(time.Hour))
+
+	for name, topo := range map[string]*Topo{"stale": stale, "future": future} {
+		msg := mockTopoMsg(t, topo)
+		tp.Receive(msg, peers[0])
+
+		if n := peers[1].rw.(*mockRW).count(); n != 0 {
+			t.Errorf("%s topo should not be forwarded, but forward %d times", name, n)
+		}
+		if tp.hasRecord(msg.Payload[:32]) {
+			t.Errorf("%s topo should not be recorded", name)
+		}
+	}
+
+	if n := tp.Graph().Size(); n != 0 {
+		t.Errorf("stale and future topo should be rejected, but graph has %d topos", n)
+	}
+
+	// slightly skewed clock is tolerated
+	fresh := mockTopo(5)
+	fresh.Time = UnixTime(time.Now().Add(time.Second))
+	tp.Receive(mockTopoMsg(t, fresh), peers[0])
+
+	if n := tp.Graph().Size(); n != 1 {
+		t.Errorf("fresh topo should be accepted, but graph has %d topos", n)
+	}
+}
+
+// slowProducer take delay to flush when closed
+type slowProducer struct {
+	mockProducer
+	delay time.Duration
+}
+
+func (p *slowProducer) Close() error {
+	time.Sleep(p.delay)
+	return nil
+}
+
+func TestTopology_Shutdown(t *testing.T) {
+	tp := New(&Config{})
+	tp.term = make(chan struct{})
+	tp.prod = &slowProducer{delay: time.Second}
+	peers := tp.addMockPeers("a", "b")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	err := tp.Shutdown(ctx)
+	if err == nil || errors.Cause(err) != context.DeadlineExceeded {
+		t.Errorf("should return deadline exceeded, but got %v", err)
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("should return at the deadline, but took %s", d)
+	}
+
+	for _, p := range peers {
+		if reason := p.rw.(*mockRW).disconnected; reason != p2p.DiscQuitting {
+			t.Errorf("peer %s should be disconnected, but got %v", p.id, reason)
+		}
+	}
+
+	// already shutdown
+	if err = tp.Shutdown(context.Background()); err != nil {
+		t.Errorf("shutdown again should return nil, but got %v", err)
+	}
+
+	tp = New(&Config{})
+	tp.term = make(chan struct{})
+	tp.prod = &slowProducer{delay: 10 * time.Millisecond}
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err = tp.Shutdown(ctx); err != nil {
+		t.Errorf("should flush before the deadline, but got %v", err)
+	}
+}
+
+func waitFor(timeout time.Duration, fn func() bool) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if fn() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return fn()
+}
+
+// blockRW block ReadMsg until closed
+type blockRW struct {
+	mockRW
+	closed chan struct{}
+}
+
+func (rw *blockRW) ReadMsg() (*p2p.Msg, error) {
+	<-rw.closed
+	return nil, io.EOF
+}
+
+func TestTopology_DisconnectPeer(t *testing.T) {
+	tp := New(&Config{})
+	tp.term = make(chan struct{})
+
+	rw := &blockRW{closed: make(chan struct{})}
+	defer close(rw.closed)
+
+	peer := mockPeer("a")
+	peer.rw = rw
+
+	errch := make(chan error, 1)
+	go func() {
+		errch <- tp.handle(peer)
+	}()
+
+	if !waitFor(time.Second, func() bool { return tp.peers.get("a") != nil }) {
+		t.Fatal("peer should be handled")
+	}
+
+	// the other peer is not affected
+	tp.DisconnectPeer("b")
+
+	select {
+	case err := <-errch:
+		t.Fatalf("handle should not return, but got %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	tp.DisconnectPeer("a")
+	tp.DisconnectPeer("a")
+
+	select {
+	case err := <-errch:
+		if err != p2p.DiscRequested {
+			t.Errorf("should return %v, but got %v", p2p.DiscRequested, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("handle should return after DisconnectPeer")
+	}
+
+	if tp.peers.get("a") != nil {
+		t.Error("peer should be removed")
+	}
+}
+
+func TestTopology_MaxPeers(t *testing.T) {
+	tp := New(&Config{MaxPeers: 2})
+	tp.term = make(chan struct{})
+	defer close(tp.term)
+
+	rw := &blockRW{closed: make(chan struct{})}
+	defer close(rw.closed)
+
+	handle := func(id string) chan error {
+		peer := mockPeer(id)
+		peer.rw = rw
+
+		errch := make(chan error, 1)
+		go func() {
+			errch <- tp.handle(peer)
+		}()
+		return errch
+	}
+
+	handle("a")
+	handle("b")
+	if !waitFor(time.Second, func() bool { return tp.peers.size() == 2 }) {
+		t.Fatalf("should handle 2 peers, but handle %d", tp.peers.size())
+	}
+
+	select {
+	case err := <-handle("c"):
+		if err != p2p.DiscTooManyPeers {
+			t.Errorf("should return %v, but got %v", p2p.DiscTooManyPeers, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("excess peer should be rejected")
+	}
+	if tp.peers.get("c") != nil {
+		t.Error("excess peer should not be added")
+	}
+
+	// slot is freed
+	tp.DisconnectPeer("a")
+	if !waitFor(time.Second, func() bool { return tp.peers.get("a") == nil }) {
+		t.Fatal("peer a should be removed")
+	}
+
+	handle("c")
+	if !waitFor(time.Second, func() bool { return tp.peers.get("c") != nil }) {
+		t.Error("peer should be accepted after a slot is freed")
+	}
+}
+
+func TestTopology_OnError(t *testing.T) {
+	type failure struct {
+		stage string
+		err   error
+	}
+	var failures []failure
+
+	tp := New(&Config{MaxTopoMsgSize: 10})
+	tp.send(mockTopo(0))
+
+	tp.OnError(func(stage string, err error) {
+		failures = append(failures, failure{stage, err})
+	})
+
+	// even the pivot can`t fit MaxTopoMsgSize
+	tp.send(mockTopo(0))
+	if len(failures) != 1 || failures[0].stage != "serialize" || failures[0].err != errTopoTooLarge {
+		t.Fatalf("should fire serialize error, but got %v", failures)
+	}
+
+	tp.MaxTopoMsgSize = defaultMaxTopoMsgSize
+	errWrite := errors.New("write error")
+	peer := tp.addMockPeers("a")[0]
+	peer.rw.(*mockRW).err = errWrite
+
+	tp.send(mockTopo(1))
+	if len(failures) != 2 || failures[1].stage != "write" || errors.Cause(failures[1].err) != errWrite {
+		t.Fatalf("should fire write error, but got %v", failures)
+	}
+}
+
+func TestTopology_send_history(t *testing.T) {
+	tp := New(&Config{MaxTopoMsgSize: 500})
+	peer := tp.addMockPeers("a")[0]
+
+	tp.send(mockTopo(10))
+
+	rw := peer.rw.(*mockRW)
+	if rw.count() != 1 {
+		t.Fatalf("topo should be sent, but sent %d", rw.count())
+	}
+	topo := new(Topo)
+	if err := topo.Deserialize(rw.msgs[0].Payload[32:]); err != nil {
+		t.Fatal(err)
+	}
+	if !topo.Truncated {
+		t.Fatal("topo sent should be truncated to fit MaxTopoMsgSize")
+	}
+
+	// the topo kept in history is not changed by truncating
+	history := tp.History()
+	if len(history) != 1 {
+		t.Fatalf("topo should be kept in history, but got %d", len(history))
+	}
+	if len(history[0].Peers) != 10 || history[0].Truncated {
+		t.Errorf("topo in history should keep all peers, but got %d", len(history[0].Peers))
+	}
+}
+
+// pipeRW deliver messages written to it to the other end
+type pipeRW struct {
+	in   chan *p2p.Msg
+	out  chan *p2p.Msg
+	term chan struct{}
+}
+
+func newPipe() (a, b *pipeRW) {
+	ab, ba, term := make(chan *p2p.Msg, 10), make(chan *p2p.Msg, 10), make(chan struct{})
+	return &pipeRW{ba, ab, term}, &pipeRW{ab, ba, term}
+}
+
+func (rw *pipeRW) ReadMsg() (*p2p.Msg, error) {
+	select {
+	case msg := <-rw.in:
+		return msg, nil
+	case <-rw.term:
+		return nil, io.EOF
+	}
+}
+
+func (rw *pipeRW) WriteMsg(msg *p2p.Msg) error {
+	select {
+	case rw.out <- &p2p.Msg{CmdSet: msg.CmdSet, Cmd: msg.Cmd, Payload: append([]byte{}, msg.Payload...)}:
+		return nil
+	case <-rw.term:
+		return io.EOF
+	}
+}
+
+func TestTopology_RequestTopo(t *testing.T) {
+	const pivotA = "vnode://6b7f8b2e1c3d4a5f6b7f8b2e1c3d4a5f6b7f8b2e1c3d4a5f6b7f8b2e1c3d4a5f@127.0.0.1:8483"
+	const pivotB = "vnode://7c8f9c3f2d4e5b6f7c8f9c3f2d4e5b6f7c8f9c3f2d4e5b6f7c8f9c3f2d4e5b6f@127.0.0.2:8483"
+
+	a := New(&Config{AdvertisePivot: pivotA})
+	b := New(&Config{AdvertisePivot: pivotB})
+	b.addMockPeers("c", "d")
+
+	rwa, rwb := newPipe()
+	defer close(rwa.term)
+
+	// peer b seen by a, and peer a seen by b
+	pb, pa := mockPeer("b"), mockPeer("a")
+	pb.rw, pa.rw = rwa, rwb
+	pb.setFormat(FormatProto)
+
+	go a.handle(pb)
+	go b.handle(pa)
+
+	if !waitFor(time.Second, func() bool {
+		return a.peers.get("b") != nil && b.peers.get("a") != nil
+	}) {
+		t.Fatal("peers should be handled")
+	}
+
+	topo, err := a.RequestTopo("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if topo.Pivot != pivotB {
+		t.Errorf("wrong pivot %s", topo.Pivot)
+	}
+	if len(topo.Peers) != 3 {
+		t.Errorf("topo of b should have 3 peers, got %d", len(topo.Peers))
+	}
+	if len(a.pending) != 0 {
+		t.Errorf("pending request should be removed")
+	}
+
+	if _, err = a.RequestTopo("x"); err != errPeerNotFound {
+		t.Errorf("should fail for unknown peer: %v", err)
+	}
+}
+
+func TestTopology_RequestTopo_timeout(t *testing.T) {
+	tp := New(&Config{RequestTimeout: 1})
+	peers := tp.addMockPeers("a")
+	peers[0].setFormat(FormatProto)
+
+	_, err := tp.RequestTopo("a")
+	if errors.Cause(err) != errTopoRequestTimeout {
+		t.Fatalf("should timeout: %v", err)
+	}
+
+	msgs := peers[0].rw.(*mockRW).msgs
+	if len(msgs) != 1 || msgs[0].Cmd != getTopoCmd || len(msgs[0].Payload) != 8 {
+		t.Errorf("should send one getTopoCmd")
+	}
+}
+
+func TestTopology_RequestTopo_legacy(t *testing.T) {
+	tp := New(&Config{})
+	peers := tp.addMockPeers("a")
+
+	_, err := tp.RequestTopo("a")
+	if errors.Cause(err) != errTopoRequestUnsupported {
+		t.Fatalf("should not ask peer hasn`t announced formatCmd: %v", err)
+	}
+	if len(peers[0].rw.(*mockRW).msgs) != 0 {
+		t.Errorf("should not send getTopoCmd")
+	}
+}
+
+func TestTopology_resolve(t *testing.T) {
+	const pivot = "vnode://7c8f9c3f2d4e5b6f7c8f9c3f2d4e5b6f7c8f9c3f2d4e5b6f7c8f9c3f2d4e5b6f@127.0.0.2:8483"
+
+	tp := New(&Config{AdvertisePivot: pivot})
+	peers := tp.addMockPeers("a", "b")
+
+	reply := func(id uint64, topo *Topo) []byte {
+		data, err := tp.serialize(topo, FormatProto)
+		if err != nil {
+			t.Fatal(err)
+		}
+		payload := make([]byte, 8, 8+len(data))
+		binary.BigEndian.PutUint64(payload, id)
+		return append(payload, data...)
+	}
+
+	ch := make(chan *Topo, 1)
+	tp.pending[1] = &topoRequest{peer: "a", ch: ch}
+
+	stale := mockTopo(1)
+	stale.Time = UnixTime(time.Now().Add(-time.Hour))
+	self := mockTopo(1)
+	self.Pivot = pivot
+
+	// reply from other peer, of self and stale reply are dropped
+	for i, c := range []struct {
+		peer *Peer
+		topo *Topo
+	}{
+		{peers[1], mockTopo(1)},
+		{peers[0], self},
+		{peers[0], stale},
+	} {
+		if err := tp.resolve(c.peer, reply(1, c.topo)); err != nil {
+			t.Fatal(err)
+		}
+		if len(ch) != 0 {
+			t.Fatalf("reply %d should be dropped", i)
+		}
+	}
+
+	if err := tp.resolve(peers[0], reply(1, mockTopo(1))); err != nil {
+		t.Fatal(err)
+	}
+	if len(ch) != 1 {
+		t.Error("reply of the requested peer should be resolved")
+	}
+}
+
+func TestTopology_answer(t *testing.T) {
+	tp := New(&Config{Interval: 60})
+	peers := tp.addMockPeers("a", "b")
+
+	payload := make([]byte, 8)
+	for _, p := range []*Peer{peers[0], peers[0], peers[1]} {
+		if err := tp.answer(p, payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n := len(peers[0].rw.(*mockRW).msgs); n != 1 {
+		t.Errorf("should answer a once every Interval, but answered %d", n)
+	}
+	if n := len(peers[1].rw.(*mockRW).msgs); n != 1 {
+		t.Errorf("should answer b, but answered %d", n)
+	}
+}
+
+func TestTopology_PeerStats(t *testing.T) {
+	tp := New(&Config{})
+	peers := tp.addMockPeers("b", "c")
+
+	rwa, remote := newPipe()
+	defer close(rwa.term)
+
+	a := mockPeer("a")
+	a.rw = rwa
+	go tp.handle(a)
+
+	msg := mockTopoMsg(t, mockTopo(3))
+	if err := remote.WriteMsg(msg); err != nil {
+		t.Fatal(err)
+	}
+
+	if !waitFor(time.Second, func() bool { return tp.PeerStats()["a"].Received == 1 }) {
+		t.Fatalf("should receive 1 topo from a, but got %+v", tp.PeerStats())
+	}
+
+	// forward to b and c, then broadcast to all
+	tp.Receive(mockTopoMsg(t, mockTopo(3)), a)
+	tp.broadcast(map[Format][]byte{FormatProto: []byte("topo")})
+
+	peers[1].rw.(*mockRW).err = errors.New("write error")
+	tp.broadcast(map[Format][]byte{FormatProto: []byte("topo")})
+
+	want := map[string]PeerStat{
+		"a": {Received: 1, Forwarded: 2},
+		"b": {Forwarded: 3},
+		"c": {Forwarded: 2},
+	}
+	stats := tp.PeerStats()
+	if len(stats) != len(want) {
+		t.Fatalf("should have stats of %d peers, but got %d", len(want), len(stats))
+	}
+	for id, stat := range want {
+		if stats[id] != stat {
+			t.Errorf("stat of %s should be %+v, but got %+v", id, stat, stats[id])
+		}
+	}
+}
+
+func TestTopology_RegisterMetrics(t *testing.T) {
+	tp := New(&Config{})
+	tp.addMockPeers("a", "b")
+	tp.selfLoops = 3
+
+	reg := make(monitor.MapRegisterer)
+	if err := tp.RegisterMetrics(reg); err != nil {
+		t.Fatal(err)
+	}
+
+	names := []string{"topo_peers", "topo_breaker_open", "topo_filter_load",
+		"topo_kafka_dropped_total", "topo_self_loops_total", "topo_write_timeouts_total"}
+	if len(reg) != len(names) {
+		t.Errorf("should register %d metrics, but got %d", len(names), len(reg))
+	}
+	for _, name := range names {
+		if _, ok := reg[name]; !ok {
+			t.Errorf("%s should be registered", name)
+		}
+	}
+
+	if v := reg["topo_peers"](); v != 2 {
+		t.Errorf("topo_peers should be 2, but got %v", v)
+	}
+	if v := reg["topo_self_loops_total"](); v != 3 {
+		t.Errorf("topo_self_loops_total should be 3, but got %v", v)
+	}
+
+	if err := tp.RegisterMetrics(reg); err == nil {
+		t.Error("should fail to register twice")
+	}
+}
+
+func TestTopology_Protocol(t *testing.T) {
+	p := New(&Config{}).Protocol()
+	if p.Name != Name || p.ID != CmdSet {
+		t.Errorf("should use the default protocol %s/%d, but got %s/%d", Name, CmdSet, p.Name, p.ID)
+	}
+
+	a := New(&Config{ProtocolName: "TopoA", ProtocolID: 30})
+	b := New(&Config{ProtocolName: "TopoB", ProtocolID: 31})
+	pa, pb := a.Protocol(), b.Protocol()
+	if pa.Name != "TopoA" || pa.ID != 30 || pb.Name != "TopoB" || pb.ID != 31 {
+		t.Errorf("should use the configured protocol, but got %s/%d and %s/%d", pa.Name, pa.ID, pb.Name, pb.ID)
+	}
+
+	// messages are written with the configured ID
+	peers := a.addMockPeers("x")
+	a.broadcast(map[Format][]byte{FormatProto: []byte("topo")})
+	if msgs := peers[0].rw.(*mockRW).msgs; len(msgs) != 1 || msgs[0].CmdSet != 30 {
+		t.Errorf("should write message of cmd set 30")
+	}
+}
+
+func TestTopology_DebugDump(t *testing.T) {
+	tp := New(&Config{Addrs: []string{"127.0.0.1:9092"}})
+	peers := tp.addMockPeers("a", "b")
+	peers[0].received()
+	peers[1].forwarded()
+	atomic.AddUint64(&tp.selfLoops, 2)
+
+	topo := mockTopo(2)
+	tp.retain(topo)
+
+	var dump struct {
+		Pivot   string                     `json:"pivot"`
+		Config  map[string]json.RawMessage `json:"config"`
+		Metrics Metrics                    `json:"metrics"`
+		Peers   map[string]PeerStat        `json:"peers"`
+		Topo    *Topo                      `json:"lastTopo"`
+	}
+	if err := json.Unmarshal(tp.DebugDump(), &dump); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(dump.Peers) != 2 || dump.Peers["a"].Received != 1 || dump.Peers["b"].Forwarded != 1 {
+		t.Errorf("should dump 2 peers and their counters, but got %v", dump.Peers)
+	}
+	if dump.Metrics.Peers != 2 || dump.Metrics.SelfLoops != 2 {
+		t.Errorf("should dump metrics, but got %+v", dump.Metrics)
+	}
+	if dump.Topo == nil || dump.Topo.Pivot != topo.Pivot || len(dump.Topo.Peers) != 2 {
+		t.Errorf("should dump the latest topo, but got %v", dump.Topo)
+	}
+	if string(dump.Config["Addrs"]) != `["127.0.0.1:9092"]` {
+		t.Errorf("should dump config, but got %s", dump.Config["Addrs"])
+	}
+	if logger := string(dump.Config["Logger"]); logger != "null" {
+		t.Errorf("logger should be omitted, but got %s", logger)
+	}
+	if dump.Pivot != "" {
+		t.Errorf("pivot should be empty before start, but got %s", dump.Pivot)
+	}
+}
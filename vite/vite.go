@@ -13,6 +13,7 @@ import (
 	"github.com/vitelabs/go-vite/common/types"
 	"github.com/vitelabs/go-vite/config"
 	"github.com/vitelabs/go-vite/consensus"
+	"github.com/vitelabs/go-vite/ledger"
 	"github.com/vitelabs/go-vite/log15"
 	"github.com/vitelabs/go-vite/onroad"
 	"github.com/vitelabs/go-vite/p2p"
@@ -112,6 +113,10 @@ func New(cfg *config.Config, walletManager *wallet.Manager) (vite *Vite, err err
 
 	// onroad
 	or := onroad.NewManager(net, pl, vite.producer, walletManager)
+	or.SetAccountBlockVerifier(func(block *ledger.AccountBlock) error {
+		return verifier.VerifyAccountBlock(block, chain)
+	})
+	or.SetTokenVerifier(verifier.VerifyTokenAllowed)
 
 	// set onroad
 	vite.onRoad = or
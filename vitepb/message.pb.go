@@ -24,6 +24,7 @@ type Handshake struct {
 	Port                 uint32   `protobuf:"varint,3,opt,name=Port,proto3" json:"Port,omitempty"`
 	Current              []byte   `protobuf:"bytes,4,opt,name=Current,proto3" json:"Current,omitempty"`
 	Genesis              []byte   `protobuf:"bytes,5,opt,name=Genesis,proto3" json:"Genesis,omitempty"`
+	BlocksVersion        uint32   `protobuf:"varint,6,opt,name=BlocksVersion,proto3" json:"BlocksVersion,omitempty"`
 	XXX_NoUnkeyedLiteral struct{} `json:"-"`
 	XXX_unrecognized     []byte   `json:"-"`
 	XXX_sizecache        int32    `json:"-"`
@@ -33,7 +34,7 @@ func (m *Handshake) Reset()         { *m = Handshake{} }
 func (m *Handshake) String() string { return proto.CompactTextString(m) }
 func (*Handshake) ProtoMessage()    {}
 func (*Handshake) Descriptor() ([]byte, []int) {
-	return fileDescriptor_message_ab411b0053a36526, []int{0}
+	return fileDescriptor_message_bf78bfdc7bb8eb97, []int{0}
 }
 func (m *Handshake) XXX_Unmarshal(b []byte) error {
 	return xxx_messageInfo_Handshake.Unmarshal(m, b)
@@ -88,6 +89,13 @@ func (m *Handshake) GetGenesis() []byte {
 	return nil
 }
 
+func (m *Handshake) GetBlocksVersion() uint32 {
+	if m != nil {
+		return m.BlocksVersion
+	}
+	return 0
+}
+
 type BlockID struct {
 	Hash                 []byte   `protobuf:"bytes,1,opt,name=Hash,proto3" json:"Hash,omitempty"`
 	Height               uint64   `protobuf:"varint,2,opt,name=Height,proto3" json:"Height,omitempty"`
@@ -100,7 +108,7 @@ func (m *BlockID) Reset()         { *m = BlockID{} }
 func (m *BlockID) String() string { return proto.CompactTextString(m) }
 func (*BlockID) ProtoMessage()    {}
 func (*BlockID) Descriptor() ([]byte, []int) {
-	return fileDescriptor_message_ab411b0053a36526, []int{1}
+	return fileDescriptor_message_bf78bfdc7bb8eb97, []int{1}
 }
 func (m *BlockID) XXX_Unmarshal(b []byte) error {
 	return xxx_messageInfo_BlockID.Unmarshal(m, b)
@@ -149,7 +157,7 @@ func (m *CompressedFileMeta) Reset()         { *m = CompressedFileMeta{} }
 func (m *CompressedFileMeta) String() string { return proto.CompactTextString(m) }
 func (*CompressedFileMeta) ProtoMessage()    {}
 func (*CompressedFileMeta) Descriptor() ([]byte, []int) {
-	return fileDescriptor_message_ab411b0053a36526, []int{2}
+	return fileDescriptor_message_bf78bfdc7bb8eb97, []int{2}
 }
 func (m *CompressedFileMeta) XXX_Unmarshal(b []byte) error {
 	return xxx_messageInfo_CompressedFileMeta.Unmarshal(m, b)
@@ -217,7 +225,7 @@ func (m *FileList) Reset()         { *m = FileList{} }
 func (m *FileList) String() string { return proto.CompactTextString(m) }
 func (*FileList) ProtoMessage()    {}
 func (*FileList) Descriptor() ([]byte, []int) {
-	return fileDescriptor_message_ab411b0053a36526, []int{3}
+	return fileDescriptor_message_bf78bfdc7bb8eb97, []int{3}
 }
 func (m *FileList) XXX_Unmarshal(b []byte) error {
 	return xxx_messageInfo_FileList.Unmarshal(m, b)
@@ -270,7 +278,7 @@ func (m *GetFiles) Reset()         { *m = GetFiles{} }
 func (m *GetFiles) String() string { return proto.CompactTextString(m) }
 func (*GetFiles) ProtoMessage()    {}
 func (*GetFiles) Descriptor() ([]byte, []int) {
-	return fileDescriptor_message_ab411b0053a36526, []int{4}
+	return fileDescriptor_message_bf78bfdc7bb8eb97, []int{4}
 }
 func (m *GetFiles) XXX_Unmarshal(b []byte) error {
 	return xxx_messageInfo_GetFiles.Unmarshal(m, b)
@@ -316,7 +324,7 @@ func (m *GetChunk) Reset()         { *m = GetChunk{} }
 func (m *GetChunk) String() string { return proto.CompactTextString(m) }
 func (*GetChunk) ProtoMessage()    {}
 func (*GetChunk) Descriptor() ([]byte, []int) {
-	return fileDescriptor_message_ab411b0053a36526, []int{5}
+	return fileDescriptor_message_bf78bfdc7bb8eb97, []int{5}
 }
 func (m *GetChunk) XXX_Unmarshal(b []byte) error {
 	return xxx_messageInfo_GetChunk.Unmarshal(m, b)
@@ -363,7 +371,7 @@ func (m *SubLedger) Reset()         { *m = SubLedger{} }
 func (m *SubLedger) String() string { return proto.CompactTextString(m) }
 func (*SubLedger) ProtoMessage()    {}
 func (*SubLedger) Descriptor() ([]byte, []int) {
-	return fileDescriptor_message_ab411b0053a36526, []int{6}
+	return fileDescriptor_message_bf78bfdc7bb8eb97, []int{6}
 }
 func (m *SubLedger) XXX_Unmarshal(b []byte) error {
 	return xxx_messageInfo_SubLedger.Unmarshal(m, b)
@@ -408,6 +416,8 @@ type GetSnapshotBlocks struct {
 	From                 *BlockID `protobuf:"bytes,1,opt,name=From,proto3" json:"From,omitempty"`
 	Count                uint64   `protobuf:"varint,2,opt,name=Count,proto3" json:"Count,omitempty"`
 	Forward              bool     `protobuf:"varint,3,opt,name=Forward,proto3" json:"Forward,omitempty"`
+	RequestID            uint64   `protobuf:"varint,4,opt,name=RequestID,proto3" json:"RequestID,omitempty"`
+	IncludeContent       bool     `protobuf:"varint,5,opt,name=IncludeContent,proto3" json:"IncludeContent,omitempty"`
 	XXX_NoUnkeyedLiteral struct{} `json:"-"`
 	XXX_unrecognized     []byte   `json:"-"`
 	XXX_sizecache        int32    `json:"-"`
@@ -417,7 +427,7 @@ func (m *GetSnapshotBlocks) Reset()         { *m = GetSnapshotBlocks{} }
 func (m *GetSnapshotBlocks) String() string { return proto.CompactTextString(m) }
 func (*GetSnapshotBlocks) ProtoMessage()    {}
 func (*GetSnapshotBlocks) Descriptor() ([]byte, []int) {
-	return fileDescriptor_message_ab411b0053a36526, []int{7}
+	return fileDescriptor_message_bf78bfdc7bb8eb97, []int{7}
 }
 func (m *GetSnapshotBlocks) XXX_Unmarshal(b []byte) error {
 	return xxx_messageInfo_GetSnapshotBlocks.Unmarshal(m, b)
@@ -458,8 +468,24 @@ func (m *GetSnapshotBlocks) GetForward() bool {
 	return false
 }
 
+func (m *GetSnapshotBlocks) GetRequestID() uint64 {
+	if m != nil {
+		return m.RequestID
+	}
+	return 0
+}
+
+func (m *GetSnapshotBlocks) GetIncludeContent() bool {
+	if m != nil {
+		return m.IncludeContent
+	}
+	return false
+}
+
 type SnapshotBlocks struct {
 	Blocks               []*SnapshotBlock `protobuf:"bytes,1,rep,name=Blocks,proto3" json:"Blocks,omitempty"`
+	RequestID            uint64           `protobuf:"varint,2,opt,name=RequestID,proto3" json:"RequestID,omitempty"`
+	Content              []*AccountBlock  `protobuf:"bytes,3,rep,name=Content,proto3" json:"Content,omitempty"`
 	XXX_NoUnkeyedLiteral struct{}         `json:"-"`
 	XXX_unrecognized     []byte           `json:"-"`
 	XXX_sizecache        int32            `json:"-"`
@@ -469,7 +495,7 @@ func (m *SnapshotBlocks) Reset()         { *m = SnapshotBlocks{} }
 func (m *SnapshotBlocks) String() string { return proto.CompactTextString(m) }
 func (*SnapshotBlocks) ProtoMessage()    {}
 func (*SnapshotBlocks) Descriptor() ([]byte, []int) {
-	return fileDescriptor_message_ab411b0053a36526, []int{8}
+	return fileDescriptor_message_bf78bfdc7bb8eb97, []int{8}
 }
 func (m *SnapshotBlocks) XXX_Unmarshal(b []byte) error {
 	return xxx_messageInfo_SnapshotBlocks.Unmarshal(m, b)
@@ -496,11 +522,26 @@ func (m *SnapshotBlocks) GetBlocks() []*SnapshotBlock {
 	return nil
 }
 
+func (m *SnapshotBlocks) GetRequestID() uint64 {
+	if m != nil {
+		return m.RequestID
+	}
+	return 0
+}
+
+func (m *SnapshotBlocks) GetContent() []*AccountBlock {
+	if m != nil {
+		return m.Content
+	}
+	return nil
+}
+
 type GetAccountBlocks struct {
 	Address              []byte   `protobuf:"bytes,1,opt,name=Address,proto3" json:"Address,omitempty"`
 	From                 *BlockID `protobuf:"bytes,2,opt,name=From,proto3" json:"From,omitempty"`
 	Count                uint64   `protobuf:"varint,3,opt,name=Count,proto3" json:"Count,omitempty"`
 	Forward              bool     `protobuf:"varint,4,opt,name=Forward,proto3" json:"Forward,omitempty"`
+	RequestID            uint64   `protobuf:"varint,5,opt,name=RequestID,proto3" json:"RequestID,omitempty"`
 	XXX_NoUnkeyedLiteral struct{} `json:"-"`
 	XXX_unrecognized     []byte   `json:"-"`
 	XXX_sizecache        int32    `json:"-"`
@@ -510,7 +551,7 @@ func (m *GetAccountBlocks) Reset()         { *m = GetAccountBlocks{} }
 func (m *GetAccountBlocks) String() string { return proto.CompactTextString(m) }
 func (*GetAccountBlocks) ProtoMessage()    {}
 func (*GetAccountBlocks) Descriptor() ([]byte, []int) {
-	return fileDescriptor_message_ab411b0053a36526, []int{9}
+	return fileDescriptor_message_bf78bfdc7bb8eb97, []int{9}
 }
 func (m *GetAccountBlocks) XXX_Unmarshal(b []byte) error {
 	return xxx_messageInfo_GetAccountBlocks.Unmarshal(m, b)
@@ -558,8 +599,16 @@ func (m *GetAccountBlocks) GetForward() bool {
 	return false
 }
 
+func (m *GetAccountBlocks) GetRequestID() uint64 {
+	if m != nil {
+		return m.RequestID
+	}
+	return 0
+}
+
 type AccountBlocks struct {
 	Blocks               []*AccountBlock `protobuf:"bytes,1,rep,name=Blocks,proto3" json:"Blocks,omitempty"`
+	RequestID            uint64          `protobuf:"varint,2,opt,name=RequestID,proto3" json:"RequestID,omitempty"`
 	XXX_NoUnkeyedLiteral struct{}        `json:"-"`
 	XXX_unrecognized     []byte          `json:"-"`
 	XXX_sizecache        int32           `json:"-"`
@@ -569,7 +618,7 @@ func (m *AccountBlocks) Reset()         { *m = AccountBlocks{} }
 func (m *AccountBlocks) String() string { return proto.CompactTextString(m) }
 func (*AccountBlocks) ProtoMessage()    {}
 func (*AccountBlocks) Descriptor() ([]byte, []int) {
-	return fileDescriptor_message_ab411b0053a36526, []int{10}
+	return fileDescriptor_message_bf78bfdc7bb8eb97, []int{10}
 }
 func (m *AccountBlocks) XXX_Unmarshal(b []byte) error {
 	return xxx_messageInfo_AccountBlocks.Unmarshal(m, b)
@@ -596,6 +645,13 @@ func (m *AccountBlocks) GetBlocks() []*AccountBlock {
 	return nil
 }
 
+func (m *AccountBlocks) GetRequestID() uint64 {
+	if m != nil {
+		return m.RequestID
+	}
+	return 0
+}
+
 func init() {
 	proto.RegisterType((*Handshake)(nil), "vitepb.Handshake")
 	proto.RegisterType((*BlockID)(nil), "vitepb.BlockID")
@@ -610,43 +666,47 @@ func init() {
 	proto.RegisterType((*AccountBlocks)(nil), "vitepb.AccountBlocks")
 }
 
-func init() { proto.RegisterFile("vitepb/message.proto", fileDescriptor_message_ab411b0053a36526) }
-
-var fileDescriptor_message_ab411b0053a36526 = []byte{
-	// 548 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x8c, 0x94, 0x4d, 0x6f, 0xd3, 0x4c,
-	0x10, 0xc7, 0xe5, 0xd8, 0x79, 0x9b, 0xa4, 0xcf, 0x53, 0x56, 0x01, 0x59, 0x81, 0x83, 0x65, 0x2e,
-	0x39, 0x40, 0x8a, 0x82, 0xe0, 0x86, 0x50, 0x08, 0x4d, 0x82, 0x54, 0x2a, 0xb4, 0xfe, 0x00, 0x68,
-	0x1d, 0x8f, 0x62, 0x93, 0xda, 0x8e, 0x76, 0xd7, 0x20, 0x71, 0x43, 0xdc, 0xf8, 0x34, 0x7c, 0x44,
-	0xb4, 0x2f, 0x4e, 0xe2, 0x42, 0xa5, 0xde, 0xf6, 0x3f, 0x33, 0xff, 0x1d, 0xff, 0x76, 0x26, 0x81,
-	0xd1, 0xd7, 0x4c, 0xe2, 0x3e, 0xbe, 0xc8, 0x51, 0x08, 0xb6, 0xc5, 0xe9, 0x9e, 0x97, 0xb2, 0x24,
-	0x1d, 0x13, 0x1d, 0x8f, 0x6d, 0x96, 0x6d, 0x36, 0x65, 0x55, 0xc8, 0xcf, 0xf1, 0x4d, 0xb9, 0xd9,
-	0x99, 0x9a, 0xf1, 0x63, 0x9b, 0x13, 0x05, 0xdb, 0x8b, 0xb4, 0x6c, 0x24, 0xc3, 0x9f, 0x0e, 0xf4,
-	0xd7, 0xac, 0x48, 0x44, 0xca, 0x76, 0x48, 0x1e, 0x41, 0x67, 0x91, 0x27, 0x11, 0x4a, 0xdf, 0x09,
-	0x9c, 0x89, 0x47, 0xad, 0x52, 0xf1, 0x35, 0x66, 0xdb, 0x54, 0xfa, 0x2d, 0x13, 0x37, 0x8a, 0x10,
-	0xf0, 0x3e, 0x95, 0x5c, 0xfa, 0x6e, 0xe0, 0x4c, 0xce, 0xa8, 0x3e, 0x13, 0x1f, 0xba, 0x8b, 0x8a,
-	0x73, 0x2c, 0xa4, 0xef, 0x05, 0xce, 0x64, 0x48, 0x6b, 0xa9, 0x32, 0x2b, 0x2c, 0x50, 0x64, 0xc2,
-	0x6f, 0x9b, 0x8c, 0x95, 0xe1, 0x2b, 0xe8, 0xbe, 0x53, 0x1f, 0xf5, 0xe1, 0xbd, 0xba, 0x72, 0xcd,
-	0x44, 0xaa, 0x3f, 0x60, 0x48, 0xf5, 0xf9, 0xae, 0xf6, 0xe1, 0x6f, 0x07, 0xc8, 0xa2, 0xcc, 0xf7,
-	0x1c, 0x85, 0xc0, 0x64, 0x99, 0xdd, 0xe0, 0x47, 0x94, 0x8c, 0x04, 0x30, 0x88, 0x24, 0xe3, 0xd2,
-	0x7a, 0x0c, 0xca, 0x69, 0x88, 0x3c, 0x81, 0xfe, 0x65, 0x91, 0x34, 0xee, 0x3c, 0x06, 0xc8, 0x18,
-	0x7a, 0xea, 0xae, 0x82, 0xe5, 0xa8, 0xc9, 0xfa, 0xf4, 0xa0, 0xeb, 0x5c, 0x94, 0x7d, 0x47, 0x8d,
-	0xe7, 0xd2, 0x83, 0x26, 0x21, 0x0c, 0x35, 0xc5, 0x75, 0x95, 0xc7, 0xc8, 0x0d, 0xa4, 0x47, 0x1b,
-	0xb1, 0xf0, 0x8b, 0xf1, 0x5f, 0x65, 0x42, 0x92, 0x17, 0xd0, 0x56, 0x67, 0xe1, 0x3b, 0x81, 0x3b,
-	0x19, 0xcc, 0xc6, 0x53, 0x33, 0xa8, 0xe9, 0xdf, 0x48, 0xd4, 0x14, 0xea, 0xf9, 0xa4, 0x55, 0xb1,
-	0x13, 0x7e, 0x2b, 0x70, 0xf5, 0x7c, 0xb4, 0x22, 0x23, 0x68, 0x5f, 0x97, 0xc5, 0xc6, 0x7c, 0xae,
-	0x47, 0x8d, 0x08, 0x5f, 0x43, 0x6f, 0x85, 0xd2, 0x38, 0x55, 0x05, 0xcb, 0x6d, 0xaf, 0x3e, 0x35,
-	0xe2, 0xe8, 0x6b, 0x9d, 0xfa, 0x66, 0xda, 0xa7, 0xaf, 0x56, 0x15, 0xfa, 0xe1, 0xec, 0x2b, 0x1a,
-	0x41, 0xce, 0xc1, 0xbd, 0x2c, 0x12, 0xeb, 0x52, 0xc7, 0xf0, 0x97, 0x03, 0xfd, 0xa8, 0x8a, 0xaf,
-	0x30, 0xd9, 0x22, 0x27, 0x17, 0xd0, 0x8d, 0x34, 0x76, 0xcd, 0xf6, 0xb0, 0x66, 0x8b, 0xec, 0x12,
-	0xea, 0x2c, 0xad, 0xab, 0xc8, 0x14, 0xba, 0x73, 0x6b, 0x68, 0x69, 0xc3, 0xa8, 0x36, 0xcc, 0xcd,
-	0x46, 0xdb, 0x7a, 0x5b, 0xa4, 0x06, 0x38, 0x8f, 0xed, 0xbb, 0x5a, 0xe8, 0x63, 0x20, 0x4c, 0xe1,
-	0xc1, 0x0a, 0x65, 0xa3, 0x95, 0x20, 0x4f, 0xc1, 0x5b, 0xf2, 0x32, 0xd7, 0x20, 0x83, 0xd9, 0xff,
-	0xf5, 0xfd, 0x76, 0xef, 0xa8, 0x4e, 0x2a, 0xdc, 0x85, 0x6a, 0x57, 0x3f, 0x88, 0x16, 0x6a, 0x71,
-	0x97, 0x25, 0xff, 0xc6, 0x78, 0xa2, 0x7b, 0xf5, 0x68, 0x2d, 0xc3, 0xb7, 0xf0, 0xdf, 0xad, 0x36,
-	0xcf, 0xa1, 0x73, 0x1f, 0x72, 0x5b, 0x14, 0xfe, 0x70, 0xe0, 0x7c, 0x85, 0xf2, 0x94, 0x52, 0xa8,
-	0x7e, 0xf3, 0x24, 0x51, 0x2b, 0x60, 0x7f, 0x06, 0xb5, 0x3c, 0x40, 0xb4, 0xee, 0x05, 0xe1, 0xde,
-	0x01, 0xe1, 0x35, 0x21, 0xde, 0xc0, 0x59, 0xb3, 0xff, 0xb3, 0x5b, 0x0c, 0xff, 0x1e, 0x86, 0xad,
-	0x89, 0x3b, 0xfa, 0x9f, 0xe4, 0xe5, 0x9f, 0x00, 0x00, 0x00, 0xff, 0xff, 0x82, 0x97, 0xa9, 0x9d,
-	0xa2, 0x04, 0x00, 0x00,
+func init() { proto.RegisterFile("vitepb/message.proto", fileDescriptor_message_bf78bfdc7bb8eb97) }
+
+var fileDescriptor_message_bf78bfdc7bb8eb97 = []byte{
+	// 621 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x8c, 0x54, 0xcd, 0x6e, 0xd3, 0x4c,
+	0x14, 0x95, 0x63, 0x27, 0x69, 0x6e, 0x7f, 0xbe, 0x7e, 0xa3, 0x82, 0xac, 0xc0, 0xc2, 0x32, 0x08,
+	0x65, 0x01, 0x29, 0x2a, 0x82, 0x7d, 0x48, 0xdb, 0xb4, 0x52, 0xa9, 0xd0, 0x58, 0x62, 0xc3, 0x02,
+	0xd9, 0xf1, 0x55, 0x63, 0x5a, 0xcf, 0x84, 0x99, 0x31, 0x48, 0x3c, 0x02, 0x12, 0xcf, 0xc0, 0x9a,
+	0x0d, 0xe2, 0x11, 0xd1, 0xfc, 0xb8, 0xae, 0x03, 0xad, 0xb2, 0x9b, 0x73, 0x7f, 0xe6, 0x9e, 0x73,
+	0xe6, 0xda, 0xb0, 0xf7, 0xb9, 0x50, 0xb8, 0xcc, 0xf6, 0x4b, 0x94, 0x32, 0xbd, 0xc0, 0xf1, 0x52,
+	0x70, 0xc5, 0x49, 0xcf, 0x46, 0x87, 0x43, 0x97, 0x4d, 0xe7, 0x73, 0x5e, 0x31, 0xf5, 0x21, 0xbb,
+	0xe2, 0xf3, 0x4b, 0x5b, 0x33, 0x7c, 0xe0, 0x72, 0x92, 0xa5, 0x4b, 0xb9, 0xe0, 0xad, 0x64, 0xfc,
+	0xd3, 0x83, 0xc1, 0x49, 0xca, 0x72, 0xb9, 0x48, 0x2f, 0x91, 0xdc, 0x87, 0xde, 0xb4, 0xcc, 0x13,
+	0x54, 0xa1, 0x17, 0x79, 0xa3, 0x80, 0x3a, 0xa4, 0xe3, 0x27, 0x58, 0x5c, 0x2c, 0x54, 0xd8, 0xb1,
+	0x71, 0x8b, 0x08, 0x81, 0xe0, 0x2d, 0x17, 0x2a, 0xf4, 0x23, 0x6f, 0xb4, 0x4d, 0xcd, 0x99, 0x84,
+	0xd0, 0x9f, 0x56, 0x42, 0x20, 0x53, 0x61, 0x10, 0x79, 0xa3, 0x2d, 0x5a, 0x43, 0x9d, 0x99, 0x21,
+	0x43, 0x59, 0xc8, 0xb0, 0x6b, 0x33, 0x0e, 0x92, 0xc7, 0xb0, 0xfd, 0x5a, 0x93, 0x92, 0xef, 0x50,
+	0xc8, 0x82, 0xb3, 0xb0, 0x67, 0x2e, 0x6c, 0x07, 0xe3, 0x97, 0xd0, 0x37, 0x81, 0xd3, 0x43, 0x3d,
+	0xf8, 0x24, 0x95, 0x0b, 0x43, 0x73, 0x8b, 0x9a, 0xf3, 0x6d, 0x24, 0xe3, 0xdf, 0x1e, 0x90, 0x29,
+	0x2f, 0x97, 0x02, 0xa5, 0xc4, 0xfc, 0xb8, 0xb8, 0xc2, 0x37, 0xa8, 0x52, 0x12, 0xc1, 0x66, 0xa2,
+	0x52, 0xa1, 0x5c, 0x8f, 0x15, 0x7c, 0x33, 0x44, 0x1e, 0xc2, 0xe0, 0x88, 0xe5, 0xad, 0x3b, 0x9b,
+	0x00, 0x19, 0xc2, 0x86, 0xbe, 0x8b, 0xa5, 0x25, 0x1a, 0xfd, 0x03, 0x7a, 0x8d, 0xeb, 0x5c, 0x52,
+	0x7c, 0x45, 0x63, 0x82, 0x4f, 0xaf, 0x31, 0x89, 0x61, 0xcb, 0xa8, 0x38, 0xaf, 0xca, 0x0c, 0x85,
+	0xb5, 0x22, 0xa0, 0xad, 0x58, 0xfc, 0xd1, 0xf6, 0x9f, 0x15, 0x52, 0x91, 0xe7, 0xd0, 0xd5, 0x67,
+	0x19, 0x7a, 0x91, 0x3f, 0xda, 0x3c, 0x18, 0x8e, 0xed, 0x73, 0x8e, 0xff, 0x96, 0x44, 0x6d, 0xa1,
+	0x79, 0xc5, 0x45, 0xc5, 0x2e, 0x65, 0xd8, 0x89, 0x7c, 0xf3, 0x8a, 0x06, 0x91, 0x3d, 0xe8, 0x9e,
+	0x73, 0x36, 0xb7, 0x74, 0x03, 0x6a, 0x41, 0xfc, 0x0a, 0x36, 0x66, 0xa8, 0x6c, 0xa7, 0xae, 0x48,
+	0x4b, 0x37, 0x6b, 0x40, 0x2d, 0x68, 0xfa, 0x3a, 0x37, 0xfb, 0x0e, 0x4c, 0x9f, 0xb9, 0x5a, 0x57,
+	0x18, 0xe3, 0x9c, 0x8b, 0x16, 0x90, 0x5d, 0xf0, 0x8f, 0x58, 0xee, 0xba, 0xf4, 0x31, 0xfe, 0xe6,
+	0xc1, 0x20, 0xa9, 0xb2, 0x33, 0xcc, 0x2f, 0x50, 0x90, 0x7d, 0xe8, 0x27, 0xf6, 0x85, 0x9d, 0xb6,
+	0x7b, 0xb5, 0xb6, 0xc4, 0xad, 0xaa, 0xc9, 0xd2, 0xba, 0x8a, 0x8c, 0xa1, 0x3f, 0x71, 0x0d, 0x1d,
+	0xd3, 0xb0, 0x57, 0x37, 0x4c, 0xec, 0xde, 0xbb, 0x7a, 0x57, 0xa4, 0x1f, 0x70, 0x92, 0x39, 0x5f,
+	0x9d, 0xe8, 0x26, 0x10, 0xff, 0xf2, 0xe0, 0xff, 0x19, 0xaa, 0xd6, 0x2c, 0x49, 0x1e, 0x41, 0x70,
+	0x2c, 0x78, 0x69, 0x94, 0x6c, 0x1e, 0xfc, 0x57, 0x0f, 0x70, 0x8b, 0x47, 0x4d, 0x52, 0xeb, 0x9d,
+	0xea, 0x79, 0xb5, 0x23, 0x06, 0xe8, 0xfd, 0x3e, 0xe6, 0xe2, 0x4b, 0x2a, 0x72, 0x33, 0x6c, 0x83,
+	0xd6, 0x50, 0x13, 0xa1, 0xf8, 0xa9, 0x42, 0xa9, 0x4e, 0x0f, 0xcd, 0x42, 0x04, 0xb4, 0x09, 0x90,
+	0x27, 0xb0, 0x73, 0xca, 0xe6, 0x57, 0x55, 0x8e, 0x53, 0xce, 0x94, 0xfe, 0x70, 0xba, 0xa6, 0x7d,
+	0x25, 0x1a, 0x7f, 0xf7, 0x60, 0x67, 0x85, 0xed, 0x33, 0xe8, 0xad, 0xe3, 0x60, 0xaf, 0x31, 0xa4,
+	0xe1, 0xd1, 0x59, 0xe5, 0x31, 0x86, 0x7e, 0x4d, 0xc0, 0xbf, 0xcb, 0xde, 0x9a, 0xcf, 0x0f, 0x0f,
+	0x76, 0x67, 0xa8, 0x6e, 0x26, 0xa5, 0x36, 0x61, 0x92, 0xe7, 0x7a, 0x31, 0xdd, 0xc7, 0x59, 0xc3,
+	0x6b, 0x67, 0x3b, 0x6b, 0x39, 0xeb, 0xdf, 0xe2, 0x6c, 0x70, 0x87, 0xb3, 0xdd, 0x15, 0x45, 0xf1,
+	0x7b, 0xd8, 0x6e, 0xb3, 0x7b, 0xba, 0xe2, 0xd7, 0xbf, 0x15, 0xae, 0x65, 0x57, 0xd6, 0x33, 0x7f,
+	0xd0, 0x17, 0x7f, 0x06, 0x00, 0x34, 0x59, 0x16, 0x0b, 0x9a, 0x05, 0x00, 0x00,
 }